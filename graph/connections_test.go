@@ -0,0 +1,374 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var (
+	sourceGVK        = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Source"}
+	clusterSourceGVK = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "ClusterSource"}
+	targetGVK        = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Target"}
+	clusterTargetGVK = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "ClusterTarget"}
+)
+
+// namespace selectors of the sources, keyed by the name of the source
+var testNamespaceSelectors = map[string]map[string]interface{}{
+	"any":   {"any": true},
+	"team":  {"matchLabels": map[string]interface{}{"team": "web"}},
+	"names": {"matchNames": []interface{}{"b"}},
+	"both":  {"matchNames": []interface{}{"a", "b"}, "matchLabels": map[string]interface{}{"team": "web"}},
+	"own":   {},
+	"none":  nil,
+}
+
+func newTestObject(gvk schema.GroupVersionKind, namespace, name string, lbls map[string]string) *unstructured.Unstructured {
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(gvk)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetUID(types.UID(fmt.Sprintf("%s-%s-%s", gvk.Kind, namespace, name)))
+	obj.SetLabels(lbls)
+	return &obj
+}
+
+func newTestSource(gvk schema.GroupVersionKind, namespace, name string, nsSelector map[string]interface{}) *unstructured.Unstructured {
+	obj := newTestObject(gvk, namespace, name, nil)
+	_ = unstructured.SetNestedStringMap(obj.Object, map[string]string{"app": "web"}, "spec", "selector")
+	_ = unstructured.SetNestedSlice(obj.Object, []interface{}{
+		map[string]interface{}{"name": "web"},
+		map[string]interface{}{"name": "web", "namespace": "b"},
+	}, "spec", "refs")
+	if nsSelector != nil {
+		_ = unstructured.SetNestedMap(obj.Object, nsSelector, "spec", "namespaceSelector")
+	}
+	return obj
+}
+
+// setTestOwners sets the owner references of obj. The first owner is the controller.
+func setTestOwners(obj *unstructured.Unstructured, owners ...*unstructured.Unstructured) {
+	refs := make([]interface{}, 0, len(owners))
+	for i, owner := range owners {
+		refs = append(refs, map[string]interface{}{
+			"apiVersion": owner.GetAPIVersion(),
+			"kind":       owner.GetKind(),
+			"name":       owner.GetName(),
+			"uid":        string(owner.GetUID()),
+			"controller": i == 0,
+		})
+	}
+	_ = unstructured.SetNestedSlice(obj.Object, refs, "metadata", "ownerReferences")
+}
+
+func newConnectionTestClient() client.Client {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(sourceGVK, meta.RESTScopeNamespace)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+	mapper.Add(clusterSourceGVK, meta.RESTScopeRoot)
+	mapper.Add(clusterTargetGVK, meta.RESTScopeRoot)
+
+	var objs []client.Object
+	objs = append(objs,
+		newNamespace("a", map[string]string{"team": "web"}),
+		newNamespace("b", map[string]string{"team": "db"}),
+		newNamespace("c", map[string]string{"team": "web"}),
+	)
+
+	names := make([]string, 0, len(testNamespaceSelectors))
+	for name := range testNamespaceSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusterSources := map[string]*unstructured.Unstructured{}
+	for _, name := range names {
+		src := newTestSource(clusterSourceGVK, "", "cluster-"+name, testNamespaceSelectors[name])
+		clusterSources[name] = src
+		objs = append(objs, src)
+	}
+
+	for _, ns := range []string{"a", "b", "c"} {
+		sources := map[string]*unstructured.Unstructured{}
+		for _, name := range names {
+			src := newTestSource(sourceGVK, ns, name, testNamespaceSelectors[name])
+			sources[name] = src
+			objs = append(objs, src)
+		}
+
+		web := newTestObject(targetGVK, ns, "web", map[string]string{"app": "web"})
+		if ns == "a" {
+			setTestOwners(web, sources["own"], clusterSources["any"])
+		} else {
+			setTestOwners(web, clusterSources["any"], sources["own"])
+		}
+		objs = append(objs, web)
+
+		for _, name := range names {
+			objs = append(objs,
+				newTestObject(targetGVK, ns, name+"-cfg", map[string]string{"app": "other"}),
+				newTestObject(targetGVK, ns, "cluster-"+name+"-cfg", nil),
+			)
+		}
+
+		// a stale owner reference to a recreated object
+		stale := newTestObject(targetGVK, ns, "stale", map[string]string{"app": "web"})
+		recreated := newTestObject(sourceGVK, ns, "own", nil)
+		recreated.SetUID("recreated")
+		setTestOwners(stale, recreated)
+		objs = append(objs, stale)
+	}
+
+	web := newTestObject(clusterTargetGVK, "", "web", map[string]string{"app": "web"})
+	// a cluster scoped object can't be owned by a namespaced object
+	setTestOwners(web, clusterSources["any"], newTestSource(sourceGVK, "a", "own", nil))
+	objs = append(objs, web)
+	for _, name := range names {
+		objs = append(objs,
+			newTestObject(clusterTargetGVK, "", name+"-cfg", nil),
+			newTestObject(clusterTargetGVK, "", "cluster-"+name+"-cfg", map[string]string{"app": "web"}),
+		)
+	}
+
+	return offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objs...).Build(),
+		mapper: mapper,
+	}
+}
+
+// TestResourcesForSymmetric checks that every connection finds the same pairs of objects
+// when traversed forward from its sources and backward from its targets.
+func TestResourcesForSymmetric(t *testing.T) {
+	kc := newConnectionTestClient()
+	finder := ObjectFinder{Client: kc}
+
+	specs := map[string]v1alpha1.ResourceConnectionSpec{
+		"MatchSelector": {
+			Type:         v1alpha1.MatchSelector,
+			SelectorPath: "spec.selector",
+		},
+		"MatchSelector/template": {
+			Type: v1alpha1.MatchSelector,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "web"},
+			},
+		},
+		"MatchName": {
+			Type:         v1alpha1.MatchName,
+			NameTemplate: "{.metadata.name}-cfg",
+		},
+		"MatchRef": {
+			Type:       v1alpha1.MatchRef,
+			References: []string{`{range .spec.refs[*]}{.name},{.namespace}{"\n"}{end}`},
+		},
+		"MatchExpression": {
+			Type:       MatchExpression,
+			References: []string{"target.metadata.labels.app == source.spec.selector.app"},
+			Selector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpExists}},
+			},
+		},
+		"MatchValue": {
+			Type:            MatchValue,
+			NameTemplate:    "{.spec.selector.app}",
+			TargetLabelPath: "metadata.labels.app",
+		},
+	}
+	ownedBy := v1alpha1.ResourceConnectionSpec{
+		Type:  v1alpha1.OwnedBy,
+		Level: v1alpha1.Owner,
+	}
+
+	type testCase struct {
+		name      string
+		src       schema.GroupVersionKind
+		dst       schema.GroupVersionKind
+		spec      v1alpha1.ResourceConnectionSpec
+		wantEmpty bool
+	}
+	var cases []testCase
+	for _, src := range []schema.GroupVersionKind{sourceGVK, clusterSourceGVK} {
+		for _, dst := range []schema.GroupVersionKind{targetGVK, clusterTargetGVK} {
+			for specName, spec := range specs {
+				for _, nsPath := range []string{"", MetadataNamespace, "spec.namespaceSelector"} {
+					spec.NamespacePath = nsPath
+					cases = append(cases, testCase{
+						name: fmt.Sprintf("%s/%s->%s/%s", specName, src.Kind, dst.Kind, nsPath),
+						src:  src,
+						dst:  dst,
+						spec: spec,
+					})
+				}
+			}
+			// owners are the targets of OwnedBy connections
+			for _, level := range []v1alpha1.OwnershipLevel{v1alpha1.Owner, v1alpha1.Controller} {
+				spec := ownedBy
+				spec.Level = level
+				cases = append(cases, testCase{
+					name: fmt.Sprintf("OwnedBy/%s/%s->%s", level, dst.Kind, src.Kind),
+					src:  dst,
+					dst:  src,
+					spec: spec,
+					// cluster scoped objects can't be owned by namespaced objects
+					wantEmpty: dst == clusterTargetGVK && src == sourceGVK,
+				})
+			}
+		}
+	}
+
+	list := func(gvk schema.GroupVersionKind) []unstructured.Unstructured {
+		var list unstructured.UnstructuredList
+		list.SetGroupVersionKind(gvk)
+		if err := kc.List(context.TODO(), &list); err != nil {
+			t.Fatal(err)
+		}
+		return list.Items
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			forward := &Edge{Src: tc.src, Dst: tc.dst, Connection: tc.spec, Forward: true}
+			backward := &Edge{Src: tc.dst, Dst: tc.src, Connection: tc.spec, Forward: false}
+
+			var fwd []string
+			for _, src := range list(tc.src) {
+				objs, err := finder.ResourcesFor(&src, forward)
+				if err != nil {
+					t.Fatalf("forward from %s: %v", apiv1.NewObjectID(&src).OID(), err)
+				}
+				for _, dst := range objs {
+					fwd = append(fwd, string(apiv1.NewObjectID(&src).OID())+" -> "+string(apiv1.NewObjectID(dst).OID()))
+				}
+			}
+			var bwd []string
+			for _, dst := range list(tc.dst) {
+				objs, err := finder.ResourcesFor(&dst, backward)
+				if err != nil {
+					t.Fatalf("backward from %s: %v", apiv1.NewObjectID(&dst).OID(), err)
+				}
+				for _, src := range objs {
+					bwd = append(bwd, string(apiv1.NewObjectID(src).OID())+" -> "+string(apiv1.NewObjectID(&dst).OID()))
+				}
+			}
+			sort.Strings(fwd)
+			sort.Strings(bwd)
+
+			if tc.wantEmpty && len(fwd) > 0 {
+				t.Errorf("expected no connected objects, got %v", fwd)
+			} else if !tc.wantEmpty && len(fwd) == 0 {
+				t.Errorf("expected connected objects")
+			}
+			if !reflect.DeepEqual(fwd, bwd) {
+				t.Errorf("forward and backward traversals disagree\nforward:  %v\nbackward: %v", fwd, bwd)
+			}
+		})
+	}
+}
+
+// TestResourcesForMatchValue checks a MatchValue connection from Helm releases to the objects
+// annotated with their release name.
+func TestResourcesForMatchValue(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(sourceGVK, meta.RESTScopeNamespace)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+
+	newRelease := func(namespace, name string) *unstructured.Unstructured {
+		return newTestObject(sourceGVK, namespace, name, nil)
+	}
+	newManaged := func(namespace, name, release string) *unstructured.Unstructured {
+		obj := newTestObject(targetGVK, namespace, name, nil)
+		if release != "" {
+			obj.SetAnnotations(map[string]string{"meta.helm.sh/release-name": release})
+		}
+		return obj
+	}
+	kc := offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			newRelease("a", "web"),
+			newRelease("a", "db"),
+			newRelease("b", "web"),
+			newManaged("a", "web-svc", "web"),
+			newManaged("a", "web-cfg", "web"),
+			newManaged("a", "db-svc", "db"),
+			newManaged("a", "other", ""),
+			newManaged("b", "web-svc", "web"),
+			newManaged("c", "web-svc", "web"),
+		).Build(),
+		mapper: mapper,
+	}
+	finder := ObjectFinder{Client: kc}
+
+	spec := v1alpha1.ResourceConnectionSpec{
+		Type:            MatchValue,
+		NameTemplate:    "{.metadata.name}",
+		TargetLabelPath: "metadata.annotations.meta.helm.sh/release-name",
+		NamespacePath:   MetadataNamespace,
+	}
+	forward := &Edge{Src: sourceGVK, Dst: targetGVK, Connection: spec, Forward: true}
+	backward := &Edge{Src: targetGVK, Dst: sourceGVK, Connection: spec}
+
+	for key, expected := range map[string][]string{
+		"a/web": {"a/web-cfg", "a/web-svc"},
+		"a/db":  {"a/db-svc"},
+		"b/web": {"b/web-svc"},
+	} {
+		k := objectKey(key)
+		objs, err := finder.ResourcesFor(newRelease(k.Namespace, k.Name), forward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+			t.Errorf("forward from %s: expected %v, got %v", key, expected, got)
+		}
+	}
+
+	for key, expected := range map[string][]string{
+		"a/web-svc": {"a/web"},
+		"a/db-svc":  {"a/db"},
+		"a/other":   {},
+		"c/web-svc": {},
+	} {
+		var obj unstructured.Unstructured
+		obj.SetGroupVersionKind(targetGVK)
+		if err := kc.Get(context.TODO(), objectKey(key), &obj); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := finder.ResourcesFor(&obj, backward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+			t.Errorf("backward from %s: expected %v, got %v", key, expected, got)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DanglingEdge is a connection whose target object does not exist.
+type DanglingEdge struct {
+	Source apiv1.ObjectID          `json:"source"`
+	Target apiv1.ObjectID          `json:"target"`
+	Type   v1alpha1.ConnectionType `json:"type"`
+	Labels []apiv1.EdgeLabel       `json:"labels"`
+}
+
+type DanglingReport struct {
+	// Dangling lists MatchRef and MatchName connections to missing objects.
+	Dangling []DanglingEdge `json:"dangling"`
+	// Orphans lists OwnedBy connections to missing owners. Target is the missing owner.
+	Orphans []DanglingEdge `json:"orphans"`
+	// Errors lists the connections that could not be evaluated.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ScanDangling walks every ResourceDescriptor connection of type MatchRef, MatchName and OwnedBy
+// in the Registry and reports the connections whose target object does not exist.
+// If namespace is set, only source objects in that namespace are scanned.
+// If gks are set, only source objects of those GroupKinds are scanned.
+func (finder ObjectFinder) ScanDangling(namespace string, gks ...schema.GroupKind) (*DanglingReport, error) {
+	filter := ksets.NewGroupKind(gks...)
+
+	var rds []*v1alpha1.ResourceDescriptor
+	Registry.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		if filter.Len() == 0 || filter.Has(rd.Spec.Resource.GroupVersionKind().GroupKind()) {
+			rds = append(rds, rd)
+		}
+	})
+	sort.Slice(rds, func(i, j int) bool { return rds[i].Name < rds[j].Name })
+
+	report := DanglingReport{
+		Dangling: []DanglingEdge{},
+		Orphans:  []DanglingEdge{},
+	}
+	for _, rd := range rds {
+		if err := finder.scanDangling(rd, namespace, &report); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+func (finder ObjectFinder) scanDangling(rd *v1alpha1.ResourceDescriptor, namespace string, report *DanglingReport) error {
+	srcGVK := rd.Spec.Resource.GroupVersionKind()
+
+	var edges []*Edge
+	var labels [][]apiv1.EdgeLabel
+	for _, c := range rd.Spec.Connections {
+		if c.Type != v1alpha1.MatchRef && c.Type != v1alpha1.MatchName && c.Type != v1alpha1.OwnedBy {
+			continue
+		}
+		dst := c.Target.GroupVersionKind()
+		if _, err := finder.isNamespaced(dst); meta.IsNoMatchError(err) {
+			// target type is not served, nothing to look for
+			continue
+		} else if err != nil {
+			return err
+		}
+		edges = append(edges, &Edge{
+			Src:        srcGVK,
+			Dst:        dst,
+			W:          0,
+			Connection: c.ResourceConnectionSpec,
+			Forward:    true,
+		})
+		labels = append(labels, c.Labels)
+	}
+	if len(edges) == 0 {
+		return nil
+	}
+
+	namespaced, err := finder.isNamespaced(srcGVK)
+	if meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	opts := client.ListOptions{}
+	if namespaced {
+		opts.Namespace = namespace
+	} else if namespace != "" {
+		return nil
+	}
+
+	var list unstructured.UnstructuredList
+	list.SetGroupVersionKind(srcGVK)
+	if err := finder.Client.List(context.TODO(), &list, &opts); err != nil {
+		if kerr.IsForbidden(err) || kerr.IsMethodNotSupported(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to list %v: %v", srcGVK, err))
+			return nil
+		}
+		return err
+	}
+
+	for i := range list.Items {
+		src := &list.Items[i]
+		srcID := apiv1.NewObjectID(src)
+		for ei, e := range edges {
+			var keys []connectionKey
+			var err error
+			switch e.Connection.Type {
+			case v1alpha1.MatchRef:
+				keys, err = finder.refKeys(src, e)
+			case v1alpha1.MatchName:
+				keys, err = finder.nameKeys(src, e)
+			case v1alpha1.OwnedBy:
+				if orphan, err := finder.isOrphan(src, e); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to check owners of %s for %v: %v", srcID.OID(), e.Dst, err))
+				} else if orphan != nil {
+					report.Orphans = append(report.Orphans, DanglingEdge{
+						Source: *srcID,
+						Target: *orphan,
+						Type:   e.Connection.Type,
+						Labels: labels[ei],
+					})
+				}
+				continue
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to evaluate connection of %s to %v: %v", srcID.OID(), e.Dst, err))
+				continue
+			}
+
+			for _, key := range keys {
+				if key.Name == "" {
+					continue
+				}
+				objects, err := finder.getObjects(e.Dst, key.ObjectKey)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to get %v %s: %v", e.Dst, key.ObjectKey, err))
+					continue
+				}
+				// a reference to an object recreated with a different uid is dangling
+				found := false
+				for _, obj := range objects {
+					if key.matches(obj) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					report.Dangling = append(report.Dangling, DanglingEdge{
+						Source: *srcID,
+						Target: apiv1.ObjectID{
+							Group:     e.Dst.Group,
+							Kind:      e.Dst.Kind,
+							Namespace: key.Namespace,
+							Name:      key.Name,
+						},
+						Type:   e.Connection.Type,
+						Labels: labels[ei],
+					})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isOrphan returns the missing owner of src for an OwnedBy edge. A missing owner is an owner
+// reference that can't be found or that points to an object recreated with a different uid.
+func (finder ObjectFinder) isOrphan(src *unstructured.Unstructured, e *Edge) (*apiv1.ObjectID, error) {
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range src.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || gv.Group != e.Dst.Group || ref.Kind != e.Dst.Kind {
+			continue
+		}
+		if e.Connection.Level == v1alpha1.Controller && (ref.Controller == nil || !*ref.Controller) {
+			continue
+		}
+
+		objkey := client.ObjectKey{Name: ref.Name}
+		if namespaced {
+			objkey.Namespace = src.GetNamespace()
+		}
+		var owner unstructured.Unstructured
+		owner.SetGroupVersionKind(e.Dst)
+		err = finder.Client.Get(context.TODO(), objkey, &owner)
+		if kerr.IsNotFound(err) || (err == nil && owner.GetUID() != ref.UID) {
+			return &apiv1.ObjectID{
+				Group:     e.Dst.Group,
+				Kind:      e.Dst.Kind,
+				Namespace: objkey.Namespace,
+				Name:      objkey.Name,
+			}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
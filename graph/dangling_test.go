@@ -0,0 +1,132 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newFakeClient(objs ...client.Object) client.Client {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Version: "v1", Kind: "Pod"},
+		{Version: "v1", Kind: "Secret"},
+		{Version: "v1", Kind: "ConfigMap"},
+		{Version: "v1", Kind: "Service"},
+		{Version: "v1", Kind: "ServiceAccount"},
+		{Version: "v1", Kind: "PersistentVolumeClaim"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	for _, gvk := range []schema.GroupVersionKind{
+		{Version: "v1", Kind: "Node"},
+		{Version: "v1", Kind: "Namespace"},
+		{Version: "v1", Kind: "PersistentVolume"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeRoot)
+	}
+	return offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objs...).Build(),
+		mapper: mapper,
+	}
+}
+
+func TestScanDangling(t *testing.T) {
+	kc := newFakeClient(
+		&core.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "present"},
+		},
+		&core.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "web"},
+			Spec: core.PodSpec{
+				Volumes: []core.Volume{
+					{
+						Name: "a",
+						VolumeSource: core.VolumeSource{
+							Secret: &core.SecretVolumeSource{SecretName: "present"},
+						},
+					},
+					{
+						Name: "b",
+						VolumeSource: core.VolumeSource{
+							Secret: &core.SecretVolumeSource{SecretName: "missing"},
+						},
+					},
+				},
+			},
+		},
+		&apps.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "demo",
+				Name:      "web-1",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "apps/v1",
+						Kind:       "Deployment",
+						Name:       "web",
+						UID:        "a6b7",
+						Controller: pointer.BoolPtr(true),
+					},
+				},
+			},
+		},
+	)
+
+	finder := ObjectFinder{Client: kc}
+	report, err := finder.ScanDangling("", schema.GroupKind{Kind: "Pod"}, schema.GroupKind{Group: "apps", Kind: "ReplicaSet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", report.Errors)
+	}
+
+	edges := func(in []DanglingEdge) []string {
+		out := make([]string, 0, len(in))
+		for _, e := range in {
+			out = append(out, string(e.Source.OID())+" -> "+string(e.Target.OID()))
+		}
+		sort.Strings(out)
+		return out
+	}
+	expectedDangling := []string{
+		"G=,K=Pod,NS=demo,N=web -> G=,K=Secret,NS=demo,N=missing",
+	}
+	if got := edges(report.Dangling); !reflect.DeepEqual(got, expectedDangling) {
+		t.Errorf("dangling: expected %v, got %v", expectedDangling, got)
+	}
+	expectedOrphans := []string{
+		"G=apps,K=ReplicaSet,NS=demo,N=web-1 -> G=apps,K=Deployment,NS=demo,N=web",
+	}
+	if got := edges(report.Orphans); !reflect.DeepEqual(got, expectedOrphans) {
+		t.Errorf("orphans: expected %v, got %v", expectedOrphans, got)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logger "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// LoadDescriptorDir reads the ResourceDescriptors in the YAML and JSON files under dir.
+// The descriptors that load are returned along with the errors of the ones that don't.
+func LoadDescriptorDir(dir string) ([]*v1alpha1.ResourceDescriptor, error) {
+	rds, err := ReadDescriptorFiles(dir)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	out := rds[:0]
+	for _, rd := range rds {
+		if err := validateDescriptor(rd); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out = append(out, rd)
+	}
+	return out, utilerrors.NewAggregate(errs)
+}
+
+// ReadDescriptorFiles decodes the ResourceDescriptors in the YAML and JSON files at the paths.
+// Directories are read recursively. A file can hold more than one descriptor. Files and
+// directories starting with "..", like the ones Kubernetes creates when it mounts a ConfigMap,
+// are skipped. The descriptors are not validated.
+func ReadDescriptorFiles(paths ...string) ([]*v1alpha1.ResourceDescriptor, error) {
+	var out []*v1alpha1.ResourceDescriptor
+	var errs []error
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != root && strings.HasPrefix(info.Name(), "..") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".yaml", ".yml", ".json":
+			default:
+				if path != root {
+					return nil
+				}
+			}
+			rds, err := readDescriptorFile(path)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to load %s", path))
+			}
+			out = append(out, rds...)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return out, utilerrors.NewAggregate(errs)
+}
+
+func readDescriptorFile(path string) ([]*v1alpha1.ResourceDescriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*v1alpha1.ResourceDescriptor
+	var errs []error
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var rd v1alpha1.ResourceDescriptor
+		if err := decoder.Decode(&rd); err == io.EOF {
+			break
+		} else if err != nil {
+			return out, utilerrors.NewAggregate(append(errs, err))
+		}
+		if rd.Kind == "" && rd.APIVersion == "" && rd.Name == "" {
+			continue // empty document
+		}
+		if rd.GroupVersionKind() != v1alpha1.SchemeGroupVersion.WithKind(v1alpha1.ResourceKindResourceDescriptor) {
+			errs = append(errs, errors.Errorf("%s %s is not a ResourceDescriptor", rd.GroupVersionKind(), rd.Name))
+			continue
+		}
+		out = append(out, &rd)
+	}
+	return out, utilerrors.NewAggregate(errs)
+}
+
+// LoadClusterDescriptors reads the ResourceDescriptors stored in the cluster.
+// Invalid descriptors are skipped and returned as errors.
+func LoadClusterDescriptors(ctx context.Context, c client.Reader) ([]*v1alpha1.ResourceDescriptor, error) {
+	var list v1alpha1.ResourceDescriptorList
+	if err := c.List(ctx, &list); err != nil {
+		return nil, err
+	}
+	out := make([]*v1alpha1.ResourceDescriptor, 0, len(list.Items))
+	var errs []error
+	for i := range list.Items {
+		rd := &list.Items[i]
+		if err := validateDescriptor(rd); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out = append(out, rd)
+	}
+	return out, utilerrors.NewAggregate(errs)
+}
+
+// UpdateDescriptors replaces the descriptors loaded from the source in the Registry. The objects
+// of every kind whose descriptor changed are requeued, so their edges are recomputed using the
+// new connections, and the plans of the connections no descriptor has any more are evicted. c is
+// used to list the requeued objects. It returns the changed kinds.
+//
+// Field indexes can't be added once the manager starts, so backward connections that are new
+// since SetupFieldIndexes fall back to listing.
+func UpdateDescriptors(ctx context.Context, c client.Reader, source DescriptorSource, rds []*v1alpha1.ResourceDescriptor) []schema.GroupVersionKind {
+	changed := Registry.Set(source, rds)
+	if len(changed) == 0 {
+		return nil
+	}
+	klog.InfoS("resource descriptors changed", "source", source, "kinds", changed)
+
+	for _, gvk := range changed {
+		rd, err := Registry.LoadByGVK(gvk)
+		if err != nil {
+			continue
+		}
+		for _, err := range plans.CompileDescriptor(rd) {
+			klog.ErrorS(err, "invalid resource connection", "descriptor", rd.Name)
+		}
+		if err := requeueKind(ctx, c, gvk); err != nil {
+			klog.ErrorS(err, "failed to requeue objects", "gvk", gvk)
+		}
+	}
+	if n := plans.Prune(Registry); n > 0 {
+		klog.V(3).InfoS("evicted unreferenced connection plans", "count", n)
+	}
+
+	if ok, err := RefreshSchema(); err != nil {
+		klog.ErrorS(err, "failed to rebuild the GraphQL schema")
+	} else if ok {
+		klog.InfoS("rebuilt the GraphQL schema", "labels", loadSchema().labels)
+	}
+	return changed
+}
+
+// requeueKind reindexes the labels and selectors of the objects of the kind and sends them to its reconciler.
+func requeueKind(ctx context.Context, c client.Reader, gvk schema.GroupVersionKind) error {
+	if !nsIndex.watching(gvk) {
+		return nil
+	}
+
+	var list unstructured.UnstructuredList
+	list.SetGroupVersionKind(gvk)
+	if err := c.List(ctx, &list); meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	evs := make([]event.GenericEvent, 0, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		labelIdx.Set(gvk, obj)
+		evs = append(evs, event.GenericEvent{Object: obj})
+	}
+	nsIndex.requeue(gvk, evs)
+	return nil
+}
+
+// WatchDescriptorDir reloads the descriptors in dir every interval. Mounted ConfigMaps are
+// updated in place, so the directory is polled instead of watched for events.
+func WatchDescriptorDir(mgr manager.Manager, dir string, interval time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		wait.UntilWithContext(ctx, func(ctx context.Context) {
+			rds, err := LoadDescriptorDir(dir)
+			if err != nil {
+				klog.ErrorS(err, "failed to load resource descriptors", "dir", dir)
+			}
+			UpdateDescriptors(ctx, mgr.GetClient(), DirectorySource, rds)
+		}, interval)
+		return nil
+	}
+}
+
+// DescriptorReconciler loads the ResourceDescriptors stored in the cluster into the Registry.
+type DescriptorReconciler struct {
+	client.Client
+}
+
+func (r *DescriptorReconciler) Reconcile(ctx context.Context, _ reconcile.Request) (reconcile.Result, error) {
+	// every change reloads the whole set, so deleted descriptors fall back to the embedded ones
+	rds, err := LoadClusterDescriptors(ctx, r.Client)
+	if rds == nil && err != nil {
+		return reconcile.Result{}, err
+	} else if err != nil {
+		logger.FromContext(ctx).Error(err, "invalid resource descriptors")
+	}
+	UpdateDescriptors(ctx, r.Client, ClusterSource, rds)
+	return reconcile.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DescriptorReconciler) SetupWithManager(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		For(&v1alpha1.ResourceDescriptor{}).
+		Complete(r)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kmodules.xyz/apiversion"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub"
+	"kmodules.xyz/resource-metadata/hub/resourcedescriptors"
+)
+
+// DescriptorSource identifies where a set of ResourceDescriptors was loaded from.
+type DescriptorSource string
+
+const (
+	DirectorySource DescriptorSource = "Directory"
+	ClusterSource   DescriptorSource = "Cluster"
+)
+
+// descriptorSources lists the sources in increasing priority. A descriptor loaded from the
+// cluster replaces one loaded from the directory for the same resource.
+var descriptorSources = []DescriptorSource{DirectorySource, ClusterSource}
+
+// DescriptorRegistry is the registry of the ResourceDescriptors used to build the graph.
+// It merges the descriptors loaded from the sources over the ones embedded in
+// kmodules.xyz/resource-metadata. A loaded descriptor replaces the embedded one for the
+// same group, version and resource, so the connections of a type can be changed without
+// forking the module.
+type DescriptorRegistry struct {
+	known *hub.Registry
+
+	m       sync.RWMutex
+	sources map[DescriptorSource]map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor
+	merged  map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor
+	gvks    map[schema.GroupVersionKind]schema.GroupVersionResource
+}
+
+func NewDescriptorRegistry(known *hub.Registry) *DescriptorRegistry {
+	return &DescriptorRegistry{
+		known:   known,
+		sources: map[DescriptorSource]map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor{},
+		merged:  map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor{},
+		gvks:    map[schema.GroupVersionKind]schema.GroupVersionResource{},
+	}
+}
+
+// Set replaces the descriptors loaded from the source and returns the kinds whose effective
+// descriptor changed, including the ones that fall back to the embedded descriptor.
+func (r *DescriptorRegistry) Set(source DescriptorSource, rds []*v1alpha1.ResourceDescriptor) []schema.GroupVersionKind {
+	loaded := make(map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor, len(rds))
+	for _, rd := range rds {
+		loaded[rd.Spec.Resource.GroupVersionResource()] = rd
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	old := r.merged
+	if len(loaded) == 0 {
+		delete(r.sources, source)
+	} else {
+		r.sources[source] = loaded
+	}
+	r.merged = map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor{}
+	r.gvks = map[schema.GroupVersionKind]schema.GroupVersionResource{}
+	for _, src := range descriptorSources {
+		for gvr, rd := range r.sources[src] {
+			r.merged[gvr] = rd
+			r.gvks[rd.Spec.Resource.GroupVersionKind()] = gvr
+		}
+	}
+
+	var changed []schema.GroupVersionKind
+	diff := func(gvr schema.GroupVersionResource) {
+		before, after := r.effective(old, gvr), r.effective(r.merged, gvr)
+		switch {
+		case before == nil && after == nil:
+			return
+		case before != nil && after != nil && equality.Semantic.DeepEqual(before.Spec.Resource, after.Spec.Resource) &&
+			equality.Semantic.DeepEqual(before.Spec.Connections, after.Spec.Connections):
+			return
+		case after != nil:
+			changed = append(changed, after.Spec.Resource.GroupVersionKind())
+		default:
+			changed = append(changed, before.Spec.Resource.GroupVersionKind())
+		}
+	}
+	for gvr := range old {
+		diff(gvr)
+	}
+	for gvr := range r.merged {
+		if _, ok := old[gvr]; !ok {
+			diff(gvr)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].String() < changed[j].String() })
+	return changed
+}
+
+// effective returns the descriptor of the resource in merged, or the embedded one.
+func (r *DescriptorRegistry) effective(merged map[schema.GroupVersionResource]*v1alpha1.ResourceDescriptor, gvr schema.GroupVersionResource) *v1alpha1.ResourceDescriptor {
+	if rd, ok := merged[gvr]; ok {
+		return rd
+	}
+	rd, err := r.known.LoadByGVR(gvr)
+	if err != nil {
+		return nil
+	}
+	return rd
+}
+
+// LoadByGVK returns the descriptor of the kind.
+func (r *DescriptorRegistry) LoadByGVK(gvk schema.GroupVersionKind) (*v1alpha1.ResourceDescriptor, error) {
+	r.m.RLock()
+	gvr, ok := r.gvks[gvk]
+	rd := r.merged[gvr]
+	r.m.RUnlock()
+	if ok {
+		return rd, nil
+	}
+	return r.known.LoadByGVK(gvk)
+}
+
+// ResourceIDForGVK returns the resource of the kind. If the version is empty, the
+// highest version of a loaded descriptor is preferred over the embedded ones.
+func (r *DescriptorRegistry) ResourceIDForGVK(gvk schema.GroupVersionKind) (*apiv1.ResourceID, error) {
+	r.m.RLock()
+	var rid *apiv1.ResourceID
+	for in, gvr := range r.gvks {
+		if in.GroupKind() != gvk.GroupKind() || (gvk.Version != "" && in.Version != gvk.Version) {
+			continue
+		}
+		if rid == nil || apiversion.MustCompare(in.Version, rid.Version) > 0 {
+			v := r.merged[gvr].Spec.Resource // copy
+			rid = &v
+		}
+	}
+	r.m.RUnlock()
+	if rid != nil {
+		return rid, nil
+	}
+	return r.known.ResourceIDForGVK(gvk)
+}
+
+// Visit calls f for the descriptor of every resource, the loaded descriptors first.
+func (r *DescriptorRegistry) Visit(f func(key string, rd *v1alpha1.ResourceDescriptor)) {
+	r.m.RLock()
+	merged := r.merged
+	r.m.RUnlock()
+
+	gvrs := make([]schema.GroupVersionResource, 0, len(merged))
+	for gvr := range merged {
+		gvrs = append(gvrs, gvr)
+	}
+	sort.Slice(gvrs, func(i, j int) bool { return gvrs[i].String() < gvrs[j].String() })
+	for _, gvr := range gvrs {
+		f(resourcedescriptors.GetName(gvr), merged[gvr])
+	}
+	r.known.Visit(func(key string, rd *v1alpha1.ResourceDescriptor) {
+		if _, ok := merged[rd.Spec.Resource.GroupVersionResource()]; !ok {
+			f(key, rd)
+		}
+	})
+}
+
+// EdgeLabels returns the labels of the connections of every descriptor.
+func (r *DescriptorRegistry) EdgeLabels() []apiv1.EdgeLabel {
+	seen := map[apiv1.EdgeLabel]bool{}
+	r.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		for _, c := range rd.Spec.Connections {
+			for _, lbl := range c.Labels {
+				seen[lbl] = true
+			}
+		}
+	})
+	out := make([]apiv1.EdgeLabel, 0, len(seen))
+	for lbl := range seen {
+		out = append(out, lbl)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// validateDescriptor checks that a loaded descriptor identifies its resource.
+func validateDescriptor(rd *v1alpha1.ResourceDescriptor) error {
+	res := rd.Spec.Resource
+	if res.Version == "" || res.Kind == "" || res.Name == "" {
+		return fmt.Errorf("descriptor %s must set the version, kind and name of the resource", rd.Name)
+	}
+	if _, err := apiversion.NewVersion(res.Version); err != nil {
+		return fmt.Errorf("descriptor %s has invalid version %q. err:%v", rd.Name, res.Version, err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub"
+)
+
+var (
+	podGVK    = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	widgetGVK = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+)
+
+func newTestDescriptor(gvk schema.GroupVersionKind, resource string, label apiv1.EdgeLabel) *v1alpha1.ResourceDescriptor {
+	return &v1alpha1.ResourceDescriptor{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       v1alpha1.ResourceKindResourceDescriptor,
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: gvk.Group + "-" + gvk.Version + "-" + resource},
+		Spec: v1alpha1.ResourceDescriptorSpec{
+			Resource: apiv1.ResourceID{
+				Group:   gvk.Group,
+				Version: gvk.Version,
+				Name:    resource,
+				Kind:    gvk.Kind,
+				Scope:   apiv1.NamespaceScoped,
+			},
+			Connections: []v1alpha1.ResourceConnection{
+				{
+					Target: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+					Labels: []apiv1.EdgeLabel{label},
+					ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+						Type:         v1alpha1.MatchName,
+						NameTemplate: "{.metadata.name}",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDescriptorRegistry(t *testing.T) {
+	reg := NewDescriptorRegistry(hub.NewRegistryOfKnownResources())
+
+	embedded, err := reg.LoadByGVK(podGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.LoadByGVK(widgetGVK); err == nil {
+		t.Fatal("expected Widget to be unregistered")
+	}
+
+	dirPod := newTestDescriptor(podGVK, "pods", "dir_label")
+	widget := newTestDescriptor(widgetGVK, "widgets", "widget_label")
+	if changed := reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{dirPod, widget}); !reflect.DeepEqual(changed, []schema.GroupVersionKind{podGVK, widgetGVK}) {
+		t.Errorf("expected Pod and Widget to change, got %v", changed)
+	}
+	if rd, _ := reg.LoadByGVK(podGVK); rd != dirPod {
+		t.Errorf("expected the descriptor of Pod to be loaded from the directory")
+	}
+	if rid, err := reg.ResourceIDForGVK(widgetGVK.GroupKind().WithVersion("")); err != nil || rid == nil || rid.Name != "widgets" {
+		t.Errorf("expected the resource of Widget, got %v %v", rid, err)
+	}
+
+	visited := map[schema.GroupVersionKind]*v1alpha1.ResourceDescriptor{}
+	reg.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		gvk := rd.Spec.Resource.GroupVersionKind()
+		if _, ok := visited[gvk]; ok {
+			t.Errorf("%v visited more than once", gvk)
+		}
+		visited[gvk] = rd
+	})
+	if visited[podGVK] != dirPod || visited[widgetGVK] != widget || visited[schema.GroupVersionKind{Version: "v1", Kind: "Service"}] == nil {
+		t.Errorf("expected Visit to merge the loaded descriptors over the embedded ones")
+	}
+
+	labels := reg.EdgeLabels()
+	for _, lbl := range []apiv1.EdgeLabel{"dir_label", "widget_label", apiv1.EdgeOffshoot} {
+		if i := sort.Search(len(labels), func(i int) bool { return labels[i] >= lbl }); i == len(labels) || labels[i] != lbl {
+			t.Errorf("expected edge label %s in %v", lbl, labels)
+		}
+	}
+
+	// reloading the same descriptors changes nothing
+	if changed := reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{newTestDescriptor(podGVK, "pods", "dir_label"), widget}); len(changed) != 0 {
+		t.Errorf("expected no change, got %v", changed)
+	}
+
+	// the cluster wins over the directory
+	clusterPod := newTestDescriptor(podGVK, "pods", "cluster_label")
+	if changed := reg.Set(ClusterSource, []*v1alpha1.ResourceDescriptor{clusterPod}); !reflect.DeepEqual(changed, []schema.GroupVersionKind{podGVK}) {
+		t.Errorf("expected Pod to change, got %v", changed)
+	}
+	if changed := reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{widget}); len(changed) != 0 {
+		t.Errorf("expected no change, got %v", changed)
+	}
+	if rd, _ := reg.LoadByGVK(podGVK); rd != clusterPod {
+		t.Errorf("expected the descriptor of Pod to be loaded from the cluster")
+	}
+
+	// removed descriptors fall back to the embedded ones
+	if changed := reg.Set(ClusterSource, nil); !reflect.DeepEqual(changed, []schema.GroupVersionKind{podGVK}) {
+		t.Errorf("expected Pod to change, got %v", changed)
+	}
+	if rd, _ := reg.LoadByGVK(podGVK); rd != embedded {
+		t.Errorf("expected the embedded descriptor of Pod")
+	}
+	if changed := reg.Set(DirectorySource, nil); !reflect.DeepEqual(changed, []schema.GroupVersionKind{widgetGVK}) {
+		t.Errorf("expected Widget to change, got %v", changed)
+	}
+	if _, err := reg.LoadByGVK(widgetGVK); err == nil {
+		t.Error("expected Widget to be unregistered")
+	}
+}
+
+func TestLoadDescriptorDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"widgets.yaml": `apiVersion: meta.k8s.appscode.com/v1alpha1
+kind: ResourceDescriptor
+metadata:
+  name: example.com-v1-widgets
+spec:
+  resource:
+    group: example.com
+    version: v1
+    name: widgets
+    kind: Widget
+    scope: Namespaced
+---
+apiVersion: meta.k8s.appscode.com/v1alpha1
+kind: ResourceDescriptor
+metadata:
+  name: example.com-v1-gadgets
+spec:
+  resource:
+    group: example.com
+    version: v1
+    name: gadgets
+    kind: Gadget
+    scope: Cluster
+`,
+		"nested/pods.json": `{"apiVersion": "meta.k8s.appscode.com/v1alpha1", "kind": "ResourceDescriptor",
+  "metadata": {"name": "core-v1-pods"},
+  "spec": {"resource": {"version": "v1", "name": "pods", "kind": "Pod", "scope": "Namespaced"}}}`,
+		"invalid.yaml": `apiVersion: meta.k8s.appscode.com/v1alpha1
+kind: ResourceDescriptor
+metadata:
+  name: example.com-v1-things
+spec:
+  resource:
+    group: example.com
+    name: things
+    kind: Thing
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-a-descriptor
+`,
+		"README.md":             "ignored",
+		"..2021_01_01/old.yaml": "ignored: [",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rds, err := LoadDescriptorDir(dir)
+	if err == nil {
+		t.Error("expected the errors of invalid.yaml")
+	}
+	var names []string
+	for _, rd := range rds {
+		names = append(names, rd.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"core-v1-pods", "example.com-v1-gadgets", "example.com-v1-widgets"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
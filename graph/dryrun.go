@@ -0,0 +1,267 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DryRunRequest is a connection to evaluate for a source object without adding it to the graph.
+// Either Source or Object must be set.
+type DryRunRequest struct {
+	// Source is the oid of the source object, read using the client of the finder.
+	Source apiv1.OID `json:"source,omitempty"`
+	// Object is the source object, eg, a manifest that is not applied yet.
+	Object *unstructured.Unstructured `json:"object,omitempty"`
+	// Connection is the connection of the type of the source object to test.
+	Connection v1alpha1.ResourceConnection `json:"connection"`
+}
+
+// DryRunResult reports what a connection matches for a source object.
+type DryRunResult struct {
+	Source apiv1.ObjectID  `json:"source"`
+	Target metav1.TypeMeta `json:"target"`
+	// Errors lists the problems of the connection spec. The connection is not evaluated if it has any.
+	Errors []string `json:"errors,omitempty"`
+	// Forward evaluates the connection from the source.
+	Forward *DryRunStep `json:"forward,omitempty"`
+	// Backward evaluates the connection backward from each target found by Forward.
+	Backward []DryRunStep `json:"backward,omitempty"`
+	// Asymmetric lists the targets from which the backward edge doesn't find the source. The graph
+	// only gets the edges found in both directions consistently, so this should be empty. The backward
+	// edges only find objects in the cluster, so targets of an Object that is not created yet are listed.
+	Asymmetric []apiv1.ObjectID `json:"asymmetric,omitempty"`
+}
+
+// DryRunStep is the evaluation of the connection from an object in one direction.
+type DryRunStep struct {
+	From apiv1.ObjectID `json:"from"`
+	// Selector is the label selector evaluated for From, if the connection uses one.
+	Selector string `json:"selector,omitempty"`
+	// References are the names or values computed for From by the references or the name template
+	// of the connection.
+	References []string         `json:"references,omitempty"`
+	Matches    []apiv1.ObjectID `json:"matches"`
+	Duration   metav1.Duration  `json:"duration"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// DryRun evaluates the connection of the request for its source object using ResourcesFor in both
+// directions. It only reads objects; the graph and the indexes are not changed, and the connection
+// is not kept in the cache of compiled connections.
+func (finder ObjectFinder) DryRun(req DryRunRequest) (*DryRunResult, error) {
+	src, err := finder.dryRunSource(req)
+	if err != nil {
+		return nil, err
+	}
+	c := req.Connection
+	result := DryRunResult{
+		Source: *apiv1.NewObjectID(src),
+		Target: c.Target,
+	}
+
+	var errs field.ErrorList
+	if c.Target.APIVersion == "" {
+		errs = append(errs, field.Required(field.NewPath("target", "apiVersion"), ""))
+	}
+	if c.Target.Kind == "" {
+		errs = append(errs, field.Required(field.NewPath("target", "kind"), ""))
+	}
+	errs = append(errs, ValidateConnection(c.ResourceConnectionSpec, nil)...)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return &result, nil
+	}
+
+	// the connection is compiled for the dry run only
+	plan, err := CompileConnection(c.ResourceConnectionSpec)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return &result, nil
+	}
+
+	fe := &Edge{
+		Src:        src.GroupVersionKind(),
+		Dst:        c.Target.GroupVersionKind(),
+		Connection: c.ResourceConnectionSpec,
+		Forward:    true,
+		plan:       plan,
+	}
+	step, targets := finder.dryRunStep(src, fe)
+	result.Forward = &step
+
+	be := &Edge{
+		Src:        fe.Dst,
+		Dst:        fe.Src,
+		Connection: fe.Connection,
+		plan:       plan,
+	}
+	for _, t := range targets {
+		step, sources := finder.dryRunStep(t, be)
+		result.Backward = append(result.Backward, step)
+		if step.Error == "" && !containsObject(sources, src) {
+			result.Asymmetric = append(result.Asymmetric, step.From)
+		}
+	}
+	return &result, nil
+}
+
+// dryRunSource returns the source object of the request.
+func (finder ObjectFinder) dryRunSource(req DryRunRequest) (*unstructured.Unstructured, error) {
+	if req.Object != nil {
+		if req.Source != "" {
+			return nil, errors.New("source and object are mutually exclusive")
+		}
+		if req.Object.GetAPIVersion() == "" || req.Object.GetKind() == "" || req.Object.GetName() == "" {
+			return nil, errors.New("object must have apiVersion, kind and name")
+		}
+		return req.Object, nil
+	}
+	if req.Source == "" {
+		return nil, errors.New("either source or object is required")
+	}
+
+	id, err := apiv1.ParseObjectID(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := ResolveGroupKind(finder.Client.RESTMapper(), id.Group, id.Kind)
+	if err != nil {
+		return nil, err
+	}
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(mapping.GroupVersionKind)
+	if err := finder.Client.Get(context.TODO(), client.ObjectKey{Namespace: id.Namespace, Name: id.Name}, &obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// dryRunStep evaluates the edge from obj and returns the step and the objects found.
+func (finder ObjectFinder) dryRunStep(obj *unstructured.Unstructured, e *Edge) (DryRunStep, []*unstructured.Unstructured) {
+	step := DryRunStep{
+		From:    *apiv1.NewObjectID(obj),
+		Matches: []apiv1.ObjectID{},
+	}
+	start := time.Now()
+	objects, err := finder.ResourcesFor(obj, e)
+	step.Duration = metav1.Duration{Duration: time.Since(start)}
+	if err != nil {
+		step.Error = err.Error()
+		return step, nil
+	}
+	for _, o := range objects {
+		step.Matches = append(step.Matches, *apiv1.NewObjectID(o))
+	}
+	sort.Slice(step.Matches, func(i, j int) bool { return step.Matches[i].OID() < step.Matches[j].OID() })
+
+	if e.Forward {
+		if err := finder.describeEdge(obj, e, &step); err != nil {
+			step.Error = err.Error()
+		}
+	}
+	return step, objects
+}
+
+// describeEdge records the selector and references of the forward edge e evaluated for src.
+func (finder ObjectFinder) describeEdge(src *unstructured.Unstructured, e *Edge, step *DryRunStep) error {
+	plan, err := e.compiled()
+	if err != nil {
+		return err
+	}
+
+	switch e.Connection.Type {
+	case v1alpha1.MatchSelector:
+		selector, err := connectionSelector(src, e)
+		if err != nil {
+			return err
+		}
+		step.Selector = selector.String()
+	case v1alpha1.MatchName, v1alpha1.MatchRef:
+		keys, err := finder.connectionKeys(src, e)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			step.References = append(step.References, key.String())
+		}
+	case MatchValue:
+		value, ok, err := plan.name.eval(src)
+		if err != nil {
+			return err
+		}
+		if ok {
+			step.References = []string{value}
+			if !plan.value.annotation {
+				step.Selector = plan.value.key + "=" + value
+			}
+		}
+	case MatchExpression:
+		if plan.selector != nil {
+			selector, err := plan.selector.eval(src)
+			if err != nil {
+				return err
+			}
+			step.Selector = selector.String()
+		}
+		if plan.name != nil {
+			name, ok, err := plan.name.eval(src)
+			if err != nil {
+				return err
+			}
+			if ok {
+				step.References = []string{name}
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the key in namespace/name format, followed by the uid if it is set.
+func (key connectionKey) String() string {
+	s := key.Name
+	if key.Namespace != "" {
+		s = key.Namespace + "/" + s
+	}
+	if key.UID != "" {
+		s = fmt.Sprintf("%s (uid %s)", s, key.UID)
+	}
+	return s
+}
+
+func containsObject(objects []*unstructured.Unstructured, obj *unstructured.Unstructured) bool {
+	for _, o := range objects {
+		if o.GroupVersionKind().GroupKind() == obj.GroupVersionKind().GroupKind() &&
+			o.GetNamespace() == obj.GetNamespace() && o.GetName() == obj.GetName() {
+			return true
+		}
+	}
+	return false
+}
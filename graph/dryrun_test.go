@@ -0,0 +1,120 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+func TestDryRun(t *testing.T) {
+	finder := ObjectFinder{Client: newConnectionTestClient()}
+	target := metav1.TypeMeta{APIVersion: targetGVK.GroupVersion().String(), Kind: targetGVK.Kind}
+	oids := func(ids []apiv1.ObjectID) []string {
+		out := make([]string, 0, len(ids))
+		for _, id := range ids {
+			out = append(out, id.Namespace+"/"+id.Name)
+		}
+		return out
+	}
+
+	t.Run("selector", func(t *testing.T) {
+		spec := v1alpha1.ResourceConnectionSpec{
+			Type:          v1alpha1.MatchSelector,
+			SelectorPath:  "spec.selector",
+			NamespacePath: MetadataNamespace,
+		}
+		result, err := finder.DryRun(DryRunRequest{
+			Source: "G=example.com,K=Source,NS=a,N=own",
+			Connection: v1alpha1.ResourceConnection{
+				Target:                 target,
+				Labels:                 []apiv1.EdgeLabel{apiv1.EdgeExposedBy},
+				ResourceConnectionSpec: spec,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Forward == nil || result.Forward.Error != "" {
+			t.Fatalf("expected the forward step to succeed, got %+v", result.Forward)
+		}
+		if result.Forward.Selector != "app=web" {
+			t.Errorf("expected selector app=web, got %q", result.Forward.Selector)
+		}
+		if expected, got := []string{"a/stale", "a/web"}, oids(result.Forward.Matches); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected matches %v, got %v", expected, got)
+		}
+		if len(result.Backward) != 2 {
+			t.Errorf("expected a backward step per target, got %d", len(result.Backward))
+		}
+		if len(result.Asymmetric) > 0 {
+			t.Errorf("expected a symmetric connection, got %v", result.Asymmetric)
+		}
+		if plans.has(spec) {
+			t.Error("expected the connection not to be added to the plan cache")
+		}
+	})
+
+	t.Run("inline object", func(t *testing.T) {
+		result, err := finder.DryRun(DryRunRequest{
+			Object: newTestSource(sourceGVK, "a", "new", nil),
+			Connection: v1alpha1.ResourceConnection{
+				Target: target,
+				ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+					Type:       v1alpha1.MatchRef,
+					References: []string{`{range .spec.refs[*]}{.name},{.namespace}{"\n"}{end}`},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"a/web", "b/web"}; !reflect.DeepEqual(result.Forward.References, expected) {
+			t.Errorf("expected references %v, got %v", expected, result.Forward.References)
+		}
+		if expected, got := []string{"a/web", "b/web"}, oids(result.Forward.Matches); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected matches %v, got %v", expected, got)
+		}
+		// the source is not in the cluster, so it can't be found backward
+		if expected, got := []string{"a/web", "b/web"}, oids(result.Asymmetric); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected asymmetric targets %v, got %v", expected, got)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		result, err := finder.DryRun(DryRunRequest{
+			Object: newTestSource(sourceGVK, "a", "new", nil),
+			Connection: v1alpha1.ResourceConnection{
+				ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Errors) != 3 || result.Forward != nil {
+			t.Errorf("expected 3 errors and no evaluation, got %+v", result)
+		}
+	})
+
+	if _, err := finder.DryRun(DryRunRequest{Source: "G=example.com,K=Source,NS=a,N=missing"}); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kmodules.xyz/client-go/pointer"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MatchExpression connects a source to the targets for which every CEL predicate in References is
+// true. The predicates see the objects as the maps source and target, e.g.
+//
+//	target.spec.volumeName == source.metadata.name &&
+//	target.metadata.namespace == source.spec.claimRef.namespace
+//
+// The targets are looked up by the index hints of the connection, so they aren't scanned one by one.
+// The kind of the targets is the Target of the connection, NamespacePath restricts their namespaces,
+// Selector is a label selector template the targets must match and NameTemplate is the name of the
+// target. Selector or NameTemplate is required. The hints are part of the connection, so a pair is
+// only connected if it satisfies the hints and the predicates.
+const MatchExpression v1alpha1.ConnectionType = "MatchExpression"
+
+var (
+	celEnv     *cel.Env
+	celEnvErr  error
+	celEnvOnce sync.Once
+)
+
+func celEnvironment() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		celEnv, celEnvErr = newObjectEnvironment(nil, nil)
+	})
+	return celEnv, celEnvErr
+}
+
+// compilePredicate parses and type checks a CEL predicate. The predicate must return a bool.
+// The types of the fields of the objects other than apiVersion, kind and metadata depend on their
+// kinds, they are checked against the schemas of the descriptors by ValidateConnectionTypes.
+func compilePredicate(expr string) (cel.Program, error) {
+	env, err := celEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if t := ast.ResultType(); t.GetPrimitive() != exprpb.Type_BOOL && t.GetDyn() == nil {
+		return nil, fmt.Errorf("expression returns %s, expected bool", cel.FormatType(t))
+	}
+	return env.Program(ast)
+}
+
+func compileExpressionConnection(p *ConnectionPlan, fldPath *field.Path) field.ErrorList {
+	spec := p.Spec
+	var errs field.ErrorList
+	if len(spec.References) == 0 {
+		errs = append(errs, field.Required(fldPath.Child("references"), "references must have at least one expression"))
+	}
+	if spec.SelectorPath != "" {
+		errs = append(errs, field.Forbidden(fldPath.Child("selectorPath"), "selectorPath is not supported, use selector"))
+	} else if spec.Selector == nil && spec.NameTemplate == "" {
+		errs = append(errs, field.Required(fldPath.Child("selector"), "selector or nameTemplate is required to look up the targets"))
+	}
+	for i, expr := range spec.References {
+		prg, err := compilePredicate(expr)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("references").Index(i), expr, err.Error()))
+			continue
+		}
+		p.predicates = append(p.predicates, prg)
+	}
+	if spec.Selector != nil {
+		sel, err := compileSelectorTemplate(spec.Selector)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("selector"), spec.Selector, err.Error()))
+		}
+		p.selector = sel
+	}
+	if spec.NameTemplate != "" {
+		name, err := compileNameTemplate(spec.NameTemplate)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("nameTemplate"), spec.NameTemplate, err.Error()))
+		}
+		p.name = name
+	}
+	return errs
+}
+
+// matches returns true if every predicate is true for the pair. A predicate that fails to
+// evaluate, e.g. because a field is missing, is false.
+func (p *ConnectionPlan) matches(src, dst *unstructured.Unstructured) bool {
+	vars := map[string]interface{}{
+		"source": src.Object,
+		"target": dst.Object,
+	}
+	for _, prg := range p.predicates {
+		out, _, err := prg.Eval(vars)
+		if err != nil {
+			return false
+		}
+		if v, ok := out.Value().(bool); !ok || !v {
+			return false
+		}
+	}
+	return true
+}
+
+// expressionHints are the index hints of a MatchExpression connection evaluated for a source.
+type expressionHints struct {
+	namespaces []string // nil means all namespaces
+	selector   labels.Selector
+	name       string
+	hasName    bool
+}
+
+// expressionHints evaluates the index hints of the connection for src, once for all of its
+// candidate targets. namespaced is true if the targets are namespaced. It returns nil if src
+// connects to no target, because its name template has no value.
+func (finder ObjectFinder) expressionHints(plan *ConnectionPlan, e *Edge, src *unstructured.Unstructured, namespaced bool) (*expressionHints, error) {
+	var h expressionHints
+	if namespaced {
+		namespaces, err := finder.Namespaces(src, e.Connection.NamespacePath)
+		if err != nil {
+			return nil, err
+		}
+		h.namespaces = namespaces
+	}
+	if plan.selector != nil {
+		sel, err := plan.selector.eval(src)
+		if err != nil {
+			return nil, err
+		}
+		h.selector = sel
+	}
+	if plan.name != nil {
+		name, ok, err := plan.name.eval(src)
+		if err != nil || !ok {
+			return nil, err
+		}
+		h.name, h.hasName = name, true
+	}
+	return &h, nil
+}
+
+// allows returns true if dst satisfies the hints.
+func (h *expressionHints) allows(dst *unstructured.Unstructured) bool {
+	if dst.GetNamespace() != "" && !namespaceAllowed(h.namespaces, dst.GetNamespace()) {
+		return false
+	}
+	if h.selector != nil && !h.selector.Matches(labels.Set(dst.GetLabels())) {
+		return false
+	}
+	return !h.hasName || h.name == dst.GetName()
+}
+
+// expressionTargets returns the targets of src over a forward MatchExpression edge.
+func (finder ObjectFinder) expressionTargets(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, err
+	}
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	h, err := finder.expressionHints(plan, e, src, namespaced)
+	if err != nil || h == nil {
+		return nil, err
+	}
+
+	var candidates []*unstructured.Unstructured
+	namespaces := h.namespaces
+	if namespaces == nil {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	if h.hasName {
+		for _, ns := range namespaces {
+			objects, err := finder.getObjects(e.Dst, client.ObjectKey{Namespace: ns, Name: h.name})
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, objects...)
+		}
+	} else if finder.Index.Synced(e.Dst.GroupKind()) {
+		candidates, err = finder.getByKeys(e.Dst, finder.Index.Select(e.Dst.GroupKind(), h.selector, h.namespaces))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, ns := range namespaces {
+			var result unstructured.UnstructuredList
+			result.SetGroupVersionKind(e.Dst)
+			if err := finder.Client.List(context.TODO(), &result, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: h.selector}); err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, pointer.ToUnstructuredP(result.Items)...)
+		}
+	}
+
+	var out []*unstructured.Unstructured
+	for _, rs := range candidates {
+		if h.allows(rs) && plan.matches(src, rs) && isConnected(e.Connection.Level, rs, src) {
+			out = append(out, rs)
+		}
+	}
+	return out, nil
+}
+
+// expressionSources returns the sources of src over a backward MatchExpression edge. The sources are
+// looked up by the field index of the name template or by the label index of the selector. Without
+// them, e.g. for types read from the apiserver, the sources are listed.
+func (finder ObjectFinder) expressionSources(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*unstructured.Unstructured
+	field := exprNameField(e.Src.GroupKind(), e.Connection)
+	switch {
+	case plan.name != nil && finder.Fields.Has(e.Dst, field):
+		var ns string
+		if e.Connection.NamespacePath == MetadataNamespace {
+			namespaced, err := finder.isNamespaced(e.Dst)
+			if err != nil {
+				return nil, err
+			}
+			if namespaced {
+				ns = src.GetNamespace()
+			}
+		}
+		candidates, err = finder.listByField(e.Dst, ns, field, src.GetName())
+	case plan.name != nil && plan.name.has(MetadataNameQuery):
+		candidates, err = finder.nameCandidates(src, e, plan.name, src.GetName())
+	case plan.selector != nil && finder.Index.Synced(e.Dst.GroupKind()):
+		candidates, err = finder.getByKeys(e.Dst, finder.Index.Selecting(e, src.GetLabels()))
+	default:
+		candidates, err = finder.sourceCandidates(src, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*unstructured.Unstructured
+	for _, rs := range candidates {
+		h, err := finder.expressionHints(plan, e, rs, src.GetNamespace() != "")
+		if err != nil {
+			return nil, err
+		}
+		if h != nil && h.allows(src) && plan.matches(rs, src) && isConnected(e.Connection.Level, src, rs) {
+			out = append(out, rs)
+		}
+	}
+	return out, nil
+}
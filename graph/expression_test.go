@@ -0,0 +1,260 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	crdv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCompileExpressionConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		exprs   []string
+		noHint  bool
+		wantErr bool
+	}{
+		{name: "bool", exprs: []string{"target.spec.volumeName == source.metadata.name"}},
+		{name: "dyn", exprs: []string{"source.spec.enabled"}},
+		{name: "macro", exprs: []string{`has(source.spec.claimRef) && source.spec.claimRef.kind == "PersistentVolumeClaim"`}},
+		{name: "metadata", exprs: []string{`source.metadata.labels["app"] == target.metadata.labels.app && target.metadata.generation > 1`}},
+		{name: "owners", exprs: []string{"target.metadata.ownerReferences.exists(r, r.uid == source.metadata.uid && r.controller)"}},
+		{name: "syntax", exprs: []string{"target.spec.volumeName =="}, wantErr: true},
+		{name: "undeclared", exprs: []string{"pod.metadata.name == source.metadata.name"}, wantErr: true},
+		{name: "not bool", exprs: []string{"size(source.metadata.name) + 1"}, wantErr: true},
+		{name: "one invalid", exprs: []string{"true", "source +"}, wantErr: true},
+		{name: "misspelled metadata field", exprs: []string{"target.metadata.nmae == source.metadata.name"}, wantErr: true},
+		{name: "misspelled owner field", exprs: []string{"target.metadata.ownerReferences.exists(r, r.ui == source.metadata.uid)"}, wantErr: true},
+		{name: "comparison type", exprs: []string{`source.metadata.generation == "1"`}, wantErr: true},
+		{name: "label type", exprs: []string{"target.metadata.labels.replicas > 1"}, wantErr: true},
+		{name: "empty", wantErr: true},
+		{name: "no hint", exprs: []string{"true"}, noHint: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := v1alpha1.ResourceConnectionSpec{
+				Type:       MatchExpression,
+				References: test.exprs,
+			}
+			if !test.noHint {
+				spec.NameTemplate = "{.spec.claimRef.name}"
+			}
+			_, err := CompileConnection(spec)
+			if (err != nil) != test.wantErr {
+				t.Errorf("wantErr %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateConnectionTypes(t *testing.T) {
+	preserve := true
+	volume := &crdv1.CustomResourceValidation{OpenAPIV3Schema: &crdv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]crdv1.JSONSchemaProps{
+			"spec": {
+				Type: "object",
+				Properties: map[string]crdv1.JSONSchemaProps{
+					"claimRef": {
+						Type: "object",
+						Properties: map[string]crdv1.JSONSchemaProps{
+							"name":      {Type: "string"},
+							"namespace": {Type: "string"},
+						},
+					},
+					"capacity": {
+						Type:                 "object",
+						AdditionalProperties: &crdv1.JSONSchemaPropsOrBool{Schema: &crdv1.JSONSchemaProps{XIntOrString: true}},
+					},
+					"mountOptions": {Type: "array", Items: &crdv1.JSONSchemaPropsOrArray{Schema: &crdv1.JSONSchemaProps{Type: "string"}}},
+					"parameters":   {Type: "object", XPreserveUnknownFields: &preserve, Properties: map[string]crdv1.JSONSchemaProps{"replicas": {Type: "integer"}}},
+					"template":     {Type: "object", XEmbeddedResource: true},
+				},
+			},
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		expr    string
+		schema  *crdv1.CustomResourceValidation
+		wantErr bool
+	}{
+		{name: "nested", expr: "target.metadata.name == source.spec.claimRef.name", schema: volume},
+		{name: "map", expr: `source.spec.capacity["storage"] == "1Gi"`, schema: volume},
+		{name: "list", expr: `"ro" in source.spec.mountOptions`, schema: volume},
+		{name: "preserved", expr: "source.spec.parameters.replicas > 1 && source.spec.parameters.zone == target.metadata.labels.zone", schema: volume},
+		{name: "embedded", expr: "source.spec.template.metadata.name == target.metadata.name && source.spec.template.spec.x", schema: volume},
+		{name: "without schema", expr: "source.spec.claimRef.nmae == target.metadata.name"},
+		{name: "misspelled", expr: "source.spec.claimRef.nmae == target.metadata.name", schema: volume, wantErr: true},
+		{name: "unknown top level field", expr: "source.sepc.claimRef.name == target.metadata.name", schema: volume, wantErr: true},
+		{name: "comparison type", expr: "source.spec.parameters.replicas == target.metadata.name", schema: volume, wantErr: true},
+		{name: "element type", expr: "1 in source.spec.mountOptions", schema: volume, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := v1alpha1.ResourceConnectionSpec{
+				Type:         MatchExpression,
+				References:   []string{test.expr},
+				NameTemplate: "{.spec.claimRef.name}",
+			}
+			if _, err := CompileConnection(spec); err != nil {
+				t.Fatal(err)
+			}
+			errs := ValidateConnectionTypes(spec, test.schema, nil, nil)
+			if (len(errs) > 0) != test.wantErr {
+				t.Errorf("wantErr %v, got %v", test.wantErr, errs)
+			}
+		})
+	}
+}
+
+// TestCompileDescriptorTypes checks that the predicates are type checked against the schemas of
+// the descriptors of their source and target when the descriptors are loaded.
+func TestCompileDescriptorTypes(t *testing.T) {
+	withSchema := func(rd *v1alpha1.ResourceDescriptor, props map[string]crdv1.JSONSchemaProps) *v1alpha1.ResourceDescriptor {
+		rd.Spec.Validation = &crdv1.CustomResourceValidation{OpenAPIV3Schema: &crdv1.JSONSchemaProps{Type: "object", Properties: props}}
+		return rd
+	}
+	spec := map[string]crdv1.JSONSchemaProps{
+		"spec": {Type: "object", Properties: map[string]crdv1.JSONSchemaProps{"volumeName": {Type: "string"}}},
+	}
+	volumeGVK := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Volume"}
+	claimGVK := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Claim"}
+	volume := withSchema(newTestDescriptor(volumeGVK, "volumes", apiv1.EdgeOffshoot), nil)
+	claim := withSchema(newTestDescriptor(claimGVK, "claims", apiv1.EdgeOffshoot), spec)
+	for _, expr := range []string{"target.spec.volumeName == source.metadata.name", "target.spec.volume == source.metadata.name"} {
+		volume.Spec.Connections = []v1alpha1.ResourceConnection{{
+			Target:                 metav1.TypeMeta{APIVersion: "example.com/v1", Kind: "Claim"},
+			Labels:                 []apiv1.EdgeLabel{apiv1.EdgeOffshoot},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{expr}, NameTemplate: "{.spec.claimRef.name}"},
+		}}
+		reg := NewDescriptorRegistry(hub.NewRegistryOfKnownResources())
+		reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{volume, claim})
+
+		errs := NewConnectionPlans().compileDescriptor(volume, reg)
+		if valid := expr == "target.spec.volumeName == source.metadata.name"; valid != (len(errs) == 0) {
+			t.Errorf("%s: expected valid %v, got %v", expr, valid, errs)
+		}
+	}
+}
+
+// TestResourcesForExpression connects volumes to the claims bound to them, with a selector or a name hint.
+func TestResourcesForExpression(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(clusterSourceGVK, meta.RESTScopeRoot)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+
+	newVolume := func(name, claimNamespace, claimName string) *unstructured.Unstructured {
+		obj := newTestObject(clusterSourceGVK, "", name, nil)
+		if claimName != "" {
+			_ = unstructured.SetNestedStringMap(obj.Object, map[string]string{
+				"namespace": claimNamespace,
+				"name":      claimName,
+			}, "spec", "claimRef")
+		}
+		return obj
+	}
+	newClaim := func(namespace, name, volumeName string) *unstructured.Unstructured {
+		obj := newTestObject(targetGVK, namespace, name, map[string]string{"storage": "volume"})
+		_ = unstructured.SetNestedField(obj.Object, volumeName, "spec", "volumeName")
+		return obj
+	}
+	kc := offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			newVolume("pv-1", "a", "data"),
+			newVolume("pv-2", "b", "data"),
+			newVolume("pv-3", "", ""),
+			newVolume("pv-4", "a", "logs"),
+			newClaim("a", "data", "pv-1"),
+			newClaim("b", "data", "pv-2"),
+			// the claim names pv-1, but pv-1 is bound to a/data
+			newClaim("c", "data", "pv-1"),
+			// the claim is not bound to pv-4 yet
+			newClaim("a", "logs", ""),
+		).Build(),
+		mapper: mapper,
+	}
+
+	exprs := []string{
+		"target.spec.volumeName == source.metadata.name",
+		"target.metadata.namespace == source.spec.claimRef.namespace",
+	}
+	specs := map[string]v1alpha1.ResourceConnectionSpec{
+		"selector": {Type: MatchExpression, References: exprs, Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"storage": "volume"}}},
+		"name":     {Type: MatchExpression, References: exprs, NameTemplate: "{.spec.claimRef.name}"},
+	}
+	for specName, spec := range specs {
+		t.Run(specName, func(t *testing.T) {
+			finder := ObjectFinder{Client: kc}
+			forward := &Edge{Src: clusterSourceGVK, Dst: targetGVK, Connection: spec, Forward: true}
+			backward := &Edge{Src: targetGVK, Dst: clusterSourceGVK, Connection: spec}
+
+			for name, expected := range map[string][]string{
+				"pv-1": {"a/data"},
+				"pv-2": {"b/data"},
+				"pv-3": {},
+				"pv-4": {},
+			} {
+				var obj unstructured.Unstructured
+				obj.SetGroupVersionKind(clusterSourceGVK)
+				if err := kc.Get(context.TODO(), objectKey("/"+name), &obj); err != nil {
+					t.Fatal(err)
+				}
+				objs, err := finder.ResourcesFor(&obj, forward)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+					t.Errorf("forward from %s: expected %v, got %v", name, expected, got)
+				}
+			}
+
+			for key, expected := range map[string][]string{
+				"a/data": {"/pv-1"},
+				"b/data": {"/pv-2"},
+				"c/data": {},
+				"a/logs": {},
+			} {
+				var obj unstructured.Unstructured
+				obj.SetGroupVersionKind(targetGVK)
+				if err := kc.Get(context.TODO(), objectKey(key), &obj); err != nil {
+					t.Fatal(err)
+				}
+				objs, err := finder.ResourcesFor(&obj, backward)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+					t.Errorf("backward from %s: expected %v, got %v", key, expected, got)
+				}
+			}
+		})
+	}
+}
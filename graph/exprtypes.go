@@ -0,0 +1,230 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	crdv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// The names of the message types of the CEL environment. They are qualified, so they can't be
+// mistaken for a selection on the source or target variables.
+const (
+	sourceTypeName         = "graph.Source"
+	targetTypeName         = "graph.Target"
+	objectMetaTypeName     = "graph.ObjectMeta"
+	ownerReferenceTypeName = "graph.OwnerReference"
+)
+
+// objectType is a message type of the CEL environment, describing a Kubernetes object or one of its
+// fields. The objects are unstructured maps at evaluation time, so the message types are only used
+// to type check the predicates: fields are selected from the maps as usual.
+type objectType struct {
+	fields map[string]*exprpb.Type
+	// open types have fields that aren't declared, of type dyn
+	open bool
+}
+
+// objectTypes is the type provider of the CEL environment. It declares the message types of the
+// objects on top of the standard types.
+type objectTypes struct {
+	ref.TypeRegistry
+	types map[string]*objectType
+}
+
+func newObjectTypes() (*objectTypes, error) {
+	reg, err := types.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	p := &objectTypes{
+		TypeRegistry: reg,
+		types:        map[string]*objectType{},
+	}
+	p.types[ownerReferenceTypeName] = &objectType{fields: map[string]*exprpb.Type{
+		"apiVersion":         decls.String,
+		"kind":               decls.String,
+		"name":               decls.String,
+		"uid":                decls.String,
+		"controller":         decls.Bool,
+		"blockOwnerDeletion": decls.Bool,
+	}}
+	p.types[objectMetaTypeName] = &objectType{fields: map[string]*exprpb.Type{
+		"name":                       decls.String,
+		"generateName":               decls.String,
+		"namespace":                  decls.String,
+		"selfLink":                   decls.String,
+		"uid":                        decls.String,
+		"resourceVersion":            decls.String,
+		"generation":                 decls.Int,
+		"creationTimestamp":          decls.String,
+		"deletionTimestamp":          decls.String,
+		"deletionGracePeriodSeconds": decls.Int,
+		"labels":                     decls.NewMapType(decls.String, decls.String),
+		"annotations":                decls.NewMapType(decls.String, decls.String),
+		"ownerReferences":            decls.NewListType(decls.NewObjectType(ownerReferenceTypeName)),
+		"finalizers":                 decls.NewListType(decls.String),
+		"clusterName":                decls.String,
+		"managedFields":              decls.NewListType(decls.Dyn),
+	}}
+	return p, nil
+}
+
+// FindType returns the type of the declared message types, or of the standard types.
+func (p *objectTypes) FindType(typeName string) (*exprpb.Type, bool) {
+	if _, ok := p.types[typeName]; ok {
+		return decls.NewTypeType(decls.NewObjectType(typeName)), true
+	}
+	return p.TypeRegistry.FindType(typeName)
+}
+
+// FindFieldType returns the type of a field of the declared message types, or of the standard types.
+func (p *objectTypes) FindFieldType(messageType, fieldName string) (*ref.FieldType, bool) {
+	t, ok := p.types[messageType]
+	if !ok {
+		return p.TypeRegistry.FindFieldType(messageType, fieldName)
+	}
+	if ft, ok := t.fields[fieldName]; ok {
+		return &ref.FieldType{Type: ft}, true
+	}
+	if t.open {
+		return &ref.FieldType{Type: decls.Dyn}, true
+	}
+	return nil, false
+}
+
+// declareObject declares the message type of the objects with the given schema. The type of
+// apiVersion, kind and metadata is known for every object. Without a schema, the other fields of
+// the objects are dyn.
+func (p *objectTypes) declareObject(name string, schema *crdv1.JSONSchemaProps) *exprpb.Type {
+	t := &objectType{
+		fields: map[string]*exprpb.Type{
+			"apiVersion": decls.String,
+			"kind":       decls.String,
+			"metadata":   decls.NewObjectType(objectMetaTypeName),
+		},
+		open: schema == nil || len(schema.Properties) == 0 || preservesUnknownFields(schema),
+	}
+	if schema != nil {
+		for k, prop := range schema.Properties {
+			if _, ok := t.fields[k]; !ok {
+				prop := prop
+				t.fields[k] = p.schemaType(name+"."+k, &prop)
+			}
+		}
+	}
+	p.types[name] = t
+	return decls.NewObjectType(name)
+}
+
+// schemaType returns the type of the values of the schema, declaring the message types of the
+// objects with properties under the given name.
+func (p *objectTypes) schemaType(name string, schema *crdv1.JSONSchemaProps) *exprpb.Type {
+	switch {
+	case schema.XEmbeddedResource:
+		return p.declareObject(name, schema)
+	case schema.XIntOrString:
+		return decls.Dyn
+	case len(schema.Properties) > 0:
+		t := &objectType{
+			fields: map[string]*exprpb.Type{},
+			open:   preservesUnknownFields(schema),
+		}
+		for k, prop := range schema.Properties {
+			prop := prop
+			t.fields[k] = p.schemaType(name+"."+k, &prop)
+		}
+		p.types[name] = t
+		return decls.NewObjectType(name)
+	}
+
+	switch schema.Type {
+	case "string":
+		return decls.String
+	case "integer":
+		return decls.Int
+	case "boolean":
+		return decls.Bool
+	case "array":
+		if schema.Items != nil && schema.Items.Schema != nil {
+			return decls.NewListType(p.schemaType(name+"[]", schema.Items.Schema))
+		}
+		return decls.NewListType(decls.Dyn)
+	case "object":
+		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+			return decls.NewMapType(decls.String, p.schemaType(name+"{}", schema.AdditionalProperties.Schema))
+		}
+		return decls.NewMapType(decls.String, decls.Dyn)
+	}
+	// numbers are decoded as int64 or float64 depending on their value
+	return decls.Dyn
+}
+
+func preservesUnknownFields(schema *crdv1.JSONSchemaProps) bool {
+	return schema.XPreserveUnknownFields != nil && *schema.XPreserveUnknownFields
+}
+
+// newObjectEnvironment returns a CEL environment declaring source and target as the objects with
+// the given schemas. nil schemas declare objects whose fields other than apiVersion, kind and
+// metadata are dyn.
+func newObjectEnvironment(source, target *crdv1.JSONSchemaProps) (*cel.Env, error) {
+	p, err := newObjectTypes()
+	if err != nil {
+		return nil, err
+	}
+	return cel.NewEnv(
+		cel.CustomTypeProvider(p),
+		cel.Declarations(
+			decls.NewVar("source", p.declareObject(sourceTypeName, source)),
+			decls.NewVar("target", p.declareObject(targetTypeName, target)),
+		),
+	)
+}
+
+// ValidateConnectionTypes type checks the predicates of a MatchExpression connection against the
+// schemas of its source and target, so predicates selecting fields the objects don't have or
+// comparing values of different types are found at load time. nil schemas only check the metadata
+// of the objects. The connection is expected to be valid otherwise, see ValidateConnection.
+func ValidateConnectionTypes(spec v1alpha1.ResourceConnectionSpec, source, target *crdv1.CustomResourceValidation, fldPath *field.Path) field.ErrorList {
+	if spec.Type != MatchExpression {
+		return nil
+	}
+	env, err := newObjectEnvironment(openAPISchema(source), openAPISchema(target))
+	if err != nil {
+		return field.ErrorList{field.InternalError(fldPath.Child("references"), err)}
+	}
+	var errs field.ErrorList
+	for i, expr := range spec.References {
+		if _, iss := env.Compile(expr); iss.Err() != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("references").Index(i), expr, iss.Err().Error()))
+		}
+	}
+	return errs
+}
+
+func openAPISchema(v *crdv1.CustomResourceValidation) *crdv1.JSONSchemaProps {
+	if v == nil {
+		return nil
+	}
+	return v.OpenAPIV3Schema
+}
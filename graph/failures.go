@@ -0,0 +1,156 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	connectionErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resource_graph_connection_errors_total",
+		Help: "Number of connections that failed to evaluate, by source and target kind and reason.",
+	}, []string{"source", "target", "reason"})
+	failingConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "resource_graph_failing_connections",
+		Help: "Number of connections of objects that failed in their last reconcile, by source and target kind.",
+	}, []string{"source", "target"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(connectionErrorsTotal, failingConnections)
+}
+
+// ConnectionFailure is a connection of an object that failed to evaluate when the object was last
+// reconciled. The reconcile is retried with backoff until the connection succeeds.
+type ConnectionFailure struct {
+	Source apiv1.ObjectID      `json:"source"`
+	Target metav1.GroupKind    `json:"target"`
+	Labels []apiv1.EdgeLabel   `json:"labels"`
+	Error  string              `json:"error"`
+	Reason metav1.StatusReason `json:"reason,omitempty"`
+	// Failures is the number of consecutive reconciles in which the connection failed.
+	Failures    int         `json:"failures"`
+	Since       metav1.Time `json:"since"`
+	LastFailure metav1.Time `json:"lastFailure"`
+}
+
+// connectionFailures keeps the failed connections of the objects, keyed by the oid of the source.
+type connectionFailures struct {
+	m        sync.RWMutex
+	failures map[apiv1.OID]map[string]*ConnectionFailure
+}
+
+func newConnectionFailures() *connectionFailures {
+	return &connectionFailures{
+		failures: map[apiv1.OID]map[string]*ConnectionFailure{},
+	}
+}
+
+// set replaces the failed connections of src with errs. Connections that no longer fail are removed.
+func (f *connectionFailures) set(src apiv1.ObjectID, errs ConnectionErrors) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	oid := src.OID()
+	srcGK := schema.GroupKind{Group: src.Group, Kind: src.Kind}.String()
+	now := metav1.NewTime(time.Now())
+	old := f.failures[oid]
+	cur := make(map[string]*ConnectionFailure, len(errs))
+	for _, err := range errs {
+		key := fmt.Sprintf("%s/%v", err.Target, err.Labels)
+		reason := kerr.ReasonForError(err.Err)
+		connectionErrorsTotal.WithLabelValues(srcGK, err.Target.String(), reasonLabel(reason)).Inc()
+
+		failure, ok := old[key]
+		if !ok {
+			failure = &ConnectionFailure{
+				Source: src,
+				Target: metav1.GroupKind{Group: err.Target.Group, Kind: err.Target.Kind},
+				Labels: err.Labels,
+				Since:  now,
+			}
+			failingConnections.WithLabelValues(srcGK, err.Target.String()).Inc()
+		}
+		failure.Error = err.Err.Error()
+		failure.Reason = reason
+		failure.Failures++
+		failure.LastFailure = now
+		cur[key] = failure
+	}
+	for key, failure := range old {
+		if _, ok := cur[key]; !ok {
+			failingConnections.WithLabelValues(srcGK, failure.Target.String()).Dec()
+		}
+	}
+
+	if len(cur) == 0 {
+		delete(f.failures, oid)
+	} else {
+		f.failures[oid] = cur
+	}
+}
+
+// delete forgets the failed connections of a deleted object.
+func (f *connectionFailures) delete(src apiv1.ObjectID) {
+	f.set(src, nil)
+}
+
+// List returns the failed connections, sorted by source and target.
+func (f *connectionFailures) List() []ConnectionFailure {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	out := make([]ConnectionFailure, 0, len(f.failures))
+	for _, failures := range f.failures {
+		for _, failure := range failures {
+			out = append(out, *failure)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if si, sj := out[i].Source.OID(), out[j].Source.OID(); si != sj {
+			return si < sj
+		}
+		if out[i].Target != out[j].Target {
+			return out[i].Target.String() < out[j].Target.String()
+		}
+		return fmt.Sprint(out[i].Labels) < fmt.Sprint(out[j].Labels)
+	})
+	return out
+}
+
+func reasonLabel(reason metav1.StatusReason) string {
+	if reason == metav1.StatusReasonUnknown {
+		return "Unknown"
+	}
+	return string(reason)
+}
+
+// ConnectionFailures returns the connections that failed when their objects were last reconciled.
+func ConnectionFailures() []ConnectionFailure {
+	return connFailures.List()
+}
@@ -0,0 +1,151 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// forbiddenClient denies reading the objects of one kind.
+type forbiddenClient struct {
+	client.Client
+	gvk schema.GroupVersionKind
+}
+
+func (c forbiddenClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if obj.GetObjectKind().GroupVersionKind() == c.gvk {
+		return kerr.NewForbidden(schema.GroupResource{Group: c.gvk.Group, Resource: "clustertargets"}, key.Name, errors.New("denied"))
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c forbiddenClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if gvk := list.GetObjectKind().GroupVersionKind(); gvk.GroupKind() == c.gvk.GroupKind() {
+		return kerr.NewForbidden(schema.GroupResource{Group: c.gvk.Group, Resource: "clustertargets"}, "", errors.New("denied"))
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestListConnectedObjectIDsIsolatesErrors(t *testing.T) {
+	finder := ObjectFinder{Client: forbiddenClient{Client: newConnectionTestClient(), gvk: clusterTargetGVK}}
+	src := newTestSource(sourceGVK, "a", "own", nil)
+	connections := []v1alpha1.ResourceConnection{
+		{
+			Target: metav1.TypeMeta{APIVersion: targetGVK.GroupVersion().String(), Kind: targetGVK.Kind},
+			Labels: []apiv1.EdgeLabel{apiv1.EdgeExposedBy},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+				Type:          v1alpha1.MatchSelector,
+				SelectorPath:  "spec.selector",
+				NamespacePath: MetadataNamespace,
+			},
+		},
+		{
+			Target: metav1.TypeMeta{APIVersion: clusterTargetGVK.GroupVersion().String(), Kind: clusterTargetGVK.Kind},
+			Labels: []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+				Type:         v1alpha1.MatchName,
+				NameTemplate: "{.metadata.name}-cfg",
+			},
+		},
+	}
+
+	result, err := finder.ListConnectedObjectIDs(src, connections)
+	var failed ConnectionErrors
+	if !errors.As(err, &failed) || len(failed) != 1 {
+		t.Fatalf("expected one connection error, got %v", err)
+	}
+	if failed[0].Target != clusterTargetGVK.GroupKind() || !kerr.IsForbidden(failed[0]) {
+		t.Errorf("expected a forbidden error of %s, got %v", clusterTargetGVK.GroupKind(), failed[0])
+	}
+	web := apiv1.ObjectID{Group: targetGVK.Group, Kind: targetGVK.Kind, Namespace: "a", Name: "web"}
+	stale := apiv1.ObjectID{Group: targetGVK.Group, Kind: targetGVK.Kind, Namespace: "a", Name: "stale"}
+	if expected := []apiv1.OID{stale.OID(), web.OID()}; !reflect.DeepEqual(result[apiv1.EdgeExposedBy].List(), expected) {
+		t.Errorf("expected exposed_by edges %v, got %v", expected, result[apiv1.EdgeExposedBy].List())
+	}
+
+	// the edges of the failed connection survive the update, the others are replaced
+	g := NewObjectGraph()
+	srcID := apiv1.NewObjectID(src)
+	cfg := apiv1.ObjectID{Group: clusterTargetGVK.Group, Kind: clusterTargetGVK.Kind, Name: "own-cfg"}
+	other := apiv1.ObjectID{Group: targetGVK.Group, Kind: targetGVK.Kind, Namespace: "a", Name: "own-cfg"}
+	g.Update(srcID.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeAuthVia:   ksets.NewOID(cfg.OID(), other.OID()),
+		apiv1.EdgeExposedBy: ksets.NewOID(other.OID()),
+	})
+	g.Update(srcID.OID(), result, failed...)
+	links, err := g.Links(srcID, apiv1.EdgeAuthVia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[metav1.GroupKind][]apiv1.ObjectID{{Group: cfg.Group, Kind: cfg.Kind}: {cfg}}; !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected auth_via links %v, got %v", expected, links)
+	}
+	if expected := []apiv1.OID{stale.OID(), web.OID()}; !reflect.DeepEqual(connectionsOf(g)[srcID.OID()][apiv1.EdgeExposedBy].List(), expected) {
+		t.Errorf("expected exposed_by edges %v, got %v", expected, connectionsOf(g)[srcID.OID()][apiv1.EdgeExposedBy].List())
+	}
+}
+
+func TestConnectionFailures(t *testing.T) {
+	f := newConnectionFailures()
+	src := apiv1.ObjectID{Group: sourceGVK.Group, Kind: sourceGVK.Kind, Namespace: "a", Name: "failures"}
+	errs := ConnectionErrors{{
+		Target: clusterTargetGVK.GroupKind(),
+		Labels: []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+		Err:    kerr.NewForbidden(schema.GroupResource{Group: clusterTargetGVK.Group, Resource: "clustertargets"}, "", errors.New("denied")),
+	}}
+	gauge := func() float64 {
+		var m dto.Metric
+		if err := failingConnections.WithLabelValues(sourceGVK.GroupKind().String(), clusterTargetGVK.GroupKind().String()).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+	before := gauge()
+
+	f.set(src, errs)
+	f.set(src, errs)
+	failures := f.List()
+	if len(failures) != 1 {
+		t.Fatalf("expected one failure, got %v", failures)
+	}
+	if got := failures[0]; got.Failures != 2 || got.Reason != metav1.StatusReasonForbidden || got.Since.After(got.LastFailure.Time) {
+		t.Errorf("unexpected failure %+v", got)
+	}
+	if got := gauge() - before; got != 1 {
+		t.Errorf("expected the gauge to count one failing connection, got %v", got)
+	}
+
+	f.set(src, nil)
+	if failures := f.List(); len(failures) != 0 {
+		t.Errorf("expected the failures to be cleared, got %v", failures)
+	}
+	if got := gauge() - before; got != 0 {
+		t.Errorf("expected the gauge to be reset, got %v", got)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	cuapiutil "kmodules.xyz/client-go/client/apiutil"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// OwnerUIDField is the field index of the uids in the ownerReferences of an object.
+const OwnerUIDField = "metadata.ownerReferences.uid"
+
+// FieldIndexes records the cache field indexes registered for the reverse lookups of MatchRef,
+// MatchExpression and OwnedBy connections. The finder lists the sources of a backward MatchRef or
+// MatchExpression edge and the children of a backward OwnedBy edge via these indexes, instead of
+// listing the whole type.
+type FieldIndexes struct {
+	m      sync.RWMutex
+	fields map[schema.GroupVersionKind]map[string]client.IndexerFunc
+}
+
+func NewFieldIndexes() *FieldIndexes {
+	return &FieldIndexes{
+		fields: map[schema.GroupVersionKind]map[string]client.IndexerFunc{},
+	}
+}
+
+// refField returns the name of the field index of the references of a MatchRef connection to dst.
+func refField(dst schema.GroupKind, c v1alpha1.ResourceConnectionSpec) string {
+	h := fnv.New32a()
+	for _, ref := range c.References {
+		_, _ = h.Write([]byte(ref))
+		_, _ = h.Write([]byte{0})
+	}
+	return fmt.Sprintf("graph.ref/%s/%08x", dst, h.Sum32())
+}
+
+// exprNameField returns the name of the field index of the target names of a MatchExpression
+// connection to dst.
+func exprNameField(dst schema.GroupKind, c v1alpha1.ResourceConnectionSpec) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(c.NameTemplate))
+	return fmt.Sprintf("graph.expr/%s/%08x", dst, h.Sum32())
+}
+
+// refIndexValue returns the value of a reference in the field index of a MatchRef connection.
+func refIndexValue(objkey client.ObjectKey) string {
+	return objkey.Namespace + "/" + objkey.Name
+}
+
+// Register adds the field indexes for the MatchRef, MatchExpression and OwnedBy connections of the type
+// to the indexer. Indexes can't be added to a running informer, so they must be registered before the cache starts.
+// Connections to types unknown to the RESTMapper are skipped.
+func (f *FieldIndexes) Register(ctx context.Context, indexer client.FieldIndexer, mapper meta.RESTMapper, gvk schema.GroupVersionKind, connections []v1alpha1.ResourceConnection) error {
+	indexes := map[string]client.IndexerFunc{}
+	for _, c := range connections {
+		switch c.Type {
+		case v1alpha1.MatchRef:
+			dst := c.Target.GroupVersionKind()
+			mapping, err := mapper.RESTMapping(dst.GroupKind(), dst.Version)
+			if err != nil {
+				klog.V(3).InfoS("skipping reference index", "src", gvk, "dst", dst, "err", err)
+				continue
+			}
+			e := &Edge{
+				Src:        gvk,
+				Dst:        dst,
+				Connection: c.ResourceConnectionSpec,
+				Forward:    true,
+			}
+			indexes[refField(dst.GroupKind(), c.ResourceConnectionSpec)] = refIndexer(e, mapping.Scope.Name() == meta.RESTScopeNameNamespace)
+		case MatchExpression:
+			if c.NameTemplate == "" {
+				continue
+			}
+			plan, err := plans.Plan(c.ResourceConnectionSpec)
+			if err != nil {
+				continue
+			}
+			indexes[exprNameField(c.Target.GroupVersionKind().GroupKind(), c.ResourceConnectionSpec)] = nameIndexer(plan.name)
+		case v1alpha1.OwnedBy:
+			indexes[OwnerUIDField] = ownerUIDIndexer
+		}
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	registered, ok := f.fields[gvk]
+	if !ok {
+		registered = map[string]client.IndexerFunc{}
+		f.fields[gvk] = registered
+	}
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(gvk)
+	for field, fn := range indexes {
+		if _, ok := registered[field]; ok {
+			continue
+		}
+		if err := indexer.IndexField(ctx, &obj, field, fn); err != nil {
+			return err
+		}
+		registered[field] = fn
+	}
+	return nil
+}
+
+// Has returns true if the field index is registered for the type.
+func (f *FieldIndexes) Has(gvk schema.GroupVersionKind, field string) bool {
+	if f == nil {
+		return false
+	}
+	f.m.RLock()
+	defer f.m.RUnlock()
+	_, ok := f.fields[gvk][field]
+	return ok
+}
+
+func refIndexer(e *Edge, namespaced bool) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil
+		}
+		keys, err := references(u, e, namespaced)
+		if err != nil {
+			return nil
+		}
+		out := make([]string, 0, len(keys))
+		for _, key := range keys {
+			out = append(out, refIndexValue(key.ObjectKey))
+		}
+		return out
+	}
+}
+
+func nameIndexer(t *nameTemplate) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil
+		}
+		name, ok, err := t.eval(u)
+		if err != nil || !ok {
+			return nil
+		}
+		return []string{name}
+	}
+}
+
+func ownerUIDIndexer(obj client.Object) []string {
+	refs := obj.GetOwnerReferences()
+	out := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		out = append(out, string(ref.UID))
+	}
+	return out
+}
+
+// SetupFieldIndexes registers the field indexes for the types in the Registry. It must be called before
+// the manager starts, with the objects passed to the client of the manager as uncached. Types that are
+// not served by the cluster are skipped, as are the types the client reads from the apiserver: field
+// selectors on them would be sent to the apiserver, which only supports a few built-in fields.
+func SetupFieldIndexes(ctx context.Context, mgr manager.Manager, uncached ...client.Object) error {
+	cachable, err := cuapiutil.NewDynamicCachable(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	uncachedGKs := ksets.NewGroupKind()
+	for _, obj := range uncached {
+		gvk, err := apiutil.GVKForObject(obj, mgr.GetScheme())
+		if err != nil {
+			return err
+		}
+		uncachedGKs.Insert(gvk.GroupKind())
+	}
+	// mirrors the delegating client of the manager
+	cached := func(gvk schema.GroupVersionKind) bool {
+		if uncachedGKs.Has(gvk.GroupKind()) {
+			return false
+		}
+		ok, err := cachable.GVK(gvk)
+		return err == nil && ok
+	}
+
+	var rds []*v1alpha1.ResourceDescriptor
+	Registry.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		rds = append(rds, rd)
+	})
+	return fieldIdx.registerDescriptors(ctx, mgr.GetFieldIndexer(), mgr.GetRESTMapper(), rds, cached)
+}
+
+// registerDescriptors registers the field indexes for the types of the descriptors served by the
+// cluster and read from the cache.
+func (f *FieldIndexes) registerDescriptors(ctx context.Context, indexer client.FieldIndexer, mapper meta.RESTMapper, rds []*v1alpha1.ResourceDescriptor, cached func(gvk schema.GroupVersionKind) bool) error {
+	for _, rd := range rds {
+		gvk := rd.Spec.Resource.GroupVersionKind()
+		if gkSet.Has(gvk.GroupKind()) {
+			continue
+		}
+		if _, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			continue
+		}
+		if !cached(gvk) {
+			klog.V(3).InfoS("skipping field indexes of uncached type", "gvk", gvk)
+			continue
+		}
+		if err := f.Register(ctx, indexer, mapper, gvk, rd.Spec.Connections); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/client-go/pointer"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// indexedClient serves field selectors from client-go indexers, like the controller-runtime cache.
+type indexedClient struct {
+	client.Client
+	indexers    map[schema.GroupVersionKind]toolscache.Indexer
+	fieldLists  int
+	allListsFor map[schema.GroupKind]int
+}
+
+var _ client.FieldIndexer = &indexedClient{}
+
+func newIndexedClient(c client.Client) *indexedClient {
+	return &indexedClient{
+		Client:      c,
+		indexers:    map[schema.GroupVersionKind]toolscache.Indexer{},
+		allListsFor: map[schema.GroupKind]int{},
+	}
+}
+
+func (c *indexedClient) IndexField(_ context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	indexer, ok := c.indexers[gvk]
+	if !ok {
+		indexer = toolscache.NewIndexer(toolscache.MetaNamespaceKeyFunc, toolscache.Indexers{})
+		c.indexers[gvk] = indexer
+	}
+	return indexer.AddIndexers(toolscache.Indexers{
+		"field:" + field: func(raw interface{}) ([]string, error) {
+			obj := raw.(client.Object)
+			var out []string
+			for _, v := range extractValue(obj) {
+				out = append(out, "__all_namespaces/"+v)
+				if obj.GetNamespace() != "" {
+					out = append(out, obj.GetNamespace()+"/"+v)
+				}
+			}
+			return out, nil
+		},
+	})
+}
+
+// add stores the objects in the indexers of their types.
+func (c *indexedClient) add(objs ...*unstructured.Unstructured) error {
+	for _, obj := range objs {
+		if indexer, ok := c.indexers[obj.GroupVersionKind()]; ok {
+			if err := indexer.Add(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	var listOpts client.ListOptions
+	listOpts.ApplyOptions(opts)
+	u, ok := list.(*unstructured.UnstructuredList)
+	if !ok || listOpts.FieldSelector == nil {
+		if ok {
+			c.allListsFor[u.GroupVersionKind().GroupKind()]++
+		}
+		return c.Client.List(ctx, list, opts...)
+	}
+
+	c.fieldLists++
+	reqs := listOpts.FieldSelector.Requirements()
+	if len(reqs) != 1 {
+		return fmt.Errorf("non-exact field matches are not supported by the cache")
+	}
+	indexer, ok := c.indexers[u.GroupVersionKind()]
+	if !ok {
+		return fmt.Errorf("no index for %v", u.GroupVersionKind())
+	}
+	ns := listOpts.Namespace
+	if ns == "" {
+		ns = "__all_namespaces"
+	}
+	items, err := indexer.ByIndex("field:"+reqs[0].Field, ns+"/"+reqs[0].Value)
+	if err != nil {
+		return err
+	}
+	objs := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		objs = append(objs, item.(*unstructured.Unstructured).DeepCopy())
+	}
+	return meta.SetList(list, objs)
+}
+
+func testConnection(dst schema.GroupVersionKind, spec v1alpha1.ResourceConnectionSpec) v1alpha1.ResourceConnection {
+	return v1alpha1.ResourceConnection{
+		Target:                 metav1.TypeMeta{APIVersion: dst.GroupVersion().String(), Kind: dst.Kind},
+		ResourceConnectionSpec: spec,
+	}
+}
+
+var (
+	testRefSpec = v1alpha1.ResourceConnectionSpec{
+		Type:       v1alpha1.MatchRef,
+		References: []string{`{range .spec.refs[*]}{.name},{.namespace}{"\n"}{end}`},
+	}
+	testExprSpec = v1alpha1.ResourceConnectionSpec{
+		Type:         MatchExpression,
+		References:   []string{"target.metadata.labels.app == source.spec.selector.app"},
+		NameTemplate: "{.spec.refs[0].name}",
+	}
+	testOwnerSpec = v1alpha1.ResourceConnectionSpec{
+		Type:  v1alpha1.OwnedBy,
+		Level: v1alpha1.Owner,
+	}
+)
+
+func TestFieldIndexesRegister(t *testing.T) {
+	kc := newIndexedClient(newConnectionTestClient())
+	f := NewFieldIndexes()
+
+	unknown := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Unknown"}
+	connections := []v1alpha1.ResourceConnection{
+		testConnection(targetGVK, testRefSpec),
+		testConnection(unknown, testRefSpec),
+		testConnection(sourceGVK, testOwnerSpec),
+		testConnection(clusterSourceGVK, testOwnerSpec),
+		testConnection(targetGVK, testExprSpec),
+		testConnection(clusterTargetGVK, v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{"true"}, Selector: &metav1.LabelSelector{}}),
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.Register(context.TODO(), kc, kc.RESTMapper(), sourceGVK, connections); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for field, expected := range map[string]bool{
+		refField(targetGVK.GroupKind(), testRefSpec): true,
+		refField(unknown.GroupKind(), testRefSpec):   false,
+		OwnerUIDField: true,
+		exprNameField(targetGVK.GroupKind(), testExprSpec):        true,
+		exprNameField(clusterTargetGVK.GroupKind(), testExprSpec): false,
+	} {
+		if got := f.Has(sourceGVK, field); got != expected {
+			t.Errorf("%s: expected %v, got %v", field, expected, got)
+		}
+	}
+	if f.Has(targetGVK, OwnerUIDField) {
+		t.Errorf("expected no index for %v", targetGVK)
+	}
+}
+
+// TestResourcesForFieldIndex checks that backward MatchRef, MatchExpression and OwnedBy connections resolved via
+// field indexes find the same objects as listing, without listing the whole type.
+func TestResourcesForFieldIndex(t *testing.T) {
+	base := newConnectionTestClient()
+
+	tests := []struct {
+		name string
+		src  schema.GroupVersionKind // type holding the references
+		dst  schema.GroupVersionKind
+		spec v1alpha1.ResourceConnectionSpec
+	}{
+		{name: "MatchRef/Source->Target", src: sourceGVK, dst: targetGVK, spec: testRefSpec},
+		{name: "MatchRef/ClusterSource->Target", src: clusterSourceGVK, dst: targetGVK, spec: testRefSpec},
+		{name: "MatchRef/Source->ClusterTarget", src: sourceGVK, dst: clusterTargetGVK, spec: testRefSpec},
+		{name: "MatchExpression/Source->Target", src: sourceGVK, dst: targetGVK, spec: testExprSpec},
+		{name: "MatchExpression/ClusterSource->Target", src: clusterSourceGVK, dst: targetGVK, spec: testExprSpec},
+		{name: "MatchExpression/Source->ClusterTarget", src: sourceGVK, dst: clusterTargetGVK, spec: testExprSpec},
+		{name: "OwnedBy/Target->Source", src: targetGVK, dst: sourceGVK, spec: testOwnerSpec},
+		{name: "OwnedBy/Target->ClusterSource", src: targetGVK, dst: clusterSourceGVK, spec: testOwnerSpec},
+		{name: "OwnedBy/ClusterTarget->ClusterSource", src: clusterTargetGVK, dst: clusterSourceGVK, spec: testOwnerSpec},
+	}
+	for _, test := range tests {
+		for _, nsPath := range []string{"", MetadataNamespace, "spec.namespaceSelector"} {
+			spec := test.spec
+			spec.NamespacePath = nsPath
+			t.Run(test.name+"/"+nsPath, func(t *testing.T) {
+				kc := newIndexedClient(base)
+				f := NewFieldIndexes()
+				err := f.Register(context.TODO(), kc, kc.RESTMapper(), test.src, []v1alpha1.ResourceConnection{testConnection(test.dst, spec)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var sources unstructured.UnstructuredList
+				sources.SetGroupVersionKind(test.src)
+				if err := base.List(context.TODO(), &sources); err != nil {
+					t.Fatal(err)
+				}
+				if err := kc.add(pointer.ToUnstructuredP(sources.Items)...); err != nil {
+					t.Fatal(err)
+				}
+				var targets unstructured.UnstructuredList
+				targets.SetGroupVersionKind(test.dst)
+				if err := base.List(context.TODO(), &targets); err != nil {
+					t.Fatal(err)
+				}
+
+				indexed := ObjectFinder{Client: kc, Fields: f}
+				listed := ObjectFinder{Client: base}
+				e := &Edge{Src: test.dst, Dst: test.src, Connection: spec}
+
+				var found bool
+				for i := range targets.Items {
+					obj := &targets.Items[i]
+					expected, err := listed.ResourcesFor(obj, e)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := indexed.ResourcesFor(obj, e)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if g, x := objectNames(got), objectNames(expected); !reflect.DeepEqual(g, x) {
+						t.Errorf("from %s/%s: expected %v, got %v", obj.GetNamespace(), obj.GetName(), x, g)
+					}
+					found = found || len(expected) > 0
+				}
+				if !found {
+					t.Error("expected connected objects")
+				}
+				if kc.fieldLists == 0 {
+					t.Error("expected lookups via field index")
+				}
+				if n := kc.allListsFor[test.src.GroupKind()]; n > 0 {
+					t.Errorf("expected no lists of %v, got %d", test.src.Kind, n)
+				}
+			})
+		}
+	}
+}
+
+// TestFieldIndexesSkipUncached checks that types read from the apiserver get no field indexes, so
+// backward lookups of them list the type instead of sending field selectors to the apiserver.
+func TestFieldIndexesSkipUncached(t *testing.T) {
+	base := newConnectionTestClient()
+	kc := newIndexedClient(base)
+	f := NewFieldIndexes()
+
+	descriptor := func(gvk schema.GroupVersionKind) *v1alpha1.ResourceDescriptor {
+		rd := &v1alpha1.ResourceDescriptor{}
+		rd.Spec.Resource = apiv1.ResourceID{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}
+		rd.Spec.Connections = []v1alpha1.ResourceConnection{
+			testConnection(targetGVK, testRefSpec),
+			testConnection(targetGVK, testOwnerSpec),
+		}
+		return rd
+	}
+	rds := []*v1alpha1.ResourceDescriptor{descriptor(sourceGVK), descriptor(clusterSourceGVK)}
+	cached := func(gvk schema.GroupVersionKind) bool {
+		return gvk != sourceGVK
+	}
+	if err := f.registerDescriptors(context.TODO(), kc, kc.RESTMapper(), rds, cached); err != nil {
+		t.Fatal(err)
+	}
+	if f.Has(sourceGVK, OwnerUIDField) || f.Has(sourceGVK, refField(targetGVK.GroupKind(), testRefSpec)) {
+		t.Errorf("expected no field indexes for the uncached %v", sourceGVK)
+	}
+	if !f.Has(clusterSourceGVK, OwnerUIDField) || !f.Has(clusterSourceGVK, refField(targetGVK.GroupKind(), testRefSpec)) {
+		t.Errorf("expected field indexes for the cached %v", clusterSourceGVK)
+	}
+
+	var sources unstructured.UnstructuredList
+	sources.SetGroupVersionKind(clusterSourceGVK)
+	if err := base.List(context.TODO(), &sources); err != nil {
+		t.Fatal(err)
+	}
+	if err := kc.add(pointer.ToUnstructuredP(sources.Items)...); err != nil {
+		t.Fatal(err)
+	}
+	var targets unstructured.UnstructuredList
+	targets.SetGroupVersionKind(targetGVK)
+	if err := base.List(context.TODO(), &targets); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed := ObjectFinder{Client: kc, Fields: f}
+	listed := ObjectFinder{Client: base}
+	for _, src := range []schema.GroupVersionKind{sourceGVK, clusterSourceGVK} {
+		for _, spec := range []v1alpha1.ResourceConnectionSpec{testRefSpec, testOwnerSpec} {
+			e := &Edge{Src: targetGVK, Dst: src, Connection: spec}
+			for i := range targets.Items {
+				obj := &targets.Items[i]
+				expected, err := listed.ResourcesFor(obj, e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the indexed client fails field selectors on types without indexes, like the apiserver
+				got, err := indexed.ResourcesFor(obj, e)
+				if err != nil {
+					t.Fatalf("%s %s from %s: %v", src.Kind, spec.Type, obj.GetName(), err)
+				}
+				if g, x := objectNames(got), objectNames(expected); !reflect.DeepEqual(g, x) {
+					t.Errorf("%s %s from %s: expected %v, got %v", src.Kind, spec.Type, obj.GetName(), x, g)
+				}
+			}
+		}
+	}
+	if kc.fieldLists == 0 {
+		t.Errorf("expected lookups of %v via field index", clusterSourceGVK)
+	}
+	if kc.allListsFor[sourceGVK.GroupKind()] == 0 {
+		t.Errorf("expected lookups of %v by listing", sourceGVK)
+	}
+	if n := kc.allListsFor[clusterSourceGVK.GroupKind()]; n > 0 {
+		t.Errorf("expected no lists of %v, got %d", clusterSourceGVK, n)
+	}
+}
+
+// newBenchmarkClient returns n sources in 10 namespaces, each referring to and owning its own target.
+func newBenchmarkClient(n int) (client.Client, []*unstructured.Unstructured, []*unstructured.Unstructured) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(sourceGVK, meta.RESTScopeNamespace)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+
+	var objs []client.Object
+	var sources, targets []*unstructured.Unstructured
+	for i := 0; i < n; i++ {
+		ns := fmt.Sprintf("ns-%d", i%10)
+		name := fmt.Sprintf("obj-%d", i)
+		target := newTestObject(targetGVK, ns, name, nil)
+		src := newTestObject(sourceGVK, ns, name, nil)
+		_ = unstructured.SetNestedSlice(src.Object, []interface{}{
+			map[string]interface{}{"name": name},
+		}, "spec", "refs")
+		setTestOwners(target, src)
+		sources = append(sources, src)
+		targets = append(targets, target)
+		objs = append(objs, src, target)
+	}
+	kc := offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objs...).Build(),
+		mapper: mapper,
+	}
+	return kc, sources, targets
+}
+
+func benchmarkReverseLookup(b *testing.B, withIndex bool, e *Edge, from func(sources, targets []*unstructured.Unstructured) []*unstructured.Unstructured) {
+	base, sources, targets := newBenchmarkClient(5000)
+	finder := ObjectFinder{Client: base}
+	if withIndex {
+		kc := newIndexedClient(base)
+		f := NewFieldIndexes()
+		err := f.Register(context.TODO(), kc, kc.RESTMapper(), e.Dst, []v1alpha1.ResourceConnection{testConnection(e.Src, e.Connection)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := kc.add(sources...); err != nil {
+			b.Fatal(err)
+		}
+		if err := kc.add(targets...); err != nil {
+			b.Fatal(err)
+		}
+		finder = ObjectFinder{Client: kc, Fields: f}
+	}
+	objs := from(sources, targets)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := finder.ResourcesFor(objs[i%len(objs)], e)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(result) != 1 {
+			b.Fatalf("expected 1 object, got %d", len(result))
+		}
+	}
+}
+
+func BenchmarkReverseMatchRef(b *testing.B) {
+	e := &Edge{Src: targetGVK, Dst: sourceGVK, Connection: testRefSpec}
+	targetsOf := func(_, targets []*unstructured.Unstructured) []*unstructured.Unstructured { return targets }
+	b.Run("list", func(b *testing.B) { benchmarkReverseLookup(b, false, e, targetsOf) })
+	b.Run("index", func(b *testing.B) { benchmarkReverseLookup(b, true, e, targetsOf) })
+}
+
+func BenchmarkFindChildren(b *testing.B) {
+	e := &Edge{Src: sourceGVK, Dst: targetGVK, Connection: testOwnerSpec}
+	sourcesOf := func(sources, _ []*unstructured.Unstructured) []*unstructured.Unstructured { return sources }
+	b.Run("list", func(b *testing.B) { benchmarkReverseLookup(b, false, e, sourcesOf) })
+	b.Run("index", func(b *testing.B) { benchmarkReverseLookup(b, true, e, sourcesOf) })
+}
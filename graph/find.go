@@ -0,0 +1,140 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ResolveGroupKind resolves a kind, eg, Deployment, or a resource name, eg, deployments or
+// deployment, in the given group using the RESTMapper.
+func ResolveGroupKind(mapper meta.RESTMapper, group, kindOrResource string) (*meta.RESTMapping, error) {
+	mapping, err := mapper.RESTMapping(schema.GroupKind{Group: group, Kind: kindOrResource})
+	if err == nil {
+		// a DefaultRESTMapper matches kinds case insensitively and returns the kind as given
+		if gvk, err := mapper.KindFor(mapping.Resource); err == nil {
+			mapping.GroupVersionKind = gvk
+		}
+		return mapping, nil
+	} else if !meta.IsNoMatchError(err) {
+		return nil, err
+	}
+
+	gvk, err := mapper.KindFor(schema.GroupVersionResource{Group: group, Resource: strings.ToLower(kindOrResource)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to detect kind of %q in group %q", kindOrResource, group)
+	}
+	return mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+// NormalizeObjectID resolves the kind of id using the RESTMapper. The namespace of a namespaced
+// object defaults to default and the namespace of a cluster scoped object is cleared.
+func NormalizeObjectID(mapper meta.RESTMapper, id apiv1.ObjectID) (*apiv1.ObjectID, error) {
+	if id.Name == "" {
+		return nil, fmt.Errorf("name of %s is not set", id.Kind)
+	}
+	mapping, err := ResolveGroupKind(mapper, id.Group, id.Kind)
+	if err != nil {
+		return nil, err
+	}
+	out := apiv1.ObjectID{
+		Group:     mapping.GroupVersionKind.Group,
+		Kind:      mapping.GroupVersionKind.Kind,
+		Namespace: id.Namespace,
+		Name:      id.Name,
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		out.Namespace = ""
+	} else if out.Namespace == "" {
+		out.Namespace = metav1.NamespaceDefault
+	}
+	return &out, nil
+}
+
+// ParseObjectRef parses an object reference in kubectl format, eg, deployment.apps/coredns,
+// deployments.apps/coredns or Deployment.apps/coredns. namespace is used for namespaced objects.
+func ParseObjectRef(mapper meta.RESTMapper, ref, namespace string) (*apiv1.ObjectID, error) {
+	idx := strings.LastIndex(ref, "/")
+	if idx <= 0 || idx == len(ref)-1 {
+		return nil, fmt.Errorf("invalid object reference %q, expected kind/name format", ref)
+	}
+	gr := schema.ParseGroupResource(ref[:idx])
+	return NormalizeObjectID(mapper, apiv1.ObjectID{
+		Group:     gr.Group,
+		Kind:      gr.Resource,
+		Namespace: namespace,
+		Name:      ref[idx+1:],
+	})
+}
+
+// FindByUID returns the object with the given uid known to the graph.
+func FindByUID(uid types.UID) (*apiv1.ObjectID, error) {
+	s := objGraph.Snapshot()
+	defer s.Release()
+	return s.FindByUID(uid)
+}
+
+// FindByUID returns the object with the given uid known to the snapshot.
+func (s *Snapshot) FindByUID(uid types.UID) (*apiv1.ObjectID, error) {
+	oid, ok := s.LookupUID(uid)
+	if !ok {
+		return nil, fmt.Errorf("no object found with uid %s", uid)
+	}
+	return apiv1.ParseObjectID(oid)
+}
+
+// FindMany returns the objects of the given GroupKind matching the label selector. If namespace is empty,
+// objects in all namespaces are returned. gk.Kind can also be a resource name.
+func (finder ObjectFinder) FindMany(gk schema.GroupKind, namespace string, selector labels.Selector) ([]apiv1.ObjectID, error) {
+	mapping, err := ResolveGroupKind(finder.Client.RESTMapper(), gk.Group, gk.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := client.ListOptions{
+		LabelSelector: selector,
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		opts.Namespace = namespace
+	}
+
+	var list unstructured.UnstructuredList
+	list.SetGroupVersionKind(mapping.GroupVersionKind)
+	if err := finder.Client.List(context.TODO(), &list, &opts); err != nil {
+		return nil, err
+	}
+
+	out := make([]apiv1.ObjectID, 0, len(list.Items))
+	for i := range list.Items {
+		out = append(out, *apiv1.NewObjectID(&list.Items[i]))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OID() < out[j].OID() })
+	return out, nil
+}
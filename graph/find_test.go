@@ -0,0 +1,179 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+)
+
+func TestFind(t *testing.T) {
+	kc := newFakeClient()
+	coredns := apiv1.ObjectID{Group: "apps", Kind: "Deployment", Namespace: "kube-system", Name: "coredns"}
+	objGraph.SetUID(coredns.OID(), "5e2b8c3a")
+	defer objGraph.DeleteUID(coredns.OID())
+
+	tests := []struct {
+		name     string
+		query    string
+		expected *apiv1.ObjectID
+	}{
+		{
+			name:     "oid",
+			query:    `{ find(oid: "G=apps,K=Deployment,NS=kube-system,N=coredns") { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:     "object with kind",
+			query:    `{ find(object: {group: "apps", kind: "Deployment", namespace: "kube-system", name: "coredns"}) { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:     "object with resource",
+			query:    `{ find(object: {group: "apps", kind: "deployments", namespace: "kube-system", name: "coredns"}) { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:     "kubectl ref",
+			query:    `{ find(ref: "deployment.apps/coredns", namespace: "kube-system") { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:     "kubectl ref with resource",
+			query:    `{ find(ref: "deployments.apps/coredns", namespace: "kube-system") { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:     "kubectl ref defaults namespace",
+			query:    `{ find(ref: "pods/web") { group kind namespace name } }`,
+			expected: &apiv1.ObjectID{Kind: "Pod", Namespace: "default", Name: "web"},
+		},
+		{
+			name:     "cluster scoped ref ignores namespace",
+			query:    `{ find(ref: "node/kind-control-plane", namespace: "demo") { group kind namespace name } }`,
+			expected: &apiv1.ObjectID{Kind: "Node", Name: "kind-control-plane"},
+		},
+		{
+			name:     "uid",
+			query:    `{ find(uid: "5e2b8c3a") { group kind namespace name } }`,
+			expected: &coredns,
+		},
+		{
+			name:  "unknown uid",
+			query: `{ find(uid: "a6b7") { group kind namespace name } }`,
+		},
+		{
+			name:  "multiple identifiers",
+			query: `{ find(oid: "G=apps,K=Deployment,NS=kube-system,N=coredns", uid: "5e2b8c3a") { group kind namespace name } }`,
+		},
+		{
+			name:  "unknown resource",
+			query: `{ find(ref: "foos/bar") { group kind namespace name } }`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := graphql.Do(graphql.Params{
+				Schema:        *CurrentSchema(),
+				RequestString: test.query,
+				Context:       WithClient(context.TODO(), kc),
+			})
+			if test.expected == nil {
+				if !result.HasErrors() {
+					t.Fatalf("expected error, got %v", result.Data)
+				}
+				return
+			}
+			if result.HasErrors() {
+				t.Fatal(result.Errors)
+			}
+			found := result.Data.(map[string]interface{})["find"].(map[string]interface{})
+			got := apiv1.ObjectID{
+				Group:     found["group"].(string),
+				Kind:      found["kind"].(string),
+				Namespace: found["namespace"].(string),
+				Name:      found["name"].(string),
+			}
+			if got != *test.expected {
+				t.Errorf("expected %+v, got %+v", *test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFindMany(t *testing.T) {
+	kc := newFakeClient(
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "web-1", Labels: map[string]string{"app": "web"}}},
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "web-2", Labels: map[string]string{"app": "web"}}},
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "web-3", Labels: map[string]string{"app": "web"}}},
+		&core.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "db-1", Labels: map[string]string{"app": "db"}}},
+		&apps.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "web", Labels: map[string]string{"app": "web"}}},
+	)
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{
+			name:     "selector in namespace",
+			query:    `{ findMany(kind: "Pod", namespace: "demo", selector: "app=web") { name } }`,
+			expected: []string{"web-1", "web-2"},
+		},
+		{
+			name:     "selector in all namespaces",
+			query:    `{ findMany(kind: "pods", selector: "app=web") { name } }`,
+			expected: []string{"web-1", "web-2", "web-3"},
+		},
+		{
+			name:     "set based selector",
+			query:    `{ findMany(kind: "Pod", namespace: "demo", selector: "app in (db)") { name } }`,
+			expected: []string{"db-1"},
+		},
+		{
+			name:     "group",
+			query:    `{ findMany(group: "apps", kind: "deployments", selector: "app=web") { name } }`,
+			expected: []string{"web"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := graphql.Do(graphql.Params{
+				Schema:        *CurrentSchema(),
+				RequestString: test.query,
+				Context:       WithClient(context.TODO(), kc),
+			})
+			if result.HasErrors() {
+				t.Fatal(result.Errors)
+			}
+			var got []string
+			for _, v := range result.Data.(map[string]interface{})["findMany"].([]interface{}) {
+				got = append(got, v.(map[string]interface{})["name"].(string))
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
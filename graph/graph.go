@@ -17,165 +17,439 @@ limitations under the License.
 package graph
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"gomodules.xyz/sets"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	apiv1 "kmodules.xyz/client-go/api/v1"
 	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
 	"kmodules.xyz/resource-metadata/hub"
 	ksets "kmodules.xyz/sets"
 )
 
+// ObjectGraph is a versioned graph of objects. Every update creates a new version, and readers
+// read a Snapshot of one version, so a query spanning several reads sees a consistent graph.
+// Updates are applied one at a time, while readers don't lock the graph.
 type ObjectGraph struct {
-	m     sync.RWMutex
-	edges map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID // oid -> label -> edges
-	ids   map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID // oid -> label -> edges
+	version uint64 // the published version, accessed atomically
+
+	// m serializes the updates
+	m             sync.Mutex
+	in            interner
+	uids          sync.Map        // types.UID -> *uidVersion
+	versioned     map[nodeID]bool // nodes with versions kept for open snapshots
+	versionedUIDs map[types.UID]bool
+
+	openMu sync.Mutex
+	open   map[uint64]int // version -> number of open snapshots
+
+	history atomic.Value // *History recording the changes of the edges
+}
+
+func NewObjectGraph() *ObjectGraph {
+	return &ObjectGraph{
+		versioned:     map[nodeID]bool{},
+		versionedUIDs: map[types.UID]bool{},
+		open:          map[uint64]int{},
+	}
+}
+
+// Version returns the current version of the graph.
+func (g *ObjectGraph) Version() uint64 {
+	return atomic.LoadUint64(&g.version)
 }
 
-func (g *ObjectGraph) Update(src apiv1.OID, connsPerLabel map[apiv1.EdgeLabel]ksets.OID) {
+// SetUID records the uid of an object, replacing the uid of a previous object with the same oid.
+func (g *ObjectGraph) SetUID(oid apiv1.OID, uid types.UID) {
 	g.m.Lock()
 	defer g.m.Unlock()
 
-	for lbl, conns := range connsPerLabel {
+	t := g.begin()
+	defer t.commit()
+	if _, cur := t.current(oid); cur != nil && cur.uid == uid {
+		return
+	}
+	n := t.node(g.in.intern(oid))
+	if n.uid != "" {
+		t.setUID(n.uid, "")
+	}
+	n.uid = uid
+	t.setUID(uid, oid)
+}
 
-		if oldConnsPerLabel, ok := g.ids[src]; ok {
-			if oldConns, ok := oldConnsPerLabel[lbl]; ok {
-				if oldConns.Difference(conns).Len() == 0 {
-					continue
-				}
+// DeleteUID forgets the uid of a deleted object.
+func (g *ObjectGraph) DeleteUID(oid apiv1.OID) {
+	g.m.Lock()
+	defer g.m.Unlock()
 
-				g.edges[src][lbl].Delete(oldConns.UnsortedList()...)
-				for dst := range oldConns {
-					g.edges[dst][lbl].Delete(src)
-				}
-			}
-		}
+	t := g.begin()
+	defer t.commit()
+	id, cur := t.current(oid)
+	if cur == nil || cur.uid == "" {
+		return
+	}
+	n := t.node(id)
+	t.setUID(n.uid, "")
+	n.uid = ""
+}
 
-		if _, ok := g.edges[src]; !ok {
-			g.edges[src] = map[apiv1.EdgeLabel]ksets.OID{}
-		}
-		if _, ok := g.edges[src][lbl]; !ok {
-			g.edges[src][lbl] = ksets.NewOID()
-		}
-		g.edges[src][lbl].Insert(conns.UnsortedList()...)
+// LookupUID returns the oid of the object with the given uid.
+func (g *ObjectGraph) LookupUID(uid types.UID) (apiv1.OID, bool) {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.LookupUID(uid)
+}
 
-		for dst := range conns {
-			if _, ok := g.edges[dst]; !ok {
-				g.edges[dst] = map[apiv1.EdgeLabel]ksets.OID{}
-			}
-			if _, ok := g.edges[dst][lbl]; !ok {
-				g.edges[dst][lbl] = ksets.NewOID()
-			}
-			g.edges[dst][lbl].Insert(src)
+// LookupUID returns the oid of the object with the given uid.
+func (s *Snapshot) LookupUID(uid types.UID) (apiv1.OID, bool) {
+	for u := s.g.loadUID(uid); u != nil; u = u.prev {
+		if u.version <= s.version {
+			return u.oid, u.oid != ""
 		}
 	}
+	return "", false
+}
 
-	// remove edged that don't exist anymore
-	oldConnsPerLabel := g.ids[src]
-	for lbl, conns := range oldConnsPerLabel {
-		if _, ok := connsPerLabel[lbl]; ok {
-			continue
+// Update replaces the edges made by the connections of src. The current edges made by the failed
+// connections are kept, so updating src with partial results doesn't drop them. Only edges with
+// the labels of a failed connection to objects of its target kind are kept.
+func (g *ObjectGraph) Update(src apiv1.OID, connsPerLabel map[apiv1.EdgeLabel]ksets.OID, failed ...*ConnectionError) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	t := g.begin()
+	defer t.commit()
+
+	id, cur := t.current(src)
+	var oldConns adjacency
+	if cur != nil {
+		oldConns = cur.conns
+	}
+	if len(failed) > 0 {
+		connsPerLabel = g.keepFailed(connsPerLabel, oldConns, failed)
+	}
+	if len(connsPerLabel) == 0 && len(oldConns) == 0 {
+		return
+	}
+	conns := g.in.toAdjacency(connsPerLabel)
+	if conns.equal(oldConns) {
+		return
+	}
+	if cur == nil {
+		id = g.in.intern(src)
+	}
+
+	n := t.node(id)
+	removed, added := conns.diff(oldConns), oldConns.diff(conns)
+	if h := g.loadHistory(); h != nil {
+		now := h.now()
+		h.record(append(g.edgeEvents(now, edgeRemoved, src, removed), g.edgeEvents(now, edgeAdded, src, added)...)...)
+	}
+	for _, lbl := range labelsOf(removed, added) {
+		// remove edges that don't exist anymore
+		remove, add := removed.get(lbl), added.get(lbl)
+		n.edges = n.edges.update(lbl, add, remove)
+		for _, dst := range remove {
+			dn := t.node(dst)
+			dn.edges = dn.edges.update(lbl, nil, []nodeID{id})
+		}
+		for _, dst := range add {
+			dn := t.node(dst)
+			dn.edges = dn.edges.update(lbl, []nodeID{id}, nil)
 		}
+	}
+	n.conns = conns
+}
 
-		g.edges[src][lbl].Delete(conns.UnsortedList()...)
-		for dst := range conns {
-			g.edges[dst][lbl].Delete(src)
+// keepFailed returns a copy of connsPerLabel with the edges in old made by the failed connections.
+// The caller must hold the write lock.
+func (g *ObjectGraph) keepFailed(connsPerLabel map[apiv1.EdgeLabel]ksets.OID, old adjacency, failed []*ConnectionError) map[apiv1.EdgeLabel]ksets.OID {
+	out := make(map[apiv1.EdgeLabel]ksets.OID, len(connsPerLabel))
+	for lbl, oids := range connsPerLabel {
+		out[lbl] = ksets.NewOID().Union(oids)
+	}
+	for _, f := range failed {
+		for _, lbl := range f.Labels {
+			for _, dst := range old.get(lbl) {
+				o := &g.in.entry(dst).object
+				if o.err != nil || o.id.Group != f.Target.Group || o.id.Kind != f.Target.Kind {
+					continue
+				}
+				if _, ok := out[lbl]; !ok {
+					out[lbl] = ksets.NewOID()
+				}
+				out[lbl].Insert(o.oid)
+			}
 		}
 	}
+	return out
+}
 
-	if len(connsPerLabel) == 0 {
-		delete(g.ids, src)
-	} else {
-		g.ids[src] = connsPerLabel
+// labelsOf returns the labels of the edges in lists.
+func labelsOf(lists ...adjacency) []apiv1.EdgeLabel {
+	var labels []apiv1.EdgeLabel
+	for _, a := range lists {
+		for _, e := range a {
+			if !containsLabel(labels, e.label) {
+				labels = append(labels, e.label)
+			}
+		}
 	}
+	return labels
 }
 
 func (g *ObjectGraph) Links(oid *apiv1.ObjectID, edgeLabel apiv1.EdgeLabel) (map[metav1.GroupKind][]apiv1.ObjectID, error) {
-	g.m.RLock()
-	defer g.m.RUnlock()
+	s := g.Snapshot()
+	defer s.Release()
+	return s.Links(oid, edgeLabel)
+}
 
+func (s *Snapshot) Links(oid *apiv1.ObjectID, edgeLabel apiv1.EdgeLabel) (map[metav1.GroupKind][]apiv1.ObjectID, error) {
+	src, ok := s.lookup(oid.OID())
+	if !ok {
+		return map[metav1.GroupKind][]apiv1.ObjectID{}, nil
+	}
 	if edgeLabel == apiv1.EdgeOffshoot || edgeLabel == apiv1.EdgeView {
-		return g.links(oid, nil, edgeLabel)
+		return s.links(src, nil, edgeLabel)
 	}
 
-	src := oid.OID()
-	offshoots := g.connectedOIDs([]apiv1.OID{src}, apiv1.EdgeOffshoot)
-	offshoots.Delete(src)
-	return g.links(oid, offshoots.UnsortedList(), edgeLabel)
+	offshoots := s.connected([]nodeID{src}, apiv1.EdgeOffshoot)
+	return s.links(src, offshoots[1:], edgeLabel)
 }
 
-func (g *ObjectGraph) links(oid *apiv1.ObjectID, seeds []apiv1.OID, edgeLabel apiv1.EdgeLabel) (map[metav1.GroupKind][]apiv1.ObjectID, error) {
-	src := oid.OID()
-	links := g.connectedOIDs(append([]apiv1.OID{src}, seeds...), edgeLabel)
-	links.Delete(src)
+func (s *Snapshot) links(src nodeID, seeds []nodeID, edgeLabel apiv1.EdgeLabel) (map[metav1.GroupKind][]apiv1.ObjectID, error) {
+	links := s.connected(append([]nodeID{src}, seeds...), edgeLabel)
 
 	result := map[metav1.GroupKind][]apiv1.ObjectID{}
-	for v := range links {
-		id, err := apiv1.ParseObjectID(v)
-		if err != nil {
-			return nil, err
+	for _, id := range links[1:] {
+		o := s.object(id)
+		if o.err != nil {
+			return nil, o.err
 		}
-		gk := id.MetaGroupKind()
-		result[gk] = append(result[gk], *id)
+		gk := o.id.MetaGroupKind()
+		result[gk] = append(result[gk], o.id)
 	}
 	return result, nil
 }
 
-func (g *ObjectGraph) connectedOIDs(idsToProcess []apiv1.OID, edgeLabel apiv1.EdgeLabel) ksets.OID {
-	processed := ksets.NewOID()
-	var x apiv1.OID
+// connected returns the nodes reachable from idsToProcess following the edges with the given label,
+// in the order they are reached. The result starts with idsToProcess.
+func (s *Snapshot) connected(idsToProcess []nodeID, edgeLabel apiv1.EdgeLabel) []nodeID {
+	processed := map[nodeID]bool{}
+	var out []nodeID
+	var x nodeID
 	for len(idsToProcess) > 0 {
 		x, idsToProcess = idsToProcess[0], idsToProcess[1:]
-		processed.Insert(x)
-
-		var edges ksets.OID
-		if edgedPerLabel, ok := g.edges[x]; ok {
-			edges = edgedPerLabel[edgeLabel]
+		if processed[x] {
+			continue
 		}
-		for id := range edges {
-			if !processed.Has(id) {
+		processed[x] = true
+		out = append(out, x)
+
+		for _, id := range s.edges(x).get(edgeLabel) {
+			if !processed[id] {
 				idsToProcess = append(idsToProcess, id)
 			}
 		}
 	}
-	return processed
+	return out
+}
+
+// PathStep is an object on a path through the graph. Label is the label of the edge
+// connecting the object to the previous step and is empty for the first step.
+type PathStep struct {
+	Object apiv1.ObjectID  `json:"object"`
+	Label  apiv1.EdgeLabel `json:"label,omitempty"`
+}
+
+func Path(src, dst apiv1.ObjectID) ([]PathStep, error) {
+	return objGraph.Path(src, dst)
+}
+
+// Path returns a shortest path from src to dst following edges of any label.
+// It returns nil if dst is not reachable from src.
+func (g *ObjectGraph) Path(src, dst apiv1.ObjectID) ([]PathStep, error) {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.Path(src, dst)
+}
+
+// Path returns a shortest path from src to dst following edges of any label.
+// It returns nil if dst is not reachable from src.
+func (s *Snapshot) Path(src, dst apiv1.ObjectID) ([]PathStep, error) {
+	type parent struct {
+		id    nodeID
+		label apiv1.EdgeLabel
+	}
+
+	if src.OID() == dst.OID() {
+		return []PathStep{{Object: src}}, nil
+	}
+	from, ok := s.lookup(src.OID())
+	if !ok {
+		return nil, nil
+	}
+	to, ok := s.lookup(dst.OID())
+	if !ok {
+		return nil, nil
+	}
+
+	parents := map[nodeID]parent{from: {}}
+	idsToProcess := []nodeID{from}
+	var x nodeID
+	var peers []nodeID
+	for len(idsToProcess) > 0 && x != to {
+		x, idsToProcess = idsToProcess[0], idsToProcess[1:]
+
+		// the labels are sorted, the peers are visited in the order of their oids
+		for _, e := range s.edges(x) {
+			peers = append(peers[:0], e.nodes...)
+			sort.Slice(peers, func(i, j int) bool { return s.object(peers[i]).oid < s.object(peers[j]).oid })
+			for _, id := range peers {
+				if _, ok := parents[id]; !ok {
+					parents[id] = parent{id: x, label: e.label}
+					idsToProcess = append(idsToProcess, id)
+				}
+			}
+		}
+	}
+	if _, ok := parents[to]; !ok {
+		return nil, nil
+	}
+
+	var path []PathStep
+	for cur := to; ; {
+		o := s.object(cur)
+		if o.err != nil {
+			return nil, o.err
+		}
+		p := parents[cur]
+		path = append(path, PathStep{Object: o.id, Label: p.label})
+		if cur == from {
+			break
+		}
+		cur = p.id
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
 }
 
 type objectEdge struct {
-	Source apiv1.OID
-	Target apiv1.OID
+	Source nodeID
+	Target nodeID
+}
+
+// edge returns the key of the edge between x and y, with the objects ordered by oid.
+func (s *Snapshot) edge(x, y nodeID) objectEdge {
+	if s.object(y).oid < s.object(x).oid {
+		return objectEdge{Source: y, Target: x}
+	}
+	return objectEdge{Source: x, Target: y}
 }
 
 func ResourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
-	objGraph.m.RLock()
-	defer objGraph.m.RUnlock()
+	return objGraph.ResourceGraph(mapper, src)
+}
 
-	return objGraph.resourceGraph(mapper, src)
+func (g *ObjectGraph) ResourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.ResourceGraph(mapper, src)
 }
 
-func (g *ObjectGraph) resourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
+func (s *Snapshot) ResourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
+	return s.resourceGraph(mapper, src)
+}
+
+// GraphCounts are the number of objects of a kind in the graph and of the edges made by their connections.
+type GraphCounts struct {
+	Objects int
+	Edges   int
+}
+
+// Counts returns the number of objects and edges in the graph by kind.
+func (g *ObjectGraph) Counts() map[schema.GroupKind]GraphCounts {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.Counts()
+}
+
+// Counts returns the number of objects and edges in the graph by kind.
+func (s *Snapshot) Counts() map[schema.GroupKind]GraphCounts {
+	counts := map[schema.GroupKind]GraphCounts{}
+	s.each(func(id nodeID, n *node) {
+		if n.uid == "" && len(n.conns) == 0 {
+			return
+		}
+		o := s.object(id)
+		if o.err != nil {
+			return
+		}
+		c := counts[o.groupKind()]
+		if n.uid != "" {
+			c.Objects++
+		}
+		c.Edges += n.conns.len()
+		counts[o.groupKind()] = c
+	})
+	return counts
+}
+
+// FullResourceGraph returns every connection in the graph.
+func (g *ObjectGraph) FullResourceGraph(mapper meta.RESTMapper) (*v1alpha1.ResourceGraphResponse, error) {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.FullResourceGraph(mapper)
+}
+
+// FullResourceGraph returns every connection in the graph.
+func (s *Snapshot) FullResourceGraph(mapper meta.RESTMapper) (*v1alpha1.ResourceGraphResponse, error) {
+	connections := map[objectEdge]sets.String{}
+	s.each(func(src nodeID, n *node) {
+		for _, e := range n.conns {
+			for _, dst := range e.nodes {
+				key := s.edge(src, dst)
+				if _, ok := connections[key]; !ok {
+					connections[key] = sets.NewString()
+				}
+				connections[key].Insert(string(e.label))
+			}
+		}
+	})
+	return s.toResourceGraphResponse(mapper, connections)
+}
+
+func (s *Snapshot) resourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
 	connections := map[objectEdge]sets.String{}
 
-	offshoots := g.connectedEdges([]apiv1.OID{src.OID()}, apiv1.EdgeOffshoot, ksets.NewGroupKind(), connections).UnsortedList()
+	srcID, ok := s.lookup(src.OID())
+	if !ok {
+		return s.toResourceGraphResponse(mapper, connections)
+	}
+	offshoots := s.connectedEdges([]nodeID{srcID}, apiv1.EdgeOffshoot, ksets.NewGroupKind(), connections)
 	skipGKs := ksets.NewGroupKind()
-	var objID *apiv1.ObjectID
-	for _, oid := range offshoots {
-		objID, _ = apiv1.ParseObjectID(oid)
-		skipGKs.Insert(objID.GroupKind())
+	for _, id := range offshoots {
+		skipGKs.Insert(s.object(id).groupKind())
 	}
 	for _, label := range hub.ListEdgeLabels(apiv1.EdgeOffshoot, apiv1.EdgeView) {
-		g.connectedEdges(offshoots, label, skipGKs, connections)
+		s.connectedEdges(offshoots, label, skipGKs, connections)
 	}
 
+	return s.toResourceGraphResponse(mapper, connections)
+}
+
+func (s *Snapshot) toResourceGraphResponse(mapper meta.RESTMapper, connections map[objectEdge]sets.String) (*v1alpha1.ResourceGraphResponse, error) {
 	gkSet := ksets.NewGroupKind()
 	for e := range connections {
-		objID, _ = apiv1.ParseObjectID(e.Source)
-		gkSet.Insert(objID.GroupKind())
-		objID, _ = apiv1.ParseObjectID(e.Target)
-		gkSet.Insert(objID.GroupKind())
+		gkSet.Insert(s.object(e.Source).groupKind())
+		gkSet.Insert(s.object(e.Target).groupKind())
 	}
 	gks := gkSet.List()
 
@@ -196,19 +470,19 @@ func (g *ObjectGraph) resourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID)
 	}
 
 	for e, labels := range connections {
-		src, _ := apiv1.ParseObjectID(e.Source)
-		target, _ := apiv1.ParseObjectID(e.Target)
+		src := s.object(e.Source)
+		target := s.object(e.Target)
 
 		resp.Connections = append(resp.Connections, v1alpha1.ObjectConnection{
 			Source: v1alpha1.ObjectPointer{
-				ResourceID: gkMap[src.GroupKind()],
-				Namespace:  src.Namespace,
-				Name:       src.Name,
+				ResourceID: gkMap[src.groupKind()],
+				Namespace:  src.id.Namespace,
+				Name:       src.id.Name,
 			},
 			Target: v1alpha1.ObjectPointer{
-				ResourceID: gkMap[target.GroupKind()],
-				Namespace:  target.Namespace,
-				Name:       target.Name,
+				ResourceID: gkMap[target.groupKind()],
+				Namespace:  target.id.Namespace,
+				Name:       target.id.Name,
 			},
 			Labels: labels.List(),
 		})
@@ -216,43 +490,31 @@ func (g *ObjectGraph) resourceGraph(mapper meta.RESTMapper, src apiv1.ObjectID)
 	return &resp, nil
 }
 
-func (g *ObjectGraph) connectedEdges(idsToProcess []apiv1.OID, edgeLabel apiv1.EdgeLabel, skipGKs ksets.GroupKind, connections map[objectEdge]sets.String) ksets.OID {
-	processed := ksets.NewOID()
-	var x apiv1.OID
-	var objID *apiv1.ObjectID
+func (s *Snapshot) connectedEdges(idsToProcess []nodeID, edgeLabel apiv1.EdgeLabel, skipGKs ksets.GroupKind, connections map[objectEdge]sets.String) []nodeID {
+	processed := map[nodeID]bool{}
+	var out []nodeID
+	var x nodeID
 	for len(idsToProcess) > 0 {
 		x, idsToProcess = idsToProcess[0], idsToProcess[1:]
-		processed.Insert(x)
-
-		var edges ksets.OID
-		if edgedPerLabel, ok := g.edges[x]; ok {
-			edges = edgedPerLabel[edgeLabel]
+		if processed[x] {
+			continue
 		}
-		for id := range edges {
-			objID, _ = apiv1.ParseObjectID(id)
-			if skipGKs.Len() == 0 || !skipGKs.Has(objID.GroupKind()) {
-				var key objectEdge
-				if x < id {
-					key = objectEdge{
-						Source: x,
-						Target: id,
-					}
-				} else {
-					key = objectEdge{
-						Source: id,
-						Target: x,
-					}
-				}
+		processed[x] = true
+		out = append(out, x)
+
+		for _, id := range s.edges(x).get(edgeLabel) {
+			if skipGKs.Len() == 0 || !skipGKs.Has(s.object(id).groupKind()) {
+				key := s.edge(x, id)
 				if _, ok := connections[key]; !ok {
 					connections[key] = sets.NewString()
 				}
 				connections[key].Insert(string(edgeLabel))
 
-				if !processed.Has(id) {
+				if !processed[id] {
 					idsToProcess = append(idsToProcess, id)
 				}
 			}
 		}
 	}
-	return processed
+	return out
 }
@@ -0,0 +1,465 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gomodules.xyz/sets"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+)
+
+func TestPath(t *testing.T) {
+	var (
+		deploy = apiv1.ObjectID{Group: "apps", Kind: "Deployment", Namespace: "demo", Name: "web"}
+		rs     = apiv1.ObjectID{Group: "apps", Kind: "ReplicaSet", Namespace: "demo", Name: "web-1"}
+		pod    = apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-1-x"}
+		secret = apiv1.ObjectID{Kind: "Secret", Namespace: "demo", Name: "web-auth"}
+		svc    = apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+		other  = apiv1.ObjectID{Kind: "ConfigMap", Namespace: "demo", Name: "unused"}
+	)
+
+	g := NewObjectGraph()
+	g.Update(rs.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeOffshoot: ksets.NewOID(deploy.OID(), pod.OID()),
+	})
+	g.Update(pod.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeOffshoot: ksets.NewOID(secret.OID()),
+	})
+	g.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeExposedBy: ksets.NewOID(pod.OID()),
+	})
+
+	tests := []struct {
+		name     string
+		src, dst apiv1.ObjectID
+		expected []PathStep
+	}{
+		{
+			name: "same object",
+			src:  pod,
+			dst:  pod,
+			expected: []PathStep{
+				{Object: pod},
+			},
+		},
+		{
+			name: "deployment to secret",
+			src:  deploy,
+			dst:  secret,
+			expected: []PathStep{
+				{Object: deploy},
+				{Object: rs, Label: apiv1.EdgeOffshoot},
+				{Object: pod, Label: apiv1.EdgeOffshoot},
+				{Object: secret, Label: apiv1.EdgeOffshoot},
+			},
+		},
+		{
+			name: "across labels",
+			src:  svc,
+			dst:  rs,
+			expected: []PathStep{
+				{Object: svc},
+				{Object: pod, Label: apiv1.EdgeExposedBy},
+				{Object: rs, Label: apiv1.EdgeOffshoot},
+			},
+		},
+		{
+			name:     "not connected",
+			src:      deploy,
+			dst:      other,
+			expected: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := g.Path(test.src, test.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(path, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, path)
+			}
+		})
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	const (
+		objects = 120
+		writers = 6
+		readers = 6
+		updates = 300
+	)
+	id := func(i int) apiv1.OID {
+		oid := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("pod-%d", i%objects)}
+		return oid.OID()
+	}
+	// every object alternates between three sets of connections
+	connsOf := func(i, variant int) map[apiv1.EdgeLabel]ksets.OID {
+		switch variant % 3 {
+		case 0:
+			return map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(id(i+1), id(i+7))}
+		case 1:
+			return map[apiv1.EdgeLabel]ksets.OID{
+				apiv1.EdgeOffshoot: ksets.NewOID(id(i + 3)),
+				apiv1.EdgeAuthVia:  ksets.NewOID(id(i + 11)),
+			}
+		default:
+			return nil
+		}
+	}
+	connsKey := func(connsPerLabel map[apiv1.EdgeLabel]ksets.OID) string {
+		var key []string
+		for lbl, conns := range connsPerLabel {
+			for _, dst := range conns.List() {
+				key = append(key, string(lbl)+"="+string(dst))
+			}
+		}
+		sort.Strings(key)
+		return strings.Join(key, ";")
+	}
+	valid := map[apiv1.OID]sets.String{}
+	for i := 0; i < objects; i++ {
+		valid[id(i)] = sets.NewString(connsKey(connsOf(i, 0)), connsKey(connsOf(i, 1)), connsKey(connsOf(i, 2)))
+	}
+
+	// check verifies that every update is either fully visible to s or not at all
+	check := func(s *Snapshot) error {
+		type halfEdge struct {
+			x, y nodeID
+			lbl  apiv1.EdgeLabel
+		}
+		expected := map[halfEdge]bool{}
+		var err error
+		s.each(func(x nodeID, n *node) {
+			connsPerLabel := map[apiv1.EdgeLabel]ksets.OID{}
+			for _, e := range n.conns {
+				connsPerLabel[e.label] = ksets.NewOID()
+				for _, y := range e.nodes {
+					connsPerLabel[e.label].Insert(s.object(y).oid)
+					expected[halfEdge{x, y, e.label}] = true
+					expected[halfEdge{y, x, e.label}] = true
+				}
+			}
+			if key := connsKey(connsPerLabel); !valid[s.object(x).oid].Has(key) {
+				err = fmt.Errorf("unexpected connections of %s: %s", s.object(x).oid, key)
+			}
+		})
+		s.each(func(x nodeID, n *node) {
+			for _, e := range n.edges {
+				for _, y := range e.nodes {
+					if !expected[halfEdge{x, y, e.label}] {
+						err = fmt.Errorf("unexpected %s edge from %s to %s", e.label, s.object(x).oid, s.object(y).oid)
+					}
+					delete(expected, halfEdge{x, y, e.label})
+				}
+			}
+		})
+		if err == nil && len(expected) > 0 {
+			err = fmt.Errorf("missing %d edges", len(expected))
+		}
+		return err
+	}
+
+	g := NewObjectGraph()
+	last := make([]int, objects)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < updates; n++ {
+				// every object is updated by a single writer, so its last connections are known
+				i := w + writers*(n%(objects/writers))
+				g.Update(id(i), connsOf(i, n+w))
+				last[i] = n + w
+				if n%5 == 0 {
+					g.SetUID(id(i), types.UID(fmt.Sprintf("uid-%d-%d", i, n)))
+				} else if n%7 == 0 {
+					g.DeleteUID(id(i))
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	errs := make([]error, readers)
+	var rg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		rg.Add(1)
+		go func(r int) {
+			defer rg.Done()
+			read := func(n int) error {
+				s := g.Snapshot()
+				defer s.Release()
+
+				if err := check(s); err != nil {
+					return err
+				}
+				src := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("pod-%d", (n+r)%objects)}
+				dst := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("pod-%d", (n+r+40)%objects)}
+				if _, err := s.Links(&src, apiv1.EdgeExposedBy); err != nil {
+					return err
+				}
+				if _, err := s.Path(src, dst); err != nil {
+					return err
+				}
+				if _, err := s.Dependents(src); err != nil {
+					return err
+				}
+				if _, err := g.Path(src, dst); err != nil {
+					return err
+				}
+				// a snapshot reads the same graph however long it is held
+				return check(s)
+			}
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := read(n); err != nil {
+					errs[r] = err
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(done)
+	rg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	s := g.Snapshot()
+	if err := check(s); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < objects; i++ {
+		expected := connsKey(connsOf(i, last[i]))
+		actual := connsKey(connectionsOf(g)[id(i)])
+		if expected != actual {
+			t.Errorf("expected %s to have connections %q, got %q", id(i), expected, actual)
+		}
+	}
+	s.Release()
+
+	// the versions kept for the snapshots are dropped by the next update
+	g.Update(id(0), connsOf(0, last[0]+1))
+	if len(g.versioned) != 0 || len(g.versionedUIDs) != 0 {
+		t.Errorf("expected no old versions, got %d nodes and %d uids", len(g.versioned), len(g.versionedUIDs))
+	}
+}
+
+// The benchmarks run on a synthetic graph of benchObjects objects with 10 connections each, 1M edges.
+// The objects are grouped in namespaces of 1000 and apps of 10. Every object is an offshoot of the
+// first object of its app, and the other connections point to objects in the same namespace.
+const benchObjects = 100000
+
+var (
+	benchKinds = []schema.GroupKind{
+		{Group: "apps", Kind: "Deployment"},
+		{Group: "apps", Kind: "ReplicaSet"},
+		{Kind: "Pod"},
+		{Kind: "Service"},
+		{Kind: "Secret"},
+		{Kind: "ConfigMap"},
+		{Kind: "ServiceAccount"},
+	}
+	benchLabels = []apiv1.EdgeLabel{
+		apiv1.EdgeAuthVia,
+		apiv1.EdgeBackupVia,
+		apiv1.EdgeConnectVia,
+		apiv1.EdgeExposedBy,
+		apiv1.EdgeMonitoredBy,
+		apiv1.EdgeScaledBy,
+	}
+)
+
+func benchObjectID(i int) apiv1.ObjectID {
+	gk := benchKinds[i%len(benchKinds)]
+	return apiv1.ObjectID{
+		Group:     gk.Group,
+		Kind:      gk.Kind,
+		Namespace: fmt.Sprintf("ns-%d", i/1000),
+		Name:      fmt.Sprintf("obj-%d", i),
+	}
+}
+
+// benchConnections returns the connections of the i-th object. Changing seed changes the targets.
+func benchConnections(i, seed int) map[apiv1.EdgeLabel]ksets.OID {
+	conns := map[apiv1.EdgeLabel]ksets.OID{}
+	if app := i - i%10; app != i {
+		id := benchObjectID(app)
+		conns[apiv1.EdgeOffshoot] = ksets.NewOID(id.OID())
+	}
+	for k := len(conns); k < 10; k++ {
+		lbl := benchLabels[k%len(benchLabels)]
+		if _, ok := conns[lbl]; !ok {
+			conns[lbl] = ksets.NewOID()
+		}
+		id := benchObjectID(i - i%1000 + (i*7919+k*104729+seed)%1000)
+		conns[lbl].Insert(id.OID())
+	}
+	return conns
+}
+
+func newBenchGraph() *ObjectGraph {
+	g := NewObjectGraph()
+	for i := 0; i < benchObjects; i++ {
+		id := benchObjectID(i)
+		g.SetUID(id.OID(), types.UID(fmt.Sprintf("uid-%d", i)))
+		g.Update(id.OID(), benchConnections(i, 0))
+	}
+	return g
+}
+
+var benchGraph struct {
+	once sync.Once
+	g    *ObjectGraph
+}
+
+func sharedBenchGraph(b *testing.B) *ObjectGraph {
+	benchGraph.once.Do(func() {
+		benchGraph.g = newBenchGraph()
+	})
+	b.ResetTimer()
+	return benchGraph.g
+}
+
+func BenchmarkBuildGraph(b *testing.B) {
+	b.ReportAllocs()
+	var heap float64
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		g := newBenchGraph()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		heap += float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / (1 << 20)
+		runtime.KeepAlive(g)
+	}
+	b.ReportMetric(heap/float64(b.N), "MiB/graph")
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	g := sharedBenchGraph(b)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		i := (n * 31) % benchObjects
+		id := benchObjectID(i)
+		g.Update(id.OID(), benchConnections(i, n%2))
+	}
+}
+
+func BenchmarkLinks(b *testing.B) {
+	g := sharedBenchGraph(b)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		id := benchObjectID((n * 31) % benchObjects)
+		if _, err := g.Links(&id, apiv1.EdgeExposedBy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResourceGraph(b *testing.B) {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}, {Group: "apps", Version: "v1"}})
+	for _, gk := range benchKinds {
+		mapper.Add(gk.WithVersion("v1"), meta.RESTScopeNamespace)
+	}
+	g := sharedBenchGraph(b)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		id := benchObjectID((n * 31) % benchObjects)
+		if _, err := g.ResourceGraph(mapper, id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPath(b *testing.B) {
+	g := sharedBenchGraph(b)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		src, dst := benchObjectID((n*31)%benchObjects), benchObjectID((n*31+benchObjects/2)%benchObjects)
+		if _, err := g.Path(src, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDependents(b *testing.B) {
+	g := sharedBenchGraph(b)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		id := benchObjectID((n * 31) % benchObjects)
+		if _, err := g.dependents(id, registryConnections); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLinksDuringUpdates reads the graph in parallel while it is updated continuously.
+func BenchmarkLinksDuringUpdates(b *testing.B) {
+	g := sharedBenchGraph(b)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			i := (n * 31) % benchObjects
+			id := benchObjectID(i)
+			g.Update(id.OID(), benchConnections(i, n%2))
+		}
+	}()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			id := benchObjectID((n * 31) % benchObjects)
+			if _, err := g.Links(&id, apiv1.EdgeOffshoot); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	close(done)
+	wg.Wait()
+}
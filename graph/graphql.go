@@ -17,15 +17,91 @@ limitations under the License.
 package graph
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/graphql-go/graphql"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	apiv1 "kmodules.xyz/client-go/api/v1"
-	"kmodules.xyz/resource-metadata/hub"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func getGraphQLSchema() graphql.Schema {
+type clientKey struct{}
+
+// WithClient returns a copy of ctx carrying the client used by the GraphQL resolvers
+// that read objects from the cluster. The resolvers use the indexes of the graph, so kc
+// should be the client of the manager building the graph.
+func WithClient(ctx context.Context, kc client.Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, kc)
+}
+
+func clientFrom(ctx context.Context) (client.Client, error) {
+	if ctx != nil {
+		if kc, ok := ctx.Value(clientKey{}).(client.Client); ok {
+			return kc, nil
+		}
+	}
+	return nil, errors.New("graphql context is missing kube client")
+}
+
+// findObject resolves the arguments of the find query to an object id.
+func findObject(p graphql.ResolveParams) (*apiv1.ObjectID, error) {
+	var set []string
+	for _, arg := range []string{"oid", "object", "ref", "uid"} {
+		if v, ok := p.Args[arg]; ok && v != nil {
+			set = append(set, arg)
+		}
+	}
+	if len(set) != 1 {
+		return nil, fmt.Errorf("exactly one of oid, object, ref or uid must be set, found %v", set)
+	}
+
+	switch set[0] {
+	case "oid":
+		return apiv1.ParseObjectID(apiv1.OID(p.Args["oid"].(string)))
+	case "uid":
+		// uids are not recorded by the history, so they are looked up in the current graph
+		s, release := snapshotFrom(p.Context)
+		defer release()
+		return s.FindByUID(types.UID(p.Args["uid"].(string)))
+	}
+
+	kc, err := clientFrom(p.Context)
+	if err != nil {
+		return nil, err
+	}
+	if set[0] == "ref" {
+		var namespace string
+		if v, ok := p.Args["namespace"]; ok {
+			namespace = v.(string)
+		}
+		return ParseObjectRef(kc.RESTMapper(), p.Args["ref"].(string), namespace)
+	}
+
+	var id apiv1.ObjectID
+	obj := p.Args["object"].(map[string]interface{})
+	if v, ok := obj["group"].(string); ok {
+		id.Group = v
+	}
+	if v, ok := obj["kind"].(string); ok {
+		id.Kind = v
+	}
+	if v, ok := obj["namespace"].(string); ok {
+		id.Namespace = v
+	}
+	if v, ok := obj["name"].(string); ok {
+		id.Name = v
+	}
+	return NormalizeObjectID(kc.RESTMapper(), id)
+}
+
+// newGraphQLSchema returns a schema serving the edge labels as fields of ObjectID.
+func newGraphQLSchema(edgeLabels []apiv1.EdgeLabel) (graphql.Schema, error) {
 	oidType := graphql.NewObject(graphql.ObjectConfig{
 		Name:        "ObjectID",
 		Description: "Uniquely identifies a Kubernetes object",
@@ -48,7 +124,29 @@ func getGraphQLSchema() graphql.Schema {
 			},
 		},
 	})
-	for _, label := range hub.ListEdgeLabels() {
+	oidInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "ObjectIDInput",
+		Description: "Identifies a Kubernetes object",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"group": &graphql.InputObjectFieldConfig{
+				Type:        graphql.String,
+				Description: "The group of the Object",
+			},
+			"kind": &graphql.InputObjectFieldConfig{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "The kind or resource name of the Object",
+			},
+			"namespace": &graphql.InputObjectFieldConfig{
+				Type:        graphql.String,
+				Description: "The namespace of the Object",
+			},
+			"name": &graphql.InputObjectFieldConfig{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "The name of the Object.",
+			},
+		},
+	})
+	for _, label := range edgeLabels {
 		func(edgeLabel apiv1.EdgeLabel) {
 			oidType.AddFieldConfig(string(edgeLabel), &graphql.Field{
 				Type:        graphql.NewList(oidType),
@@ -76,7 +174,9 @@ func getGraphQLSchema() graphql.Schema {
 					}
 
 					if oid, ok := p.Source.(apiv1.ObjectID); ok {
-						links, err := objGraph.Links(&oid, edgeLabel)
+						s, release := snapshotOf(p)
+						defer release()
+						links, err := s.Links(&oid, edgeLabel)
 						if err != nil {
 							return nil, err
 						}
@@ -97,30 +197,279 @@ func getGraphQLSchema() graphql.Schema {
 		}(label)
 	}
 
+	dependentType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Dependent",
+		Description: "An object affected by the deletion of another object",
+		Fields: graphql.Fields{
+			"object": &graphql.Field{
+				Type:        graphql.NewNonNull(oidType),
+				Description: "The dependent object",
+			},
+			"level": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "Impact level of the deletion on this object (Owned, Referenced or Selected)",
+			},
+			"labels": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Labels of the edges connecting this object",
+			},
+			"type": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Type of the connection that makes this object a dependent",
+			},
+			"via": &graphql.Field{
+				Type:        oidType,
+				Description: "The deleted or garbage collected object this object depends on",
+			},
+		},
+	})
+	impactType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Impact",
+		Description: "Dependents of an object grouped by severity",
+		Fields: graphql.Fields{
+			"owned": &graphql.Field{
+				Type:        graphql.NewList(dependentType),
+				Description: "Dependents owned by the object that will be garbage collected",
+			},
+			"referenced": &graphql.Field{
+				Type:        graphql.NewList(dependentType),
+				Description: "Dependents referencing the object that will break",
+			},
+			"selected": &graphql.Field{
+				Type:        graphql.NewList(dependentType),
+				Description: "Dependents merely selecting the object",
+			},
+		},
+	})
+	oidType.AddFieldConfig("dependents", &graphql.Field{
+		Type:        impactType,
+		Description: "Objects affected if this object is deleted",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if oid, ok := p.Source.(apiv1.ObjectID); ok {
+				s, release := snapshotOf(p)
+				defer release()
+				return s.Dependents(oid)
+			}
+			return nil, nil
+		},
+	})
+
+	pathStepType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "PathStep",
+		Description: "An object on a path through the graph",
+		Fields: graphql.Fields{
+			"object": &graphql.Field{
+				Type:        graphql.NewNonNull(oidType),
+				Description: "The object",
+			},
+			"label": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Label of the edge from the previous object",
+			},
+		},
+	})
+	oidType.AddFieldConfig("path", &graphql.Field{
+		Type:        graphql.NewList(pathStepType),
+		Description: "Shortest path from this object to another object",
+		Args: graphql.FieldConfigArgument{
+			"to": &graphql.ArgumentConfig{
+				Description: "Object ID of the destination in OID format",
+				Type:        graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			dst, err := apiv1.ParseObjectID(apiv1.OID(p.Args["to"].(string)))
+			if err != nil {
+				return nil, err
+			}
+			if oid, ok := p.Source.(apiv1.ObjectID); ok {
+				s, release := snapshotOf(p)
+				defer release()
+				return s.Path(oid, *dst)
+			}
+			return nil, nil
+		},
+	})
+
+	danglingEdgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "DanglingEdge",
+		Description: "A connection whose target object does not exist",
+		Fields: graphql.Fields{
+			"source": &graphql.Field{
+				Type:        graphql.NewNonNull(oidType),
+				Description: "The object holding the connection",
+			},
+			"target": &graphql.Field{
+				Type:        graphql.NewNonNull(oidType),
+				Description: "The missing object",
+			},
+			"type": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "Type of the connection",
+			},
+			"labels": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Labels of the connection",
+			},
+		},
+	})
+	danglingReportType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "DanglingReport",
+		Description: "Dangling references and orphaned objects",
+		Fields: graphql.Fields{
+			"dangling": &graphql.Field{
+				Type:        graphql.NewList(danglingEdgeType),
+				Description: "References to missing objects",
+			},
+			"orphans": &graphql.Field{
+				Type:        graphql.NewList(danglingEdgeType),
+				Description: "Owned objects whose owner is missing",
+			},
+			"errors": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Connections that could not be evaluated",
+			},
+		},
+	})
+
 	queryType := graphql.NewObject(graphql.ObjectConfig{
 		Name: "Query",
 		Fields: graphql.Fields{
 			"find": &graphql.Field{
-				Type: oidType,
+				Type:        oidType,
+				Description: "Finds an object by exactly one of oid, object, ref or uid",
 				Args: graphql.FieldConfigArgument{
 					"oid": &graphql.ArgumentConfig{
 						Description: "Object ID in OID format",
-						Type:        graphql.NewNonNull(graphql.String),
+						Type:        graphql.String,
+					},
+					"object": &graphql.ArgumentConfig{
+						Description: "Object ID, kind can be a kind or a resource name",
+						Type:        oidInputType,
+					},
+					"ref": &graphql.ArgumentConfig{
+						Description: "Object in kubectl format, eg, deployment.apps/coredns",
+						Type:        graphql.String,
+					},
+					"namespace": &graphql.ArgumentConfig{
+						Description: "Namespace of the object given by ref",
+						Type:        graphql.String,
+					},
+					"uid": &graphql.ArgumentConfig{
+						Description: "UID of the object",
+						Type:        graphql.String,
+					},
+					"at": &graphql.ArgumentConfig{
+						Description: "Reads the graph as of this time, reconstructed from its history",
+						Type:        graphql.DateTime,
 					},
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					key := p.Args["oid"].(string)
-					oid, err := apiv1.ParseObjectID(apiv1.OID(key))
+					if at, ok := p.Args["at"].(time.Time); ok {
+						if err := setPastSnapshot(p, at); err != nil {
+							return nil, err
+						}
+					}
+					oid, err := findObject(p)
 					if err != nil {
 						return nil, err
 					}
 					return *oid, nil
 				},
 			},
+			"findMany": &graphql.Field{
+				Type:        graphql.NewList(oidType),
+				Description: "Finds the objects of a kind matching a label selector",
+				Args: graphql.FieldConfigArgument{
+					"group": &graphql.ArgumentConfig{
+						Description: "group of the objects",
+						Type:        graphql.String,
+					},
+					"kind": &graphql.ArgumentConfig{
+						Description: "kind or resource name of the objects",
+						Type:        graphql.NewNonNull(graphql.String),
+					},
+					"namespace": &graphql.ArgumentConfig{
+						Description: "namespace of the objects, all namespaces if empty",
+						Type:        graphql.String,
+					},
+					"selector": &graphql.ArgumentConfig{
+						Description: "label selector, eg, app=web,tier!=cache",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var group, namespace, selector string
+					if v, ok := p.Args["group"]; ok {
+						group = v.(string)
+					}
+					kind := p.Args["kind"].(string)
+					if v, ok := p.Args["namespace"]; ok {
+						namespace = v.(string)
+					}
+					if v, ok := p.Args["selector"]; ok {
+						selector = v.(string)
+					}
+					sel, err := labels.Parse(selector)
+					if err != nil {
+						return nil, err
+					}
+
+					kc, err := clientFrom(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					finder := NewFinder(kc)
+					return finder.FindMany(schema.GroupKind{Group: group, Kind: kind}, namespace, sel)
+				},
+			},
+			"dangling": &graphql.Field{
+				Type:        danglingReportType,
+				Description: "Scans the cluster for dangling references and orphaned objects",
+				Args: graphql.FieldConfigArgument{
+					"namespace": &graphql.ArgumentConfig{
+						Description: "namespace of the scanned objects",
+						Type:        graphql.String,
+					},
+					"group": &graphql.ArgumentConfig{
+						Description: "group of the scanned objects",
+						Type:        graphql.String,
+					},
+					"kind": &graphql.ArgumentConfig{
+						Description: "kind of the scanned objects",
+						Type:        graphql.String,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var namespace, group, kind string
+					if v, ok := p.Args["namespace"]; ok {
+						namespace = v.(string)
+					}
+					if v, ok := p.Args["group"]; ok {
+						group = v.(string)
+					}
+					if v, ok := p.Args["kind"]; ok {
+						kind = v.(string)
+					}
+					if group != "" && kind == "" { // group can be empty
+						return nil, fmt.Errorf("group is set but kind is not set")
+					}
+
+					kc, err := clientFrom(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					finder := NewFinder(kc)
+					if kind != "" {
+						return finder.ScanDangling(namespace, schema.GroupKind{Group: group, Kind: kind})
+					}
+					return finder.ScanDangling(namespace)
+				},
+			},
 		},
 	})
-	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
-		Query: queryType,
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:      queryType,
+		Extensions: []graphql.Extension{snapshotExtension{}},
 	})
-	return schema
 }
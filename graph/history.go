@@ -0,0 +1,726 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// DefaultHistoryFlushInterval is how often the recorded events are written to the store.
+	DefaultHistoryFlushInterval = time.Second
+	// historyPruneInterval is how often the events older than the retention are pruned.
+	historyPruneInterval = time.Minute
+	// historyCheckpointEvents is the number of events after which the edges are checkpointed, so
+	// reconstructing the graph replays at most that many events.
+	historyCheckpointEvents = 10000
+	// historyMaxPendingEvents is the number of events kept in memory while the store can't be
+	// written. Beyond that, the events are dropped until the current edges are written again.
+	historyMaxPendingEvents = 100000
+)
+
+var droppedHistoryEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "resource_graph_history_dropped_events_total",
+	Help: "Number of graph history events dropped because they couldn't be written to the store.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(droppedHistoryEvents)
+}
+
+var (
+	eventsBucket      = []byte("events")      // sequence -> edgeEvent
+	timesBucket       = []byte("times")       // timeKey of the events
+	baseBucket        = []byte("base")        // edgeKey of the edges as of since
+	checkpointsBucket = []byte("checkpoints") // sequence -> bucket of the edgeKey of the edges as of the event
+	gapsBucket        = []byte("gaps")        // start -> end of the periods with dropped events
+	metaBucket        = []byte("meta")
+	sinceKey          = []byte("since")
+)
+
+type edgeOp string
+
+const (
+	edgeAdded   edgeOp = "add"
+	edgeRemoved edgeOp = "remove"
+	// graphReset removes every edge. The graph is rebuilt from scratch after a restart, so edges
+	// removed while it was down would be kept otherwise.
+	graphReset edgeOp = "reset"
+)
+
+// edgeEvent is an edge added to or removed from the graph by the connections of its source.
+type edgeEvent struct {
+	Time   time.Time       `json:"time"`
+	Op     edgeOp          `json:"op"`
+	Source apiv1.OID       `json:"source,omitempty"`
+	Label  apiv1.EdgeLabel `json:"label,omitempty"`
+	Target apiv1.OID       `json:"target,omitempty"`
+}
+
+// apply applies the event to the connections of every object.
+func (ev *edgeEvent) apply(conns map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID) {
+	switch ev.Op {
+	case edgeAdded:
+		connsPerLabel, ok := conns[ev.Source]
+		if !ok {
+			connsPerLabel = map[apiv1.EdgeLabel]ksets.OID{}
+			conns[ev.Source] = connsPerLabel
+		}
+		if _, ok := connsPerLabel[ev.Label]; !ok {
+			connsPerLabel[ev.Label] = ksets.NewOID()
+		}
+		connsPerLabel[ev.Label].Insert(ev.Target)
+	case edgeRemoved:
+		if targets, ok := conns[ev.Source][ev.Label]; ok {
+			targets.Delete(ev.Target)
+		}
+	case graphReset:
+		for src := range conns {
+			delete(conns, src)
+		}
+	}
+}
+
+// HistoryOptions configures the History of a graph.
+type HistoryOptions struct {
+	// Path is the file of the embedded store.
+	Path string
+	// Retention is how long the events are kept. The graph can't be reconstructed as of a time
+	// older than the retention. Zero keeps every event.
+	Retention time.Duration
+	// FlushInterval is how often the recorded events are written to the store. Defaults to
+	// DefaultHistoryFlushInterval.
+	FlushInterval time.Duration
+}
+
+// History is an append-only log of the edges added to and removed from an ObjectGraph, stored in
+// a local bbolt database. It reconstructs the graph as of a past time by replaying the log from
+// the latest checkpoint of the edges before then.
+//
+// The log is ordered by sequence. The time of an event is never before the time of the previous
+// event, so a wall clock stepping back can't reorder the log.
+//
+// Events older than the retention are folded into the edges the log starts from, so the graph
+// can be reconstructed as of any time since the oldest event kept.
+//
+// If the store fails for so long that too many events are pending, the events are dropped and
+// the history is lost until the current edges of the graph are written again. The graph can't be
+// reconstructed as of a time in between.
+type History struct {
+	db   *bolt.DB
+	opts HistoryOptions
+	now  func() time.Time
+	// checkpointEvents is the number of events after which the edges are checkpointed.
+	checkpointEvents uint64
+
+	m       sync.Mutex
+	pending []edgeEvent // recorded but not yet written events
+	// maxPending is the number of pending events beyond which the events are dropped.
+	maxPending int
+	// lost is set while events are dropped, since lostSince.
+	lost      bool
+	lostSince time.Time
+	// state returns a reset followed by the current edges of the graph, restarting the recording
+	// from them. Set by ObjectGraph.SetHistory.
+	state func() []edgeEvent
+
+	// flushMu serializes the flushes, so the events are stored in the order they were recorded
+	flushMu sync.Mutex
+	// last is the time of the last event written
+	last time.Time
+}
+
+// OpenHistory opens the history stored in opts.Path, creating it if it doesn't exist.
+func OpenHistory(opts HistoryOptions) (*History, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultHistoryFlushInterval
+	}
+	db, err := bolt.Open(opts.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open graph history %s", opts.Path)
+	}
+
+	h := &History{
+		db:               db,
+		opts:             opts,
+		now:              time.Now,
+		checkpointEvents: historyCheckpointEvents,
+		maxPending:       historyMaxPendingEvents,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{eventsBucket, timesBucket, baseBucket, checkpointsBucket, gapsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if k, _ := tx.Bucket(timesBucket).Cursor().Last(); k != nil {
+			h.last, _ = parseTimeKey(k)
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if meta.Get(sinceKey) != nil {
+			return nil
+		}
+		return putTime(meta, sinceKey, h.now())
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "failed to initialize graph history %s", opts.Path)
+	}
+	return h, nil
+}
+
+// Close writes the recorded events and closes the store.
+func (h *History) Close() error {
+	err := h.Flush()
+	if cerr := h.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Run writes the recorded events every flush interval and prunes the events older than the
+// retention, until ctx is done. The history is closed when Run returns.
+func (h *History) Run(ctx context.Context) error {
+	var pruned time.Time
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := h.Flush(); err != nil {
+			klog.ErrorS(err, "failed to write the graph history")
+		}
+		if now := h.now(); now.Sub(pruned) >= historyPruneInterval {
+			pruned = now
+			if err := h.Prune(); err != nil {
+				klog.ErrorS(err, "failed to prune the graph history")
+			}
+		}
+	}, h.opts.FlushInterval)
+	return h.Close()
+}
+
+// record appends events to the log. They are written to the store by the next flush.
+func (h *History) record(events ...edgeEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.lost {
+		droppedHistoryEvents.Add(float64(len(events)))
+		return
+	}
+	h.pending = append(h.pending, events...)
+	h.dropOverflow()
+}
+
+// dropOverflow drops the pending events once there are more than maxPending, so they can't pile up
+// while the store fails. The history is lost until the next flush writes the current edges of the
+// graph. The caller must hold h.m.
+func (h *History) dropOverflow() {
+	if len(h.pending) <= h.maxPending {
+		return
+	}
+	droppedHistoryEvents.Add(float64(len(h.pending)))
+	h.lost = true
+	h.lostSince = h.pending[0].Time
+	h.pending = nil
+}
+
+// setState sets the function returning the current edges of the graph recorded in h.
+func (h *History) setState(state func() []edgeEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.state = state
+}
+
+// restart drops the pending events, as the recording restarts from the current edges of the
+// graph. The graph must not change until the edges are recorded.
+func (h *History) restart() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.pending = nil
+	h.lost = false
+}
+
+// Flush writes the recorded events to the store. If the history is lost, it writes a reset
+// followed by the current edges of the graph instead and records the period the events were
+// dropped in.
+func (h *History) Flush() error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	h.m.Lock()
+	lost, lostSince, state := h.lost, h.lostSince, h.state
+	events := h.pending
+	h.pending = nil
+	h.m.Unlock()
+	if lost {
+		if state == nil {
+			return nil
+		}
+		events = state()
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	last := h.last
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		times := tx.Bucket(timesBucket)
+		for _, ev := range events {
+			if ev.Time.Before(last) {
+				ev.Time = last
+			}
+			last = ev.Time
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(sequenceKey(seq), data); err != nil {
+				return err
+			}
+			if err := times.Put(timeKey(ev.Time, seq), nil); err != nil {
+				return err
+			}
+		}
+		if lost {
+			if err := putTime(tx.Bucket(gapsBucket), timeKey(lostSince, 0), last); err != nil {
+				return err
+			}
+		}
+		return h.checkpoint(tx)
+	})
+	if err != nil {
+		h.m.Lock()
+		if lost {
+			// the current edges are read again by the next flush
+			h.lost = true
+			h.pending = nil
+		} else {
+			// keep the events for the next flush
+			h.pending = append(events, h.pending...)
+			h.dropOverflow()
+		}
+		h.m.Unlock()
+		return err
+	}
+	h.last = last
+	if lost {
+		klog.InfoS("recorded the graph history again after dropping events", "since", lostSince)
+	}
+	return nil
+}
+
+// checkpoint stores the current edges if checkpointEvents events have been written since the
+// latest checkpoint.
+func (h *History) checkpoint(tx *bolt.Tx) error {
+	checkpoints := tx.Bucket(checkpointsBucket)
+	var latest uint64
+	if k, _ := checkpoints.Cursor().Last(); k != nil {
+		latest = binary.BigEndian.Uint64(k)
+	}
+	seq := tx.Bucket(eventsBucket).Sequence()
+	if seq-latest < h.checkpointEvents {
+		return nil
+	}
+
+	conns, _, err := replay(tx, seq)
+	if err != nil {
+		return err
+	}
+	b, err := checkpoints.CreateBucket(sequenceKey(seq))
+	if err != nil {
+		return err
+	}
+	for src, connsPerLabel := range conns {
+		for lbl, targets := range connsPerLabel {
+			for dst := range targets {
+				if err := b.Put(edgeKey(src, lbl, dst), nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Prune folds the events older than the retention into the edges the log starts from.
+func (h *History) Prune() error {
+	if h.opts.Retention <= 0 {
+		return nil
+	}
+	if err := h.Flush(); err != nil {
+		return err
+	}
+
+	horizon := h.now().Add(-h.opts.Retention)
+	return h.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		since, err := getTime(meta, sinceKey)
+		if err != nil {
+			return err
+		}
+		if !horizon.After(since) {
+			return nil
+		}
+
+		// the events before the horizon are the events up to the last one before it
+		expiredSeq := lastSequence(tx, horizon.Add(-1))
+		base := tx.Bucket(baseBucket)
+		c := tx.Bucket(eventsBucket).Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) <= expiredSeq; k, v = c.First() {
+			var ev edgeEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			switch ev.Op {
+			case edgeAdded:
+				err = base.Put(edgeKey(ev.Source, ev.Label, ev.Target), nil)
+			case edgeRemoved:
+				err = base.Delete(edgeKey(ev.Source, ev.Label, ev.Target))
+			case graphReset:
+				if err = tx.DeleteBucket(baseBucket); err == nil {
+					base, err = tx.CreateBucket(baseBucket)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		c = tx.Bucket(timesBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			if _, seq := parseTimeKey(k); seq > expiredSeq {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		// the checkpoints up to the expired events are replaced by the base
+		checkpoints := tx.Bucket(checkpointsBucket)
+		var expired [][]byte
+		c = checkpoints.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= expiredSeq; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := checkpoints.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+
+		gaps := tx.Bucket(gapsBucket)
+		expired = nil
+		err = gaps.ForEach(func(k, _ []byte) error {
+			if end, err := getTime(gaps, k); err != nil {
+				return err
+			} else if end.Before(horizon) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := gaps.Delete(k); err != nil {
+				return err
+			}
+		}
+		return putTime(meta, sinceKey, horizon)
+	})
+}
+
+// Since returns the oldest time the graph can be reconstructed as of.
+func (h *History) Since() (time.Time, error) {
+	var since time.Time
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		since, err = getTime(tx.Bucket(metaBucket), sinceKey)
+		return err
+	})
+	return since, err
+}
+
+// GraphAt reconstructs the graph as of at.
+func (h *History) GraphAt(at time.Time) (*ObjectGraph, error) {
+	if err := h.Flush(); err != nil {
+		return nil, err
+	}
+	h.m.Lock()
+	lost, lostSince := h.lost, h.lostSince
+	h.m.Unlock()
+	if lost && !at.Before(lostSince) {
+		return nil, fmt.Errorf("the graph history is incomplete since %s", lostSince.Format(time.RFC3339))
+	}
+
+	var conns map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID
+	err := h.db.View(func(tx *bolt.Tx) error {
+		since, err := getTime(tx.Bucket(metaBucket), sinceKey)
+		if err != nil {
+			return err
+		}
+		if at.Before(since) {
+			return fmt.Errorf("the graph history starts at %s", since.Format(time.RFC3339))
+		}
+		gaps := tx.Bucket(gapsBucket)
+		err = gaps.ForEach(func(k, _ []byte) error {
+			start, _ := parseTimeKey(k)
+			end, err := getTime(gaps, k)
+			if err != nil {
+				return err
+			}
+			if !at.Before(start) && at.Before(end) {
+				return fmt.Errorf("the graph history is incomplete from %s to %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		conns, _, err = replay(tx, lastSequence(tx, at))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g := NewObjectGraph()
+	for src, connsPerLabel := range conns {
+		g.Update(src, connsPerLabel)
+	}
+	return g, nil
+}
+
+// lastSequence returns the sequence of the last event at or before at, 0 if there is none.
+func lastSequence(tx *bolt.Tx, at time.Time) uint64 {
+	c := tx.Bucket(timesBucket).Cursor()
+	k, _ := c.Seek(timeKey(at, math.MaxUint64))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil {
+		return 0
+	}
+	_, seq := parseTimeKey(k)
+	return seq
+}
+
+// replay returns the edges as of the event with sequence seq, replaying the events since the
+// latest checkpoint up to that event, or since the base if there is none. It also returns the
+// number of events replayed.
+func replay(tx *bolt.Tx, seq uint64) (map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID, int, error) {
+	conns := map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{}
+	load := func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, _ []byte) error {
+			ev := edgeEvent{Op: edgeAdded}
+			var ok bool
+			if ev.Source, ev.Label, ev.Target, ok = parseEdgeKey(k); !ok {
+				return fmt.Errorf("invalid edge %q in graph history", k)
+			}
+			ev.apply(conns)
+			return nil
+		})
+	}
+
+	var from uint64
+	checkpoints := tx.Bucket(checkpointsBucket)
+	cc := checkpoints.Cursor()
+	k, _ := cc.Seek(sequenceKey(seq + 1))
+	if k == nil {
+		k, _ = cc.Last()
+	} else {
+		k, _ = cc.Prev()
+	}
+	if k != nil {
+		from = binary.BigEndian.Uint64(k)
+		if err := load(checkpoints.Bucket(k)); err != nil {
+			return nil, 0, err
+		}
+	} else if err := load(tx.Bucket(baseBucket)); err != nil {
+		return nil, 0, err
+	}
+
+	replayed := 0
+	c := tx.Bucket(eventsBucket).Cursor()
+	for k, v := c.Seek(sequenceKey(from + 1)); k != nil && binary.BigEndian.Uint64(k) <= seq; k, v = c.Next() {
+		var ev edgeEvent
+		if err := json.Unmarshal(v, &ev); err != nil {
+			return nil, 0, err
+		}
+		ev.apply(conns)
+		replayed++
+	}
+	return conns, replayed, nil
+}
+
+func sequenceKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// timeKey returns the key of the event with the given time and sequence in the times bucket,
+// ordered by time.
+func timeKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func parseTimeKey(k []byte) (time.Time, uint64) {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k))), binary.BigEndian.Uint64(k[8:])
+}
+
+// edgeKey returns the key of an edge in the base bucket and the checkpoints. OIDs and labels never
+// contain a NUL byte.
+func edgeKey(src apiv1.OID, lbl apiv1.EdgeLabel, dst apiv1.OID) []byte {
+	return []byte(string(src) + "\x00" + string(lbl) + "\x00" + string(dst))
+}
+
+func parseEdgeKey(k []byte) (apiv1.OID, apiv1.EdgeLabel, apiv1.OID, bool) {
+	parts := bytes.Split(k, []byte{0})
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return apiv1.OID(parts[0]), apiv1.EdgeLabel(parts[1]), apiv1.OID(parts[2]), true
+}
+
+func putTime(b *bolt.Bucket, key []byte, t time.Time) error {
+	data, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func getTime(b *bolt.Bucket, key []byte) (time.Time, error) {
+	var t time.Time
+	err := t.UnmarshalText(b.Get(key))
+	return t, err
+}
+
+// SetHistory records the changes of the edges of g in h, starting with the current edges.
+// A nil h stops recording.
+func (g *ObjectGraph) SetHistory(h *History) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if old := g.loadHistory(); old != nil {
+		old.setState(nil)
+	}
+	g.history.Store(h)
+	if h != nil {
+		h.setState(func() []edgeEvent {
+			g.m.Lock()
+			defer g.m.Unlock()
+			h.restart()
+			return g.stateEvents(h.now())
+		})
+		g.recordState(h)
+	}
+}
+
+func (g *ObjectGraph) loadHistory() *History {
+	h, _ := g.history.Load().(*History)
+	return h
+}
+
+// recordState records a reset of the graph followed by its current edges.
+// The caller must hold the write lock.
+func (g *ObjectGraph) recordState(h *History) {
+	h.record(g.stateEvents(h.now())...)
+}
+
+// stateEvents returns a reset of the graph followed by the events of its current edges.
+// The caller must hold the write lock.
+func (g *ObjectGraph) stateEvents(now time.Time) []edgeEvent {
+	events := []edgeEvent{{Time: now, Op: graphReset}}
+	g.in.each(func(id nodeID, e *entry) {
+		if n := e.node(); n != nil {
+			events = append(events, g.edgeEvents(now, edgeAdded, e.oid, n.conns)...)
+		}
+	})
+	return events
+}
+
+// edgeEvents returns the events of the edges a of src. The caller must hold the write lock.
+func (g *ObjectGraph) edgeEvents(now time.Time, op edgeOp, src apiv1.OID, a adjacency) []edgeEvent {
+	events := make([]edgeEvent, 0, a.len())
+	for _, e := range a {
+		for _, dst := range e.nodes {
+			events = append(events, edgeEvent{
+				Time:   now,
+				Op:     op,
+				Source: src,
+				Label:  e.label,
+				Target: g.in.entry(dst).oid,
+			})
+		}
+	}
+	return events
+}
+
+// SnapshotAt returns a snapshot of the graph as of at, reconstructed from its history.
+func (g *ObjectGraph) SnapshotAt(at time.Time) (*Snapshot, error) {
+	h := g.loadHistory()
+	if h == nil {
+		return nil, errors.New("graph history is not enabled")
+	}
+	past, err := h.GraphAt(at)
+	if err != nil {
+		return nil, err
+	}
+	return past.Snapshot(), nil
+}
+
+// EnableHistory records the changes of the graph queried by the GraphQL schema in h.
+func EnableHistory(h *History) {
+	objGraph.SetHistory(h)
+}
+
+// NewSnapshotAt returns a snapshot of the graph queried by the GraphQL schema as of at.
+func NewSnapshotAt(at time.Time) (*Snapshot, error) {
+	return objGraph.SnapshotAt(at)
+}
@@ -0,0 +1,432 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	dto "github.com/prometheus/client_model/go"
+	bolt "go.etcd.io/bbolt"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+)
+
+// testClock returns the time set by the test.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func openTestHistory(t *testing.T, path string, retention time.Duration, clock *testClock) *History {
+	h, err := OpenHistory(HistoryOptions{Path: path, Retention: retention})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.now = clock.now
+	return h
+}
+
+func TestHistory(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+	old := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-old"}
+	cur := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-new"}
+	exposedBy := func(pods ...apiv1.ObjectID) map[apiv1.EdgeLabel]ksets.OID {
+		oids := ksets.NewOID()
+		for _, pod := range pods {
+			oids.Insert(pod.OID())
+		}
+		return map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: oids}
+	}
+
+	path := filepath.Join(t.TempDir(), "history.db")
+	start := time.Now().Add(time.Hour)
+	clock := &testClock{t: start}
+	h := openTestHistory(t, path, 0, clock)
+
+	g := NewObjectGraph()
+	g.Update(svc.OID(), exposedBy(old))
+	// the edges made before the history is enabled are recorded as of then
+	g.SetHistory(h)
+	clock.t = start.Add(time.Minute)
+	g.Update(svc.OID(), exposedBy(old, cur))
+	clock.t = start.Add(2 * time.Minute)
+	g.Update(svc.OID(), exposedBy(cur))
+
+	expected := []map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{
+		{svc.OID(): exposedBy(old)},
+		{svc.OID(): exposedBy(old, cur)},
+		{svc.OID(): exposedBy(cur)},
+	}
+	check := func(h *History) {
+		t.Helper()
+		for i, conns := range expected {
+			at := start.Add(time.Duration(i)*time.Minute + time.Second)
+			past, err := h.GraphAt(at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := connectionsOf(past); !reflect.DeepEqual(got, conns) {
+				t.Errorf("expected the graph as of %s to be %v, got %v", at, conns, got)
+			}
+		}
+	}
+	check(h)
+	if _, err := h.GraphAt(time.Now().Add(-time.Hour)); err == nil {
+		t.Error("expected no graph before the history started")
+	}
+
+	// the graph is rebuilt after a restart, dropping the edges removed in between
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h = openTestHistory(t, path, 0, clock)
+	defer h.Close()
+	clock.t = start.Add(3 * time.Minute)
+	g = NewObjectGraph()
+	g.SetHistory(h)
+	clock.t = start.Add(4 * time.Minute)
+	g.Update(svc.OID(), exposedBy(old))
+	expected = append(expected,
+		map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{},
+		map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{svc.OID(): exposedBy(old)},
+	)
+	check(h)
+
+	// pruning folds the expired events into the edges the history starts from
+	h.opts.Retention = 3*time.Minute + 30*time.Second
+	clock.t = start.Add(5 * time.Minute)
+	if err := h.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	since, err := h.Since()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedSince := start.Add(90 * time.Second); !since.Equal(expectedSince) {
+		t.Errorf("expected the history to start at %s, got %s", expectedSince, since)
+	}
+	if _, err := h.GraphAt(start.Add(time.Minute)); err == nil {
+		t.Error("expected no graph before the retention")
+	}
+	expected[0], expected[1] = nil, nil
+	for i, conns := range expected[2:] {
+		at := start.Add(time.Duration(i+2)*time.Minute + time.Second)
+		past, err := h.GraphAt(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := connectionsOf(past); !reflect.DeepEqual(got, conns) {
+			t.Errorf("expected the pruned graph as of %s to be %v, got %v", at, conns, got)
+		}
+	}
+}
+
+func TestHistoryGraphQL(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "history", Name: "web"}
+	old := apiv1.ObjectID{Kind: "Pod", Namespace: "history", Name: "web-old"}
+	cur := apiv1.ObjectID{Kind: "Pod", Namespace: "history", Name: "web-new"}
+
+	start := time.Now().Add(time.Hour).UTC()
+	clock := &testClock{t: start}
+	h := openTestHistory(t, filepath.Join(t.TempDir(), "history.db"), 0, clock)
+	defer h.Close()
+	EnableHistory(h)
+	defer EnableHistory(nil)
+	objGraph.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(old.OID())})
+	defer objGraph.Update(svc.OID(), nil)
+	clock.t = start.Add(time.Minute)
+	objGraph.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(cur.OID())})
+
+	// the nested fields of a find query with at read the past graph
+	query := `query($at: DateTime) {
+  past: find(oid: "` + string(svc.OID()) + `", at: $at) { exposed_by { name exposed_by { name } } }
+  now: find(oid: "` + string(svc.OID()) + `") { exposed_by { name } }
+}`
+	snap := objGraph.Snapshot()
+	defer snap.Release()
+	result := graphql.Do(graphql.Params{
+		Schema:         *CurrentSchema(),
+		RequestString:  query,
+		VariableValues: map[string]interface{}{"at": start.Add(time.Second).Format(time.RFC3339Nano)},
+		Context:        WithSnapshot(context.TODO(), snap),
+	})
+	if result.HasErrors() {
+		t.Fatal(result.Errors)
+	}
+	data, _ := json.Marshal(result.Data)
+	if expected := `{"now":{"exposed_by":[{"name":"web-new"}]},"past":{"exposed_by":[{"exposed_by":[{"name":"web"}],"name":"web-old"}]}}`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+
+	result = graphql.Do(graphql.Params{
+		Schema:        *CurrentSchema(),
+		RequestString: `{ find(oid: "` + string(svc.OID()) + `", at: "2000-01-01T00:00:00Z") { name } }`,
+		Context:       WithSnapshot(context.TODO(), snap),
+	})
+	if !result.HasErrors() {
+		t.Error("expected an error before the history started")
+	}
+}
+
+// TestHistoryCheckpoints checks that the graph replayed from the checkpoints matches the graph
+// replayed from the whole log, across a reset of the graph and a prune.
+func TestHistoryCheckpoints(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+	pods := make([]apiv1.ObjectID, 6)
+	for i := range pods {
+		pods[i] = apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("web-%d", i)}
+	}
+	exposedBy := func(pods ...apiv1.ObjectID) map[apiv1.EdgeLabel]ksets.OID {
+		oids := ksets.NewOID()
+		for _, pod := range pods {
+			oids.Insert(pod.OID())
+		}
+		return map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: oids}
+	}
+
+	start := time.Now().Add(time.Hour)
+	clock := &testClock{t: start}
+	h := openTestHistory(t, filepath.Join(t.TempDir(), "history.db"), 0, clock)
+	defer h.Close()
+	h.checkpointEvents = 3
+
+	// minute i has the edges of expected[i]
+	var expected []map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID
+	g := NewObjectGraph()
+	g.SetHistory(h)
+	for i := range pods {
+		clock.t = start.Add(time.Duration(i) * time.Minute)
+		g.Update(svc.OID(), exposedBy(pods[i/2*2:i+1]...))
+		expected = append(expected, map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{svc.OID(): exposedBy(pods[i/2*2 : i+1]...)})
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a restart resets the graph
+	clock.t = start.Add(6 * time.Minute)
+	g = NewObjectGraph()
+	g.SetHistory(h)
+	expected = append(expected, map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{})
+	clock.t = start.Add(7 * time.Minute)
+	g.Update(svc.OID(), exposedBy(pods[0]))
+	expected = append(expected, map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{svc.OID(): exposedBy(pods[0])})
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(from int) {
+		t.Helper()
+		for i := from; i < len(expected); i++ {
+			at := start.Add(time.Duration(i)*time.Minute + time.Second)
+			past, err := h.GraphAt(at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := connectionsOf(past); !reflect.DeepEqual(got, expected[i]) {
+				t.Errorf("expected the graph as of %s to be %v, got %v", at, expected[i], got)
+			}
+
+			err = h.db.View(func(tx *bolt.Tx) error {
+				_, replayed, err := replay(tx, lastSequence(tx, at))
+				// a flush may write a few events past the checkpoint threshold
+				if err == nil && replayed > 2*int(h.checkpointEvents) {
+					t.Errorf("expected at most %d events replayed as of %s, got %d", h.checkpointEvents, at, replayed)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkpoints := func() int {
+		n := 0
+		_ = h.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(checkpointsBucket).ForEach(func(_, _ []byte) error {
+				n++
+				return nil
+			})
+		})
+		return n
+	}
+	if n := checkpoints(); n < 2 {
+		t.Fatalf("expected checkpoints, got %d", n)
+	}
+	check(0)
+
+	// pruning drops the checkpoints older than the horizon
+	before := checkpoints()
+	h.opts.Retention = 3*time.Minute + 30*time.Second
+	clock.t = start.Add(7*time.Minute + 30*time.Second)
+	if err := h.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if n := checkpoints(); n >= before {
+		t.Errorf("expected fewer than %d checkpoints after the prune, got %d", before, n)
+	}
+	check(4)
+}
+
+// TestHistoryLost checks that the events are dropped and counted once too many are pending
+// because the store can't be written, and that the graph can't be reconstructed as of the time
+// the events were dropped in, until the current edges are written again.
+func TestHistoryLost(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+	pods := make([]apiv1.ObjectID, 3)
+	for i := range pods {
+		pods[i] = apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("web-%d", i)}
+	}
+	exposedBy := func(pod apiv1.ObjectID) map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID {
+		return map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{
+			svc.OID(): {apiv1.EdgeExposedBy: ksets.NewOID(pod.OID())},
+		}
+	}
+	dropped := func() float64 {
+		var m dto.Metric
+		if err := droppedHistoryEvents.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	path := filepath.Join(t.TempDir(), "history.db")
+	start := time.Now().Add(time.Hour)
+	clock := &testClock{t: start}
+	h := openTestHistory(t, path, 0, clock)
+	h.maxPending = 3
+	g := NewObjectGraph()
+	g.SetHistory(h)
+	clock.t = start.Add(time.Minute)
+	g.Update(svc.OID(), exposedBy(pods[0])[svc.OID()])
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store fails while the edges change
+	if err := h.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := dropped()
+	clock.t = start.Add(2 * time.Minute)
+	g.Update(svc.OID(), exposedBy(pods[1])[svc.OID()])
+	if err := h.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	clock.t = start.Add(3 * time.Minute)
+	g.Update(svc.OID(), exposedBy(pods[2])[svc.OID()])
+	if n := dropped() - before; n != 4 {
+		t.Errorf("expected 4 dropped events, got %v", n)
+	}
+	if len(h.pending) != 0 || !h.lost {
+		t.Errorf("expected the history to be lost, got %d pending events", len(h.pending))
+	}
+
+	// the current edges are written once the store recovers
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.db = db
+	clock.t = start.Add(4 * time.Minute)
+	check := func(h *History) {
+		t.Helper()
+		// the events at 2m and 3m were dropped
+		for i, expected := range []map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{
+			0: {},
+			1: exposedBy(pods[0]),
+			4: exposedBy(pods[2]),
+		} {
+			at := start.Add(time.Duration(i)*time.Minute + time.Second)
+			past, err := h.GraphAt(at)
+			if expected == nil {
+				if err == nil {
+					t.Errorf("expected no graph as of %s", at)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := connectionsOf(past); !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected the graph as of %s to be %v, got %v", at, expected, got)
+			}
+		}
+	}
+	check(h)
+	if h.lost {
+		t.Error("expected the history to be recorded again")
+	}
+
+	// the gap is kept across restarts
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h = openTestHistory(t, path, 0, clock)
+	defer h.Close()
+	check(h)
+}
+
+// TestHistoryClockStep checks that a wall clock stepping back doesn't reorder the log.
+func TestHistoryClockStep(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+	pods := make([]apiv1.ObjectID, 3)
+	for i := range pods {
+		pods[i] = apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: fmt.Sprintf("web-%d", i)}
+	}
+	exposedBy := func(pod apiv1.ObjectID) map[apiv1.EdgeLabel]ksets.OID {
+		return map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(pod.OID())}
+	}
+
+	start := time.Now().Add(time.Hour)
+	clock := &testClock{t: start}
+	h := openTestHistory(t, filepath.Join(t.TempDir(), "history.db"), 0, clock)
+	defer h.Close()
+	h.checkpointEvents = 1
+	g := NewObjectGraph()
+	g.SetHistory(h)
+	for i, d := range []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute} {
+		clock.t = start.Add(d)
+		g.Update(svc.OID(), exposedBy(pods[i]))
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for at, expected := range map[time.Duration]apiv1.ObjectID{
+		// the last event happened after the one at 3m, so it isn't part of the graph before
+		2*time.Minute + 30*time.Second: pods[0],
+		3*time.Minute + 30*time.Second: pods[2],
+	} {
+		past, err := h.GraphAt(start.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, x := connectionsOf(past), map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{svc.OID(): exposedBy(expected)}; !reflect.DeepEqual(got, x) {
+			t.Errorf("expected the graph as of %s to be %v, got %v", at, x, got)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// ImpactLevel describes what happens to a dependent when the object it depends on is deleted.
+type ImpactLevel string
+
+const (
+	// ImpactOwned dependents are owned by the deleted object and will be garbage collected.
+	ImpactOwned ImpactLevel = "Owned"
+	// ImpactReferenced dependents reference the deleted object by name and will break.
+	ImpactReferenced ImpactLevel = "Referenced"
+	// ImpactSelected dependents merely select the deleted object via a label selector.
+	ImpactSelected ImpactLevel = "Selected"
+)
+
+// higher value means more severe
+var impactSeverity = map[ImpactLevel]int{
+	ImpactSelected:   1,
+	ImpactReferenced: 2,
+	ImpactOwned:      3,
+}
+
+type Dependent struct {
+	Object apiv1.ObjectID    `json:"object"`
+	Level  ImpactLevel       `json:"level"`
+	Labels []apiv1.EdgeLabel `json:"labels"`
+	// Type of the connection that makes this object a dependent
+	Type v1alpha1.ConnectionType `json:"type"`
+	// Via is the object this dependent is connected to. This is the deleted object itself
+	// or one of its owned dependents that will be garbage collected along with it.
+	Via apiv1.ObjectID `json:"via"`
+}
+
+type Impact struct {
+	Object     apiv1.ObjectID `json:"object"`
+	Owned      []Dependent    `json:"owned"`
+	Referenced []Dependent    `json:"referenced"`
+	Selected   []Dependent    `json:"selected"`
+}
+
+// ConnectionLookup returns the connections defined for resources of a GroupKind.
+type ConnectionLookup func(gk schema.GroupKind) []v1alpha1.ResourceConnection
+
+// Dependents returns the objects that will be affected if src is deleted, grouped by severity.
+func Dependents(src apiv1.ObjectID) (*Impact, error) {
+	return objGraph.dependents(src, registryConnections)
+}
+
+// Dependents returns the objects that will be affected if src is deleted, grouped by severity.
+func (s *Snapshot) Dependents(src apiv1.ObjectID) (*Impact, error) {
+	return s.dependents(src, registryConnections)
+}
+
+func registryConnections(gk schema.GroupKind) []v1alpha1.ResourceConnection {
+	rid, err := Registry.ResourceIDForGVK(gk.WithVersion(""))
+	if err != nil || rid == nil {
+		return nil
+	}
+	rd, err := Registry.LoadByGVK(rid.GroupVersionKind())
+	if err != nil {
+		return nil
+	}
+	return rd.Spec.Connections
+}
+
+func (g *ObjectGraph) dependents(src apiv1.ObjectID, lookup ConnectionLookup) (*Impact, error) {
+	s := g.Snapshot()
+	defer s.Release()
+	return s.dependents(src, lookup)
+}
+
+// dependents follows the edges of the graph backwards starting from src.
+// An object y is a dependent of x if
+//   - y is OwnedBy x,
+//   - y refers to x via MatchRef or MatchName,
+//   - y selects x via MatchSelector,
+//   - x selects y via MatchSelector with Owner or Controller level, ie, y is owned by x.
+//
+// Owned dependents are garbage collected with x, so their dependents are included too.
+func (s *Snapshot) dependents(src apiv1.ObjectID, lookup ConnectionLookup) (*Impact, error) {
+	result := map[nodeID]*Dependent{}
+	record := func(x nodeID, via *apiv1.ObjectID, lbl apiv1.EdgeLabel, c *v1alpha1.ResourceConnection, level ImpactLevel) error {
+		d, ok := result[x]
+		if !ok {
+			o := s.object(x)
+			if o.err != nil {
+				return o.err
+			}
+			d = &Dependent{Object: o.id, Level: level, Via: *via}
+			if c != nil {
+				d.Type = c.Type
+			}
+			result[x] = d
+		} else if impactSeverity[level] > impactSeverity[d.Level] {
+			d.Level = level
+			d.Via = *via
+			if c != nil {
+				d.Type = c.Type
+			}
+		}
+		if !containsLabel(d.Labels, lbl) {
+			d.Labels = append(d.Labels, lbl)
+		}
+		return nil
+	}
+
+	var idsToProcess []nodeID
+	srcID, ok := s.lookup(src.OID())
+	if ok {
+		idsToProcess = append(idsToProcess, srcID)
+	}
+	processed := map[nodeID]bool{srcID: ok}
+	var x nodeID
+	for len(idsToProcess) > 0 {
+		x, idsToProcess = idsToProcess[0], idsToProcess[1:]
+		xObj := s.object(x)
+		if xObj.err != nil {
+			return nil, xObj.err
+		}
+		xID := &xObj.id
+
+		// incoming edges: y -> x
+		for _, e := range s.edges(x) {
+			lbl := e.label
+			for _, y := range e.nodes {
+				if y == srcID || !s.conns(y).has(lbl, x) {
+					continue
+				}
+				yObj := s.object(y)
+				if yObj.err != nil {
+					return nil, yObj.err
+				}
+				c := findConnection(lookup(yObj.groupKind()), xObj.groupKind(), lbl)
+				level := ImpactReferenced
+				if c != nil {
+					switch c.Type {
+					case v1alpha1.OwnedBy:
+						level = ImpactOwned
+					case v1alpha1.MatchSelector:
+						level = ImpactSelected
+					}
+				}
+				if err := record(y, xID, lbl, c, level); err != nil {
+					return nil, err
+				}
+				if level == ImpactOwned && !processed[y] {
+					processed[y] = true
+					idsToProcess = append(idsToProcess, y)
+				}
+			}
+		}
+
+		// outgoing edges: x -> z, where z is controlled by x
+		for _, e := range s.conns(x) {
+			lbl := e.label
+			for _, z := range e.nodes {
+				if z == srcID {
+					continue
+				}
+				zObj := s.object(z)
+				if zObj.err != nil {
+					return nil, zObj.err
+				}
+				c := findConnection(lookup(xObj.groupKind()), zObj.groupKind(), lbl)
+				if c == nil || c.Type != v1alpha1.MatchSelector ||
+					(c.Level != v1alpha1.Owner && c.Level != v1alpha1.Controller) {
+					continue
+				}
+				if err := record(z, xID, lbl, c, ImpactOwned); err != nil {
+					return nil, err
+				}
+				if !processed[z] {
+					processed[z] = true
+					idsToProcess = append(idsToProcess, z)
+				}
+			}
+		}
+	}
+
+	out := Impact{
+		Object:     src,
+		Owned:      []Dependent{},
+		Referenced: []Dependent{},
+		Selected:   []Dependent{},
+	}
+	for _, d := range result {
+		sort.Slice(d.Labels, func(i, j int) bool { return d.Labels[i] < d.Labels[j] })
+		switch d.Level {
+		case ImpactOwned:
+			out.Owned = append(out.Owned, *d)
+		case ImpactReferenced:
+			out.Referenced = append(out.Referenced, *d)
+		case ImpactSelected:
+			out.Selected = append(out.Selected, *d)
+		}
+	}
+	for _, deps := range [][]Dependent{out.Owned, out.Referenced, out.Selected} {
+		sort.Slice(deps, func(i, j int) bool {
+			return deps[i].Object.OID() < deps[j].Object.OID()
+		})
+	}
+	return &out, nil
+}
+
+// findConnection returns the connection to the dst GroupKind that produces edges with the given label.
+func findConnection(connections []v1alpha1.ResourceConnection, dst schema.GroupKind, lbl apiv1.EdgeLabel) *v1alpha1.ResourceConnection {
+	for i, c := range connections {
+		if c.Target.GroupVersionKind().GroupKind() == dst && containsLabel(c.Labels, lbl) {
+			return &connections[i]
+		}
+	}
+	return nil
+}
+
+func containsLabel(arr []apiv1.EdgeLabel, item apiv1.EdgeLabel) bool {
+	for _, v := range arr {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
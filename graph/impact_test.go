@@ -0,0 +1,163 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ksets "kmodules.xyz/sets"
+)
+
+func newTestConnection(apiVersion, kind string, t v1alpha1.ConnectionType, level v1alpha1.OwnershipLevel, labels ...apiv1.EdgeLabel) v1alpha1.ResourceConnection {
+	return v1alpha1.ResourceConnection{
+		Target: metav1.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		Labels: labels,
+		ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+			Type:  t,
+			Level: level,
+		},
+	}
+}
+
+func TestDependents(t *testing.T) {
+	var (
+		deploy  = apiv1.ObjectID{Group: "apps", Kind: "Deployment", Namespace: "demo", Name: "web"}
+		rs      = apiv1.ObjectID{Group: "apps", Kind: "ReplicaSet", Namespace: "demo", Name: "web-1"}
+		pod     = apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-1-x"}
+		secret  = apiv1.ObjectID{Kind: "Secret", Namespace: "demo", Name: "web-auth"}
+		svc     = apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+		ingress = apiv1.ObjectID{Group: "networking.k8s.io", Kind: "Ingress", Namespace: "demo", Name: "web"}
+		other   = apiv1.ObjectID{Kind: "ConfigMap", Namespace: "demo", Name: "unused"}
+	)
+
+	connections := map[schema.GroupKind][]v1alpha1.ResourceConnection{
+		rs.GroupKind(): {
+			newTestConnection("v1", "Pod", v1alpha1.MatchSelector, v1alpha1.Controller, apiv1.EdgeOffshoot),
+			newTestConnection("apps/v1", "Deployment", v1alpha1.OwnedBy, v1alpha1.Controller, apiv1.EdgeOffshoot),
+		},
+		pod.GroupKind(): {
+			newTestConnection("v1", "Secret", v1alpha1.MatchRef, v1alpha1.Reference, apiv1.EdgeOffshoot),
+		},
+		svc.GroupKind(): {
+			newTestConnection("v1", "Pod", v1alpha1.MatchSelector, v1alpha1.Reference, apiv1.EdgeExposedBy),
+		},
+		ingress.GroupKind(): {
+			newTestConnection("v1", "Service", v1alpha1.MatchRef, v1alpha1.Reference, apiv1.EdgeExposedBy),
+		},
+	}
+	lookup := func(gk schema.GroupKind) []v1alpha1.ResourceConnection {
+		return connections[gk]
+	}
+
+	g := NewObjectGraph()
+	g.Update(rs.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeOffshoot: ksets.NewOID(deploy.OID(), pod.OID()),
+	})
+	g.Update(pod.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeOffshoot: ksets.NewOID(secret.OID()),
+	})
+	g.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeExposedBy: ksets.NewOID(pod.OID()),
+	})
+	g.Update(ingress.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeExposedBy: ksets.NewOID(svc.OID()),
+	})
+
+	type dep struct {
+		oid apiv1.OID
+		via apiv1.OID
+	}
+	summarize := func(deps []Dependent) []dep {
+		out := make([]dep, 0, len(deps))
+		for _, d := range deps {
+			out = append(out, dep{oid: d.Object.OID(), via: d.Via.OID()})
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		src        apiv1.ObjectID
+		owned      []dep
+		referenced []dep
+		selected   []dep
+	}{
+		{
+			name:       "secret referenced by pod",
+			src:        secret,
+			owned:      []dep{},
+			referenced: []dep{{oid: pod.OID(), via: secret.OID()}},
+			selected:   []dep{},
+		},
+		{
+			name: "deployment cascades to pods",
+			src:  deploy,
+			owned: []dep{
+				{oid: pod.OID(), via: rs.OID()},
+				{oid: rs.OID(), via: deploy.OID()},
+			},
+			referenced: []dep{},
+			selected:   []dep{{oid: svc.OID(), via: pod.OID()}},
+		},
+		{
+			name:       "service exposed by ingress",
+			src:        svc,
+			owned:      []dep{},
+			referenced: []dep{{oid: ingress.OID(), via: svc.OID()}},
+			selected:   []dep{},
+		},
+		{
+			name:       "pod selected by controller and service",
+			src:        pod,
+			owned:      []dep{},
+			referenced: []dep{},
+			selected: []dep{
+				{oid: svc.OID(), via: pod.OID()},
+				{oid: rs.OID(), via: pod.OID()},
+			},
+		},
+		{
+			name:       "object without dependents",
+			src:        other,
+			owned:      []dep{},
+			referenced: []dep{},
+			selected:   []dep{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			impact, err := g.dependents(test.src, lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := summarize(impact.Owned); !reflect.DeepEqual(got, test.owned) {
+				t.Errorf("owned: expected %v, got %v", test.owned, got)
+			}
+			if got := summarize(impact.Referenced); !reflect.DeepEqual(got, test.referenced) {
+				t.Errorf("referenced: expected %v, got %v", test.referenced, got)
+			}
+			if got := summarize(impact.Selected); !reflect.DeepEqual(got, test.selected) {
+				t.Errorf("selected: expected %v, got %v", test.selected, got)
+			}
+		})
+	}
+}
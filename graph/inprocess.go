@@ -0,0 +1,62 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"sort"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// ListObjects lists the objects of every type in the Registry served by the cluster.
+// Types that can't be listed are skipped. The result can be passed to BuildGraph to
+// compute the graph in process, without the watcher service.
+func (finder ObjectFinder) ListObjects() ([]*unstructured.Unstructured, error) {
+	var rds []*v1alpha1.ResourceDescriptor
+	Registry.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		if !gkSet.Has(rd.Spec.Resource.GroupVersionKind().GroupKind()) {
+			rds = append(rds, rd)
+		}
+	})
+	sort.Slice(rds, func(i, j int) bool { return rds[i].Name < rds[j].Name })
+
+	var out []*unstructured.Unstructured
+	for _, rd := range rds {
+		var list unstructured.UnstructuredList
+		list.SetGroupVersionKind(rd.Spec.Resource.GroupVersionKind())
+		err := finder.Client.List(context.TODO(), &list)
+		if meta.IsNoMatchError(err) || kerr.IsNotFound(err) || kerr.IsForbidden(err) || kerr.IsMethodNotSupported(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			out = append(out, &list.Items[i])
+		}
+	}
+	return out, nil
+}
+
+// SetGraph replaces the contents of the graph queried by the GraphQL schema and
+// the renderer with the contents of g. g must not be updated afterwards.
+func SetGraph(g *ObjectGraph) {
+	objGraph.replace(g)
+}
@@ -0,0 +1,267 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+)
+
+// nodeID is the interned id of an object in the graph.
+type nodeID uint32
+
+// object is an interned object. Its oid is parsed once, when it is interned.
+type object struct {
+	oid apiv1.OID
+	id  apiv1.ObjectID
+	err error
+}
+
+func (o *object) groupKind() schema.GroupKind {
+	return schema.GroupKind{Group: o.id.Group, Kind: o.id.Kind}
+}
+
+// entry is the slot of an interned object.
+type entry struct {
+	object
+	head atomic.Value // *node, the latest published version of the object
+}
+
+func (e *entry) node() *node {
+	n, _ := e.head.Load().(*node)
+	return n
+}
+
+const entriesPerChunk = 1024
+
+type chunk [entriesPerChunk]entry
+
+// interner assigns dense ids to the objects in the graph and stores their entries. It is read
+// without locks, and written by one update of the graph at a time. The ids of the objects
+// dropped from the graph are reused once no snapshot can read them.
+type interner struct {
+	ids    sync.Map     // apiv1.OID -> nodeID
+	chunks atomic.Value // []*chunk, copied when it grows
+	next   nodeID
+	free   []nodeID
+}
+
+func (in *interner) lookup(oid apiv1.OID) (nodeID, bool) {
+	v, ok := in.ids.Load(oid)
+	if !ok {
+		return 0, false
+	}
+	return v.(nodeID), true
+}
+
+func (in *interner) intern(oid apiv1.OID) nodeID {
+	if id, ok := in.lookup(oid); ok {
+		return id
+	}
+
+	o := object{oid: oid}
+	if id, err := apiv1.ParseObjectID(oid); err != nil {
+		o.err = err
+	} else {
+		o.id = *id
+	}
+
+	var id nodeID
+	if n := len(in.free); n > 0 {
+		id, in.free = in.free[n-1], in.free[:n-1]
+	} else {
+		id = in.next
+		in.next++
+		if chunks := in.chunkList(); int(id/entriesPerChunk) >= len(chunks) {
+			in.chunks.Store(append(chunks[:len(chunks):len(chunks)], new(chunk)))
+		}
+	}
+	in.entry(id).object = o
+	in.ids.Store(oid, id)
+	return id
+}
+
+// release frees the id of an object dropped from the graph.
+func (in *interner) release(id nodeID) {
+	e := in.entry(id)
+	in.ids.Delete(e.oid)
+	e.object = object{}
+	in.free = append(in.free, id)
+}
+
+func (in *interner) chunkList() []*chunk {
+	chunks, _ := in.chunks.Load().([]*chunk)
+	return chunks
+}
+
+func (in *interner) entry(id nodeID) *entry {
+	return &in.chunkList()[id/entriesPerChunk][id%entriesPerChunk]
+}
+
+// each calls f with every entry, including the free ones.
+func (in *interner) each(f func(id nodeID, e *entry)) {
+	for i, c := range in.chunkList() {
+		for j := range c {
+			f(nodeID(i*entriesPerChunk+j), &c[j])
+		}
+	}
+}
+
+// adjacency is a compact adjacency list, the edges of a node grouped by label. Both the labels and
+// the nodes of a label are sorted. Adjacency lists are immutable, so versions of a node share them.
+type adjacency []labelEdges
+
+type labelEdges struct {
+	label apiv1.EdgeLabel
+	nodes []nodeID
+}
+
+func (a adjacency) find(lbl apiv1.EdgeLabel) (int, bool) {
+	i := sort.Search(len(a), func(i int) bool { return a[i].label >= lbl })
+	return i, i < len(a) && a[i].label == lbl
+}
+
+// get returns the nodes connected by edges with the given label.
+func (a adjacency) get(lbl apiv1.EdgeLabel) []nodeID {
+	if i, ok := a.find(lbl); ok {
+		return a[i].nodes
+	}
+	return nil
+}
+
+func (a adjacency) has(lbl apiv1.EdgeLabel, id nodeID) bool {
+	_, ok := searchNode(a.get(lbl), id)
+	return ok
+}
+
+// len returns the number of edges.
+func (a adjacency) len() int {
+	var n int
+	for _, e := range a {
+		n += len(e.nodes)
+	}
+	return n
+}
+
+func (a adjacency) equal(b adjacency) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].label != b[i].label || len(a[i].nodes) != len(b[i].nodes) {
+			return false
+		}
+		for j := range a[i].nodes {
+			if a[i].nodes[j] != b[i].nodes[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// update returns a copy of a where the edges with the given label connect to the nodes of add,
+// and not to the nodes of remove. add and remove must be sorted. a is not modified.
+func (a adjacency) update(lbl apiv1.EdgeLabel, add, remove []nodeID) adjacency {
+	i, ok := a.find(lbl)
+	var old []nodeID
+	if ok {
+		old = a[i].nodes
+	}
+
+	nodes := make([]nodeID, 0, len(old)+len(add))
+	for len(old) > 0 || len(add) > 0 {
+		var id nodeID
+		switch {
+		case len(add) == 0 || (len(old) > 0 && old[0] < add[0]):
+			id, old = old[0], old[1:]
+		case len(old) == 0 || add[0] < old[0]:
+			id, add = add[0], add[1:]
+		default:
+			id, old, add = old[0], old[1:], add[1:]
+		}
+		for len(remove) > 0 && remove[0] < id {
+			remove = remove[1:]
+		}
+		if len(remove) == 0 || remove[0] != id {
+			nodes = append(nodes, id)
+		}
+	}
+
+	out := make(adjacency, 0, len(a)+1)
+	out = append(out, a[:i]...)
+	if len(nodes) > 0 {
+		out = append(out, labelEdges{label: lbl, nodes: nodes})
+	}
+	if ok {
+		i++
+	}
+	out = append(out, a[i:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// diff returns the edges of b missing in a.
+func (a adjacency) diff(b adjacency) adjacency {
+	var out adjacency
+	for _, e := range b {
+		old := a.get(e.label)
+		var nodes []nodeID
+		for _, id := range e.nodes {
+			if _, ok := searchNode(old, id); !ok {
+				nodes = append(nodes, id)
+			}
+		}
+		if len(nodes) > 0 {
+			out = append(out, labelEdges{label: e.label, nodes: nodes})
+		}
+	}
+	return out
+}
+
+func searchNode(nodes []nodeID, id nodeID) (int, bool) {
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i] >= id })
+	return i, i < len(nodes) && nodes[i] == id
+}
+
+// toAdjacency interns the objects of connsPerLabel and returns their adjacency list.
+func (in *interner) toAdjacency(connsPerLabel map[apiv1.EdgeLabel]ksets.OID) adjacency {
+	out := make(adjacency, 0, len(connsPerLabel))
+	for lbl, conns := range connsPerLabel {
+		if conns.Len() == 0 {
+			continue
+		}
+		nodes := make([]nodeID, 0, conns.Len())
+		for oid := range conns {
+			nodes = append(nodes, in.intern(oid))
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+		out = append(out, labelEdges{label: lbl, nodes: nodes})
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].label < out[j].label })
+	return out
+}
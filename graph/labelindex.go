@@ -0,0 +1,399 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	toolscache "k8s.io/client-go/tools/cache"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LabelIndex is an in-memory inverted index from labels to objects and from the label selectors
+// of MatchSelector and MatchExpression connections to their sources. It is maintained from watch
+// events, so selector connections resolve without listing the target type in the forward direction
+// or every potential source in the backward direction.
+//
+// A type is only served by the index once its informer has synced. Until then, the finder falls
+// back to listing.
+type LabelIndex struct {
+	m         sync.RWMutex
+	kinds     map[schema.GroupKind]*kindIndex
+	selectors map[selectorKey]*selectorIndex
+
+	// connections returns the connections of a type. Defaults to the connections in the Registry.
+	connections func(gvk schema.GroupVersionKind) []v1alpha1.ResourceConnection
+}
+
+type kindIndex struct {
+	synced  bool
+	objects map[apiv1.OID]*indexedObject
+	labels  map[string]map[string]ksets.OID // label key -> value -> objects
+	store   client.Reader                   // the informer store the index is built from
+}
+
+type indexedObject struct {
+	key       client.ObjectKey
+	labels    labels.Set
+	selectors map[selectorKey]labels.Selector
+}
+
+// selectorKey identifies the label selector of a MatchSelector or MatchExpression connection.
+type selectorKey struct {
+	Source       schema.GroupKind
+	Target       schema.GroupKind
+	SelectorPath string
+	Selector     string
+}
+
+// selectorIndex indexes the sources of a selector connection by the equality requirements of their selectors.
+type selectorIndex struct {
+	byLabel map[string]map[string]ksets.OID // label key -> value -> sources requiring it
+	scan    ksets.OID                       // sources whose selectors have no equality requirement
+}
+
+func NewLabelIndex() *LabelIndex {
+	return &LabelIndex{
+		kinds:     map[schema.GroupKind]*kindIndex{},
+		selectors: map[selectorKey]*selectorIndex{},
+		connections: func(gvk schema.GroupVersionKind) []v1alpha1.ResourceConnection {
+			rd, err := Registry.LoadByGVK(gvk)
+			if err != nil {
+				return nil
+			}
+			return rd.Spec.Connections
+		},
+	}
+}
+
+func newSelectorKey(e *Edge) selectorKey {
+	src, dst := e.Src, e.Dst
+	if !e.Forward {
+		src, dst = e.Dst, e.Src
+	}
+	key := selectorKey{
+		Source:       src.GroupKind(),
+		Target:       dst.GroupKind(),
+		SelectorPath: e.Connection.SelectorPath,
+	}
+	if e.Connection.Selector != nil {
+		key.Selector = metav1.FormatLabelSelector(e.Connection.Selector)
+	}
+	return key
+}
+
+// Watch indexes the objects of the given type using the informer in the cache.
+// The type is served by the index once the informer has synced.
+func (idx *LabelIndex) Watch(ctx context.Context, c cache.Cache, gvk schema.GroupVersionKind) error {
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(gvk)
+	informer, err := c.GetInformer(ctx, &obj)
+	if err != nil {
+		return err
+	}
+	idx.m.Lock()
+	idx.kind(gvk.GroupKind()).store = c
+	idx.m.Unlock()
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				idx.Set(gvk, u)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				idx.Set(gvk, u)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if d, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				idx.Delete(gvk, apiv1.NewObjectID(u).OID())
+			}
+		},
+	})
+	go func() {
+		if toolscache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			idx.MarkSynced(gvk.GroupKind())
+		}
+	}()
+	return nil
+}
+
+func (idx *LabelIndex) kind(gk schema.GroupKind) *kindIndex {
+	ki, ok := idx.kinds[gk]
+	if !ok {
+		ki = &kindIndex{
+			objects: map[apiv1.OID]*indexedObject{},
+			labels:  map[string]map[string]ksets.OID{},
+		}
+		idx.kinds[gk] = ki
+	}
+	return ki
+}
+
+// MarkSynced marks the index of the given type complete.
+func (idx *LabelIndex) MarkSynced(gk schema.GroupKind) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.kind(gk).synced = true
+}
+
+// Synced returns true if the index of the given type is complete.
+func (idx *LabelIndex) Synced(gk schema.GroupKind) bool {
+	if idx == nil {
+		return false
+	}
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+	ki, ok := idx.kinds[gk]
+	return ok && ki.synced
+}
+
+// store returns the reader of the informer store the index of the given type is built from, nil if
+// the index is not built from an informer.
+func (idx *LabelIndex) store(gk schema.GroupKind) client.Reader {
+	if idx == nil {
+		return nil
+	}
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+	if ki, ok := idx.kinds[gk]; ok {
+		return ki.store
+	}
+	return nil
+}
+
+// Set indexes the labels of obj and the selectors of its MatchSelector and MatchExpression connections.
+func (idx *LabelIndex) Set(gvk schema.GroupVersionKind, obj *unstructured.Unstructured) {
+	oid := apiv1.NewObjectID(obj).OID()
+	entry := &indexedObject{
+		key:       client.ObjectKeyFromObject(obj),
+		labels:    labels.Set(obj.GetLabels()),
+		selectors: map[selectorKey]labels.Selector{},
+	}
+	for _, c := range idx.connections(gvk) {
+		if c.Type != v1alpha1.MatchSelector && (c.Type != MatchExpression || c.Selector == nil) {
+			continue
+		}
+		e := &Edge{
+			Src:        gvk,
+			Dst:        c.Target.GroupVersionKind(),
+			Connection: c.ResourceConnectionSpec,
+			Forward:    true,
+		}
+		if sel, err := connectionSelector(obj, e); err == nil {
+			entry.selectors[newSelectorKey(e)] = sel
+		}
+	}
+
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.remove(gvk.GroupKind(), oid)
+
+	ki := idx.kind(gvk.GroupKind())
+	ki.objects[oid] = entry
+	for k, v := range entry.labels {
+		insertLabel(ki.labels, k, v, oid)
+	}
+	for key, sel := range entry.selectors {
+		si, ok := idx.selectors[key]
+		if !ok {
+			si = &selectorIndex{
+				byLabel: map[string]map[string]ksets.OID{},
+				scan:    ksets.NewOID(),
+			}
+			idx.selectors[key] = si
+		}
+		reqs, _ := sel.Requirements()
+		if k, values, ok := equalityRequirement(reqs); ok {
+			for _, v := range values {
+				insertLabel(si.byLabel, k, v, oid)
+			}
+		} else {
+			si.scan.Insert(oid)
+		}
+	}
+}
+
+// Delete removes the object from the index.
+func (idx *LabelIndex) Delete(gvk schema.GroupVersionKind, oid apiv1.OID) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	idx.remove(gvk.GroupKind(), oid)
+}
+
+func (idx *LabelIndex) remove(gk schema.GroupKind, oid apiv1.OID) {
+	ki, ok := idx.kinds[gk]
+	if !ok {
+		return
+	}
+	entry, ok := ki.objects[oid]
+	if !ok {
+		return
+	}
+	delete(ki.objects, oid)
+	for k, v := range entry.labels {
+		deleteLabel(ki.labels, k, v, oid)
+	}
+	for key, sel := range entry.selectors {
+		si, ok := idx.selectors[key]
+		if !ok {
+			continue
+		}
+		reqs, _ := sel.Requirements()
+		if k, values, ok := equalityRequirement(reqs); ok {
+			for _, v := range values {
+				deleteLabel(si.byLabel, k, v, oid)
+			}
+		} else {
+			si.scan.Delete(oid)
+		}
+	}
+}
+
+// Select returns the keys of the objects of the given type matching the selector in the given
+// namespaces. nil namespaces means all namespaces.
+func (idx *LabelIndex) Select(gk schema.GroupKind, selector labels.Selector, namespaces []string) []client.ObjectKey {
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+
+	ki, ok := idx.kinds[gk]
+	if !ok {
+		return nil
+	}
+
+	var candidates ksets.OID
+	reqs, _ := selector.Requirements()
+	for _, r := range reqs {
+		if !isEquality(r.Operator()) {
+			continue
+		}
+		matched := ksets.NewOID()
+		for v := range r.Values() {
+			matched = matched.Union(ki.labels[r.Key()][v])
+		}
+		if candidates == nil || matched.Len() < candidates.Len() {
+			candidates = matched
+		}
+	}
+
+	var out []client.ObjectKey
+	visit := func(entry *indexedObject) {
+		if namespaceAllowed(namespaces, entry.key.Namespace) && selector.Matches(entry.labels) {
+			out = append(out, entry.key)
+		}
+	}
+	if candidates == nil {
+		for _, entry := range ki.objects {
+			visit(entry)
+		}
+	} else {
+		for oid := range candidates {
+			visit(ki.objects[oid])
+		}
+	}
+	return out
+}
+
+// Selecting returns the keys of the sources of the MatchSelector or MatchExpression edge whose
+// selectors match the labels.
+// The edge may be in either direction.
+func (idx *LabelIndex) Selecting(e *Edge, lbls labels.Set) []client.ObjectKey {
+	key := newSelectorKey(e)
+
+	idx.m.RLock()
+	defer idx.m.RUnlock()
+
+	ki, ok := idx.kinds[key.Source]
+	if !ok {
+		return nil
+	}
+	si, ok := idx.selectors[key]
+	if !ok {
+		return nil
+	}
+
+	candidates := ksets.NewOID().Union(si.scan)
+	for k, v := range lbls {
+		candidates = candidates.Union(si.byLabel[k][v])
+	}
+
+	var out []client.ObjectKey
+	for oid := range candidates {
+		entry := ki.objects[oid]
+		if sel, ok := entry.selectors[key]; ok && sel.Matches(lbls) {
+			out = append(out, entry.key)
+		}
+	}
+	return out
+}
+
+// equalityRequirement returns the first requirement of the selector that can only be satisfied
+// by one of the returned label values.
+func equalityRequirement(reqs labels.Requirements) (string, []string, bool) {
+	for _, r := range reqs {
+		if isEquality(r.Operator()) {
+			return r.Key(), r.Values().List(), true
+		}
+	}
+	return "", nil, false
+}
+
+func isEquality(op selection.Operator) bool {
+	return op == selection.Equals || op == selection.DoubleEquals || op == selection.In
+}
+
+func insertLabel(m map[string]map[string]ksets.OID, k, v string, oid apiv1.OID) {
+	values, ok := m[k]
+	if !ok {
+		values = map[string]ksets.OID{}
+		m[k] = values
+	}
+	if _, ok := values[v]; !ok {
+		values[v] = ksets.NewOID()
+	}
+	values[v].Insert(oid)
+}
+
+func deleteLabel(m map[string]map[string]ksets.OID, k, v string, oid apiv1.OID) {
+	values, ok := m[k]
+	if !ok {
+		return
+	}
+	if oids, ok := values[v]; ok {
+		oids.Delete(oid)
+		if oids.Len() == 0 {
+			delete(values, v)
+		}
+	}
+	if len(values) == 0 {
+		delete(m, k)
+	}
+}
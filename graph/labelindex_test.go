@@ -0,0 +1,276 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func keyNames(keys []client.ObjectKey) []string {
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, k.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestLabelIndexSelect(t *testing.T) {
+	idx := NewLabelIndex()
+	idx.connections = func(gvk schema.GroupVersionKind) []v1alpha1.ResourceConnection { return nil }
+
+	idx.Set(targetGVK, newTestObject(targetGVK, "a", "web", map[string]string{"app": "web", "tier": "frontend"}))
+	idx.Set(targetGVK, newTestObject(targetGVK, "b", "web", map[string]string{"app": "web"}))
+	idx.Set(targetGVK, newTestObject(targetGVK, "a", "db", map[string]string{"app": "db", "tier": "backend"}))
+	idx.Set(targetGVK, newTestObject(targetGVK, "a", "none", nil))
+
+	tests := []struct {
+		selector   string
+		namespaces []string
+		expected   []string
+	}{
+		{selector: "app=web", expected: []string{"a/web", "b/web"}},
+		{selector: "app=web", namespaces: []string{"b"}, expected: []string{"b/web"}},
+		{selector: "app in (web,db)", expected: []string{"a/db", "a/web", "b/web"}},
+		{selector: "app=web,tier", expected: []string{"a/web"}},
+		{selector: "tier", expected: []string{"a/db", "a/web"}},
+		{selector: "app,tier notin (backend)", expected: []string{"a/web", "b/web"}},
+		{selector: "!app", expected: []string{"a/none"}},
+		{selector: "app=cache", expected: []string{}},
+		{selector: "app=web", namespaces: []string{}, expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%v", test.selector, test.namespaces), func(t *testing.T) {
+			sel, err := labels.Parse(test.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := keyNames(idx.Select(targetGVK.GroupKind(), sel, test.namespaces))
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+
+	// relabel and delete
+	idx.Set(targetGVK, newTestObject(targetGVK, "b", "web", map[string]string{"app": "db"}))
+	idx.Delete(targetGVK, apiv1.NewObjectID(newTestObject(targetGVK, "a", "db", nil)).OID())
+	sel := labels.SelectorFromSet(labels.Set{"app": "db"})
+	if got, expected := keyNames(idx.Select(targetGVK.GroupKind(), sel, nil)), []string{"b/web"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, found := idx.kinds[targetGVK.GroupKind()].labels["tier"]["backend"]; found {
+		t.Error("expected deleted object to be removed from the label index")
+	}
+}
+
+func TestLabelIndexSelecting(t *testing.T) {
+	conn := v1alpha1.ResourceConnection{
+		Target: metav1.TypeMeta{APIVersion: targetGVK.GroupVersion().String(), Kind: targetGVK.Kind},
+		ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{
+			Type:         v1alpha1.MatchSelector,
+			SelectorPath: "spec.selector",
+		},
+	}
+	idx := NewLabelIndex()
+	idx.connections = func(gvk schema.GroupVersionKind) []v1alpha1.ResourceConnection {
+		if gvk == sourceGVK {
+			return []v1alpha1.ResourceConnection{conn}
+		}
+		return nil
+	}
+
+	newSource := func(name string, selector map[string]interface{}) *unstructured.Unstructured {
+		obj := newTestObject(sourceGVK, "a", name, nil)
+		if selector != nil {
+			_ = unstructured.SetNestedMap(obj.Object, selector, "spec", "selector")
+		}
+		return obj
+	}
+	idx.Set(sourceGVK, newSource("web", map[string]interface{}{"app": "web"}))
+	idx.Set(sourceGVK, newSource("any-app", map[string]interface{}{
+		"matchExpressions": []interface{}{
+			map[string]interface{}{"key": "app", "operator": "Exists"},
+		},
+	}))
+	idx.Set(sourceGVK, newSource("db", map[string]interface{}{"app": "db", "tier": "backend"}))
+	idx.Set(sourceGVK, newSource("none", nil))
+
+	e := &Edge{Src: targetGVK, Dst: sourceGVK, Connection: conn.ResourceConnectionSpec}
+	tests := []struct {
+		labels   labels.Set
+		expected []string
+	}{
+		{labels: labels.Set{"app": "web"}, expected: []string{"a/any-app", "a/web"}},
+		{labels: labels.Set{"app": "db"}, expected: []string{"a/any-app"}},
+		{labels: labels.Set{"app": "db", "tier": "backend"}, expected: []string{"a/any-app", "a/db"}},
+		{labels: labels.Set{"tier": "backend"}, expected: []string{}},
+	}
+	for _, test := range tests {
+		got := keyNames(idx.Selecting(e, test.labels))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.labels, test.expected, got)
+		}
+	}
+
+	// change the selector of a source
+	idx.Set(sourceGVK, newSource("web", map[string]interface{}{"app": "cache"}))
+	if got, expected := keyNames(idx.Selecting(e, labels.Set{"app": "web"})), []string{"a/any-app"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// listCounter counts the List and Get calls per type.
+type listCounter struct {
+	client.Client
+	lists map[schema.GroupKind]int
+	gets  map[schema.GroupKind]int
+}
+
+func (c *listCounter) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if c.gets != nil {
+		c.gets[obj.GetObjectKind().GroupVersionKind().GroupKind()]++
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *listCounter) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if u, ok := list.(*unstructured.UnstructuredList); ok {
+		c.lists[u.GroupVersionKind().GroupKind()]++
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+// TestResourcesForLabelIndex checks that selector connections resolved via a synced index
+// find the same objects as listing, without listing the indexed types. Indexes built from an
+// informer read the selected objects from its store instead of the client.
+func TestResourcesForLabelIndex(t *testing.T) {
+	kc := newConnectionTestClient()
+	specs := map[string]v1alpha1.ResourceConnectionSpec{
+		"path": {
+			Type:         v1alpha1.MatchSelector,
+			SelectorPath: "spec.selector",
+		},
+		"template": {
+			Type: v1alpha1.MatchSelector,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "web"},
+			},
+		},
+		"expression": {
+			Type:       MatchExpression,
+			References: []string{"target.metadata.labels.app == source.spec.selector.app"},
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "web"},
+			},
+		},
+	}
+
+	for specName, spec := range specs {
+		for _, src := range []schema.GroupVersionKind{sourceGVK, clusterSourceGVK} {
+			for _, dst := range []schema.GroupVersionKind{targetGVK, clusterTargetGVK} {
+				for _, nsPath := range []string{"", MetadataNamespace, "spec.namespaceSelector"} {
+					spec.NamespacePath = nsPath
+					t.Run(fmt.Sprintf("%s/%s->%s/%s", specName, src.Kind, dst.Kind, nsPath), func(t *testing.T) {
+						conn := v1alpha1.ResourceConnection{
+							Target:                 metav1.TypeMeta{APIVersion: dst.GroupVersion().String(), Kind: dst.Kind},
+							ResourceConnectionSpec: spec,
+						}
+						idx := NewLabelIndex()
+						idx.connections = func(gvk schema.GroupVersionKind) []v1alpha1.ResourceConnection {
+							if gvk == src {
+								return []v1alpha1.ResourceConnection{conn}
+							}
+							return nil
+						}
+						objects := map[schema.GroupVersionKind][]unstructured.Unstructured{}
+						for _, gvk := range []schema.GroupVersionKind{src, dst} {
+							var list unstructured.UnstructuredList
+							list.SetGroupVersionKind(gvk)
+							if err := kc.List(context.TODO(), &list); err != nil {
+								t.Fatal(err)
+							}
+							for i := range list.Items {
+								idx.Set(gvk, &list.Items[i])
+							}
+							idx.MarkSynced(gvk.GroupKind())
+							objects[gvk] = list.Items
+						}
+
+						listed := ObjectFinder{Client: kc}
+						for _, fromStore := range []bool{false, true} {
+							if fromStore {
+								for _, gvk := range []schema.GroupVersionKind{src, dst} {
+									idx.kinds[gvk.GroupKind()].store = kc
+								}
+							}
+							counter := &listCounter{Client: kc, lists: map[schema.GroupKind]int{}, gets: map[schema.GroupKind]int{}}
+							indexed := ObjectFinder{Client: counter, Index: idx}
+
+							for _, e := range []*Edge{
+								{Src: src, Dst: dst, Connection: spec, Forward: true},
+								{Src: dst, Dst: src, Connection: spec, Forward: false},
+							} {
+								for i := range objects[e.Src] {
+									obj := &objects[e.Src][i]
+									expected, err := listed.ResourcesFor(obj, e)
+									if err != nil {
+										t.Fatal(err)
+									}
+									got, err := indexed.ResourcesFor(obj, e)
+									if err != nil {
+										t.Fatal(err)
+									}
+									if g, x := objectNames(got), objectNames(expected); !reflect.DeepEqual(g, x) {
+										t.Errorf("forward=%v from %s: expected %v, got %v", e.Forward, obj.GetName(), x, g)
+									}
+								}
+							}
+							if n := counter.lists[src.GroupKind()] + counter.lists[dst.GroupKind()]; n > 0 {
+								t.Errorf("expected no lists of indexed types, got %d", n)
+							}
+							if n := counter.gets[src.GroupKind()] + counter.gets[dst.GroupKind()]; fromStore && n > 0 {
+								t.Errorf("expected no gets of types read from the informer store, got %d", n)
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func objectNames(objs []*unstructured.Unstructured) []string {
+	out := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		out = append(out, string(apiv1.NewObjectID(obj).OID()))
+	}
+	sort.Strings(out)
+	return out
+}
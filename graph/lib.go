@@ -17,16 +17,12 @@ limitations under the License.
 package graph
 
 import (
-	"bytes"
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
-	"regexp"
 	"sort"
 	"strings"
 
-	"gomodules.xyz/jsonpath"
 	core "k8s.io/api/core/v1"
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -36,6 +32,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/tools/cache"
 	"kmodules.xyz/apiversion"
 	apiv1 "kmodules.xyz/client-go/api/v1"
@@ -63,8 +60,23 @@ func appendObjects(arr []*unstructured.Unstructured, items ...*unstructured.Unst
 	return out
 }
 
+// NewFinder returns a finder using the label and field indexes of the graph. The indexes are built
+// from the cache of the manager, so c must be the client of the manager.
+func NewFinder(c client.Client) ObjectFinder {
+	return ObjectFinder{
+		Client: c,
+		Index:  labelIdx,
+		Fields: fieldIdx,
+	}
+}
+
 type ObjectFinder struct {
 	Client client.Client
+	// Index, if set, resolves MatchSelector connections of the synced types without listing.
+	Index *LabelIndex
+	// Fields, if set, resolves backward MatchRef and OwnedBy connections of the indexed types
+	// via cache field indexes.
+	Fields *FieldIndexes
 }
 
 func (finder ObjectFinder) List(src *unstructured.Unstructured, path []*Edge) ([]*unstructured.Unstructured, error) {
@@ -130,6 +142,36 @@ func (finder ObjectFinder) ListConnectedPartials(src *unstructured.Unstructured,
 	return result, nil
 }
 
+// ConnectionError is the error of evaluating the connections of an object to a target kind
+// with the given edge labels.
+type ConnectionError struct {
+	Target schema.GroupKind
+	Labels []apiv1.EdgeLabel
+	Err    error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connection to %s with labels %v: %v", e.Target, e.Labels, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionErrors are the connections of an object that failed to evaluate, sorted by target.
+type ConnectionErrors []*ConnectionError
+
+func (errs ConnectionErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ListConnectedObjectIDs returns the objects connected to src, per edge label. The connections are
+// evaluated independently: if some of them fail, the objects found by the others are returned along
+// with ConnectionErrors listing the failed ones.
 func (finder ObjectFinder) ListConnectedObjectIDs(src *unstructured.Unstructured, connections []v1alpha1.ResourceConnection) (map[apiv1.EdgeLabel]ksets.OID, error) {
 	type GKL struct {
 		Group  string
@@ -139,6 +181,10 @@ func (finder ObjectFinder) ListConnectedObjectIDs(src *unstructured.Unstructured
 	srcGVK := src.GroupVersionKind()
 	connsPerGKL := map[GKL][]v1alpha1.ResourceConnection{}
 	for _, c := range connections {
+		// invalid connections are reported by CompileConnections
+		if _, err := plans.Plan(c.ResourceConnectionSpec); err != nil {
+			continue
+		}
 		gvk := c.Target.GroupVersionKind()
 		labels := make([]string, 0, len(c.Labels))
 		for _, lbl := range c.Labels {
@@ -154,6 +200,7 @@ func (finder ObjectFinder) ListConnectedObjectIDs(src *unstructured.Unstructured
 	}
 
 	edges := map[apiv1.EdgeLabel]ksets.OID{}
+	var errs ConnectionErrors
 	for _, conns := range connsPerGKL {
 		if len(conns) > 1 {
 			sort.Slice(conns, func(i, j int) bool {
@@ -168,10 +215,16 @@ func (finder ObjectFinder) ListConnectedObjectIDs(src *unstructured.Unstructured
 			Connection: conns[0].ResourceConnectionSpec,
 			Forward:    true,
 		})
-		if kerr.IsNotFound(err) || len(objects) == 0 {
+		// skip targets that are missing or whose type is not served
+		if kerr.IsNotFound(err) || meta.IsNoMatchError(err) {
 			continue
 		} else if err != nil {
-			return nil, err
+			errs = append(errs, &ConnectionError{
+				Target: conns[0].Target.GroupVersionKind().GroupKind(),
+				Labels: conns[0].Labels,
+				Err:    err,
+			})
+			continue
 		}
 		for _, obj := range objects {
 			oid := apiv1.NewObjectID(obj).OID()
@@ -184,519 +237,719 @@ func (finder ObjectFinder) ListConnectedObjectIDs(src *unstructured.Unstructured
 		}
 	}
 
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool {
+			if errs[i].Target != errs[j].Target {
+				return errs[i].Target.String() < errs[j].Target.String()
+			}
+			return fmt.Sprint(errs[i].Labels) < fmt.Sprint(errs[j].Labels)
+		})
+		return edges, errs
+	}
 	return edges, nil
 }
 
+// ResourcesFor returns the objects connected to src by the edge e. The namespaces of a connection are
+// handled the same way in both directions, so t is found from src over a backward edge if and only if
+// src is found from t over the matching forward edge.
 func (finder ObjectFinder) ResourcesFor(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
 	if e.Src != src.GroupVersionKind() {
 		return nil, fmt.Errorf("edge src %v does not match ref %v", e.Src, src.GroupVersionKind())
 	}
 
-	if e.Forward {
-		// FIXME: How to handle namespace for Backward direction
-		if e.Connection.Type == v1alpha1.MatchSelector {
-			// var ls string
-			var selector labels.Selector
-			var err error
+	switch e.Connection.Type {
+	case v1alpha1.MatchSelector:
+		if e.Forward {
+			return finder.selectedObjects(src, e)
+		}
+		return finder.selectingObjects(src, e)
+	case v1alpha1.MatchName, v1alpha1.MatchRef:
+		if e.Forward {
+			return finder.referredObjects(src, e)
+		}
+		return finder.referringObjects(src, e)
+	case MatchValue:
+		if e.Forward {
+			return finder.valueTargets(src, e)
+		}
+		return finder.valueSources(src, e)
+	case MatchExpression:
+		if e.Forward {
+			return finder.expressionTargets(src, e)
+		}
+		return finder.expressionSources(src, e)
+	case v1alpha1.OwnedBy:
+		if e.Forward {
+			return finder.findOwners(e, src)
+		}
+		return finder.findChildren(e, src)
+	}
+	return nil, nil
+}
 
-			if e.Connection.SelectorPath != "" {
-				selector, err = ExtractSelector(src, e.Connection.SelectorPath)
-				if err != nil {
-					return nil, err
-				}
-			} else if e.Connection.Selector != nil {
-				s2, err := evalLabelSelector(src, e.Connection.Selector)
-				if err != nil {
-					return nil, err
-				}
-				selector, err = metav1.LabelSelectorAsSelector(s2)
-				if err != nil {
-					return nil, err
-				}
-				// ls = selector.String()
-			} else {
-				return nil, fmt.Errorf("edge %v is missing selectorPath and selector", e)
-			}
+// selectedObjects returns the objects selected by src over a forward MatchSelector edge.
+func (finder ObjectFinder) selectedObjects(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	selector, err := connectionSelector(src, e)
+	if err != nil {
+		return nil, err
+	}
+	if _, selectable := selector.Requirements(); !selectable {
+		return nil, nil
+	}
 
-			namespaces, err := Namespaces(src, e.Connection.NamespacePath)
-			if err != nil {
-				return nil, err
-			}
-			if len(namespaces) == 0 {
-				namespaces = []string{metav1.NamespaceAll}
-			}
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	// the namespaces of a connection don't apply to cluster scoped targets
+	var selected []string
+	if namespaced {
+		selected, err = finder.Namespaces(src, e.Connection.NamespacePath)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			var out []*unstructured.Unstructured
-
-			if _, selectable := selector.Requirements(); selectable {
-				for _, ns := range namespaces {
-					opts := client.ListOptions{LabelSelector: labels.Everything()}
-					if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-						return nil, err
-					} else if namespaced {
-						opts.Namespace = ns
-					}
-
-					selInApp := e.Connection.TargetLabelPath != "" &&
-						strings.Trim(e.Connection.TargetLabelPath, ".") != MetadataLabels
-					if !selInApp {
-						// TODO(tamal): check for correctness
-						opts.LabelSelector = selector
-					}
-					var result unstructured.UnstructuredList
-					result.SetGroupVersionKind(e.Dst) // KB: ok?
-					err := finder.Client.List(context.TODO(), &result, &opts)
-					if err != nil {
-						return nil, err
-					}
-					for i := range result.Items {
-						rs := result.Items[i]
-
-						if selInApp {
-							lbl, ok, err := unstructured.NestedStringMap(rs.Object, fields(e.Connection.TargetLabelPath)...)
-							if err != nil {
-								return nil, err
-							}
-							if !ok || !selector.Matches(labels.Set(lbl)) {
-								continue
-							}
-						}
-
-						if isConnected(e.Connection.Level, &rs, src) {
-							out = append(out, &rs)
-						}
-					}
-				}
-			}
-			return out, nil
-		} else if e.Connection.Type == v1alpha1.MatchName {
-			if e.Connection.NameTemplate == "" {
-				return nil, fmt.Errorf("edge %v is missing nameTemplate", e)
-			}
-			name := strings.ReplaceAll(e.Connection.NameTemplate, MetadataNameQuery, src.GetName())
+	selInApp := e.Connection.TargetLabelPath != "" &&
+		strings.Trim(e.Connection.TargetLabelPath, ".") != MetadataLabels
 
-			namespaces, err := Namespaces(src, e.Connection.NamespacePath)
-			if err != nil {
-				return nil, err
-			}
-			if len(namespaces) == 0 {
-				namespaces = []string{metav1.NamespaceAll}
+	var out []*unstructured.Unstructured
+	if !selInApp && finder.Index.Synced(e.Dst.GroupKind()) {
+		objects, err := finder.getByKeys(e.Dst, finder.Index.Select(e.Dst.GroupKind(), selector, selected))
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range objects {
+			if isConnected(e.Connection.Level, rs, src) {
+				out = append(out, rs)
 			}
+		}
+		return out, nil
+	}
 
-			var out []*unstructured.Unstructured
-			for _, ns := range namespaces {
-				objkey := client.ObjectKey{Name: name}
-				if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-					return nil, err
-				} else if namespaced {
-					objkey.Namespace = ns
-				}
+	namespaces := selected
+	if namespaces == nil {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, ns := range namespaces {
+		opts := client.ListOptions{LabelSelector: labels.Everything(), Namespace: ns}
+		if !selInApp {
+			// TODO(tamal): check for correctness
+			opts.LabelSelector = selector
+		}
+		var result unstructured.UnstructuredList
+		result.SetGroupVersionKind(e.Dst) // KB: ok?
+		err := finder.Client.List(context.TODO(), &result, &opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Items {
+			rs := result.Items[i]
 
-				var rs unstructured.Unstructured
-				rs.SetGroupVersionKind(e.Dst)
-				err := finder.Client.Get(context.TODO(), objkey, &rs)
+			if selInApp {
+				lbl, ok, err := unstructured.NestedStringMap(rs.Object, fields(e.Connection.TargetLabelPath)...)
 				if err != nil {
 					return nil, err
 				}
-
-				if isConnected(e.Connection.Level, &rs, src) {
-					out = append(out, &rs)
+				if !ok || !selector.Matches(labels.Set(lbl)) {
+					continue
 				}
 			}
-			return out, nil
-		} else if e.Connection.Type == v1alpha1.OwnedBy {
-			return finder.findOwners(e, src.GetOwnerReferences(), src.GetNamespace())
-		} else if e.Connection.Type == v1alpha1.MatchRef {
-			// TODO: check that namespacePath must be empty
-
-			var out []*unstructured.Unstructured
-
-			for _, reference := range e.Connection.References {
-				j := jsonpath.New("jsonpath")
-				j.AllowMissingKeys(true)
-				err := j.Parse(reference)
-				if err != nil {
-					return nil, fmt.Errorf("fails to parse reference %q between %s -> %s. err:%v", e.Connection.References, e.Src, e.Dst, err)
-				}
-				buf := new(bytes.Buffer)
-				err = j.Execute(buf, src.Object)
-				if err != nil {
-					return nil, fmt.Errorf("fails to execute reference %q between %s -> %s. err:%v", e.Connection.References, e.Src, e.Dst, err)
-				}
-				r := csv.NewReader(buf)
-				// Mapper.Comma = ';'
-				r.Comment = '#'
-				records, err := r.ReadAll()
-				if err != nil {
-					return nil, err
-				}
-				refs, err := ParseResourceRefs(records)
-				if err != nil {
-					return nil, err
-				}
 
-				var objects []*unstructured.Unstructured
-				for _, ref := range refs {
-					// if apiGroup is set, it must match
-					if ref.APIGroup != "" && ref.APIGroup != e.Dst.Group {
-						continue
-					}
-					// if apiGroup is set, it must match
-					if ref.Kind != "" && ref.Kind != e.Dst.Kind {
-						continue
-					}
-
-					objkey := client.ObjectKey{Name: ref.Name}
-					if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-						return nil, err
-					} else if namespaced {
-						ns := ref.Namespace
-						if ns == "" {
-							ns = src.GetNamespace()
-						}
-						if ns == "" {
-							// dst is namespaced &&
-							// no namespace is defined in reference &&
-							// src is not-namespaced
-							return nil, errors.New("namespace must be defined in reference")
-						}
-						objkey.Namespace = ns
-					}
-
-					var rs unstructured.Unstructured
-					rs.SetGroupVersionKind(e.Dst)
-					err := finder.Client.Get(context.TODO(), objkey, &rs)
-					if err != nil {
-						return nil, err
-					}
-
-					if isConnected(e.Connection.Level, &rs, src) {
-						objects = append(objects, &rs)
-					}
-				}
-				out = appendObjects(out, objects...)
+			if isConnected(e.Connection.Level, &rs, src) {
+				out = append(out, &rs)
 			}
-			return out, nil
 		}
-	} else {
-		namespace := core.NamespaceAll
-		if e.Connection.NamespacePath == MetadataNamespace {
-			namespace = src.GetNamespace()
-		} // else all namespace RETHINK
+	}
+	return out, nil
+}
 
-		if e.Connection.Type == v1alpha1.MatchSelector {
-			var out []*unstructured.Unstructured
+// selectingObjects returns the objects selecting src over a backward MatchSelector edge.
+func (finder ObjectFinder) selectingObjects(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	lbl := src.GetLabels()
+	if e.Connection.TargetLabelPath != "" && strings.Trim(e.Connection.TargetLabelPath, ".") != MetadataLabels {
+		l2, ok, err := unstructured.NestedStringMap(src.Object, fields(e.Connection.TargetLabelPath)...)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil // empty result
+		}
+		lbl = l2
+	}
 
-			lbl := src.GetLabels()
-			if e.Connection.TargetLabelPath != "" && strings.Trim(e.Connection.TargetLabelPath, ".") != MetadataLabels {
-				l2, ok, err := unstructured.NestedStringMap(src.Object, fields(e.Connection.TargetLabelPath)...)
-				if err != nil {
-					return nil, err
-				}
-				if !ok {
-					return out, nil // empty result
-				}
-				lbl = l2
-			}
+	var candidates []*unstructured.Unstructured
+	var err error
+	if finder.Index.Synced(e.Dst.GroupKind()) {
+		candidates, err = finder.getByKeys(e.Dst, finder.Index.Selecting(e, lbl))
+	} else {
+		candidates, err = finder.sourceCandidates(src, e)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			opts := client.ListOptions{LabelSelector: labels.Everything()}
-			if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-				return nil, err
-			} else if namespaced {
-				opts.Namespace = namespace
-			}
+	var out []*unstructured.Unstructured
+	for i := range candidates {
+		rs := candidates[i]
 
-			var result unstructured.UnstructuredList
-			result.SetGroupVersionKind(e.Dst)
-			err := finder.Client.List(context.TODO(), &result, &opts)
+		if src.GetNamespace() != "" {
+			namespaces, err := finder.Namespaces(rs, e.Connection.NamespacePath)
 			if err != nil {
 				return nil, err
 			}
-			for i := range result.Items {
-				rs := result.Items[i]
-
-				if e.Connection.NamespacePath != "" && e.Connection.NamespacePath != MetadataNamespace {
-					namespaces, err := Namespaces(&rs, e.Connection.NamespacePath)
-					if err != nil {
-						return nil, err
-					}
-					if len(namespaces) > 0 && !contains(namespaces, src.GetNamespace()) {
-						continue
-					}
-				}
+			if !namespaceAllowed(namespaces, src.GetNamespace()) {
+				continue
+			}
+		}
 
-				var selector labels.Selector
-				if e.Connection.SelectorPath != "" {
-					selector, err = ExtractSelector(&rs, e.Connection.SelectorPath)
-					if err != nil {
-						return nil, err
-					}
-				} else if e.Connection.Selector != nil {
-					s2, err := evalLabelSelector(&rs, e.Connection.Selector)
-					if err != nil {
-						return nil, err
-					}
-					selector, err = metav1.LabelSelectorAsSelector(s2)
-					if err != nil {
-						return nil, err
-					}
-					_ = selector.String()
-				} else {
-					return nil, fmt.Errorf("edge %v is missing selectorPath and selector", e)
-				}
+		selector, err := connectionSelector(rs, e)
+		if err != nil {
+			return nil, err
+		}
+		if _, selectable := selector.Requirements(); !selectable {
+			continue
+		}
 
-				if _, selectable := selector.Requirements(); !selectable {
-					continue
-				}
+		if selector.Matches(labels.Set(lbl)) && isConnected(e.Connection.Level, src, rs) {
+			out = append(out, rs)
+		}
+	}
+	return out, nil
+}
 
-				if selector.Matches(labels.Set(lbl)) {
-					if isConnected(e.Connection.Level, src, &rs) {
-						out = append(out, &rs)
-					}
-				}
+// connectionSelector returns the label selector of the MatchSelector connection evaluated for src.
+func connectionSelector(src *unstructured.Unstructured, e *Edge) (labels.Selector, error) {
+	if e.Connection.SelectorPath != "" {
+		return ExtractSelector(src, e.Connection.SelectorPath)
+	} else if e.Connection.Selector != nil {
+		plan, err := e.compiled()
+		if err != nil {
+			return nil, err
+		}
+		return plan.selector.eval(src)
+	}
+	return nil, fmt.Errorf("edge %v is missing selectorPath and selector", e)
+}
+
+// referredObjects returns the objects src points to over a forward MatchName or MatchRef edge.
+// Missing objects are skipped.
+func (finder ObjectFinder) referredObjects(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	keys, err := finder.connectionKeys(src, e)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*unstructured.Unstructured
+	for _, key := range keys {
+		objects, err := finder.getObjects(e.Dst, key.ObjectKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range objects {
+			if key.matches(rs) && isConnected(e.Connection.Level, rs, src) {
+				out = append(out, rs)
 			}
-			return out, nil
-		} else if e.Connection.Type == v1alpha1.MatchName {
-			if e.Connection.NameTemplate != "" {
-				name, ok := ExtractName(src.GetName(), e.Connection.NameTemplate)
-				if !ok {
-					return nil, fmt.Errorf("failed to detect name from %s and %s", src.GetName(), e.Connection.NameTemplate)
-				}
+		}
+	}
+	return out, nil
+}
 
-				var out []*unstructured.Unstructured
-				objkey := client.ObjectKey{Name: name}
-				if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-					return nil, err
-				} else if namespaced {
-					objkey.Namespace = namespace
-				}
-				var rs unstructured.Unstructured
-				rs.SetGroupVersionKind(e.Dst)
-				err := finder.Client.Get(context.TODO(), objkey, &rs)
-				if err != nil {
-					return nil, err
-				}
+// referringObjects returns the objects pointing to src over a backward MatchName or MatchRef edge.
+// A candidate is returned if the keys computed for it by the forward edge include src.
+func (finder ObjectFinder) referringObjects(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	fe := &Edge{
+		Src:        e.Dst,
+		Dst:        e.Src,
+		W:          e.W,
+		Connection: e.Connection,
+		Forward:    true,
+		plan:       e.plan,
+	}
 
-				if isConnected(e.Connection.Level, src, &rs) {
-					out = append(out, &rs)
-				}
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*unstructured.Unstructured
+	if e.Connection.Type == v1alpha1.MatchName && plan.name.has(MetadataNameQuery) {
+		candidates, err = finder.nameCandidates(src, e, plan.name, src.GetName())
+	} else if field := refField(e.Src.GroupKind(), e.Connection); e.Connection.Type == v1alpha1.MatchRef && finder.Fields.Has(e.Dst, field) {
+		candidates, err = finder.listByField(e.Dst, "", field, refIndexValue(client.ObjectKeyFromObject(src)))
+	} else {
+		candidates, err = finder.sourceCandidates(src, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*unstructured.Unstructured
+	for _, rs := range candidates {
+		keys, err := finder.connectionKeys(rs, fe)
+		if err != nil {
+			return nil, err
+		}
+		if matchesKey(keys, src) && isConnected(e.Connection.Level, src, rs) {
+			out = append(out, rs)
+		}
+	}
+	return out, nil
+}
 
-				return out, nil
+// nameCandidates gets the objects of type e.Dst whose names may generate the value over the backward
+// edge e from src. The name template may match the value in more than one way, so every possible
+// name is tried.
+func (finder ObjectFinder) nameCandidates(src *unstructured.Unstructured, e *Edge, t *nameTemplate, value string) ([]*unstructured.Unstructured, error) {
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	var ns string
+	if namespaced && e.Connection.NamespacePath == MetadataNamespace {
+		ns = src.GetNamespace()
+	}
+
+	var out []*unstructured.Unstructured
+	seen := map[client.ObjectKey]bool{}
+	for _, values := range t.match(value) {
+		objkey := client.ObjectKey{Namespace: ns, Name: values[MetadataNameQuery]}
+		if v, ok := values[MetadataNamespaceQuery]; ok {
+			if !namespaced || (ns != "" && ns != v) {
+				continue
 			}
-		} else if e.Connection.Type == v1alpha1.OwnedBy {
-			return finder.findChildren(e, src)
-		} else if e.Connection.Type == v1alpha1.MatchRef {
-			// TODO: check that namespacePath must be empty
+			objkey.Namespace = v
+		}
+		if seen[objkey] {
+			continue
+		}
+		seen[objkey] = true
 
-			opts := client.ListOptions{LabelSelector: labels.Everything()}
-			if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
-				return nil, err
-			} else if namespaced {
-				ns := metav1.NamespaceAll
-				if e.Connection.NamespacePath == MetadataNamespace {
-					ns = src.GetNamespace()
-				}
-				opts.Namespace = ns
+		objects, err := finder.getObjects(e.Dst, objkey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, objects...)
+	}
+	return out, nil
+}
+
+// valueTargets returns the objects whose label or annotation matches the value computed for src over
+// a forward MatchValue edge.
+func (finder ObjectFinder) valueTargets(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, err
+	}
+	value, ok, err := plan.name.eval(src)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	// the namespaces of a connection don't apply to cluster scoped targets
+	var selected []string
+	if namespaced {
+		selected, err = finder.Namespaces(src, e.Connection.NamespacePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var selector labels.Selector
+	if !plan.value.annotation {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, nil // no object has this label
+		}
+		selector = labels.SelectorFromValidatedSet(labels.Set{plan.value.key: value})
+	}
+
+	var candidates []*unstructured.Unstructured
+	if selector != nil && finder.Index.Synced(e.Dst.GroupKind()) {
+		candidates, err = finder.getByKeys(e.Dst, finder.Index.Select(e.Dst.GroupKind(), selector, selected))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		namespaces := selected
+		if namespaces == nil {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+		for _, ns := range namespaces {
+			opts := client.ListOptions{LabelSelector: selector, Namespace: ns}
+			if selector == nil {
+				opts.LabelSelector = labels.Everything()
 			}
 			var result unstructured.UnstructuredList
 			result.SetGroupVersionKind(e.Dst)
-			err := finder.Client.List(context.TODO(), &result, &opts)
-			if err != nil {
+			if err := finder.Client.List(context.TODO(), &result, &opts); err != nil {
 				return nil, err
 			}
-
-			var out []*unstructured.Unstructured
-		NextItem:
-			for i := range result.Items {
-				rs := result.Items[i]
-
-				for _, reference := range e.Connection.References {
-
-					j := jsonpath.New("jsonpath")
-					j.AllowMissingKeys(true)
-					err := j.Parse(reference)
-					if err != nil {
-						return nil, fmt.Errorf("fails to parse reference %q between %s -> %s. err:%v", e.Connection.References, e.Src, e.Dst, err)
-					}
-
-					buf := new(bytes.Buffer)
-					err = j.Execute(buf, rs.Object)
-					if err != nil {
-						return nil, fmt.Errorf("fails to execute reference %q between %s -> %s. err:%v", e.Connection.References, e.Src, e.Dst, err)
-					}
-					r := csv.NewReader(buf)
-					// Mapper.Comma = ';'
-					r.Comment = '#'
-					records, err := r.ReadAll()
-					if err != nil {
-						return nil, err
-					}
-					refs, err := ParseResourceRefs(records)
-					if err != nil {
-						return nil, err
-					}
-					for _, ref := range refs {
-						// if apiGroup is set, it must match
-						if ref.APIGroup != "" && ref.APIGroup != e.Src.Group {
-							continue
-						}
-
-						// if apiGroup is set, it must match
-						if ref.Kind != "" && ref.Kind != e.Src.Kind {
-							continue
-						}
-
-						ns := ref.Namespace
-						namespaced, err := finder.isNamespaced(e.Src)
-						if err != nil {
-							return nil, err
-						}
-						if ns == "" && namespaced {
-							ns = rs.GetNamespace()
-							if ns == "" {
-								// src is namespaced &&
-								// no namespace is defined in reference &&
-								// rs is not-namespaced
-								return nil, errors.New("namespace must be defined in reference")
-							}
-
-							if ns != src.GetNamespace() {
-								continue
-							}
-						}
-
-						if ref.Name != src.GetName() {
-							continue
-						}
-
-						if isConnected(e.Connection.Level, src, &rs) {
-							out = append(out, &rs)
-						}
-						continue NextItem
-					}
-				}
-			}
-			return out, nil
+			candidates = append(candidates, pointer.ToUnstructuredP(result.Items)...)
 		}
 	}
 
-	return nil, nil
+	var out []*unstructured.Unstructured
+	for _, rs := range candidates {
+		if v, ok := plan.value.get(rs); ok && v == value && isConnected(e.Connection.Level, rs, src) {
+			out = append(out, rs)
+		}
+	}
+	return out, nil
 }
 
-func isConnected(conn v1alpha1.OwnershipLevel, obj *unstructured.Unstructured, owner *unstructured.Unstructured) bool {
-	switch conn {
-	case v1alpha1.Controller:
-		if metav1.IsControlledBy(obj, owner) {
-			return true
+// valueSources returns the objects whose value over the backward MatchValue edge e matches the label
+// or annotation of src.
+func (finder ObjectFinder) valueSources(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, err
+	}
+	value, ok := plan.value.get(src)
+	if !ok {
+		return nil, nil
+	}
+
+	var candidates []*unstructured.Unstructured
+	if plan.name.has(MetadataNameQuery) {
+		candidates, err = finder.nameCandidates(src, e, plan.name, value)
+	} else {
+		candidates, err = finder.sourceCandidates(src, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*unstructured.Unstructured
+	for _, rs := range candidates {
+		if src.GetNamespace() != "" {
+			namespaces, err := finder.Namespaces(rs, e.Connection.NamespacePath)
+			if err != nil {
+				return nil, err
+			}
+			if !namespaceAllowed(namespaces, src.GetNamespace()) {
+				continue
+			}
 		}
-	case v1alpha1.Owner:
-		if IsOwnedBy(obj, owner) {
-			return true
+		v, ok, err := plan.name.eval(rs)
+		if err != nil {
+			return nil, err
+		}
+		if ok && v == value && isConnected(e.Connection.Level, src, rs) {
+			out = append(out, rs)
 		}
-	default:
-		return true
 	}
-	return false
+	return out, nil
 }
 
-func evalLabelSelector(obj *unstructured.Unstructured, in *metav1.LabelSelector) (*metav1.LabelSelector, error) {
-	out := in.DeepCopy()
-	for k, v := range out.MatchLabels {
-		if strings.ContainsRune(k, '{') {
-			return nil, fmt.Errorf("invalid selector key %v", k)
+// sourceCandidates lists the objects of type e.Dst that may point to src over the backward edge e.
+// Only connections to the source's own namespace narrow the search to the namespace of src, since
+// references may point to objects in other namespaces.
+func (finder ObjectFinder) sourceCandidates(src *unstructured.Unstructured, e *Edge) ([]*unstructured.Unstructured, error) {
+	opts := client.ListOptions{LabelSelector: labels.Everything()}
+	if e.Connection.NamespacePath == MetadataNamespace && e.Connection.Type != v1alpha1.MatchRef {
+		if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
+			return nil, err
+		} else if namespaced {
+			opts.Namespace = src.GetNamespace()
 		}
-		if v == MetadataNameQuery {
-			out.MatchLabels[k] = obj.GetName()
-			continue
+	}
+
+	var result unstructured.UnstructuredList
+	result.SetGroupVersionKind(e.Dst)
+	err := finder.Client.List(context.TODO(), &result, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return pointer.ToUnstructuredP(result.Items), nil
+}
+
+// listByField returns the objects of type gvk in the namespace whose field index has the value.
+func (finder ObjectFinder) listByField(gvk schema.GroupVersionKind, namespace, field, value string) ([]*unstructured.Unstructured, error) {
+	var result unstructured.UnstructuredList
+	result.SetGroupVersionKind(gvk)
+	err := finder.Client.List(context.TODO(), &result, client.InNamespace(namespace), client.MatchingFields{field: value})
+	if err != nil {
+		return nil, err
+	}
+	return pointer.ToUnstructuredP(result.Items), nil
+}
+
+// connectionKeys returns the keys of the objects src points to over a forward MatchName or MatchRef edge.
+func (finder ObjectFinder) connectionKeys(src *unstructured.Unstructured, e *Edge) ([]connectionKey, error) {
+	if e.Connection.Type == v1alpha1.MatchName {
+		return finder.nameKeys(src, e)
+	}
+	return finder.refKeys(src, e)
+}
+
+// getObjects returns the objects of type gvk with the given key. A key of a namespaced type without
+// a namespace matches the objects with that name in all namespaces. Missing objects are skipped.
+func (finder ObjectFinder) getObjects(gvk schema.GroupVersionKind, objkey client.ObjectKey) ([]*unstructured.Unstructured, error) {
+	namespaced, err := finder.isNamespaced(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	if !namespaced || objkey.Namespace != "" {
+		var rs unstructured.Unstructured
+		rs.SetGroupVersionKind(gvk)
+		err := finder.Client.Get(context.TODO(), objkey, &rs)
+		if kerr.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-		if v == MetadataNamespaceQuery {
-			out.MatchLabels[k] = obj.GetNamespace()
-			continue
+		return []*unstructured.Unstructured{&rs}, nil
+	}
+
+	var result unstructured.UnstructuredList
+	result.SetGroupVersionKind(gvk)
+	err = finder.Client.List(context.TODO(), &result, client.InNamespace(metav1.NamespaceAll))
+	if err != nil {
+		return nil, err
+	}
+	var out []*unstructured.Unstructured
+	for i := range result.Items {
+		if result.Items[i].GetName() == objkey.Name {
+			out = append(out, &result.Items[i])
 		}
-		if v[0] == '{' && v[len(v)-1] == '}' {
-			val, err := evalJsonPath(obj, v)
+	}
+	return out, nil
+}
+
+// getByKeys returns the objects of type gvk with the given keys, selected via the label index.
+// Missing objects are skipped. The objects are read from the informer store the index is built
+// from, as the client bypasses the cache for some types and would make a request per key.
+func (finder ObjectFinder) getByKeys(gvk schema.GroupVersionKind, keys []client.ObjectKey) ([]*unstructured.Unstructured, error) {
+	var out []*unstructured.Unstructured
+	store := finder.Index.store(gvk.GroupKind())
+	if store == nil {
+		for _, objkey := range keys {
+			objects, err := finder.getObjects(gvk, objkey)
 			if err != nil {
 				return nil, err
 			}
-			out.MatchLabels[k] = val
+			out = append(out, objects...)
 		}
+		return out, nil
 	}
-	for i := range out.MatchExpressions {
-		expr := out.MatchExpressions[i]
-		if strings.ContainsRune(expr.Key, '{') {
-			return nil, fmt.Errorf("selector has invalid key %v", expr.Key)
-		}
-		for vi := range expr.Values {
-			v := expr.Values[vi]
-			if v[0] == '{' && v[len(v)-1] == '}' {
-				val, err := evalJsonPath(obj, v)
-				if err != nil {
-					return nil, err
-				}
-				expr.Values[vi] = val
-			}
+
+	for _, objkey := range keys {
+		var rs unstructured.Unstructured
+		rs.SetGroupVersionKind(gvk)
+		err := store.Get(context.TODO(), objkey, &rs)
+		if kerr.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
-		out.MatchExpressions[i] = expr
+		out = append(out, &rs)
 	}
 	return out, nil
 }
 
-func evalJsonPath(src *unstructured.Unstructured, template string) (string, error) {
-	j := jsonpath.New("jsonpath")
-	j.AllowMissingKeys(true)
-	err := j.Parse(template)
+// connectionKey identifies the objects a MatchName or MatchRef connection points to. A key without a
+// namespace matches objects of a namespaced type in any namespace, and a key with a uid only matches
+// the object with that uid.
+type connectionKey struct {
+	client.ObjectKey
+	UID types.UID
+}
+
+func (key connectionKey) matches(obj *unstructured.Unstructured) bool {
+	return key.Name == obj.GetName() &&
+		(key.Namespace == "" || key.Namespace == obj.GetNamespace()) &&
+		(key.UID == "" || key.UID == obj.GetUID())
+}
+
+// matchesKey returns true if obj matches one of the keys.
+func matchesKey(keys []connectionKey, obj *unstructured.Unstructured) bool {
+	for _, key := range keys {
+		if key.matches(obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceAllowed returns true if ns is one of the namespaces returned by Namespaces.
+func namespaceAllowed(namespaces []string, ns string) bool {
+	return namespaces == nil || contains(namespaces, ns)
+}
+
+// nameKeys returns the keys of the objects a forward MatchName connection points to.
+// The keys of a namespaced type have no namespace if the connection selects all namespaces.
+func (finder ObjectFinder) nameKeys(src *unstructured.Unstructured, e *Edge) ([]connectionKey, error) {
+	plan, err := e.compiled()
 	if err != nil {
-		return "", fmt.Errorf("fails to parse value of selector key. err:%v", err)
+		return nil, fmt.Errorf("invalid connection between %s -> %s. err:%v", e.Src, e.Dst, err)
 	}
-	buf := new(bytes.Buffer)
-	err = j.Execute(buf, src.Object)
+	name, ok, err := plan.name.eval(src)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	if !namespaced {
+		return []connectionKey{{ObjectKey: client.ObjectKey{Name: name}}}, nil
+	}
+
+	namespaces, err := finder.Namespaces(src, e.Connection.NamespacePath)
 	if err != nil {
-		return "", fmt.Errorf("fails to evaluate value of selector key. err:%v", err)
+		return nil, err
+	}
+	if namespaces == nil {
+		namespaces = []string{metav1.NamespaceAll}
 	}
-	return strings.TrimSpace(buf.String()), nil
+	keys := make([]connectionKey, 0, len(namespaces))
+	for _, ns := range namespaces {
+		keys = append(keys, connectionKey{ObjectKey: client.ObjectKey{Namespace: ns, Name: name}})
+	}
+	return keys, nil
 }
 
-func (finder ObjectFinder) findOwners(e *Edge, srcOwnerRefs []metav1.OwnerReference, namespace string) ([]*unstructured.Unstructured, error) {
-	var out []*unstructured.Unstructured
+// refKeys returns the keys of the objects a forward MatchRef connection points to.
+// A reference without a namespace points to the namespace of src. If the connection has a
+// NamespaceSelector, references to namespaces not selected by it are ignored.
+func (finder ObjectFinder) refKeys(src *unstructured.Unstructured, e *Edge) ([]connectionKey, error) {
+	namespaced, err := finder.isNamespaced(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := references(src, e, namespaced)
+	if err != nil || !namespaced || e.Connection.NamespacePath == "" || e.Connection.NamespacePath == MetadataNamespace {
+		return keys, err
+	}
 
-	objkey := client.ObjectKey{}
-	if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
+	namespaces, err := finder.Namespaces(src, e.Connection.NamespacePath)
+	if err != nil {
 		return nil, err
-	} else if namespaced {
-		objkey.Namespace = namespace
 	}
-	for _, ref := range srcOwnerRefs {
-		objkey.Name = ref.Name
+	out := keys[:0]
+	for _, key := range keys {
+		if namespaceAllowed(namespaces, key.Namespace) {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+// references returns the keys of the objects referenced by src via the References of a MatchRef
+// connection, regardless of its NamespacePath. namespaced is the scope of the referenced type.
+// References to another type are ignored.
+func references(src *unstructured.Unstructured, e *Edge, namespaced bool) ([]connectionKey, error) {
+	plan, err := e.compiled()
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection between %s -> %s. err:%v", e.Src, e.Dst, err)
+	}
 
-		if ref.APIVersion == e.Dst.GroupVersion().String() && ref.Kind == e.Dst.Kind {
-			if e.Connection.Level == v1alpha1.Controller {
-				if ref.Controller != nil && *ref.Controller {
-					var rs unstructured.Unstructured
-					rs.SetGroupVersionKind(e.Dst)
-					err := finder.Client.Get(context.TODO(), objkey, &rs)
-					if err != nil {
-						return nil, err
-					}
-					out = append(out, &rs)
-					break
+	var keys []connectionKey
+	seen := map[connectionKey]bool{}
+	for _, j := range plan.references {
+		refs, err := j.resourceRefs(src.Object)
+		if err != nil {
+			return nil, fmt.Errorf("fails to execute reference %q between %s -> %s. err:%v", j.text, e.Src, e.Dst, err)
+		}
+
+		for _, ref := range refs {
+			if ref.Name == "" || !ref.matchesType(e.Dst) {
+				continue
+			}
+
+			key := connectionKey{
+				ObjectKey: client.ObjectKey{Name: ref.Name},
+				UID:       ref.UID,
+			}
+			if namespaced {
+				ns := ref.Namespace
+				if ns == "" {
+					ns = src.GetNamespace()
 				}
-			} else if e.Connection.Level == v1alpha1.Owner {
-				var rs unstructured.Unstructured
-				rs.SetGroupVersionKind(e.Dst)
-				err := finder.Client.Get(context.TODO(), objkey, &rs)
-				if err != nil {
-					return nil, err
+				if ns == "" {
+					// dst is namespaced &&
+					// no namespace is defined in reference &&
+					// src is not-namespaced
+					continue
 				}
-				out = append(out, &rs)
-			} else {
-				return nil, fmt.Errorf("connection level should be Owner or Controller, found %v", e.Connection.Level)
+				key.Namespace = ns
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
 			}
 		}
 	}
+	return keys, nil
+}
 
+func isConnected(conn v1alpha1.OwnershipLevel, obj *unstructured.Unstructured, owner *unstructured.Unstructured) bool {
+	switch conn {
+	case v1alpha1.Controller:
+		if metav1.IsControlledBy(obj, owner) {
+			return true
+		}
+	case v1alpha1.Owner:
+		if IsOwnedBy(obj, owner) {
+			return true
+		}
+	default:
+		return true
+	}
+	return false
+}
+
+// findOwners returns the owners of src over a forward OwnedBy edge. Owner references are matched
+// by group and kind, and an owner recreated with a different uid is not an owner of src.
+func (finder ObjectFinder) findOwners(e *Edge, src *unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	if e.Connection.Level != v1alpha1.Owner && e.Connection.Level != v1alpha1.Controller {
+		return nil, fmt.Errorf("connection level should be Owner or Controller, found %v", e.Connection.Level)
+	}
+
+	objkey := client.ObjectKey{}
+	if namespaced, err := finder.isNamespaced(e.Dst); err != nil {
+		return nil, err
+	} else if namespaced {
+		if src.GetNamespace() == "" {
+			// cluster scoped objects can't be owned by namespaced objects
+			return nil, nil
+		}
+		objkey.Namespace = src.GetNamespace()
+	}
+
+	var out []*unstructured.Unstructured
+	for _, ref := range src.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || gv.Group != e.Dst.Group || ref.Kind != e.Dst.Kind {
+			continue
+		}
+		if e.Connection.Level == v1alpha1.Controller && (ref.Controller == nil || !*ref.Controller) {
+			continue
+		}
+
+		objkey.Name = ref.Name
+		var rs unstructured.Unstructured
+		rs.SetGroupVersionKind(e.Dst)
+		err = finder.Client.Get(context.TODO(), objkey, &rs)
+		if kerr.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if rs.GetUID() == ref.UID {
+			out = append(out, &rs)
+		}
+	}
 	return out, nil
 }
 
+// findChildren returns the objects owned by src over a backward OwnedBy edge.
 func (finder ObjectFinder) findChildren(e *Edge, src *unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
 	if e.Connection.Level != v1alpha1.Owner && e.Connection.Level != v1alpha1.Controller {
 		return nil, fmt.Errorf("connection level should be Owner or Controller, found %v", e.Connection.Level)
@@ -709,6 +962,13 @@ func (finder ObjectFinder) findChildren(e *Edge, src *unstructured.Unstructured)
 		return nil, err
 	} else if namespaced {
 		opts.Namespace = src.GetNamespace()
+	} else if src.GetNamespace() != "" {
+		// cluster scoped objects can't be owned by namespaced objects
+		return nil, nil
+	}
+
+	if finder.Fields.Has(e.Dst, OwnerUIDField) {
+		client.MatchingFields{OwnerUIDField: string(src.GetUID())}.ApplyToList(&opts)
 	}
 
 	var result unstructured.UnstructuredList
@@ -748,10 +1008,21 @@ func IsOwnedBy(obj metav1.Object, owner metav1.Object) bool {
 	return false
 }
 
-// len([]string) == 0 && err == nil => all namespaces
+// Namespaces returns the namespaces selected by the NamespaceSelector at nsSelector in ref.
+// Label selectors need the Namespace objects and return an error, use ObjectFinder.Namespaces
+// to evaluate them.
+// nil && err == nil => all namespaces, len([]string) == 0 => no namespace
 func Namespaces(ref *unstructured.Unstructured, nsSelector string) ([]string, error) {
+	return ObjectFinder{}.Namespaces(ref, nsSelector)
+}
+
+// Namespaces returns the namespaces selected by the NamespaceSelector at nsSelector in ref.
+// Label selectors are evaluated against the Namespace objects read via the finder's client.
+// The own namespace of a cluster scoped ref means all namespaces.
+// nil && err == nil => all namespaces, len([]string) == 0 => no namespace
+func (finder ObjectFinder) Namespaces(ref *unstructured.Unstructured, nsSelector string) ([]string, error) {
 	if nsSelector == MetadataNamespace {
-		return []string{ref.GetNamespace()}, nil
+		return ownNamespace(ref), nil
 	} else if nsSelector != "" {
 		var nsel NamespaceSelector
 		ok, err := Extract(ref, nsSelector, &nsel)
@@ -760,8 +1031,10 @@ func Namespaces(ref *unstructured.Unstructured, nsSelector string) ([]string, er
 		}
 		if ok {
 			// https://gitg.r.com/coreos/prometheus-operator/blob/cc584ecfa08d2eb95ba9401f116e3a20bf71be8b/pkg/prometheus/promcfg.go#L392
-			if !nsel.Any && len(nsel.MatchNames) == 0 {
-				return []string{ref.GetNamespace()}, nil
+			if nsel.SelectsByLabel() {
+				return finder.namespacesMatching(nsel)
+			} else if !nsel.Any && len(nsel.MatchNames) == 0 {
+				return ownNamespace(ref), nil
 			} else if len(nsel.MatchNames) > 0 {
 				return nsel.MatchNames, nil
 			}
@@ -771,6 +1044,39 @@ func Namespaces(ref *unstructured.Unstructured, nsSelector string) ([]string, er
 	return nil, nil
 }
 
+func ownNamespace(ref *unstructured.Unstructured) []string {
+	if ref.GetNamespace() == "" {
+		return nil
+	}
+	return []string{ref.GetNamespace()}
+}
+
+func (finder ObjectFinder) namespacesMatching(nsel NamespaceSelector) ([]string, error) {
+	if finder.Client == nil {
+		return nil, errors.New("a client is required to select namespaces by label")
+	}
+	sel, err := metav1.LabelSelectorAsSelector(&nsel.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var list unstructured.UnstructuredList
+	list.SetGroupVersionKind(core.SchemeGroupVersion.WithKind("Namespace"))
+	err = finder.Client.List(context.TODO(), &list, client.MatchingLabelsSelector{Selector: sel})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(list.Items))
+	for _, ns := range list.Items {
+		if len(nsel.MatchNames) == 0 || contains(nsel.MatchNames, ns.GetName()) {
+			out = append(out, ns.GetName())
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
 func Extract(u *unstructured.Unstructured, fieldPath string, v interface{}) (bool, error) {
 	if fieldPath == "" {
 		return false, errors.New("fieldPath can't be empty")
@@ -779,7 +1085,7 @@ func Extract(u *unstructured.Unstructured, fieldPath string, v interface{}) (boo
 	if !ok || err != nil {
 		return false, err
 	}
-	err = meta_util.DecodeObject(f, v)
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(f, v)
 	return err == nil, err
 }
 
@@ -827,13 +1133,18 @@ func ExtractSelector(u *unstructured.Unstructured, fieldPath string) (labels.Sel
 	return sel, nil
 }
 
-func ExtractName(name, selector string) (string, bool) {
-	re := regexp.MustCompile(`^` + strings.ReplaceAll(selector, MetadataNameQuery, `(.*)`) + `$`)
-	matches := re.FindStringSubmatch(name)
-	if len(matches) != 2 {
+// ExtractName returns the source name from a name generated by the name template.
+// It returns false if the name can't be generated by the template or the source name is ambiguous.
+func ExtractName(name, template string) (string, bool) {
+	t, err := compileNameTemplate(template)
+	if err != nil {
+		return "", false
+	}
+	names := t.values(name, MetadataNameQuery)
+	if len(names) != 1 {
 		return "", false
 	}
-	return matches[1], true
+	return names[0], true
 }
 
 func ParseResourceRefs(records [][]string) ([]ResourceRef, error) {
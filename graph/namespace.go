@@ -0,0 +1,264 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var namespaceGK = schema.GroupKind{Kind: "Namespace"}
+
+// namespaceIndex tracks the objects whose connections select namespaces by label,
+// so that their edges are recomputed when the labels of a Namespace they select change.
+type namespaceIndex struct {
+	m       sync.Mutex
+	labels  map[string]labels.Set                     // namespace -> labels
+	sources map[apiv1.OID]namespaceSelectors          // objects selecting namespaces by label
+	queues  map[schema.GroupVersionKind]*requeueQueue // gvk -> reconciler queue
+	// ctx stops the senders of the queues, nil until the senders are started
+	ctx context.Context
+}
+
+// namespaceSelectors are the label selectors of the namespaces selected by the connections of an object.
+type namespaceSelectors struct {
+	gvk       schema.GroupVersionKind
+	selectors []labels.Selector
+}
+
+// matches returns true if any of the selectors matches the labels.
+func (s namespaceSelectors) matches(lbls labels.Set) bool {
+	for _, sel := range s.selectors {
+		if sel.Matches(lbls) {
+			return true
+		}
+	}
+	return false
+}
+
+// requeueQueue sends the requeued objects of a type to the channel source of its reconciler. A
+// single sender drains the pending objects, so a busy reconciler neither blocks the caller nor
+// piles up goroutines. An object requeued again before it is sent is only sent once. Objects
+// requeued before the sender starts are sent once it does.
+type requeueQueue struct {
+	ch   chan event.GenericEvent
+	wake chan struct{}
+
+	m       sync.Mutex
+	pending map[types.NamespacedName]event.GenericEvent
+}
+
+func newRequeueQueue() *requeueQueue {
+	return &requeueQueue{
+		ch:      make(chan event.GenericEvent, 1024),
+		wake:    make(chan struct{}, 1),
+		pending: map[types.NamespacedName]event.GenericEvent{},
+	}
+}
+
+// add queues the events to be sent by the sender.
+func (q *requeueQueue) add(evs []event.GenericEvent) {
+	q.m.Lock()
+	for _, ev := range evs {
+		q.pending[types.NamespacedName{Namespace: ev.Object.GetNamespace(), Name: ev.Object.GetName()}] = ev
+	}
+	q.m.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the pending events to the channel until ctx is done.
+func (q *requeueQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+
+		q.m.Lock()
+		evs := q.pending
+		q.pending = map[types.NamespacedName]event.GenericEvent{}
+		q.m.Unlock()
+
+		for _, ev := range evs {
+			select {
+			case q.ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func newNamespaceIndex() *namespaceIndex {
+	return &namespaceIndex{
+		labels:  map[string]labels.Set{},
+		sources: map[apiv1.OID]namespaceSelectors{},
+		queues:  map[schema.GroupVersionKind]*requeueQueue{},
+	}
+}
+
+// queue returns the channel used to requeue objects of the given type.
+func (idx *namespaceIndex) queue(gvk schema.GroupVersionKind) chan event.GenericEvent {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	q, ok := idx.queues[gvk]
+	if !ok {
+		q = newRequeueQueue()
+		idx.queues[gvk] = q
+		if idx.ctx != nil {
+			go q.run(idx.ctx)
+		}
+	}
+	return q.ch
+}
+
+// Start runs the senders of the queues until ctx is done.
+func (idx *namespaceIndex) Start(ctx context.Context) error {
+	idx.m.Lock()
+	idx.ctx = ctx
+	for _, q := range idx.queues {
+		go q.run(ctx)
+	}
+	idx.m.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+// RunRequeueQueues sends the objects requeued on namespace or descriptor changes to their
+// reconcilers until ctx is done. It must run as a Runnable of the manager running the reconcilers.
+func RunRequeueQueues(ctx context.Context) error {
+	return nsIndex.Start(ctx)
+}
+
+// track records the label selectors of the namespaces selected by the connections of an object.
+// Objects without selectors are not tracked.
+func (idx *namespaceIndex) track(oid apiv1.OID, gvk schema.GroupVersionKind, selectors []labels.Selector) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	if len(selectors) > 0 {
+		idx.sources[oid] = namespaceSelectors{gvk: gvk, selectors: selectors}
+	} else {
+		delete(idx.sources, oid)
+	}
+}
+
+// namespaceChanged requeues the tracked objects selecting the namespace by its old or new labels,
+// if the labels of the namespace changed. A nil ns means the namespace was deleted.
+func (idx *namespaceIndex) namespaceChanged(name string, ns *unstructured.Unstructured) {
+	for q, evs := range idx.selecting(name, ns) {
+		q.add(evs)
+	}
+}
+
+// selecting records the labels of the namespace and returns the events of the tracked objects to
+// requeue, per queue. The events are queued by the caller, without holding the lock.
+func (idx *namespaceIndex) selecting(name string, ns *unstructured.Unstructured) map[*requeueQueue][]event.GenericEvent {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+
+	old, found := idx.labels[name]
+	var cur labels.Set
+	if ns == nil {
+		if !found {
+			return nil
+		}
+		delete(idx.labels, name)
+	} else {
+		cur = labels.Set(ns.GetLabels())
+		if found && labels.Equals(old, cur) {
+			return nil
+		}
+		idx.labels[name] = cur
+	}
+
+	events := map[*requeueQueue][]event.GenericEvent{}
+	for oid, src := range idx.sources {
+		// the namespace was selected before or is selected now
+		if !(found && src.matches(old)) && !(ns != nil && src.matches(cur)) {
+			continue
+		}
+		q, ok := idx.queues[src.gvk]
+		if !ok {
+			continue
+		}
+		id, err := apiv1.ParseObjectID(oid)
+		if err != nil {
+			continue
+		}
+		var obj metav1.PartialObjectMetadata
+		obj.SetGroupVersionKind(src.gvk)
+		obj.SetNamespace(id.Namespace)
+		obj.SetName(id.Name)
+		events[q] = append(events[q], event.GenericEvent{Object: &obj})
+	}
+	return events
+}
+
+// requeue sends the objects to the reconciler of their type. It returns false if the type has no reconciler.
+func (idx *namespaceIndex) requeue(gvk schema.GroupVersionKind, evs []event.GenericEvent) bool {
+	idx.m.Lock()
+	q, ok := idx.queues[gvk]
+	idx.m.Unlock()
+	if !ok {
+		return false
+	}
+	q.add(evs)
+	return true
+}
+
+// watching returns true if the type has a reconciler.
+func (idx *namespaceIndex) watching(gvk schema.GroupVersionKind) bool {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	_, ok := idx.queues[gvk]
+	return ok
+}
+
+// namespaceLabelSelectors returns the label selectors of the NamespaceSelectors of the connections of src.
+func namespaceLabelSelectors(src *unstructured.Unstructured, connections []v1alpha1.ResourceConnection) []labels.Selector {
+	var out []labels.Selector
+	for _, c := range connections {
+		if c.NamespacePath == "" || c.NamespacePath == MetadataNamespace {
+			continue
+		}
+		var nsel NamespaceSelector
+		if ok, err := Extract(src, c.NamespacePath, &nsel); err != nil || !ok || !nsel.SelectsByLabel() {
+			continue
+		}
+		if sel, err := metav1.LabelSelectorAsSelector(&nsel.LabelSelector); err == nil {
+			out = append(out, sel)
+		}
+	}
+	return out
+}
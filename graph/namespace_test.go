@@ -0,0 +1,377 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func newNamespace(name string, lbls map[string]string) *core.Namespace {
+	return &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: lbls}}
+}
+
+func newServiceMonitor(namespace string, nsSelector map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "monitoring.coreos.com/v1",
+			"kind":       "ServiceMonitor",
+			"metadata": map[string]interface{}{
+				"namespace": namespace,
+				"name":      "app",
+			},
+			"spec": map[string]interface{}{
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						"app": "web",
+					},
+				},
+			},
+		},
+	}
+	if nsSelector != nil {
+		_ = unstructured.SetNestedMap(obj.Object, nsSelector, "spec", "namespaceSelector")
+	}
+	return obj
+}
+
+func TestNamespaces(t *testing.T) {
+	kc := newFakeClient(
+		newNamespace("monitoring", map[string]string{"team": "infra"}),
+		newNamespace("prod", map[string]string{"team": "web", "env": "prod"}),
+		newNamespace("staging", map[string]string{"team": "web", "env": "staging"}),
+		newNamespace("default", nil),
+	)
+	finder := ObjectFinder{Client: kc}
+
+	tests := []struct {
+		name       string
+		nsSelector map[string]interface{}
+		expected   []string
+	}{
+		{
+			name:       "missing selector",
+			nsSelector: nil,
+			expected:   nil,
+		},
+		{
+			name:       "empty selector",
+			nsSelector: map[string]interface{}{},
+			expected:   []string{"monitoring"},
+		},
+		{
+			name:       "any",
+			nsSelector: map[string]interface{}{"any": true},
+			expected:   nil,
+		},
+		{
+			name:       "match names",
+			nsSelector: map[string]interface{}{"matchNames": []interface{}{"prod", "default"}},
+			expected:   []string{"prod", "default"},
+		},
+		{
+			name: "match labels",
+			nsSelector: map[string]interface{}{
+				"matchLabels": map[string]interface{}{"team": "web"},
+			},
+			expected: []string{"prod", "staging"},
+		},
+		{
+			name: "match expressions",
+			nsSelector: map[string]interface{}{
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "env", "operator": "NotIn", "values": []interface{}{"prod"}},
+					map[string]interface{}{"key": "team", "operator": "Exists"},
+				},
+			},
+			expected: []string{"monitoring", "staging"},
+		},
+		{
+			name: "match labels and names",
+			nsSelector: map[string]interface{}{
+				"matchLabels": map[string]interface{}{"team": "web"},
+				"matchNames":  []interface{}{"staging", "default"},
+			},
+			expected: []string{"staging"},
+		},
+		{
+			name: "no matching namespace",
+			nsSelector: map[string]interface{}{
+				"matchLabels": map[string]interface{}{"team": "data"},
+			},
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newServiceMonitor("monitoring", test.nsSelector)
+			namespaces, err := finder.Namespaces(src, "spec.namespaceSelector")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(namespaces, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, namespaces)
+			}
+		})
+	}
+}
+
+// TestNamespacesWithoutClient checks that the package level Namespaces selects by name without a
+// client, and returns an error for label selectors instead of reading the Namespaces.
+func TestNamespacesWithoutClient(t *testing.T) {
+	src := newServiceMonitor("monitoring", map[string]interface{}{"matchNames": []interface{}{"prod"}})
+	namespaces, err := Namespaces(src, "spec.namespaceSelector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"prod"}; !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("expected %#v, got %#v", expected, namespaces)
+	}
+
+	src = newServiceMonitor("monitoring", map[string]interface{}{
+		"matchLabels": map[string]interface{}{"team": "web"},
+	})
+	if _, err := Namespaces(src, "spec.namespaceSelector"); err == nil {
+		t.Error("expected an error for a label selector")
+	}
+}
+
+func TestResourcesForNamespaceLabelSelector(t *testing.T) {
+	newService := func(namespace string) *core.Service {
+		return &core.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      "web",
+				Labels:    map[string]string{"app": "web"},
+			},
+		}
+	}
+	kc := newFakeClient(
+		newNamespace("monitoring", map[string]string{"team": "infra"}),
+		newNamespace("prod", map[string]string{"team": "web"}),
+		newNamespace("staging", map[string]string{"team": "web"}),
+		newNamespace("default", nil),
+		newService("monitoring"),
+		newService("prod"),
+		newService("staging"),
+		newService("default"),
+	)
+	finder := ObjectFinder{Client: kc}
+
+	src := newServiceMonitor("monitoring", map[string]interface{}{
+		"matchLabels": map[string]interface{}{"team": "web"},
+	})
+	e := &Edge{
+		Src: src.GroupVersionKind(),
+		Dst: schema.GroupVersionKind{Version: "v1", Kind: "Service"},
+		Connection: v1alpha1.ResourceConnectionSpec{
+			Type:          v1alpha1.MatchSelector,
+			NamespacePath: "spec.namespaceSelector",
+			SelectorPath:  "spec.selector",
+		},
+		Forward: true,
+	}
+	objs, err := finder.ResourcesFor(src, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objs {
+		got = append(got, obj.GetNamespace())
+	}
+	sort.Strings(got)
+	if expected := []string{"prod", "staging"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected services in %v, got %v", expected, got)
+	}
+
+	selectors := namespaceLabelSelectors(src, []v1alpha1.ResourceConnection{{ResourceConnectionSpec: e.Connection}})
+	if len(selectors) != 1 {
+		t.Fatalf("expected connection to select namespaces by label, got %v", selectors)
+	}
+	if !selectors[0].Matches(labels.Set{"team": "web"}) || selectors[0].Matches(labels.Set{"team": "infra"}) {
+		t.Errorf("unexpected namespace selector %v", selectors[0])
+	}
+}
+
+func TestNamespaceIndex(t *testing.T) {
+	smGVK := schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	sm := apiv1.ObjectID{Group: smGVK.Group, Kind: smGVK.Kind, Namespace: "monitoring", Name: "app"}
+
+	idx := newNamespaceIndex()
+	ch := idx.queue(smGVK)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = idx.Start(ctx) }()
+	idx.track(sm.OID(), smGVK, []labels.Selector{labels.SelectorFromSet(labels.Set{"team": "web"})})
+
+	ns := func(lbls map[string]string) *unstructured.Unstructured {
+		var obj unstructured.Unstructured
+		obj.SetName("prod")
+		obj.SetLabels(lbls)
+		return &obj
+	}
+	expectEvent := func(t *testing.T, expected bool) {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			if !expected {
+				t.Fatalf("unexpected event for %s/%s", ev.Object.GetNamespace(), ev.Object.GetName())
+			}
+			if ev.Object.GetNamespace() != sm.Namespace || ev.Object.GetName() != sm.Name {
+				t.Errorf("expected event for %s/%s, got %s/%s", sm.Namespace, sm.Name, ev.Object.GetNamespace(), ev.Object.GetName())
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expected {
+				t.Fatal("expected event")
+			}
+		}
+	}
+
+	t.Run("new namespace", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "web"}))
+		expectEvent(t, true)
+	})
+	t.Run("unchanged labels", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "web"}))
+		expectEvent(t, false)
+	})
+	t.Run("changed labels no longer selected", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "data"}))
+		expectEvent(t, true)
+	})
+	t.Run("changed labels never selected", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "ml"}))
+		expectEvent(t, false)
+	})
+	t.Run("deleted namespace never selected", func(t *testing.T) {
+		idx.namespaceChanged("prod", nil)
+		expectEvent(t, false)
+	})
+	t.Run("new namespace not selected", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "data"}))
+		expectEvent(t, false)
+	})
+	t.Run("changed labels selected", func(t *testing.T) {
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "web", "tier": "gold"}))
+		expectEvent(t, true)
+	})
+	t.Run("deleted namespace", func(t *testing.T) {
+		idx.namespaceChanged("prod", nil)
+		expectEvent(t, true)
+	})
+	t.Run("untracked object", func(t *testing.T) {
+		idx.track(sm.OID(), smGVK, nil)
+		idx.namespaceChanged("prod", ns(map[string]string{"team": "web"}))
+		expectEvent(t, false)
+	})
+}
+
+// TestRequeueQueue checks that requeues to a busy reconciler don't pile up goroutines and that
+// every requeued object is sent.
+func TestRequeueQueue(t *testing.T) {
+	smGVK := schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	idx := newNamespaceIndex()
+	ch := idx.queue(smGVK)
+
+	evs := make([]event.GenericEvent, 2000)
+	for i := range evs {
+		var obj metav1.PartialObjectMetadata
+		obj.SetGroupVersionKind(smGVK)
+		obj.SetNamespace("monitoring")
+		obj.SetName(fmt.Sprintf("app-%d", i))
+		evs[i] = event.GenericEvent{Object: &obj}
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if !idx.requeue(smGVK, evs) {
+			t.Fatal("expected a reconciler")
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Errorf("expected no goroutines per requeue, got %d more", n)
+	}
+
+	// the objects requeued before the senders start are sent once they do
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = idx.Start(ctx) }()
+
+	received := map[string]bool{}
+	for len(received) < len(evs) {
+		select {
+		case ev := <-ch:
+			received[ev.Object.GetName()] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d objects, got %d", len(evs), len(received))
+		}
+	}
+}
+
+// TestRequeueQueueStop checks that the senders stop with the context of the manager, even if
+// the reconciler doesn't receive the requeued objects.
+func TestRequeueQueueStop(t *testing.T) {
+	smGVK := schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	idx := newNamespaceIndex()
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = idx.Start(ctx)
+		close(done)
+	}()
+	idx.queue(smGVK)
+
+	evs := make([]event.GenericEvent, 2000)
+	for i := range evs {
+		var obj metav1.PartialObjectMetadata
+		obj.SetGroupVersionKind(smGVK)
+		obj.SetNamespace("monitoring")
+		obj.SetName(fmt.Sprintf("app-%d", i))
+		evs[i] = event.GenericEvent{Object: &obj}
+	}
+	// more objects than the channel holds, so the sender blocks
+	idx.requeue(smGVK, evs)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Start to return")
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the senders to stop, got %d more goroutines", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
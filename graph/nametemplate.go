@@ -0,0 +1,196 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// nameTemplate is the name template of a MatchName connection, e.g. {.metadata.name}-{.spec.shard}-auth.
+// It is a sequence of literal text and jsonpath placeholders evaluated against the source.
+type nameTemplate struct {
+	segments []nameSegment
+}
+
+type nameSegment struct {
+	literal string
+	query   string        // the placeholder, empty for literal text
+	path    *compiledPath // nil for literal text and the name and namespace of the source
+}
+
+func compileNameTemplate(template string) (*nameTemplate, error) {
+	t := &nameTemplate{}
+	appendLiteral := func(s string) {
+		if s == "" {
+			return
+		}
+		if n := len(t.segments); n > 0 && t.segments[n-1].query == "" {
+			t.segments[n-1].literal += s
+			return
+		}
+		t.segments = append(t.segments, nameSegment{literal: s})
+	}
+
+	rest := template
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			appendLiteral(rest)
+			break
+		}
+		appendLiteral(rest[:start])
+
+		end, depth := -1, 0
+		for i := start; i < len(rest) && end < 0; i++ {
+			switch rest[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder at %q", rest[start:])
+		}
+
+		seg := nameSegment{query: rest[start : end+1]}
+		if seg.query != MetadataNameQuery && seg.query != MetadataNamespaceQuery {
+			path, err := parseJSONPath(seg.query)
+			if err != nil {
+				return nil, err
+			}
+			if path.ranged {
+				return nil, fmt.Errorf("placeholder %s can't use range", seg.query)
+			}
+			seg.path = path
+		}
+		t.segments = append(t.segments, seg)
+		rest = rest[end+1:]
+	}
+	return t, nil
+}
+
+// has returns true if the template has the placeholder.
+func (t *nameTemplate) has(query string) bool {
+	for _, seg := range t.segments {
+		if seg.query == query {
+			return true
+		}
+	}
+	return false
+}
+
+// eval returns the name generated for obj. It returns false if any placeholder is empty.
+func (t *nameTemplate) eval(obj *unstructured.Unstructured) (string, bool, error) {
+	var sb strings.Builder
+	for _, seg := range t.segments {
+		var v string
+		switch {
+		case seg.query == "":
+			v = seg.literal
+		case seg.query == MetadataNameQuery:
+			v = obj.GetName()
+		case seg.query == MetadataNamespaceQuery:
+			v = obj.GetNamespace()
+		default:
+			buf, err := seg.path.execute(obj.Object)
+			if err != nil {
+				return "", false, fmt.Errorf("fails to evaluate %s. err:%v", seg.query, err)
+			}
+			v = strings.TrimSpace(buf.String())
+		}
+		if v == "" {
+			return "", false, nil
+		}
+		sb.WriteString(v)
+	}
+	return sb.String(), true, nil
+}
+
+// match returns every assignment of the placeholders that generates the name. A placeholder used
+// more than once takes the same value everywhere. Placeholders are never empty. More than one
+// assignment is returned if the placeholders are ambiguous, e.g. matching my-db-0-auth against
+// {.metadata.name}-{.spec.shard}-auth gives name my with shard db-0 and name my-db with shard 0.
+func (t *nameTemplate) match(name string) []map[string]string {
+	var out []map[string]string
+	values := map[string]string{}
+
+	var visit func(i int, rest string)
+	visit = func(i int, rest string) {
+		if i == len(t.segments) {
+			if rest == "" {
+				m := make(map[string]string, len(values))
+				for k, v := range values {
+					m[k] = v
+				}
+				out = append(out, m)
+			}
+			return
+		}
+
+		seg := t.segments[i]
+		if seg.query == "" {
+			if strings.HasPrefix(rest, seg.literal) {
+				visit(i+1, rest[len(seg.literal):])
+			}
+			return
+		}
+		if v, ok := values[seg.query]; ok {
+			if strings.HasPrefix(rest, v) {
+				visit(i+1, rest[len(v):])
+			}
+			return
+		}
+		// a placeholder followed by text ends where the text occurs, the last placeholder takes the rest
+		next := ""
+		if i+1 < len(t.segments) {
+			next = t.segments[i+1].literal
+		}
+		for n := 1; n <= len(rest); n++ {
+			if i+1 == len(t.segments) && n < len(rest) {
+				continue
+			}
+			if next != "" && !strings.HasPrefix(rest[n:], next) {
+				continue
+			}
+			values[seg.query] = rest[:n]
+			visit(i+1, rest[n:])
+		}
+		delete(values, seg.query)
+	}
+	visit(0, name)
+	return out
+}
+
+// values returns the distinct values of the placeholder over the assignments that generate the name.
+func (t *nameTemplate) values(name, query string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range t.match(name) {
+		if v, ok := m[query]; ok && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,220 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCompileNameTemplate(t *testing.T) {
+	for _, template := range []string{
+		"{.metadata.name",
+		"{.metadata.name}-{.spec.shard[}",
+		`{range .spec.shards[*]}{.name}{end}`,
+	} {
+		if _, err := compileNameTemplate(template); err == nil {
+			t.Errorf("expected %q to fail to compile", template)
+		}
+	}
+}
+
+func TestNameTemplateEval(t *testing.T) {
+	obj := newTestObject(sourceGVK, "demo", "my-db", map[string]string{"app.kubernetes.io/instance": "web"})
+	obj.SetAnnotations(map[string]string{"shard": "0"})
+	_ = unstructured.SetNestedField(obj.Object, "shard", "spec", "topology", "prefix")
+
+	tests := []struct {
+		template string
+		expected string
+		ok       bool
+	}{
+		{template: "{.metadata.name}-auth", expected: "my-db-auth", ok: true},
+		{template: "{.metadata.namespace}.{.metadata.name}", expected: "demo.my-db", ok: true},
+		{template: `{.metadata.labels.app\.kubernetes\.io/instance}-cfg`, expected: "web-cfg", ok: true},
+		{template: "{.metadata.name}-{.spec.topology.prefix}{.metadata.annotations.shard}-auth", expected: "my-db-shard0-auth", ok: true},
+		{template: "{.metadata.name}-{.spec.missing}-auth", ok: false},
+		{template: "static", expected: "static", ok: true},
+	}
+	for _, test := range tests {
+		nt, err := compileNameTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, ok, err := nt.eval(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.expected || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.template, test.expected, test.ok, name, ok)
+		}
+	}
+}
+
+func TestNameTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		name     string
+		expected []map[string]string
+	}{
+		{
+			template: "{.metadata.name}-{.spec.shard}-auth",
+			name:     "my-db-0-auth",
+			expected: []map[string]string{
+				{MetadataNameQuery: "my", "{.spec.shard}": "db-0"},
+				{MetadataNameQuery: "my-db", "{.spec.shard}": "0"},
+			},
+		},
+		{
+			template: "{.metadata.name}{.spec.suffix}",
+			name:     "ab",
+			expected: []map[string]string{
+				{MetadataNameQuery: "a", "{.spec.suffix}": "b"},
+			},
+		},
+		{
+			template: "{.metadata.namespace}.{.metadata.name}.{.metadata.namespace}",
+			name:     "a.b.c.a.b",
+			expected: []map[string]string{
+				{MetadataNamespaceQuery: "a.b", MetadataNameQuery: "c"},
+			},
+		},
+		{
+			template: "{.metadata.name}-auth",
+			name:     "-auth",
+		},
+		{
+			template: "{.metadata.name}-auth",
+			name:     "my-db-cfg",
+		},
+	}
+	for _, test := range tests {
+		nt, err := compileNameTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := nt.match(test.name)
+		sort.Slice(got, func(i, j int) bool {
+			return got[i][MetadataNameQuery] < got[j][MetadataNameQuery]
+		})
+		if len(got) != len(test.expected) || (len(got) > 0 && !reflect.DeepEqual(got, test.expected)) {
+			t.Errorf("%s ~ %s: expected %v, got %v", test.template, test.name, test.expected, got)
+		}
+	}
+}
+
+// TestResourcesForNameTemplate checks a MatchName connection whose name template matches
+// the names of its targets in more than one way, like the auth secrets of sharded databases.
+func TestResourcesForNameTemplate(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(sourceGVK, meta.RESTScopeNamespace)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+
+	newShard := func(namespace, name, shard string) *unstructured.Unstructured {
+		obj := newTestObject(sourceGVK, namespace, name, nil)
+		if shard != "" {
+			_ = unstructured.SetNestedField(obj.Object, shard, "spec", "shard")
+		}
+		return obj
+	}
+	kc := offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			newShard("a", "my", "db-0"),
+			newShard("a", "my-db", "0"),
+			newShard("a", "my-db-0", ""),
+			newShard("b", "my-db", "0"),
+			newTestObject(targetGVK, "a", "my-db-0-auth", nil),
+			newTestObject(targetGVK, "b", "my-db-0-auth", nil),
+			newTestObject(targetGVK, "b", "other-auth", nil),
+		).Build(),
+		mapper: mapper,
+	}
+	finder := ObjectFinder{Client: kc}
+
+	spec := v1alpha1.ResourceConnectionSpec{
+		Type:          v1alpha1.MatchName,
+		NameTemplate:  "{.metadata.name}-{.spec.shard}-auth",
+		NamespacePath: MetadataNamespace,
+	}
+	forward := &Edge{Src: sourceGVK, Dst: targetGVK, Connection: spec, Forward: true}
+	backward := &Edge{Src: targetGVK, Dst: sourceGVK, Connection: spec}
+
+	fwd := map[string][]string{
+		"a/my":      {"a/my-db-0-auth"},
+		"a/my-db":   {"a/my-db-0-auth"},
+		"a/my-db-0": {},
+		"b/my-db":   {"b/my-db-0-auth"},
+	}
+	for key, expected := range fwd {
+		var obj unstructured.Unstructured
+		obj.SetGroupVersionKind(sourceGVK)
+		if err := kc.Get(context.TODO(), objectKey(key), &obj); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := finder.ResourcesFor(&obj, forward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+			t.Errorf("forward from %s: expected %v, got %v", key, expected, got)
+		}
+	}
+
+	bwd := map[string][]string{
+		"a/my-db-0-auth": {"a/my", "a/my-db"},
+		"b/my-db-0-auth": {"b/my-db"},
+		"b/other-auth":   {},
+	}
+	for key, expected := range bwd {
+		var obj unstructured.Unstructured
+		obj.SetGroupVersionKind(targetGVK)
+		if err := kc.Get(context.TODO(), objectKey(key), &obj); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := finder.ResourcesFor(&obj, backward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+			t.Errorf("backward from %s: expected %v, got %v", key, expected, got)
+		}
+	}
+}
+
+func objectKey(s string) client.ObjectKey {
+	parts := strings.SplitN(s, "/", 2)
+	return client.ObjectKey{Namespace: parts[0], Name: parts[1]}
+}
+
+func keyStrings(objs []*unstructured.Unstructured) []string {
+	out := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		out = append(out, client.ObjectKeyFromObject(obj).String())
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,279 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/apiversion"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// LoadManifests reads Kubernetes objects from YAML and JSON files. Directories are walked recursively.
+// A path of "-" reads from stdin. Multi document YAML files (eg, rendered Helm charts) and
+// List objects (eg, kubectl get -o yaml) are expanded into individual objects.
+func LoadManifests(paths ...string) ([]*unstructured.Unstructured, error) {
+	var out []*unstructured.Unstructured
+	for _, path := range paths {
+		if path == "-" {
+			objs, err := decodeManifests(os.Stdin)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read stdin")
+			}
+			out = append(out, objs...)
+			continue
+		}
+
+		err := filepath.WalkDir(path, func(filename string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(filename))
+			if filename != path && ext != ".yaml" && ext != ".yml" && ext != ".json" {
+				return nil
+			}
+
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			objs, err := decodeManifests(f)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", filename)
+			}
+			out = append(out, objs...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func decodeManifests(r io.Reader) ([]*unstructured.Unstructured, error) {
+	var out []*unstructured.Unstructured
+
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var obj unstructured.Unstructured
+		err := decoder.Decode(&obj.Object)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(obj.Object) == 0 {
+			continue // empty document
+		}
+
+		if obj.IsList() {
+			err = obj.EachListItem(func(item runtime.Object) error {
+				u, ok := item.(*unstructured.Unstructured)
+				if !ok {
+					return fmt.Errorf("unexpected list item of type %T", item)
+				}
+				out = append(out, u)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if obj.GetKind() == "" {
+			return nil, fmt.Errorf("object %s is missing kind", obj.GetName())
+		}
+		out = append(out, &obj)
+	}
+	return out, nil
+}
+
+// LoadRESTMapper builds a RESTMapper from a static discovery file. The file can be one of
+//   - a list of metav1.APIResourceList, eg, apis.json
+//   - a list of apiv1.ResourceID, eg, rs.json
+//   - a list of restmapper.APIGroupResources, eg, resources.json
+func LoadRESTMapper(filename string) (meta.RESTMapper, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var probe []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse discovery file %s", filename)
+	}
+	if len(probe) == 0 {
+		return nil, fmt.Errorf("discovery file %s is empty", filename)
+	}
+
+	var groups []*restmapper.APIGroupResources
+	if _, ok := probe[0]["groupVersion"]; ok {
+		var lists []metav1.APIResourceList
+		if err := json.Unmarshal(data, &lists); err != nil {
+			return nil, err
+		}
+		groups = apiResourceListsToGroups(lists)
+	} else if _, ok := probe[0]["VersionedResources"]; ok {
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return nil, err
+		}
+	} else if _, ok := probe[0]["kind"]; ok {
+		var rids []apiv1.ResourceID
+		if err := json.Unmarshal(data, &rids); err != nil {
+			return nil, err
+		}
+		lists := make([]metav1.APIResourceList, 0, len(rids))
+		for _, rid := range rids {
+			lists = append(lists, metav1.APIResourceList{
+				GroupVersion: rid.GroupVersion().String(),
+				APIResources: []metav1.APIResource{
+					{
+						Name:       rid.Name,
+						Namespaced: rid.Scope == apiv1.NamespaceScoped,
+						Kind:       rid.Kind,
+						Verbs:      metav1.Verbs{"get", "list", "watch"},
+					},
+				},
+			})
+		}
+		groups = apiResourceListsToGroups(lists)
+	} else {
+		return nil, fmt.Errorf("unknown format of discovery file %s", filename)
+	}
+	return restmapper.NewDiscoveryRESTMapper(groups), nil
+}
+
+func apiResourceListsToGroups(lists []metav1.APIResourceList) []*restmapper.APIGroupResources {
+	m := map[string]*restmapper.APIGroupResources{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		g, ok := m[gv.Group]
+		if !ok {
+			g = &restmapper.APIGroupResources{
+				Group:              metav1.APIGroup{Name: gv.Group},
+				VersionedResources: map[string][]metav1.APIResource{},
+			}
+			m[gv.Group] = g
+		}
+		if _, ok := g.VersionedResources[gv.Version]; !ok {
+			g.Group.Versions = append(g.Group.Versions, metav1.GroupVersionForDiscovery{
+				GroupVersion: gv.String(),
+				Version:      gv.Version,
+			})
+		}
+		g.VersionedResources[gv.Version] = append(g.VersionedResources[gv.Version], list.APIResources...)
+	}
+
+	groups := make([]*restmapper.APIGroupResources, 0, len(m))
+	for _, g := range m {
+		sort.Slice(g.Group.Versions, func(i, j int) bool {
+			return apiversion.MustCompare(g.Group.Versions[i].Version, g.Group.Versions[j].Version) > 0
+		})
+		g.Group.PreferredVersion = g.Group.Versions[0]
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// offlineClient is an in-memory client with a static RESTMapper.
+type offlineClient struct {
+	client.Client
+	mapper meta.RESTMapper
+}
+
+func (c offlineClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+// NewOfflineClient returns an in-memory client serving the given objects. Namespaced objects
+// without a namespace are moved into defaultNamespace, like kubectl apply does.
+func NewOfflineClient(mapper meta.RESTMapper, defaultNamespace string, objs ...*unstructured.Unstructured) (client.Client, error) {
+	if defaultNamespace == "" {
+		defaultNamespace = metav1.NamespaceDefault
+	}
+
+	initObjs := make([]client.Object, 0, len(objs))
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to detect mapping for %v", gvk)
+		}
+		if mapping.Scope == meta.RESTScopeNamespace && obj.GetNamespace() == "" {
+			obj.SetNamespace(defaultNamespace)
+		}
+		initObjs = append(initObjs, obj)
+	}
+
+	kc := fake.NewClientBuilder().
+		WithScheme(runtime.NewScheme()).
+		WithObjects(initObjs...).
+		Build()
+	return offlineClient{Client: kc, mapper: mapper}, nil
+}
+
+// BuildGraph computes the connections of every object using the ResourceDescriptors in the Registry.
+// Connections that fail to evaluate are logged and left out of the graph.
+func BuildGraph(kc client.Client, objs []*unstructured.Unstructured) (*ObjectGraph, error) {
+	g := NewObjectGraph()
+	finder := ObjectFinder{Client: kc}
+	for _, obj := range objs {
+		if uid := obj.GetUID(); uid != "" {
+			g.SetUID(apiv1.NewObjectID(obj).OID(), uid)
+		}
+		rd, err := Registry.LoadByGVK(obj.GroupVersionKind())
+		if err != nil {
+			continue // no connections known for this type
+		}
+		result, err := finder.ListConnectedObjectIDs(obj, rd.Spec.Connections)
+		var failed ConnectionErrors
+		if errors.As(err, &failed) {
+			klog.Warningf("failed to list some connections of %s: %v", apiv1.NewObjectID(obj).OID(), err)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to list connections of %s", apiv1.NewObjectID(obj).OID())
+		}
+		g.Update(apiv1.NewObjectID(obj).OID(), result)
+	}
+	return g, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestLoadRESTMapper(t *testing.T) {
+	for _, filename := range []string{"../apis.json", "../rs.json"} {
+		t.Run(filename, func(t *testing.T) {
+			mapper, err := LoadRESTMapper(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mapping, err := mapper.RESTMapping(schema.GroupKind{Group: "apps", Kind: "Deployment"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mapping.Resource.Resource != "deployments" {
+				t.Errorf("expected resource deployments, got %s", mapping.Resource.Resource)
+			}
+		})
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	mapper, err := LoadRESTMapper("../rs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := LoadManifests("testdata/offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 5 {
+		t.Fatalf("expected 5 objects, got %d", len(objs))
+	}
+	kc, err := NewOfflineClient(mapper, "demo", objs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := BuildGraph(kc, objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for src, connsPerLabel := range connectionsOf(g) {
+		for label, conns := range connsPerLabel {
+			for dst := range conns {
+				got = append(got, string(src)+" -"+string(label)+"-> "+string(dst))
+			}
+		}
+	}
+	sort.Strings(got)
+
+	expected := []string{
+		"G=,K=Pod,NS=demo,N=web-6d4cf56db6-x7k2p -offshoot-> G=,K=Secret,NS=demo,N=web-auth",
+		"G=,K=Service,NS=demo,N=web -exposed_by-> G=,K=Pod,NS=demo,N=web-6d4cf56db6-x7k2p",
+		"G=apps,K=Deployment,NS=demo,N=web -offshoot-> G=apps,K=ReplicaSet,NS=demo,N=web-6d4cf56db6",
+		"G=apps,K=ReplicaSet,NS=demo,N=web-6d4cf56db6 -offshoot-> G=,K=Pod,NS=demo,N=web-6d4cf56db6-x7k2p",
+		"G=apps,K=ReplicaSet,NS=demo,N=web-6d4cf56db6 -offshoot-> G=apps,K=Deployment,NS=demo,N=web",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
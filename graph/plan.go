@@ -0,0 +1,482 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/pkg/errors"
+	"gomodules.xyz/jsonpath"
+	crdv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// ConnectionPlan is a ResourceConnectionSpec compiled for evaluation. The jsonpaths of its references
+// and selector templates are parsed, its name template is split into literal text and placeholders
+// and a selector without templates is evaluated once.
+type ConnectionPlan struct {
+	Spec v1alpha1.ResourceConnectionSpec
+
+	references []*compiledPath
+	name       *nameTemplate
+	selector   *selectorTemplate
+	value      *valuePath
+	predicates []cel.Program
+	// fields are the fields of the source read by the connection
+	fields sourceFields
+}
+
+// valuePath is the label or annotation of the targets of a MatchValue connection.
+type valuePath struct {
+	annotation bool
+	key        string
+}
+
+func parseValuePath(path string) (*valuePath, error) {
+	path = strings.TrimPrefix(path, ".")
+	if key := strings.TrimPrefix(path, MetadataLabels+"."); key != path && key != "" {
+		return &valuePath{key: key}, nil
+	}
+	if key := strings.TrimPrefix(path, MetadataAnnotations+"."); key != path && key != "" {
+		return &valuePath{annotation: true, key: key}, nil
+	}
+	return nil, fmt.Errorf("%q is not the path of a label or annotation", path)
+}
+
+// get returns the value of the label or annotation of obj.
+func (p *valuePath) get(obj *unstructured.Unstructured) (string, bool) {
+	m := obj.GetLabels()
+	if p.annotation {
+		m = obj.GetAnnotations()
+	}
+	v, ok := m[p.key]
+	return v, ok && v != ""
+}
+
+// selectorTemplate is a label selector whose values may be jsonpath templates evaluated against the source.
+type selectorTemplate struct {
+	in        *metav1.LabelSelector
+	static    labels.Selector // set if the selector has no templates
+	templates map[string]*compiledPath
+}
+
+// compiledPath is a parsed jsonpath template.
+type compiledPath struct {
+	text   string
+	parsed *jsonpath.JSONPath
+	// ranged is set if the template has a range. JSONPath rewrites its parse tree while executing
+	// a range, so such templates are parsed again for every evaluation.
+	ranged bool
+}
+
+// CompileConnection compiles the connection. It returns an error if the connection is incomplete
+// or any of its templates can't be parsed.
+func CompileConnection(spec v1alpha1.ResourceConnectionSpec) (*ConnectionPlan, error) {
+	p, errs := compileConnection(spec, nil)
+	if len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	return p, nil
+}
+
+// ValidateConnection returns the errors of the connection with their paths under fldPath.
+func ValidateConnection(spec v1alpha1.ResourceConnectionSpec, fldPath *field.Path) field.ErrorList {
+	_, errs := compileConnection(spec, fldPath)
+	return errs
+}
+
+// ConnectionTypes lists the supported connection types.
+var ConnectionTypes = []string{
+	string(v1alpha1.MatchName),
+	string(v1alpha1.MatchRef),
+	string(v1alpha1.MatchSelector),
+	string(v1alpha1.OwnedBy),
+	string(MatchValue),
+	string(MatchExpression),
+}
+
+func compileConnection(spec v1alpha1.ResourceConnectionSpec, fldPath *field.Path) (*ConnectionPlan, field.ErrorList) {
+	p := &ConnectionPlan{Spec: spec}
+	var errs field.ErrorList
+	var err error
+	switch spec.Type {
+	case v1alpha1.MatchName:
+		p.name, errs = compileRequiredNameTemplate(spec.NameTemplate, fldPath.Child("nameTemplate"))
+	case v1alpha1.MatchRef:
+		if len(spec.References) == 0 {
+			errs = append(errs, field.Required(fldPath.Child("references"), ""))
+		}
+		for i, ref := range spec.References {
+			j, err := parseJSONPath(ref)
+			if err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("references").Index(i), ref, err.Error()))
+				continue
+			}
+			p.references = append(p.references, j)
+		}
+	case v1alpha1.MatchSelector:
+		if spec.SelectorPath == "" && spec.Selector == nil {
+			errs = append(errs, field.Required(fldPath.Child("selector"), "selectorPath or selector is required"))
+		}
+		if spec.SelectorPath == "" && spec.Selector != nil {
+			p.selector, err = compileSelectorTemplate(spec.Selector)
+			if err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("selector"), spec.Selector, err.Error()))
+			}
+		}
+	case MatchValue:
+		p.name, errs = compileRequiredNameTemplate(spec.NameTemplate, fldPath.Child("nameTemplate"))
+		p.value, err = parseValuePath(spec.TargetLabelPath)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("targetLabelPath"), spec.TargetLabelPath, err.Error()))
+		}
+	case MatchExpression:
+		errs = compileExpressionConnection(p, fldPath)
+	case v1alpha1.OwnedBy:
+		if spec.Level == "" {
+			errs = append(errs, field.Required(fldPath.Child("level"), "level should be Owner or Controller"))
+		} else if spec.Level != v1alpha1.Owner && spec.Level != v1alpha1.Controller {
+			errs = append(errs, field.NotSupported(fldPath.Child("level"), spec.Level, []string{string(v1alpha1.Owner), string(v1alpha1.Controller)}))
+		}
+	case "":
+		errs = append(errs, field.Required(fldPath.Child("type"), ""))
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("type"), spec.Type, ConnectionTypes))
+	}
+	if len(errs) == 0 {
+		p.fields = p.readFields()
+	}
+	return p, errs
+}
+
+func compileRequiredNameTemplate(template string, fldPath *field.Path) (*nameTemplate, field.ErrorList) {
+	if template == "" {
+		return nil, field.ErrorList{field.Required(fldPath, "")}
+	}
+	t, err := compileNameTemplate(template)
+	if err != nil {
+		return nil, field.ErrorList{field.Invalid(fldPath, template, err.Error())}
+	}
+	return t, nil
+}
+
+func parseJSONPath(text string) (*compiledPath, error) {
+	j := jsonpath.New("jsonpath")
+	j.AllowMissingKeys(true)
+	if err := j.Parse(text); err != nil {
+		return nil, err
+	}
+	p, err := jsonpath.Parse("jsonpath", text)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledPath{
+		text:   text,
+		parsed: j,
+		ranged: hasRange(p.Root),
+	}, nil
+}
+
+func hasRange(node jsonpath.Node) bool {
+	switch n := node.(type) {
+	case *jsonpath.ListNode:
+		for _, child := range n.Nodes {
+			if hasRange(child) {
+				return true
+			}
+		}
+	case *jsonpath.IdentifierNode:
+		return n.Name == "range"
+	}
+	return false
+}
+
+// execute evaluates the template. JSONPath keeps state while executing, so each evaluation runs on
+// a copy sharing the parse tree and the cached JSONPath is never executed itself.
+func (c *compiledPath) execute(data interface{}) (*bytes.Buffer, error) {
+	j := *c.parsed
+	if c.ranged {
+		j = *jsonpath.New("jsonpath").AllowMissingKeys(true)
+		if err := j.Parse(c.text); err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := j.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func compileSelectorTemplate(in *metav1.LabelSelector) (*selectorTemplate, error) {
+	t := &selectorTemplate{
+		in:        in,
+		templates: map[string]*compiledPath{},
+	}
+	add := func(v string) error {
+		if len(v) < 2 || v[0] != '{' || v[len(v)-1] != '}' {
+			return nil
+		}
+		if _, ok := t.templates[v]; ok {
+			return nil
+		}
+		j, err := parseJSONPath(v)
+		if err != nil {
+			return errors.Wrapf(err, "fails to parse value %q of selector key", v)
+		}
+		t.templates[v] = j
+		return nil
+	}
+	for k, v := range in.MatchLabels {
+		if strings.ContainsRune(k, '{') {
+			return nil, fmt.Errorf("invalid selector key %v", k)
+		}
+		if err := add(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, expr := range in.MatchExpressions {
+		if strings.ContainsRune(expr.Key, '{') {
+			return nil, fmt.Errorf("selector has invalid key %v", expr.Key)
+		}
+		for _, v := range expr.Values {
+			if err := add(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(t.templates) == 0 {
+		sel, err := metav1.LabelSelectorAsSelector(in)
+		if err != nil {
+			return nil, err
+		}
+		t.static = sel
+	}
+	return t, nil
+}
+
+// eval returns the selector with its templates evaluated against obj.
+func (t *selectorTemplate) eval(obj *unstructured.Unstructured) (labels.Selector, error) {
+	if t.static != nil {
+		return t.static, nil
+	}
+
+	value := func(v string) (string, error) {
+		switch v {
+		case MetadataNameQuery:
+			return obj.GetName(), nil
+		case MetadataNamespaceQuery:
+			return obj.GetNamespace(), nil
+		}
+		j, ok := t.templates[v]
+		if !ok {
+			return v, nil
+		}
+		buf, err := j.execute(obj.Object)
+		if err != nil {
+			return "", fmt.Errorf("fails to evaluate value of selector key. err:%v", err)
+		}
+		return strings.TrimSpace(buf.String()), nil
+	}
+
+	out := t.in.DeepCopy()
+	var err error
+	for k, v := range out.MatchLabels {
+		if out.MatchLabels[k], err = value(v); err != nil {
+			return nil, err
+		}
+	}
+	for i := range out.MatchExpressions {
+		for vi, v := range out.MatchExpressions[i].Values {
+			if out.MatchExpressions[i].Values[vi], err = value(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return metav1.LabelSelectorAsSelector(out)
+}
+
+// ConnectionPlans caches the compiled connections, keyed by their spec.
+type ConnectionPlans struct {
+	m     sync.RWMutex
+	plans map[string]*ConnectionPlan
+	errs  map[string]error
+}
+
+func NewConnectionPlans() *ConnectionPlans {
+	return &ConnectionPlans{
+		plans: map[string]*ConnectionPlan{},
+		errs:  map[string]error{},
+	}
+}
+
+// planKey returns a key identifying the fields of the spec used by the plan.
+func planKey(spec v1alpha1.ResourceConnectionSpec) string {
+	var sb strings.Builder
+	sb.WriteString(string(spec.Type))
+	sb.WriteByte(0)
+	sb.WriteString(spec.NameTemplate)
+	sb.WriteByte(0)
+	sb.WriteString(spec.SelectorPath)
+	sb.WriteByte(0)
+	sb.WriteString(spec.TargetLabelPath)
+	sb.WriteByte(0)
+	sb.WriteString(spec.NamespacePath)
+	sb.WriteByte(0)
+	sb.WriteString(string(spec.Level))
+	for _, ref := range spec.References {
+		sb.WriteByte(0)
+		sb.WriteString(ref)
+	}
+	if spec.Selector != nil {
+		sb.WriteByte(1)
+		keys := make([]string, 0, len(spec.Selector.MatchLabels))
+		for k := range spec.Selector.MatchLabels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteString(k)
+			sb.WriteByte('=')
+			sb.WriteString(spec.Selector.MatchLabels[k])
+			sb.WriteByte(0)
+		}
+		for _, expr := range spec.Selector.MatchExpressions {
+			sb.WriteString(expr.Key)
+			sb.WriteString(string(expr.Operator))
+			sb.WriteString(strings.Join(expr.Values, ","))
+			sb.WriteByte(0)
+		}
+	}
+	return sb.String()
+}
+
+// Plan returns the compiled connection, compiling it on first use.
+func (p *ConnectionPlans) Plan(spec v1alpha1.ResourceConnectionSpec) (*ConnectionPlan, error) {
+	key := planKey(spec)
+
+	p.m.RLock()
+	plan, ok := p.plans[key]
+	err := p.errs[key]
+	p.m.RUnlock()
+	if ok || err != nil {
+		return plan, err
+	}
+
+	plan, err = CompileConnection(spec)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if err != nil {
+		p.errs[key] = err
+	} else {
+		p.plans[key] = plan
+	}
+	return plan, err
+}
+
+// has returns true if the spec is compiled, successfully or not.
+func (p *ConnectionPlans) has(spec v1alpha1.ResourceConnectionSpec) bool {
+	key := planKey(spec)
+
+	p.m.RLock()
+	defer p.m.RUnlock()
+	_, ok := p.plans[key]
+	_, failed := p.errs[key]
+	return ok || failed
+}
+
+// Prune evicts the plans and compile errors of the connections that no ResourceDescriptor in the
+// registry has, so connections removed or edited in place don't stay cached. It returns the number
+// of evicted connections.
+func (p *ConnectionPlans) Prune(reg *DescriptorRegistry) int {
+	referenced := map[string]bool{}
+	reg.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		for _, c := range rd.Spec.Connections {
+			referenced[planKey(c.ResourceConnectionSpec)] = true
+		}
+	})
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	n := 0
+	for key := range p.plans {
+		if !referenced[key] {
+			delete(p.plans, key)
+			n++
+		}
+	}
+	for key := range p.errs {
+		if !referenced[key] {
+			delete(p.errs, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Compile compiles the connections of every ResourceDescriptor in the registry and
+// returns the errors of the connections that fail to compile.
+func (p *ConnectionPlans) Compile(reg *DescriptorRegistry) error {
+	var errs []error
+	reg.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		errs = append(errs, p.compileDescriptor(rd, reg)...)
+	})
+	return utilerrors.NewAggregate(errs)
+}
+
+// CompileDescriptor compiles the connections of the ResourceDescriptor and returns the errors of
+// the connections that fail to compile. The predicates of MatchExpression connections are also
+// type checked against the schemas of the descriptors in the Registry.
+func (p *ConnectionPlans) CompileDescriptor(rd *v1alpha1.ResourceDescriptor) []error {
+	return p.compileDescriptor(rd, Registry)
+}
+
+func (p *ConnectionPlans) compileDescriptor(rd *v1alpha1.ResourceDescriptor, reg *DescriptorRegistry) []error {
+	var errs []error
+	for i, c := range rd.Spec.Connections {
+		if _, err := p.Plan(c.ResourceConnectionSpec); err != nil {
+			errs = append(errs, errors.Wrapf(err, "connection %d of %s to %s", i, rd.Name, c.Target.GroupVersionKind()))
+			continue
+		}
+		var target *crdv1.CustomResourceValidation
+		if trd, err := reg.LoadByGVK(c.Target.GroupVersionKind()); err == nil {
+			target = trd.Spec.Validation
+		}
+		if err := ValidateConnectionTypes(c.ResourceConnectionSpec, rd.Spec.Validation, target, nil).ToAggregate(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "connection %d of %s to %s", i, rd.Name, c.Target.GroupVersionKind()))
+		}
+	}
+	return errs
+}
+
+// CompileConnections compiles the connections in the Registry and reports the ones that fail to compile.
+// Connections that fail to compile return the compile error when evaluated.
+func CompileConnections() error {
+	return plans.Compile(Registry)
+}
@@ -0,0 +1,233 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCompileRegistry(t *testing.T) {
+	if err := NewConnectionPlans().Compile(Registry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConnectionPlansPrune checks that the plans and compile errors of the connections removed from
+// the registry are evicted, while the connections of the other descriptors stay compiled.
+func TestConnectionPlansPrune(t *testing.T) {
+	reg := NewDescriptorRegistry(hub.NewRegistryOfKnownResources())
+	widget := newTestDescriptor(widgetGVK, "widgets", "widget_config")
+	invalid := v1alpha1.ResourceConnection{
+		Target:                 metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		Labels:                 []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+		ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef},
+	}
+	widget.Spec.Connections = append(widget.Spec.Connections, invalid)
+	reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{widget})
+
+	p := NewConnectionPlans()
+	_ = p.Compile(reg)
+	if !p.has(widget.Spec.Connections[0].ResourceConnectionSpec) || !p.has(invalid.ResourceConnectionSpec) {
+		t.Fatal("expected the connections of the widget to be compiled")
+	}
+	if n := p.Prune(reg); n != 0 {
+		t.Errorf("expected no plans to be evicted, got %d", n)
+	}
+
+	edited := newTestDescriptor(widgetGVK, "widgets", "widget_config")
+	edited.Spec.Connections[0].NameTemplate = "{.spec.configRef}"
+	reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{edited})
+	if n := p.Prune(reg); n != 2 {
+		t.Errorf("expected 2 plans to be evicted, got %d", n)
+	}
+	if p.has(widget.Spec.Connections[0].ResourceConnectionSpec) || p.has(invalid.ResourceConnectionSpec) {
+		t.Error("expected the removed connections to be evicted")
+	}
+
+	rd, err := reg.LoadByGVK(podGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rd.Spec.Connections) > 0 && !p.has(rd.Spec.Connections[0].ResourceConnectionSpec) {
+		t.Error("expected the connections of the other descriptors to stay compiled")
+	}
+}
+
+func TestCompileConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    v1alpha1.ResourceConnectionSpec
+		wantErr bool
+	}{
+		{
+			name: "name",
+			spec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName, NameTemplate: "{.metadata.name}(x"},
+		},
+		{
+			name:    "missing name template",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName},
+			wantErr: true,
+		},
+		{
+			name: "references",
+			spec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef, References: []string{`{range .spec.refs[*]}{.name}{"\n"}{end}`}},
+		},
+		{
+			name:    "invalid reference",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef, References: []string{"{.spec.refs[}"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing references",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef},
+			wantErr: true,
+		},
+		{
+			name: "selector template",
+			spec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector, Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "{.spec.app}", "empty": ""},
+			}},
+		},
+		{
+			name: "invalid selector template",
+			spec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector, Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "{.spec.app[}"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "invalid selector key",
+			spec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector, Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"{.spec.key}": "web"},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "missing selector",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector},
+			wantErr: true,
+		},
+		{
+			name: "label value",
+			spec: v1alpha1.ResourceConnectionSpec{Type: MatchValue, NameTemplate: "{.metadata.name}", TargetLabelPath: "metadata.labels.app.kubernetes.io/instance"},
+		},
+		{
+			name: "annotation value",
+			spec: v1alpha1.ResourceConnectionSpec{Type: MatchValue, NameTemplate: "{.metadata.name}", TargetLabelPath: ".metadata.annotations.meta.helm.sh/release-name"},
+		},
+		{
+			name:    "invalid value path",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: MatchValue, NameTemplate: "{.metadata.name}", TargetLabelPath: "metadata.labels"},
+			wantErr: true,
+		},
+		{
+			name:    "missing value template",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: MatchValue, TargetLabelPath: "metadata.labels.app"},
+			wantErr: true,
+		},
+		{
+			name: "expression",
+			spec: v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{"target.spec.volumeName == source.metadata.name"}, NameTemplate: "{.spec.claimRef.name}"},
+		},
+		{
+			name:    "expression selector path",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{"true"}, SelectorPath: "spec.selector"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid expression name hint",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{"true"}, NameTemplate: "{.spec.claimRef.name"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid level",
+			spec:    v1alpha1.ResourceConnectionSpec{Type: v1alpha1.OwnedBy, Level: "Reference"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileConnection(test.spec)
+			if (err != nil) != test.wantErr {
+				t.Errorf("wantErr %v, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConnectionPlanSelector(t *testing.T) {
+	spec := v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector, Selector: &metav1.LabelSelector{
+		MatchLabels: map[string]string{"app": "{.metadata.labels.app}", "ns": MetadataNamespaceQuery, "tier": "frontend"},
+	}}
+	plan, err := CompileConnection(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newTestObject(sourceGVK, "a", "web", map[string]string{"app": "web"})
+	sel, err := plan.selector.eval(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := sel.String(), "app=web,ns=a,tier=frontend"; got != expected {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// TestConnectionPlanReuse checks that a plan evaluates the same from concurrent reconcilers.
+func TestConnectionPlanReuse(t *testing.T) {
+	e := &Edge{
+		Src: sourceGVK,
+		Dst: targetGVK,
+		Connection: v1alpha1.ResourceConnectionSpec{
+			Type:       v1alpha1.MatchRef,
+			References: []string{`{range .spec.refs[*]}{.name},{.namespace}{"\n"}{end}`},
+		},
+	}
+	src := newTestSource(sourceGVK, "a", "web", nil)
+	expected := []connectionKey{
+		{ObjectKey: client.ObjectKey{Namespace: "a", Name: "web"}},
+		{ObjectKey: client.ObjectKey{Namespace: "b", Name: "web"}},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				keys, err := references(src, e, true)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !reflect.DeepEqual(keys, expected) {
+					t.Errorf("expected %v, got %v", expected, keys)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,305 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+
+	"gomodules.xyz/jsonpath"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// baseFields are the fields of every object read by the reconciler: the name and namespace that
+// identify it, the labels matched by selectors and the owner references of OwnedBy connections.
+var baseFields = [][]string{
+	{"metadata", "name"},
+	{"metadata", "namespace"},
+	{"metadata", "labels"},
+	{"metadata", "ownerReferences"},
+}
+
+// ConnectionPredicate filters the update events of objects of type gvk that don't change any field
+// read by the connections of gvk, e.g. status updates. The connections are looked up in the Registry
+// for every event, so descriptors reloaded at runtime take effect.
+func ConnectionPredicate(gvk schema.GroupVersionKind) predicate.Predicate {
+	return connectionPredicate(Registry, gvk)
+}
+
+func connectionPredicate(reg *DescriptorRegistry, gvk schema.GroupVersionKind) predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldObj, ok := e.ObjectOld.(*unstructured.Unstructured)
+			if !ok {
+				return true
+			}
+			newObj, ok := e.ObjectNew.(*unstructured.Unstructured)
+			if !ok {
+				return true
+			}
+			return connectionFieldsChanged(reg, gvk, oldObj, newObj)
+		},
+	}
+}
+
+// connectionFieldsChanged returns true if any field read by the connections of gvk differs.
+func connectionFieldsChanged(reg *DescriptorRegistry, gvk schema.GroupVersionKind, oldObj, newObj *unstructured.Unstructured) bool {
+	for _, path := range baseFields {
+		if fieldChanged(oldObj, newObj, path) {
+			return true
+		}
+	}
+
+	rd, err := reg.LoadByGVK(gvk)
+	if err != nil {
+		return false
+	}
+	for _, c := range rd.Spec.Connections {
+		// invalid connections are not evaluated by the reconciler
+		plan, err := plans.Plan(c.ResourceConnectionSpec)
+		if err != nil {
+			continue
+		}
+		if plan.fields.all {
+			return true
+		}
+		for _, path := range plan.fields.paths {
+			if fieldChanged(oldObj, newObj, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fieldChanged(oldObj, newObj *unstructured.Unstructured, path []string) bool {
+	oldVal, _, oldErr := unstructured.NestedFieldNoCopy(oldObj.Object, path...)
+	newVal, _, newErr := unstructured.NestedFieldNoCopy(newObj.Object, path...)
+	if oldErr != nil || newErr != nil {
+		return true
+	}
+	return !reflect.DeepEqual(oldVal, newVal)
+}
+
+// sourceFields are the fields of the source read by a connection, in addition to baseFields.
+type sourceFields struct {
+	// all is set if the connection may read any field of the source.
+	all   bool
+	paths [][]string
+}
+
+func (f *sourceFields) add(path []string) {
+	if len(path) == 0 {
+		f.all = true
+		return
+	}
+	f.paths = append(f.paths, path)
+}
+
+func (f *sourceFields) addPath(path string) {
+	if path != "" && path != MetadataNamespace {
+		f.add(fields(path))
+	}
+}
+
+func (f *sourceFields) addTemplate(text string) {
+	paths, all := templateFields(text)
+	f.all = f.all || all
+	f.paths = append(f.paths, paths...)
+}
+
+func (f *sourceFields) addNameTemplate(t *nameTemplate) {
+	if t == nil {
+		return
+	}
+	for _, seg := range t.segments {
+		// the name and namespace of the source are baseFields
+		if seg.path != nil {
+			f.addTemplate(seg.path.text)
+		}
+	}
+}
+
+func (f *sourceFields) addSelectorTemplate(t *selectorTemplate) {
+	if t == nil {
+		return
+	}
+	for _, path := range t.templates {
+		f.addTemplate(path.text)
+	}
+}
+
+// readFields returns the fields of the source read by the compiled connection.
+func (p *ConnectionPlan) readFields() sourceFields {
+	var f sourceFields
+	f.addPath(p.Spec.NamespacePath)
+	// the target label path is read from the targets, and from the source when it is the
+	// target of the same connection traversed backward
+	f.addPath(p.Spec.TargetLabelPath)
+
+	switch p.Spec.Type {
+	case v1alpha1.MatchName, MatchValue:
+		f.addNameTemplate(p.name)
+	case v1alpha1.MatchRef:
+		for _, ref := range p.references {
+			f.addTemplate(ref.text)
+		}
+	case v1alpha1.MatchSelector:
+		f.addPath(p.Spec.SelectorPath)
+		f.addSelectorTemplate(p.selector)
+	case MatchExpression:
+		for _, expr := range p.Spec.References {
+			paths, all := celSourceFields(expr)
+			f.all = f.all || all
+			f.paths = append(f.paths, paths...)
+		}
+		f.addSelectorTemplate(p.selector)
+		f.addNameTemplate(p.name)
+	}
+	return f
+}
+
+// templateFields returns the longest field prefixes of the paths in a jsonpath template, e.g.
+// spec.refs for {range .spec.refs[*]}{.name}{end}. The paths inside a range are relative to its items,
+// so they are covered by the prefix of the range. all is true if the template reads the whole object.
+func templateFields(text string) (paths [][]string, all bool) {
+	p, err := jsonpath.Parse("jsonpath", text)
+	if err != nil {
+		return nil, true
+	}
+	depth := 0
+	for _, node := range p.Root.Nodes {
+		list, ok := node.(*jsonpath.ListNode)
+		if !ok || len(list.Nodes) == 0 {
+			continue
+		}
+		nodes := list.Nodes
+		if id, ok := nodes[0].(*jsonpath.IdentifierNode); ok {
+			switch id.Name {
+			case "range":
+				depth++
+				if depth > 1 {
+					continue
+				}
+				nodes = nodes[1:]
+			case "end":
+				depth--
+				continue
+			}
+		} else if depth > 0 {
+			continue
+		}
+
+		var path []string
+		for _, n := range nodes {
+			field, ok := n.(*jsonpath.FieldNode)
+			if !ok {
+				break
+			}
+			if field.Value != "" {
+				path = append(path, field.Value)
+			}
+		}
+		if len(path) == 0 {
+			return nil, true
+		}
+		paths = append(paths, path)
+	}
+	return paths, false
+}
+
+// celSourceFields returns the fields of source selected by a CEL predicate, e.g. spec.selector for
+// source.spec.selector.app == target.metadata.labels.app. all is true if the predicate uses source
+// in any other way.
+func celSourceFields(expr string) (paths [][]string, all bool) {
+	env, err := celEnvironment()
+	if err != nil {
+		return nil, true
+	}
+	ast, iss := env.Parse(expr)
+	if iss.Err() != nil {
+		return nil, true
+	}
+
+	var walk func(e *exprpb.Expr)
+	walk = func(e *exprpb.Expr) {
+		if e == nil || all {
+			return
+		}
+		switch k := e.ExprKind.(type) {
+		case *exprpb.Expr_IdentExpr:
+			all = all || k.IdentExpr.Name == "source"
+		case *exprpb.Expr_SelectExpr:
+			if path, ok := selectPath(e); ok {
+				if path[0] == "source" {
+					if len(path) == 1 {
+						all = true
+					} else {
+						paths = append(paths, path[1:])
+					}
+				}
+				return
+			}
+			walk(k.SelectExpr.Operand)
+		case *exprpb.Expr_CallExpr:
+			walk(k.CallExpr.Target)
+			for _, arg := range k.CallExpr.Args {
+				walk(arg)
+			}
+		case *exprpb.Expr_ListExpr:
+			for _, elem := range k.ListExpr.Elements {
+				walk(elem)
+			}
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range k.StructExpr.Entries {
+				walk(entry.GetMapKey())
+				walk(entry.Value)
+			}
+		case *exprpb.Expr_ComprehensionExpr:
+			c := k.ComprehensionExpr
+			walk(c.IterRange)
+			walk(c.AccuInit)
+			walk(c.LoopCondition)
+			walk(c.LoopStep)
+			walk(c.Result)
+		}
+	}
+	walk(ast.Expr())
+	if all {
+		return nil, true
+	}
+	return paths, false
+}
+
+// selectPath returns the path of a chain of field selections on an identifier, e.g. source.spec.selector.
+func selectPath(e *exprpb.Expr) ([]string, bool) {
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		return []string{k.IdentExpr.Name}, true
+	case *exprpb.Expr_SelectExpr:
+		path, ok := selectPath(k.SelectExpr.Operand)
+		if !ok {
+			return nil, false
+		}
+		return append(path, k.SelectExpr.Field), true
+	}
+	return nil, false
+}
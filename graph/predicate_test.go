@@ -0,0 +1,178 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestTemplateFields(t *testing.T) {
+	tests := []struct {
+		template string
+		expected [][]string
+		all      bool
+	}{
+		{template: "{.spec.template.spec.volumes[*].secret}", expected: [][]string{{"spec", "template", "spec", "volumes"}}},
+		{template: `{range .spec.refs[*]}{.name},{.namespace}{"\n"}{end}`, expected: [][]string{{"spec", "refs"}}},
+		{template: "{.metadata.name}-{.spec.shard}", expected: [][]string{{"metadata", "name"}, {"spec", "shard"}}},
+		{template: "auth"},
+		{template: "{..name}", all: true},
+		{template: "{.spec", all: true},
+	}
+	for _, test := range tests {
+		paths, all := templateFields(test.template)
+		if all != test.all || !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: expected %v %v, got %v %v", test.template, test.expected, test.all, paths, all)
+		}
+	}
+}
+
+func TestCELSourceFields(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected [][]string
+		all      bool
+	}{
+		{expr: "target.metadata.labels.app == source.spec.selector.app", expected: [][]string{{"spec", "selector", "app"}}},
+		{expr: `source.metadata.labels["app"] == "web"`, expected: [][]string{{"metadata", "labels"}}},
+		{expr: "source.spec.ports.exists(p, p.port == target.spec.port)", expected: [][]string{{"spec", "ports"}}},
+		{expr: "has(source.spec.volumeName) && target.metadata.name == source.spec.volumeName", expected: [][]string{{"spec", "volumeName"}, {"spec", "volumeName"}}},
+		{expr: "target.spec.replicas > 1"},
+		{expr: "size(source) > 0", all: true},
+	}
+	for _, test := range tests {
+		paths, all := celSourceFields(test.expr)
+		if all != test.all || !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: expected %v %v, got %v %v", test.expr, test.expected, test.all, paths, all)
+		}
+	}
+}
+
+func TestConnectionPredicate(t *testing.T) {
+	gadgetGVK := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Gadget"}
+	secret := metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+
+	widget := newTestDescriptor(widgetGVK, "widgets", apiv1.EdgeAuthVia)
+	widget.Spec.Connections = []v1alpha1.ResourceConnection{
+		{
+			Target:                 secret,
+			Labels:                 []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef, References: []string{"{.spec.secretRef}"}},
+		},
+		{
+			Target:                 metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			Labels:                 []apiv1.EdgeLabel{apiv1.EdgeOffshoot},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchSelector, SelectorPath: "spec.selector", NamespacePath: MetadataNamespace},
+		},
+	}
+	gadget := newTestDescriptor(gadgetGVK, "gadgets", apiv1.EdgeAuthVia)
+	gadget.Spec.Connections = []v1alpha1.ResourceConnection{
+		{
+			Target:                 secret,
+			Labels:                 []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+			ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: MatchExpression, References: []string{"size(dyn(source)) > 0"}, NameTemplate: "{.spec.secretRef.name}"},
+		},
+	}
+	reg := NewDescriptorRegistry(hub.NewRegistryOfKnownResources())
+	reg.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{widget, gadget})
+
+	newObject := func(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+		obj := newTestObject(gvk, "demo", "web", map[string]string{"app": "web"})
+		_ = unstructured.SetNestedField(obj.Object, "web-auth", "spec", "secretRef", "name")
+		_ = unstructured.SetNestedStringMap(obj.Object, map[string]string{"app": "web"}, "spec", "selector", "matchLabels")
+		_ = unstructured.SetNestedField(obj.Object, int64(1), "spec", "replicas")
+		_ = unstructured.SetNestedField(obj.Object, "Pending", "status", "phase")
+		return obj
+	}
+	updates := map[string]func(obj *unstructured.Unstructured){
+		"status": func(obj *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(obj.Object, "Ready", "status", "phase")
+		},
+		"annotations": func(obj *unstructured.Unstructured) { obj.SetAnnotations(map[string]string{"note": "x"}) },
+		"replicas": func(obj *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(obj.Object, int64(2), "spec", "replicas")
+		},
+		"labels": func(obj *unstructured.Unstructured) { obj.SetLabels(map[string]string{"app": "db"}) },
+		"owners": func(obj *unstructured.Unstructured) {
+			obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "owner", UID: "owner"}})
+		},
+		"reference": func(obj *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(obj.Object, "db-auth", "spec", "secretRef", "name")
+		},
+		"selector": func(obj *unstructured.Unstructured) {
+			_ = unstructured.SetNestedStringMap(obj.Object, map[string]string{"app": "db"}, "spec", "selector", "matchLabels")
+		},
+	}
+
+	tests := []struct {
+		gvk      schema.GroupVersionKind
+		expected map[string]bool
+	}{
+		{
+			gvk: widgetGVK,
+			expected: map[string]bool{
+				"status":      false,
+				"annotations": false,
+				"replicas":    false,
+				"labels":      true,
+				"owners":      true,
+				"reference":   true,
+				"selector":    true,
+			},
+		},
+		{
+			// the expression may read any field
+			gvk: gadgetGVK,
+			expected: map[string]bool{
+				"status":   true,
+				"replicas": true,
+			},
+		},
+		{
+			// objects without connections only need their identity and labels
+			gvk: schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Unknown"},
+			expected: map[string]bool{
+				"status":    false,
+				"reference": false,
+				"labels":    true,
+			},
+		},
+	}
+	for _, test := range tests {
+		p := connectionPredicate(reg, test.gvk)
+		for name, expected := range test.expected {
+			oldObj := newObject(test.gvk)
+			newObj := oldObj.DeepCopy()
+			updates[name](newObj)
+			if got := p.Update(event.UpdateEvent{ObjectOld: oldObj, ObjectNew: newObj}); got != expected {
+				t.Errorf("%s: expected an update of %s to pass %v, got %v", test.gvk.Kind, name, expected, got)
+			}
+		}
+		if !p.Create(event.CreateEvent{Object: newObject(test.gvk)}) || !p.Delete(event.DeleteEvent{Object: newObject(test.gvk)}) {
+			t.Errorf("%s: expected creates and deletes to pass", test.gvk.Kind)
+		}
+	}
+}
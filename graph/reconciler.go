@@ -18,15 +18,19 @@ package graph
 
 import (
 	"context"
+	"errors"
 
+	kerr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	apiv1 "kmodules.xyz/client-go/api/v1"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logger "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // Reconciler reconciles a Release object
@@ -39,29 +43,58 @@ type Reconciler struct {
 func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	log := logger.FromContext(ctx).WithValues("name", req.NamespacedName.Name)
 	gvk := r.R.GroupVersionKind()
+	watches.reconciled(gvk, req.NamespacedName)
 
 	var obj unstructured.Unstructured
 	obj.SetGroupVersionKind(gvk)
 	if err := r.Get(context.TODO(), req.NamespacedName, &obj); err != nil {
 		log.Error(err, "unable to fetch", "group", r.R.Group, "kind", r.R.Kind)
+		if kerr.IsNotFound(err) {
+			oid := apiv1.ObjectID{
+				Group:     r.R.Group,
+				Kind:      r.R.Kind,
+				Namespace: req.Namespace,
+				Name:      req.Name,
+			}
+			objGraph.DeleteUID(oid.OID())
+			connFailures.delete(oid)
+			nsIndex.track(oid.OID(), gvk, nil)
+			if gvk.GroupKind() == namespaceGK {
+				nsIndex.namespaceChanged(req.Name, nil)
+			}
+		} else {
+			watches.setError(gvk, err)
+		}
 		// we'll ignore not-found errors, since they can't be fixed by an immediate
 		// requeue (we'll need to wait for a new notification), and we can get them
 		// on deleted requests.
 		return reconcile.Result{}, client.IgnoreNotFound(err)
 	}
 
+	oid := apiv1.NewObjectID(&obj).OID()
+	objGraph.SetUID(oid, obj.GetUID())
+	if gvk.GroupKind() == namespaceGK {
+		nsIndex.namespaceChanged(obj.GetName(), &obj)
+	}
+
 	if rd, err := Registry.LoadByGVK(gvk); err == nil {
-		finder := ObjectFinder{
-			Client: r.Client,
-		}
-		if result, err := finder.ListConnectedObjectIDs(&obj, rd.Spec.Connections); err != nil {
+		finder := NewFinder(r.Client)
+		result, err := finder.ListConnectedObjectIDs(&obj, rd.Spec.Connections)
+		var failed ConnectionErrors
+		if err != nil && !errors.As(err, &failed) {
 			log.Error(err, "unable to list connections", "group", r.R.Group, "kind", r.R.Kind)
-			// we'll ignore not-found errors, since they can't be fixed by an immediate
-			// requeue (we'll need to wait for a new notification), and we can get them
-			// on deleted requests.
-			return reconcile.Result{}, client.IgnoreNotFound(err)
-		} else {
-			objGraph.Update(apiv1.NewObjectID(&obj).OID(), result)
+			watches.setError(gvk, err)
+			return reconcile.Result{}, err
+		}
+		// the edges of the failed connections are kept until they are evaluated successfully
+		objGraph.Update(oid, result, failed...)
+		nsIndex.track(oid, gvk, namespaceLabelSelectors(&obj, rd.Spec.Connections))
+		connFailures.set(*apiv1.NewObjectID(&obj), failed)
+		if len(failed) > 0 {
+			log.Error(failed, "unable to list some connections", "group", r.R.Group, "kind", r.R.Kind)
+			watches.setError(gvk, failed)
+			// the request is requeued with the backoff of the rate limiter of the controller
+			return reconcile.Result{}, failed
 		}
 	}
 
@@ -73,6 +106,9 @@ func (r *Reconciler) SetupWithManager(mgr manager.Manager) error {
 	var obj unstructured.Unstructured
 	obj.SetGroupVersionKind(r.R.GroupVersionKind())
 	return builder.ControllerManagedBy(mgr).
-		For(&obj).
+		Named(controllerName(r.R.GroupVersionKind())).
+		For(&obj, builder.WithPredicates(ConnectionPredicate(r.R.GroupVersionKind()))).
+		Watches(&source.Channel{Source: nsIndex.queue(r.R.GroupVersionKind())}, &handler.EnqueueRequestForObject{}).
+		Watches(watches.startSignal(r.R.GroupVersionKind()), &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
@@ -0,0 +1,171 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// resourceRefs returns the references selected by the reference template of a MatchRef connection.
+//
+// A template that selects objects or lists of objects, e.g. {.spec.dataSource} or
+// {.spec.secrets}, is decoded by field name as ObjectReference, TypedLocalObjectReference and
+// similar types. Otherwise the template must print CSV rows of name, namespace, kind and apiVersion.
+func (c *compiledPath) resourceRefs(data interface{}) ([]ResourceRef, error) {
+	if !c.ranged {
+		j := *c.parsed
+		results, err := j.FindResults(data)
+		if err != nil {
+			return nil, err
+		}
+		if objs, ok := structuredResults(results); ok {
+			refs := make([]ResourceRef, 0, len(objs))
+			for _, obj := range objs {
+				ref, err := decodeResourceRef(obj)
+				if err != nil {
+					return nil, err
+				}
+				refs = append(refs, ref)
+			}
+			return refs, nil
+		}
+
+		buf := new(bytes.Buffer)
+		for _, r := range results {
+			if err := j.PrintResults(buf, r); err != nil {
+				return nil, err
+			}
+		}
+		return parseRefRecords(buf)
+	}
+
+	buf, err := c.execute(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefRecords(buf)
+}
+
+func parseRefRecords(buf *bytes.Buffer) ([]ResourceRef, error) {
+	r := csv.NewReader(buf)
+	// Mapper.Comma = ';'
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return ParseResourceRefs(records)
+}
+
+// structuredResults returns the objects in the results if every result is an object or a list of objects.
+func structuredResults(results [][]reflect.Value) ([]map[string]interface{}, bool) {
+	var out []map[string]interface{}
+	for _, r := range results {
+		for _, v := range r {
+			for v.Kind() == reflect.Interface && !v.IsNil() {
+				v = v.Elem()
+			}
+			switch v.Kind() {
+			case reflect.Map:
+				m, ok := v.Interface().(map[string]interface{})
+				if !ok {
+					return nil, false
+				}
+				out = append(out, m)
+			case reflect.Slice:
+				for i := 0; i < v.Len(); i++ {
+					m, ok := v.Index(i).Interface().(map[string]interface{})
+					if !ok {
+						return nil, false
+					}
+					out = append(out, m)
+				}
+			default:
+				return nil, false
+			}
+		}
+	}
+	return out, len(out) > 0
+}
+
+// decodeResourceRef decodes an object reference by the names of its fields.
+// The group is taken from apiGroup, or from apiVersion if apiGroup is not set.
+func decodeResourceRef(obj map[string]interface{}) (ResourceRef, error) {
+	var ref ResourceRef
+	str := func(field string) (string, error) {
+		v, ok := obj[field]
+		if !ok || v == nil {
+			return "", nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("field %s of reference %v is of the type %T, expected string", field, obj, v)
+		}
+		return s, nil
+	}
+
+	var err error
+	if ref.Name, err = str("name"); err != nil {
+		return ref, err
+	}
+	if ref.Namespace, err = str("namespace"); err != nil {
+		return ref, err
+	}
+	if ref.Kind, err = str("kind"); err != nil {
+		return ref, err
+	}
+	uid, err := str("uid")
+	if err != nil {
+		return ref, err
+	}
+	ref.UID = types.UID(uid)
+
+	group, err := str("apiGroup")
+	if err != nil {
+		return ref, err
+	}
+	apiVersion, err := str("apiVersion")
+	if err != nil {
+		return ref, err
+	}
+	if _, ok := obj["apiGroup"].(string); ok {
+		ref.APIGroup = group
+		ref.groupSet = true
+	} else if apiVersion != "" {
+		gv, err := schema.ParseGroupVersion(apiVersion)
+		if err != nil {
+			return ref, fmt.Errorf("invalid apiVersion of reference %v. err:%v", obj, err)
+		}
+		ref.APIGroup = gv.Group
+		ref.groupSet = true
+	}
+	return ref, nil
+}
+
+// matchesType returns true if the group and kind of the reference, if set, are the ones of gvk.
+func (ref ResourceRef) matchesType(gvk schema.GroupVersionKind) bool {
+	if (ref.groupSet || ref.APIGroup != "") && ref.APIGroup != gvk.Group {
+		return false
+	}
+	return ref.Kind == "" || ref.Kind == gvk.Kind
+}
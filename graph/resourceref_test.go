@@ -0,0 +1,233 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDecodeResourceRef(t *testing.T) {
+	tests := []struct {
+		name     string
+		obj      map[string]interface{}
+		expected ResourceRef
+		wantErr  bool
+	}{
+		{
+			name: "ObjectReference",
+			obj: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Target",
+				"namespace":  "b",
+				"name":       "web",
+				"uid":        "1234",
+			},
+			expected: ResourceRef{Name: "web", Namespace: "b", Kind: "Target", APIGroup: "example.com", UID: "1234", groupSet: true},
+		},
+		{
+			name:     "core ObjectReference",
+			obj:      map[string]interface{}{"apiVersion": "v1", "kind": "Secret", "name": "a,b"},
+			expected: ResourceRef{Name: "a,b", Kind: "Secret", groupSet: true},
+		},
+		{
+			name:     "TypedLocalObjectReference",
+			obj:      map[string]interface{}{"apiGroup": "example.com", "kind": "Target", "name": "web"},
+			expected: ResourceRef{Name: "web", Kind: "Target", APIGroup: "example.com", groupSet: true},
+		},
+		{
+			name:     "LocalObjectReference",
+			obj:      map[string]interface{}{"name": "web"},
+			expected: ResourceRef{Name: "web"},
+		},
+		{
+			name:     "nil apiGroup",
+			obj:      map[string]interface{}{"apiGroup": nil, "kind": "Target", "name": "web"},
+			expected: ResourceRef{Name: "web", Kind: "Target"},
+		},
+		{
+			name:    "invalid name",
+			obj:     map[string]interface{}{"name": int64(1)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid apiVersion",
+			obj:     map[string]interface{}{"apiVersion": "a/b/c", "name": "web"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := decodeResourceRef(test.obj)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("wantErr %v, got %v", test.wantErr, err)
+			}
+			if !test.wantErr && !reflect.DeepEqual(ref, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, ref)
+			}
+		})
+	}
+}
+
+func TestResourceRefMatchesType(t *testing.T) {
+	core := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	tests := []struct {
+		ref      ResourceRef
+		gvk      schema.GroupVersionKind
+		expected bool
+	}{
+		{ref: ResourceRef{Name: "web"}, gvk: targetGVK, expected: true},
+		{ref: ResourceRef{Name: "web", Kind: "Target"}, gvk: targetGVK, expected: true},
+		{ref: ResourceRef{Name: "web", Kind: "Source"}, gvk: targetGVK, expected: false},
+		{ref: ResourceRef{Name: "web", APIGroup: "apps"}, gvk: targetGVK, expected: false},
+		{ref: ResourceRef{Name: "web", groupSet: true}, gvk: targetGVK, expected: false},
+		{ref: ResourceRef{Name: "web", groupSet: true}, gvk: core, expected: true},
+		{ref: ResourceRef{Name: "web"}, gvk: core, expected: true},
+	}
+	for _, test := range tests {
+		if got := test.ref.matchesType(test.gvk); got != test.expected {
+			t.Errorf("%+v ~ %v: expected %v, got %v", test.ref, test.gvk, test.expected, got)
+		}
+	}
+}
+
+func TestReferencesStructured(t *testing.T) {
+	src := newTestObject(sourceGVK, "a", "app", nil)
+	_ = unstructured.SetNestedField(src.Object, map[string]interface{}{
+		"apiGroup": "example.com",
+		"kind":     "Target",
+		"name":     "data",
+	}, "spec", "dataSource")
+	_ = unstructured.SetNestedSlice(src.Object, []interface{}{
+		map[string]interface{}{"apiVersion": "example.com/v1", "kind": "Target", "name": "web", "namespace": "b", "uid": "Target-b-web"},
+		map[string]interface{}{"apiVersion": "v1", "kind": "Secret", "name": "web"},
+		map[string]interface{}{"kind": "Target", "name": "a,b"},
+		map[string]interface{}{"name": "local"},
+		map[string]interface{}{"namespace": "a"},
+	}, "spec", "targets")
+	_ = unstructured.SetNestedField(src.Object, "web", "spec", "targetName")
+
+	tests := []struct {
+		reference string
+		expected  []connectionKey
+	}{
+		{
+			reference: "{.spec.dataSource}",
+			expected:  []connectionKey{{ObjectKey: client.ObjectKey{Namespace: "a", Name: "data"}}},
+		},
+		{
+			reference: "{.spec.targets}",
+			expected: []connectionKey{
+				{ObjectKey: client.ObjectKey{Namespace: "b", Name: "web"}, UID: "Target-b-web"},
+				{ObjectKey: client.ObjectKey{Namespace: "a", Name: "a,b"}},
+				{ObjectKey: client.ObjectKey{Namespace: "a", Name: "local"}},
+			},
+		},
+		{
+			reference: "{.spec.targets[0]}",
+			expected:  []connectionKey{{ObjectKey: client.ObjectKey{Namespace: "b", Name: "web"}, UID: "Target-b-web"}},
+		},
+		{
+			reference: "{.spec.targets[*]}",
+			expected: []connectionKey{
+				{ObjectKey: client.ObjectKey{Namespace: "b", Name: "web"}, UID: "Target-b-web"},
+				{ObjectKey: client.ObjectKey{Namespace: "a", Name: "a,b"}},
+				{ObjectKey: client.ObjectKey{Namespace: "a", Name: "local"}},
+			},
+		},
+		{
+			// CSV rows
+			reference: "{.spec.targetName}",
+			expected:  []connectionKey{{ObjectKey: client.ObjectKey{Namespace: "a", Name: "web"}}},
+		},
+		{
+			reference: "{.spec.missing}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.reference, func(t *testing.T) {
+			e := &Edge{
+				Src: sourceGVK,
+				Dst: targetGVK,
+				Connection: v1alpha1.ResourceConnectionSpec{
+					Type:       v1alpha1.MatchRef,
+					References: []string{test.reference},
+				},
+			}
+			keys, err := references(src, e, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(test.expected) || (len(keys) > 0 && !reflect.DeepEqual(keys, test.expected)) {
+				t.Errorf("expected %v, got %v", test.expected, keys)
+			}
+		})
+	}
+}
+
+// TestResourcesForStructuredRef checks that a reference with a uid only connects the object with that uid.
+func TestResourcesForStructuredRef(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(sourceGVK, meta.RESTScopeNamespace)
+	mapper.Add(targetGVK, meta.RESTScopeNamespace)
+
+	src := newTestObject(sourceGVK, "a", "app", nil)
+	_ = unstructured.SetNestedSlice(src.Object, []interface{}{
+		map[string]interface{}{"apiVersion": "example.com/v1", "kind": "Target", "name": "web", "uid": "Target-a-web"},
+		map[string]interface{}{"apiVersion": "example.com/v1", "kind": "Target", "name": "db", "uid": "old"},
+	}, "spec", "targets")
+	kc := offlineClient{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			src,
+			newTestObject(targetGVK, "a", "web", nil),
+			newTestObject(targetGVK, "a", "db", nil),
+		).Build(),
+		mapper: mapper,
+	}
+	finder := ObjectFinder{Client: kc}
+
+	spec := v1alpha1.ResourceConnectionSpec{
+		Type:       v1alpha1.MatchRef,
+		References: []string{"{.spec.targets}"},
+	}
+	objs, err := finder.ResourcesFor(src, &Edge{Src: sourceGVK, Dst: targetGVK, Connection: spec, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := keyStrings(objs), []string{"a/web"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("forward: expected %v, got %v", expected, got)
+	}
+
+	for name, expected := range map[string][]string{"web": {"a/app"}, "db": {}} {
+		dst := newTestObject(targetGVK, "a", name, nil)
+		objs, err := finder.ResourcesFor(dst, &Edge{Src: targetGVK, Dst: sourceGVK, Connection: spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyStrings(objs); !reflect.DeepEqual(got, expected) {
+			t.Errorf("backward from %s: expected %v, got %v", name, expected, got)
+		}
+	}
+}
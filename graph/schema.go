@@ -0,0 +1,296 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/handler"
+	"k8s.io/klog/v2"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+)
+
+// graphQLSchema is a GraphQL schema and the edge labels it serves as fields of ObjectID.
+type graphQLSchema struct {
+	schema graphql.Schema
+	labels []apiv1.EdgeLabel
+}
+
+var (
+	// currentSchema holds the *graphQLSchema used by new queries
+	currentSchema atomic.Value
+	// schemaMu serializes the rebuilds of the schema
+	schemaMu sync.Mutex
+	// buildSchema builds the schema serving the edge labels. Replaced in tests.
+	buildSchema = newGraphQLSchema
+)
+
+// Schema is the GraphQL schema built from the descriptors known at startup. It isn't rebuilt when
+// the edge labels change, use CurrentSchema to serve the labels of the descriptors loaded since.
+var Schema = initSchema()
+
+// objectIDFields are the fields of ObjectID that are not edge labels.
+var objectIDFields = map[apiv1.EdgeLabel]bool{
+	"group":      true,
+	"kind":       true,
+	"namespace":  true,
+	"name":       true,
+	"dependents": true,
+	"path":       true,
+}
+
+var graphQLName = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// CurrentSchema returns the current GraphQL schema. A query must use the same schema from start
+// to end, so callers should hold on to the returned schema instead of calling CurrentSchema again.
+func CurrentSchema() *graphql.Schema {
+	return &loadSchema().schema
+}
+
+func loadSchema() *graphQLSchema {
+	return currentSchema.Load().(*graphQLSchema)
+}
+
+// initSchema builds the schema served until the edge labels change. If it can't be built, the
+// schema serves no edge labels, and the labels are added by the next successful RefreshSchema.
+func initSchema() graphql.Schema {
+	labels := schemaLabels(Registry.EdgeLabels())
+	schema, err := buildSchema(labels)
+	if err != nil {
+		klog.ErrorS(err, "failed to build the GraphQL schema, serving no edge labels")
+		// nil labels never match, so the next refresh retries
+		labels = nil
+		schema, err = buildSchema(nil)
+		if err != nil {
+			klog.ErrorS(err, "failed to build the GraphQL schema")
+		}
+	}
+	currentSchema.Store(&graphQLSchema{schema: schema, labels: labels})
+	return schema
+}
+
+// RefreshSchema rebuilds the GraphQL schema if the set of edge labels in the Registry changed.
+// It returns true if the schema was replaced. Queries in flight finish using the old schema. If the
+// schema can't be rebuilt, the last one keeps being served and the error is returned.
+func RefreshSchema() (bool, error) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	labels := schemaLabels(Registry.EdgeLabels())
+	if cur := loadSchema(); reflect.DeepEqual(cur.labels, labels) {
+		return false, nil
+	}
+	schema, err := buildSchema(labels)
+	if err != nil {
+		return false, err
+	}
+	currentSchema.Store(&graphQLSchema{schema: schema, labels: labels})
+	return true, nil
+}
+
+// schemaLabels returns the labels that can be fields of ObjectID, in order.
+func schemaLabels(labels []apiv1.EdgeLabel) []apiv1.EdgeLabel {
+	out := make([]apiv1.EdgeLabel, 0, len(labels))
+	for _, lbl := range labels {
+		if err := ValidateEdgeLabel(lbl); err != nil {
+			klog.InfoS("edge label can't be a GraphQL field, skipping", "label", lbl, "reason", err)
+			continue
+		}
+		out = append(out, lbl)
+	}
+	return out
+}
+
+// ValidateEdgeLabel returns an error if the label can't be queried as a field of ObjectID.
+func ValidateEdgeLabel(lbl apiv1.EdgeLabel) error {
+	if objectIDFields[lbl] {
+		return fmt.Errorf("%s is a reserved field of ObjectID", lbl)
+	}
+	if !graphQLName.MatchString(string(lbl)) {
+		return fmt.Errorf("%s is not a GraphQL name, it must match %s", lbl, graphQLName)
+	}
+	return nil
+}
+
+// GraphQLHandler serves GraphQL queries using the current schema. A request is executed
+// against the schema that is current when it arrives, so replacing the schema doesn't affect
+// the queries in flight.
+type GraphQLHandler struct {
+	// Config configures the handler of each schema. Its Schema is ignored.
+	Config handler.Config
+	// Context returns the context of the query, eg, using WithClient.
+	Context func(r *http.Request) context.Context
+
+	current atomic.Value // *schemaHandler
+}
+
+type schemaHandler struct {
+	schema *graphQLSchema
+	h      *handler.Handler
+}
+
+func (h *GraphQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := loadSchema()
+	sh, ok := h.current.Load().(*schemaHandler)
+	if !ok || sh.schema != s {
+		conf := h.Config
+		conf.Schema = &s.schema
+		sh = &schemaHandler{schema: s, h: handler.New(&conf)}
+		h.current.Store(sh)
+	}
+
+	ctx := r.Context()
+	if h.Context != nil {
+		ctx = h.Context(r)
+	}
+	// every field of the query reads the same version of the graph
+	snap := objGraph.Snapshot()
+	defer snap.Release()
+	w.Header().Set(VersionHeader, strconv.FormatUint(snap.Version(), 10))
+	sh.h.ContextHandler(WithSnapshot(ctx, snap), w, r)
+}
+
+// snapshotExtension adds the version of the graph snapshot read by a query to the extensions of the result.
+type snapshotExtension struct{}
+
+var _ graphql.Extension = snapshotExtension{}
+
+func (snapshotExtension) Init(ctx context.Context, _ *graphql.Params) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, pastSnapshotsKey{}, &pastSnapshots{snaps: map[string]*Snapshot{}})
+}
+
+func (snapshotExtension) Name() string {
+	return "graph"
+}
+
+func (snapshotExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (snapshotExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func([]gqlerrors.FormattedError) {}
+}
+
+func (snapshotExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(*graphql.Result) {
+		if past, ok := ctx.Value(pastSnapshotsKey{}).(*pastSnapshots); ok {
+			past.release()
+		}
+	}
+}
+
+func (snapshotExtension) ResolveFieldDidStart(ctx context.Context, _ *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {}
+}
+
+func (snapshotExtension) HasResult() bool {
+	return true
+}
+
+func (snapshotExtension) GetResult(ctx context.Context) interface{} {
+	if s, ok := ctx.Value(snapshotKey{}).(*Snapshot); ok {
+		return map[string]interface{}{"version": s.Version()}
+	}
+	return nil
+}
+
+type pastSnapshotsKey struct{}
+
+// pastSnapshots holds the snapshots of the past graphs read by the find queries with the at
+// argument, by the response key of the query. The context of a query is shared by all its
+// fields, so the nested fields of a find query look up its snapshot by their root key.
+type pastSnapshots struct {
+	m     sync.Mutex
+	snaps map[string]*Snapshot
+}
+
+func (p *pastSnapshots) get(key string) *Snapshot {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.snaps[key]
+}
+
+func (p *pastSnapshots) set(key string, s *Snapshot) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if old, ok := p.snaps[key]; ok {
+		old.Release()
+	}
+	p.snaps[key] = s
+}
+
+func (p *pastSnapshots) release() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for key, s := range p.snaps {
+		s.Release()
+		delete(p.snaps, key)
+	}
+}
+
+// rootKey returns the response key of the root field of path.
+func rootKey(path *graphql.ResponsePath) string {
+	if path == nil {
+		return ""
+	}
+	for path.Prev != nil {
+		path = path.Prev
+	}
+	key, _ := path.Key.(string)
+	return key
+}
+
+// snapshotOf returns the snapshot read by the field resolved with p, the past snapshot of the
+// find query the field belongs to, or the snapshot of the query.
+func snapshotOf(p graphql.ResolveParams) (*Snapshot, func()) {
+	if p.Context != nil {
+		if past, ok := p.Context.Value(pastSnapshotsKey{}).(*pastSnapshots); ok {
+			if s := past.get(rootKey(p.Info.Path)); s != nil {
+				return s, func() {}
+			}
+		}
+	}
+	return snapshotFrom(p.Context)
+}
+
+// setPastSnapshot makes the fields of the find query resolved with p read the graph as of at.
+func setPastSnapshot(p graphql.ResolveParams, at time.Time) error {
+	past, ok := p.Context.Value(pastSnapshotsKey{}).(*pastSnapshots)
+	if !ok {
+		return errors.New("graphql context is missing past snapshots")
+	}
+	s, err := NewSnapshotAt(at)
+	if err != nil {
+		return err
+	}
+	past.set(rootKey(p.Info.Path), s)
+	return nil
+}
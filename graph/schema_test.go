@@ -0,0 +1,173 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+const schemaTestQuery = `{ find(oid: "G=example.com,K=Widget,NS=demo,N=web") { name widget_label { name } } }`
+
+func TestSchemaLabels(t *testing.T) {
+	labels := schemaLabels([]apiv1.EdgeLabel{"offshoot", "path", "my-label", "9lives", "backup_via"})
+	if expected := []apiv1.EdgeLabel{"offshoot", "backup_via"}; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+}
+
+// TestRefreshSchema adds and removes an edge label and checks that the schema served by
+// the handler follows, while a query holding the old schema keeps working.
+func TestRefreshSchema(t *testing.T) {
+	defer func() {
+		Registry.Set(DirectorySource, nil)
+		if _, err := RefreshSchema(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	srv := httptest.NewServer(&GraphQLHandler{
+		Config: handler.Config{Pretty: true},
+	})
+	defer srv.Close()
+
+	before := CurrentSchema()
+	if ok, err := RefreshSchema(); err != nil || ok {
+		t.Fatalf("expected the schema to be unchanged, got %v %v", ok, err)
+	}
+	if hasEdgeField(before, "widget_label") {
+		t.Fatal("widget_label must not be served before it is added")
+	}
+	if errs := postQuery(t, srv.URL); len(errs) == 0 {
+		t.Error("expected the query of widget_label to fail")
+	}
+
+	// add the label
+	Registry.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{newTestDescriptor(widgetGVK, "widgets", "widget_label")})
+	if ok, err := RefreshSchema(); err != nil || !ok {
+		t.Fatalf("expected the schema to be rebuilt, got %v %v", ok, err)
+	}
+	added := CurrentSchema()
+	if !hasEdgeField(added, "widget_label") {
+		t.Fatal("expected widget_label to be served")
+	}
+	if errs := postQuery(t, srv.URL); len(errs) > 0 {
+		t.Errorf("expected the query of widget_label to succeed, got %v", errs)
+	}
+	if ok, err := RefreshSchema(); err != nil || ok {
+		t.Errorf("expected the schema to be unchanged, got %v %v", ok, err)
+	}
+
+	// remove the label
+	Registry.Set(DirectorySource, nil)
+	if ok, err := RefreshSchema(); err != nil || !ok {
+		t.Fatalf("expected the schema to be rebuilt, got %v %v", ok, err)
+	}
+	if hasEdgeField(CurrentSchema(), "widget_label") {
+		t.Error("expected widget_label to be removed")
+	}
+	if errs := postQuery(t, srv.URL); len(errs) == 0 {
+		t.Error("expected the query of widget_label to fail")
+	}
+
+	// a query that started on the old schema finishes on it
+	result := graphql.Do(graphql.Params{
+		Schema:        *added,
+		RequestString: schemaTestQuery,
+		Context:       context.TODO(),
+	})
+	if result.HasErrors() {
+		t.Errorf("expected the old schema to serve widget_label, got %v", result.Errors)
+	}
+}
+
+// TestRefreshSchemaError checks that the last schema keeps being served when the schema can't be
+// rebuilt, and that the next refresh retries.
+func TestRefreshSchemaError(t *testing.T) {
+	defer func() {
+		buildSchema = newGraphQLSchema
+		Registry.Set(DirectorySource, nil)
+		if _, err := RefreshSchema(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	srv := httptest.NewServer(&GraphQLHandler{
+		Config: handler.Config{Pretty: true},
+	})
+	defer srv.Close()
+
+	before := CurrentSchema()
+	buildSchema = func([]apiv1.EdgeLabel) (graphql.Schema, error) {
+		return graphql.Schema{}, errors.New("broken")
+	}
+	Registry.Set(DirectorySource, []*v1alpha1.ResourceDescriptor{newTestDescriptor(widgetGVK, "widgets", "widget_label")})
+	if ok, err := RefreshSchema(); err == nil || ok {
+		t.Fatalf("expected the rebuild to fail, got %v %v", ok, err)
+	}
+	if CurrentSchema() != before {
+		t.Error("expected the last schema to be kept")
+	}
+	if errs := postQuery(t, srv.URL); len(errs) == 0 {
+		t.Error("expected the query of widget_label to fail on the last schema")
+	}
+
+	buildSchema = newGraphQLSchema
+	if ok, err := RefreshSchema(); err != nil || !ok {
+		t.Fatalf("expected the schema to be rebuilt, got %v %v", ok, err)
+	}
+	if errs := postQuery(t, srv.URL); len(errs) > 0 {
+		t.Errorf("expected the query of widget_label to succeed, got %v", errs)
+	}
+}
+
+func hasEdgeField(s *graphql.Schema, label string) bool {
+	obj, ok := s.Type("ObjectID").(*graphql.Object)
+	if !ok {
+		return false
+	}
+	_, ok = obj.Fields()[label]
+	return ok
+}
+
+func postQuery(t *testing.T, url string) []interface{} {
+	body, _ := json.Marshal(map[string]string{"query": schemaTestQuery})
+	resp, err := http.Post(url, handler.ContentTypeJSON, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors []interface{} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Errors
+}
@@ -94,10 +94,12 @@ func PollNewResourceTypes(cfg *restclient.Config) func(ctx context.Context) erro
 					}
 					if _, found := resourceTracker[gvk]; !found {
 						resourceTracker[gvk] = rid
+						watches.discover(rid)
 						resourceChannel <- rid
 					}
 				}
 			}
+			watches.discoveryDone()
 			return false, nil
 		}, ctx.Done())
 		if err != nil {
@@ -119,13 +121,19 @@ func SetupGraphReconciler(mgr manager.Manager) func(ctx context.Context) error {
 			}).SetupWithManager(mgr); err != nil {
 				return err
 			}
+			if err := labelIdx.Watch(ctx, mgr.GetCache(), rid.GroupVersionKind()); err != nil {
+				return err
+			}
+			if err := watches.Watch(ctx, mgr.GetCache(), rid); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 }
 
 func ExecGraphQLQuery(c client.Client, query string, vars map[string]interface{}) ([]unstructured.Unstructured, error) {
-	refs, err := execRawGraphQLQuery(query, vars)
+	refs, err := execRawGraphQLQuery(c, query, vars)
 	if err != nil {
 		return nil, err
 	}
@@ -161,11 +169,14 @@ func ExecGraphQLQuery(c client.Client, query string, vars map[string]interface{}
 	return objs, nil
 }
 
-func execRawGraphQLQuery(query string, vars map[string]interface{}) ([]apiv1.ObjectReference, error) {
+func execRawGraphQLQuery(kc client.Client, query string, vars map[string]interface{}) ([]apiv1.ObjectReference, error) {
+	snap := objGraph.Snapshot()
+	defer snap.Release()
 	params := graphql.Params{
-		Schema:         Schema,
+		Schema:         *CurrentSchema(),
 		RequestString:  query,
 		VariableValues: vars,
+		Context:        WithSnapshot(WithClient(context.TODO(), kc), snap),
 	}
 	result := graphql.Do(params)
 	if result.HasErrors() {
@@ -237,7 +248,7 @@ func ExecRawQuery(kc client.Client, src apiv1.OID, target v1alpha1.ResourceLocat
 	}
 
 	if target.Query.Type == v1alpha1.GraphQLQuery {
-		result, err := execRawGraphQLQuery(q, vars)
+		result, err := execRawGraphQLQuery(kc, q, vars)
 		return rid, result, err
 	}
 
@@ -0,0 +1,429 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+)
+
+// VersionHeader is the HTTP header carrying the version of the graph snapshot a response was read from.
+const VersionHeader = "X-Graph-Version"
+
+// node is a version of an object in the graph. Nodes are immutable once published, later updates
+// of the object publish a new version pointing to the versions the open snapshots may still read.
+type node struct {
+	version uint64
+	edges   adjacency // edges in either direction
+	conns   adjacency // edges made by the connections of the object
+	uid     types.UID
+	prev    *node
+}
+
+func (n *node) empty() bool {
+	return n.uid == "" && len(n.conns) == 0 && len(n.edges) == 0
+}
+
+// uidVersion is a version of the object a uid belongs to. oid is empty once the object is deleted.
+// Like nodes, uidVersions are immutable once published.
+type uidVersion struct {
+	version uint64
+	oid     apiv1.OID
+	prev    *uidVersion
+}
+
+// Snapshot is a consistent view of the graph at a version. Updates made after the snapshot was
+// taken are not visible to it. A snapshot must be released once it is no longer read, so the
+// versions only it can read are dropped by later updates.
+//
+// Snapshots read the graph without locks, so readers never wait for updates.
+type Snapshot struct {
+	g       *ObjectGraph
+	version uint64
+	// chunks holds the entries of every object visible to the snapshot
+	chunks  []*chunk
+	release sync.Once
+}
+
+// Snapshot returns a snapshot of the current version of the graph.
+func (g *ObjectGraph) Snapshot() *Snapshot {
+	g.openMu.Lock()
+	defer g.openMu.Unlock()
+	v := atomic.LoadUint64(&g.version)
+	g.open[v]++
+	return &Snapshot{g: g, version: v, chunks: g.in.chunkList()}
+}
+
+// Version returns the version of the graph read by the snapshot.
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+// Release releases the snapshot. It is safe to call Release more than once.
+func (s *Snapshot) Release() {
+	s.release.Do(func() {
+		s.g.openMu.Lock()
+		defer s.g.openMu.Unlock()
+		if s.g.open[s.version]--; s.g.open[s.version] <= 0 {
+			delete(s.g.open, s.version)
+		}
+	})
+}
+
+// lookup returns the id of an object.
+func (s *Snapshot) lookup(oid apiv1.OID) (nodeID, bool) {
+	id, ok := s.g.in.lookup(oid)
+	return id, ok && s.node(id) != nil
+}
+
+func (s *Snapshot) object(id nodeID) *object {
+	return &s.chunks[id/entriesPerChunk][id%entriesPerChunk].object
+}
+
+// node returns the version of the object visible to the snapshot.
+func (s *Snapshot) node(id nodeID) *node {
+	if int(id/entriesPerChunk) >= len(s.chunks) {
+		// interned after the snapshot was taken
+		return nil
+	}
+	return s.visible(s.chunks[id/entriesPerChunk][id%entriesPerChunk].node())
+}
+
+// visible returns the version of n visible to the snapshot. Objects without edges or uid are not
+// visible, their ids may be released.
+func (s *Snapshot) visible(n *node) *node {
+	for ; n != nil; n = n.prev {
+		if n.version <= s.version {
+			if n.empty() {
+				return nil
+			}
+			return n
+		}
+	}
+	return nil
+}
+
+// each calls f with every object visible to the snapshot.
+func (s *Snapshot) each(f func(id nodeID, n *node)) {
+	for i, c := range s.chunks {
+		for j := range c {
+			if n := s.visible(c[j].node()); n != nil {
+				f(nodeID(i*entriesPerChunk+j), n)
+			}
+		}
+	}
+}
+
+func (s *Snapshot) edges(id nodeID) adjacency {
+	if n := s.node(id); n != nil {
+		return n.edges
+	}
+	return nil
+}
+
+func (s *Snapshot) conns(id nodeID) adjacency {
+	if n := s.node(id); n != nil {
+		return n.conns
+	}
+	return nil
+}
+
+// NewSnapshot returns a snapshot of the graph queried by the GraphQL schema.
+func NewSnapshot() *Snapshot {
+	return objGraph.Snapshot()
+}
+
+type snapshotKey struct{}
+
+// WithSnapshot returns a copy of ctx carrying the snapshot read by the GraphQL resolvers, so every
+// field of a query is resolved against the same version of the graph.
+func WithSnapshot(ctx context.Context, s *Snapshot) context.Context {
+	return context.WithValue(ctx, snapshotKey{}, s)
+}
+
+// snapshotFrom returns the snapshot carried by ctx. Without one, it returns a snapshot of the
+// current version that must be released with the returned func.
+func snapshotFrom(ctx context.Context) (*Snapshot, func()) {
+	if ctx != nil {
+		if s, ok := ctx.Value(snapshotKey{}).(*Snapshot); ok {
+			return s, func() {}
+		}
+	}
+	s := objGraph.Snapshot()
+	return s, s.Release
+}
+
+// txn is an update of the graph creating a new version. The versions written by the update are
+// private to it until they are published by commit, all at once. The caller must hold the write lock.
+type txn struct {
+	g       *ObjectGraph
+	version uint64
+	// minKeep is the oldest version read by an open snapshot. Snapshots taken during the update
+	// read the published version, so minKeep is at most the published version.
+	minKeep uint64
+	nodes   map[nodeID]*node
+	uids    map[types.UID]*uidVersion
+}
+
+func (g *ObjectGraph) begin() *txn {
+	published := atomic.LoadUint64(&g.version)
+	t := &txn{
+		g:       g,
+		version: published + 1,
+		minKeep: published,
+		nodes:   map[nodeID]*node{},
+		uids:    map[types.UID]*uidVersion{},
+	}
+	g.openMu.Lock()
+	defer g.openMu.Unlock()
+	for v := range g.open {
+		if v < t.minKeep {
+			t.minKeep = v
+		}
+	}
+	return t
+}
+
+// current returns the latest version of the object.
+func (t *txn) current(oid apiv1.OID) (nodeID, *node) {
+	id, ok := t.g.in.lookup(oid)
+	if !ok {
+		return 0, nil
+	}
+	if n, ok := t.nodes[id]; ok {
+		return id, n
+	}
+	return id, t.g.in.entry(id).node()
+}
+
+// node returns the version of the object written by the update.
+func (t *txn) node(id nodeID) *node {
+	if n, ok := t.nodes[id]; ok {
+		return n
+	}
+
+	n := &node{version: t.version}
+	if cur := t.g.in.entry(id).node(); cur != nil {
+		// adjacency lists are immutable, so they are shared with the previous version
+		n.edges = cur.edges
+		n.conns = cur.conns
+		n.uid = cur.uid
+		n.prev = t.retain(cur)
+	}
+	t.nodes[id] = n
+	return n
+}
+
+// retain returns the versions starting at n that the open snapshots may read. Published versions
+// are never modified, the versions kept are copied if older ones are dropped.
+func (t *txn) retain(n *node) *node {
+	var keep []*node
+	for p := n; p != nil; p = p.prev {
+		keep = append(keep, p)
+		if p.version <= t.minKeep {
+			break
+		}
+	}
+	if keep[len(keep)-1].prev == nil {
+		return n
+	}
+	var out *node
+	for i := len(keep) - 1; i >= 0; i-- {
+		c := *keep[i]
+		c.prev = out
+		out = &c
+	}
+	return out
+}
+
+// setUID records the object a uid belongs to. An empty oid deletes the uid.
+func (t *txn) setUID(uid types.UID, oid apiv1.OID) {
+	if u, ok := t.uids[uid]; ok {
+		u.oid = oid
+		return
+	}
+	cur := t.g.loadUID(uid)
+	if cur == nil && oid == "" {
+		return
+	}
+	t.uids[uid] = &uidVersion{version: t.version, oid: oid, prev: t.retainUID(cur)}
+}
+
+// retainUID returns the versions starting at u that the open snapshots may read, like retain.
+func (t *txn) retainUID(u *uidVersion) *uidVersion {
+	var keep []*uidVersion
+	for p := u; p != nil; p = p.prev {
+		keep = append(keep, p)
+		if p.version <= t.minKeep {
+			break
+		}
+	}
+	if len(keep) == 0 || keep[len(keep)-1].prev == nil {
+		return u
+	}
+	var out *uidVersion
+	for i := len(keep) - 1; i >= 0; i-- {
+		c := *keep[i]
+		c.prev = out
+		out = &c
+	}
+	return out
+}
+
+// commit publishes the version written by the update. Without open snapshots, no reader can read
+// the previous versions, so they are dropped along with the objects left without edges, and the
+// ids of the dropped objects are released.
+func (t *txn) commit() {
+	g := t.g
+
+	g.openMu.Lock()
+	drop := len(g.open) == 0
+	for id, n := range t.nodes {
+		if drop {
+			n.prev = nil
+		}
+		if n.empty() && n.prev == nil {
+			n = nil
+		}
+		g.in.entry(id).head.Store(n)
+		if n == nil || n.prev != nil {
+			g.versioned[id] = true
+		}
+	}
+	for uid, u := range t.uids {
+		if drop {
+			u.prev = nil
+		}
+		if u.oid == "" && u.prev == nil {
+			g.uids.Delete(uid)
+			continue
+		}
+		g.uids.Store(uid, u)
+		if u.prev != nil {
+			g.versionedUIDs[uid] = true
+		}
+	}
+	atomic.StoreUint64(&g.version, t.version)
+	g.openMu.Unlock()
+
+	// snapshots taken from now on read the new version
+	if drop {
+		g.dropVersions()
+	}
+}
+
+// dropVersions drops the versions kept for the snapshots, once no snapshot reads them.
+// The caller must hold the write lock.
+func (g *ObjectGraph) dropVersions() {
+	for id := range g.versioned {
+		e := g.in.entry(id)
+		n := e.node()
+		if n != nil && n.empty() {
+			n = nil
+			e.head.Store(n)
+		} else if n != nil && n.prev != nil {
+			c := *n
+			c.prev = nil
+			e.head.Store(&c)
+		}
+		if n == nil {
+			g.in.release(id)
+		}
+		delete(g.versioned, id)
+	}
+	for uid := range g.versionedUIDs {
+		if u := g.loadUID(uid); u != nil {
+			if u.oid == "" {
+				g.uids.Delete(uid)
+			} else if u.prev != nil {
+				c := *u
+				c.prev = nil
+				g.uids.Store(uid, &c)
+			}
+		}
+		delete(g.versionedUIDs, uid)
+	}
+}
+
+func (g *ObjectGraph) loadUID(uid types.UID) *uidVersion {
+	u, _ := g.uids.Load(uid)
+	v, _ := u.(*uidVersion)
+	return v
+}
+
+// replace replaces the contents of g with the current version of src, as a new version of g.
+func (g *ObjectGraph) replace(src *ObjectGraph) {
+	s := src.Snapshot()
+	defer s.Release()
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	t := g.begin()
+	g.in.each(func(id nodeID, e *entry) {
+		if e.node() != nil {
+			n := t.node(id)
+			n.edges = nil
+			n.conns = nil
+			n.uid = ""
+		}
+	})
+	g.uids.Range(func(uid, _ interface{}) bool {
+		t.setUID(uid.(types.UID), "")
+		return true
+	})
+	intern := func(id nodeID) nodeID {
+		return g.in.intern(s.object(id).oid)
+	}
+	s.each(func(id nodeID, sn *node) {
+		oid := s.object(id).oid
+		n := t.node(g.in.intern(oid))
+		n.edges = sn.edges.translate(intern)
+		n.conns = sn.conns.translate(intern)
+		n.uid = sn.uid
+		if sn.uid != "" {
+			t.setUID(sn.uid, oid)
+		}
+	})
+	t.commit()
+
+	if h := g.loadHistory(); h != nil {
+		g.recordState(h)
+	}
+}
+
+// translate returns a copy of a with the node ids mapped by f.
+func (a adjacency) translate(f func(nodeID) nodeID) adjacency {
+	if a == nil {
+		return nil
+	}
+	out := make(adjacency, len(a))
+	for i, e := range a {
+		nodes := make([]nodeID, len(e.nodes))
+		for j, id := range e.nodes {
+			nodes[j] = f(id)
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+		out[i] = labelEdges{label: e.label, nodes: nodes}
+	}
+	return out
+}
@@ -0,0 +1,184 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+)
+
+// connectionsOf returns the edges made by the connections of every object in the current version of g.
+func connectionsOf(g *ObjectGraph) map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID {
+	s := g.Snapshot()
+	defer s.Release()
+
+	out := map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{}
+	s.each(func(id nodeID, n *node) {
+		if len(n.conns) == 0 {
+			return
+		}
+		connsPerLabel := map[apiv1.EdgeLabel]ksets.OID{}
+		for _, e := range n.conns {
+			connsPerLabel[e.label] = ksets.NewOID()
+			for _, dst := range e.nodes {
+				connsPerLabel[e.label].Insert(s.object(dst).oid)
+			}
+		}
+		out[s.object(id).oid] = connsPerLabel
+	})
+	return out
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "demo", Name: "web"}
+	old := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-old"}
+	cur := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web-new"}
+	podGK := metav1.GroupKind{Kind: "Pod"}
+
+	g := NewObjectGraph()
+	g.SetUID(svc.OID(), "svc")
+	g.SetUID(old.OID(), "old")
+	g.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(old.OID())})
+
+	s := g.Snapshot()
+	g.DeleteUID(old.OID())
+	g.SetUID(cur.OID(), "new")
+	g.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(cur.OID())})
+	if s.Version() >= g.Version() {
+		t.Errorf("expected the snapshot version %d to be older than the graph version %d", s.Version(), g.Version())
+	}
+
+	links, err := s.Links(&svc, apiv1.EdgeExposedBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []apiv1.ObjectID{old}; !reflect.DeepEqual(links[podGK], expected) {
+		t.Errorf("expected the snapshot to link %v, got %v", expected, links[podGK])
+	}
+	if oid, ok := s.LookupUID("old"); !ok || oid != old.OID() {
+		t.Errorf("expected the snapshot to find the deleted uid, got %q %v", oid, ok)
+	}
+	if _, ok := s.LookupUID("new"); ok {
+		t.Error("expected the snapshot not to find the added uid")
+	}
+	if counts := s.Counts()[schema.GroupKind{Kind: "Pod"}]; counts.Objects != 1 {
+		t.Errorf("expected the snapshot to count one pod, got %+v", counts)
+	}
+
+	links, err = g.Links(&svc, apiv1.EdgeExposedBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []apiv1.ObjectID{cur}; !reflect.DeepEqual(links[podGK], expected) {
+		t.Errorf("expected the graph to link %v, got %v", expected, links[podGK])
+	}
+	if _, ok := g.LookupUID("old"); ok {
+		t.Error("expected the deleted uid to be forgotten")
+	}
+
+	// the versions kept for the snapshot are dropped by the next update after it is released
+	s.Release()
+	s.Release()
+	g.SetUID(svc.OID(), "svc-2")
+	if len(g.versioned) != 0 || len(g.versionedUIDs) != 0 {
+		t.Errorf("expected no old versions, got %v %v", g.versioned, g.versionedUIDs)
+	}
+	if _, ok := g.in.lookup(old.OID()); ok {
+		t.Error("expected the deleted pod to be dropped")
+	}
+	if _, ok := g.uids.Load(types.UID("old")); ok {
+		t.Error("expected the deleted uid to be dropped")
+	}
+	g.in.each(func(id nodeID, e *entry) {
+		if n := e.node(); n != nil && n.prev != nil {
+			t.Errorf("expected %s to have one version", e.oid)
+		}
+	})
+}
+
+func TestSnapshotGraphQL(t *testing.T) {
+	svc := apiv1.ObjectID{Kind: "Service", Namespace: "snapshot", Name: "web"}
+	old := apiv1.ObjectID{Kind: "Pod", Namespace: "snapshot", Name: "web-old"}
+	cur := apiv1.ObjectID{Kind: "Pod", Namespace: "snapshot", Name: "web-new"}
+	objGraph.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(old.OID())})
+	defer objGraph.Update(svc.OID(), nil)
+
+	// the nested fields are resolved after the graph changed
+	query := `{ find(oid: "` + string(svc.OID()) + `") { exposed_by { name exposed_by { name } } } }`
+	snap := objGraph.Snapshot()
+	defer snap.Release()
+	objGraph.Update(svc.OID(), map[apiv1.EdgeLabel]ksets.OID{apiv1.EdgeExposedBy: ksets.NewOID(cur.OID())})
+
+	result := graphql.Do(graphql.Params{
+		Schema:        *CurrentSchema(),
+		RequestString: query,
+		Context:       WithSnapshot(context.TODO(), snap),
+	})
+	if result.HasErrors() {
+		t.Fatal(result.Errors)
+	}
+	data, _ := json.Marshal(result.Data)
+	if expected := `{"find":{"exposed_by":[{"exposed_by":[{"name":"web"}],"name":"web-old"}]}}`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+	if ext, ok := result.Extensions["graph"].(map[string]interface{}); !ok || ext["version"] != snap.Version() {
+		t.Errorf("expected the snapshot version %d in the extensions, got %v", snap.Version(), result.Extensions)
+	}
+
+	// the handler reads the current version
+	srv := httptest.NewServer(&GraphQLHandler{Config: handler.Config{Pretty: true}})
+	defer srv.Close()
+	body, _ := json.Marshal(map[string]string{"query": query})
+	resp, err := http.Post(srv.URL, handler.ContentTypeJSON, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data       json.RawMessage `json:"data"`
+		Extensions struct {
+			Graph struct {
+				Version uint64 `json:"version"`
+			} `json:"graph"`
+		} `json:"extensions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out.Data), "web-new") {
+		t.Errorf("expected the current graph, got %s", out.Data)
+	}
+	version, err := strconv.ParseUint(resp.Header.Get(VersionHeader), 10, 64)
+	if err != nil || version != out.Extensions.Graph.Version || version <= snap.Version() {
+		t.Errorf("expected the header and extensions to carry a version newer than %d, got %q and %d",
+			snap.Version(), resp.Header.Get(VersionHeader), out.Extensions.Graph.Version)
+	}
+}
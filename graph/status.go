@@ -0,0 +1,350 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// informerSyncTimeout is how long the informer of a resource type may take to sync before the type
+// is marked failed and no longer holds back readiness.
+const informerSyncTimeout = 2 * time.Minute
+
+// GraphStatus is the sync status of the graph, served by /debug/graph.
+type GraphStatus struct {
+	Ready bool `json:"ready"`
+	// Version is the version of the graph the counts were read from.
+	Version uint64 `json:"version"`
+	// Discovered is set once the first discovery pass has completed.
+	Discovered bool          `json:"discovered"`
+	Watches    []WatchStatus `json:"watches"`
+}
+
+// WatchStatus is the status of the controller of a resource type.
+type WatchStatus struct {
+	Resource apiv1.ResourceID `json:"resource"`
+	Started  bool             `json:"started"`
+	// Synced is set once the informer has synced and every initial object has been handed to the reconciler.
+	Synced bool `json:"synced"`
+	// Failed is set if the informer hasn't synced within the sync timeout, e.g. because listing the
+	// type is forbidden or its conversion webhook is broken. A failed type doesn't hold back readiness.
+	Failed        bool         `json:"failed"`
+	Objects       int          `json:"objects"`
+	Edges         int          `json:"edges"`
+	QueueDepth    int          `json:"queueDepth"`
+	LastError     string       `json:"lastError,omitempty"`
+	LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+}
+
+// watchTracker tracks the discovery of resource types and the sync of their controllers.
+type watchTracker struct {
+	m          sync.RWMutex
+	discovered bool
+	watches    map[schema.GroupVersionKind]*watchState
+
+	// syncTimeout is how long an informer may take to sync before its type is marked failed.
+	syncTimeout time.Duration
+}
+
+type watchState struct {
+	rid apiv1.ResourceID
+	// queue is the work queue of the controller, set once the controller has started
+	queue          workqueue.Interface
+	informerSynced bool
+	// pending are the objects in the informer when it synced that haven't been handed to the
+	// reconciler yet. The informer delivers them to the handlers of the controller after it syncs,
+	// so an empty queue alone doesn't mean they have been reconciled.
+	pending map[types.NamespacedName]bool
+	// seen are the objects handed to the reconciler before the informer was marked synced.
+	seen map[types.NamespacedName]bool
+	// synced is latched, so readiness doesn't flip when the queue backs up later.
+	synced bool
+	// failed is set while the informer hasn't synced within the sync timeout.
+	failed        bool
+	lastError     string
+	lastErrorTime *metav1.Time
+}
+
+func newWatchTracker() *watchTracker {
+	return &watchTracker{
+		watches:     map[schema.GroupVersionKind]*watchState{},
+		syncTimeout: informerSyncTimeout,
+	}
+}
+
+// controllerName returns the name of the controller of a resource type. The default name of the
+// builder is the kind, which isn't unique across groups.
+func controllerName(gvk schema.GroupVersionKind) string {
+	return strings.ToLower(gvk.GroupKind().String())
+}
+
+func (t *watchTracker) state(gvk schema.GroupVersionKind) *watchState {
+	s, ok := t.watches[gvk]
+	if !ok {
+		s = &watchState{seen: map[types.NamespacedName]bool{}}
+		t.watches[gvk] = s
+	}
+	return s
+}
+
+// discover records a resource type found by discovery. Its controller is started later.
+func (t *watchTracker) discover(rid apiv1.ResourceID) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.state(rid.GroupVersionKind()).rid = rid
+}
+
+// discoveryDone records that a discovery pass has completed.
+func (t *watchTracker) discoveryDone() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.discovered = true
+}
+
+// Watch marks the informer of the resource type synced once the informer in the cache has synced,
+// with the objects it holds then. If the informer doesn't sync within the sync timeout, the type is
+// marked failed until it does.
+func (t *watchTracker) Watch(ctx context.Context, c cache.Cache, rid apiv1.ResourceID) error {
+	gvk := rid.GroupVersionKind()
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(gvk)
+	informer, err := c.GetInformer(ctx, &obj)
+	if err != nil {
+		return err
+	}
+	keys := func() ([]types.NamespacedName, error) {
+		var list unstructured.UnstructuredList
+		list.SetGroupVersionKind(gvk)
+		if err := c.List(ctx, &list); err != nil {
+			return nil, err
+		}
+		out := make([]types.NamespacedName, 0, len(list.Items))
+		for _, item := range list.Items {
+			out = append(out, types.NamespacedName{Namespace: item.GetNamespace(), Name: item.GetName()})
+		}
+		return out, nil
+	}
+	go t.waitForSync(ctx, gvk, informer.HasSynced, keys)
+	return nil
+}
+
+// waitForSync marks the informer of the resource type synced once hasSynced returns true, with the
+// objects returned by keys. The informer retries a failed list forever without surfacing the error,
+// so the type is marked failed if it hasn't synced within the sync timeout.
+func (t *watchTracker) waitForSync(ctx context.Context, gvk schema.GroupVersionKind, hasSynced toolscache.InformerSynced, keys func() ([]types.NamespacedName, error)) {
+	syncCtx, cancel := context.WithTimeout(ctx, t.syncTimeout)
+	defer cancel()
+	if !toolscache.WaitForCacheSync(syncCtx.Done(), hasSynced) {
+		if ctx.Err() != nil {
+			return
+		}
+		err := fmt.Errorf("informer has not synced within %s", t.syncTimeout)
+		klog.ErrorS(err, "excluding resource type from readiness", "gvk", gvk)
+		t.markFailed(gvk, err)
+		if !toolscache.WaitForCacheSync(ctx.Done(), hasSynced) {
+			return
+		}
+	}
+	objs, err := keys()
+	if err != nil {
+		// the objects are only read from the synced informer, so this doesn't happen in practice
+		klog.ErrorS(err, "failed to list the initial objects", "gvk", gvk)
+	}
+	t.markInformerSynced(gvk, objs)
+}
+
+// start records that the controller of the resource type has started with the given work queue.
+func (t *watchTracker) start(gvk schema.GroupVersionKind, q workqueue.Interface) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.state(gvk).queue = q
+}
+
+// markInformerSynced records that the informer of the resource type has synced with the given objects.
+func (t *watchTracker) markInformerSynced(gvk schema.GroupVersionKind, objs []types.NamespacedName) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := t.state(gvk)
+	s.informerSynced = true
+	s.failed = false
+	if s.synced {
+		return
+	}
+	s.pending = map[types.NamespacedName]bool{}
+	for _, key := range objs {
+		if !s.seen[key] {
+			s.pending[key] = true
+		}
+	}
+	s.seen = nil
+}
+
+// reconciled records that an object of the resource type has been handed to the reconciler.
+func (t *watchTracker) reconciled(gvk schema.GroupVersionKind, key types.NamespacedName) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s, ok := t.watches[gvk]
+	if !ok || s.synced {
+		return
+	}
+	if s.informerSynced {
+		delete(s.pending, key)
+	} else {
+		s.seen[key] = true
+	}
+}
+
+// startSignal returns a source of the controller of the resource type that records when the
+// controller starts and its work queue. It never emits events.
+func (t *watchTracker) startSignal(gvk schema.GroupVersionKind) source.Source {
+	return source.Func(func(_ context.Context, _ handler.EventHandler, q workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+		t.start(gvk, q)
+		return nil
+	})
+}
+
+// markFailed records that the informer of the resource type hasn't synced in time.
+func (t *watchTracker) markFailed(gvk schema.GroupVersionKind, err error) {
+	now := metav1.NewTime(time.Now())
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := t.state(gvk)
+	s.failed = true
+	s.lastError = err.Error()
+	s.lastErrorTime = &now
+}
+
+// setError records the last error of reconciling an object of the resource type.
+func (t *watchTracker) setError(gvk schema.GroupVersionKind, err error) {
+	now := metav1.NewTime(time.Now())
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := t.state(gvk)
+	s.lastError = err.Error()
+	s.lastErrorTime = &now
+}
+
+// sync latches the synced state of the started controllers whose informers have synced, once every
+// initial object has been handed to the reconciler and their queues have drained. The last of the
+// initial objects may still be in flight when a controller is marked synced.
+func (t *watchTracker) sync() {
+	for _, s := range t.watches {
+		if !s.synced && s.queue != nil && s.informerSynced && len(s.pending) == 0 && s.queue.Len() == 0 {
+			s.synced = true
+			s.pending = nil
+			s.seen = nil
+		}
+	}
+}
+
+// Ready returns an error until the first discovery pass has completed and the controller of every
+// discovered resource type has synced. Failed resource types are skipped.
+func (t *watchTracker) Ready() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if !t.discovered {
+		return fmt.Errorf("waiting for resource discovery")
+	}
+	t.sync()
+	var pending []string
+	for gvk, s := range t.watches {
+		if !s.synced && !s.failed {
+			pending = append(pending, gvk.String())
+		}
+	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return fmt.Errorf("waiting for %d controllers to sync: %s", len(pending), strings.Join(pending, "; "))
+	}
+	return nil
+}
+
+// Status returns the sync status of every resource type with the object and edge counts of the graph.
+func (t *watchTracker) Status(g *ObjectGraph) GraphStatus {
+	snap := g.Snapshot()
+	defer snap.Release()
+	counts := snap.Counts()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.sync()
+	status := GraphStatus{
+		Ready:      t.discovered,
+		Version:    snap.Version(),
+		Discovered: t.discovered,
+		Watches:    make([]WatchStatus, 0, len(t.watches)),
+	}
+	for gvk, s := range t.watches {
+		status.Ready = status.Ready && (s.synced || s.failed)
+		c := counts[gvk.GroupKind()]
+		ws := WatchStatus{
+			Resource:      s.rid,
+			Started:       s.queue != nil,
+			Synced:        s.synced,
+			Failed:        s.failed,
+			Objects:       c.Objects,
+			Edges:         c.Edges,
+			LastError:     s.lastError,
+			LastErrorTime: s.lastErrorTime,
+		}
+		if s.queue != nil {
+			ws.QueueDepth = s.queue.Len()
+		}
+		status.Watches = append(status.Watches, ws)
+	}
+	sort.Slice(status.Watches, func(i, j int) bool {
+		ri, rj := status.Watches[i].Resource, status.Watches[j].Resource
+		if ri.Group != rj.Group {
+			return ri.Group < rj.Group
+		}
+		return ri.Kind < rj.Kind
+	})
+	return status
+}
+
+// ReadyCheck is a readiness check that passes once the graph has synced.
+func ReadyCheck(_ *http.Request) error {
+	return watches.Ready()
+}
+
+// Status returns the sync status of the graph.
+func Status() GraphStatus {
+	return watches.Status(objGraph)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	ksets "kmodules.xyz/sets"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func noKeys() ([]types.NamespacedName, error) {
+	return nil, nil
+}
+
+func TestWatchTrackerReady(t *testing.T) {
+	tr := newWatchTracker()
+
+	widgets := apiv1.ResourceID{Group: widgetGVK.Group, Version: widgetGVK.Version, Name: "widgets", Kind: widgetGVK.Kind, Scope: apiv1.NamespaceScoped}
+	pods := apiv1.ResourceID{Version: "v1", Name: "pods", Kind: "Pod", Scope: apiv1.NamespaceScoped}
+	web := types.NamespacedName{Namespace: "demo", Name: "web"}
+	db := types.NamespacedName{Namespace: "demo", Name: "db"}
+
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready before discovery")
+	}
+	tr.discover(widgets)
+	tr.discover(pods)
+	tr.discoveryDone()
+	tr.markInformerSynced(widgets.GroupVersionKind(), nil)
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready before the controllers start")
+	}
+
+	widgetQueue := workqueue.New()
+	defer widgetQueue.ShutDown()
+	podQueue := workqueue.New()
+	defer podQueue.ShutDown()
+	tr.start(widgets.GroupVersionKind(), widgetQueue)
+	tr.start(pods.GroupVersionKind(), podQueue)
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready until every informer has synced")
+	}
+
+	// the informer hands its objects to the handlers after it syncs, so the queue is still empty
+	tr.reconciled(pods.GroupVersionKind(), db)
+	tr.markInformerSynced(pods.GroupVersionKind(), []types.NamespacedName{web, db})
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready until the initial objects are handed to the reconciler")
+	}
+
+	podQueue.Add(reconcile.Request{NamespacedName: web})
+	item, _ := podQueue.Get()
+	tr.reconciled(pods.GroupVersionKind(), item.(reconcile.Request).NamespacedName)
+	podQueue.Done(item)
+	podQueue.Add(reconcile.Request{NamespacedName: db})
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready until the queue has drained")
+	}
+
+	item, _ = podQueue.Get()
+	podQueue.Done(item)
+	if err := tr.Ready(); err != nil {
+		t.Errorf("expected ready, got %v", err)
+	}
+
+	// a busy queue later doesn't make the graph unready
+	for i := 0; i < 10; i++ {
+		podQueue.Add(i)
+	}
+	if err := tr.Ready(); err != nil {
+		t.Errorf("expected to stay ready, got %v", err)
+	}
+}
+
+// TestWatchTrackerSyncTimeout checks that a resource type whose informer doesn't sync, e.g. as
+// listing it is forbidden, stops holding back readiness after the sync timeout.
+func TestWatchTrackerSyncTimeout(t *testing.T) {
+	tr := newWatchTracker()
+	tr.syncTimeout = 50 * time.Millisecond
+
+	pods := apiv1.ResourceID{Version: "v1", Name: "pods", Kind: "Pod", Scope: apiv1.NamespaceScoped}
+	tr.discover(pods)
+	tr.discoveryDone()
+	q := workqueue.New()
+	defer q.ShutDown()
+	tr.start(pods.GroupVersionKind(), q)
+
+	var synced int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		tr.waitForSync(ctx, pods.GroupVersionKind(), func() bool { return atomic.LoadInt32(&synced) == 1 }, noKeys)
+		close(done)
+	}()
+
+	if err := tr.Ready(); err == nil {
+		t.Error("expected not ready before the sync timeout")
+	}
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return tr.Ready() == nil })
+	status := tr.Status(NewObjectGraph())
+	if ws := status.Watches[0]; !status.Ready || !ws.Failed || ws.Synced || ws.LastError == "" {
+		t.Errorf("expected a ready graph with a failed watch, got %+v", status)
+	}
+
+	// the type rejoins once its informer syncs
+	atomic.StoreInt32(&synced, 1)
+	<-done
+	status = tr.Status(NewObjectGraph())
+	if ws := status.Watches[0]; !status.Ready || ws.Failed || !ws.Synced {
+		t.Errorf("expected a synced watch, got %+v", status)
+	}
+}
+
+func TestWatchTrackerStatus(t *testing.T) {
+	tr := newWatchTracker()
+	q := workqueue.New()
+	defer q.ShutDown()
+	q.Add("a")
+	q.Add("b")
+	widgets := apiv1.ResourceID{Group: widgetGVK.Group, Version: widgetGVK.Version, Name: "widgets", Kind: widgetGVK.Kind, Scope: apiv1.NamespaceScoped}
+	tr.discover(widgets)
+	tr.discoveryDone()
+	tr.start(widgetGVK, q)
+	tr.markInformerSynced(widgetGVK, nil)
+	tr.setError(widgetGVK, errors.New("denied"))
+
+	g := NewObjectGraph()
+	a := apiv1.ObjectID{Group: widgetGVK.Group, Kind: widgetGVK.Kind, Namespace: "demo", Name: "a"}
+	b := apiv1.ObjectID{Group: widgetGVK.Group, Kind: widgetGVK.Kind, Namespace: "demo", Name: "b"}
+	secret := apiv1.ObjectID{Kind: "Secret", Namespace: "demo", Name: "auth"}
+	pod := apiv1.ObjectID{Kind: "Pod", Namespace: "demo", Name: "web"}
+	g.SetUID(a.OID(), "a")
+	g.SetUID(b.OID(), "b")
+	g.Update(a.OID(), map[apiv1.EdgeLabel]ksets.OID{
+		apiv1.EdgeAuthVia:  ksets.NewOID(secret.OID()),
+		apiv1.EdgeOffshoot: ksets.NewOID(pod.OID(), b.OID()),
+	})
+
+	status := tr.Status(g)
+	if status.Ready || !status.Discovered {
+		t.Errorf("expected a discovered graph that isn't ready, got %+v", status)
+	}
+	if len(status.Watches) != 1 {
+		t.Fatalf("expected one watch, got %+v", status.Watches)
+	}
+	ws := status.Watches[0]
+	if ws.Resource != widgets || !ws.Started || ws.Synced || ws.Objects != 2 || ws.Edges != 3 || ws.QueueDepth != 2 {
+		t.Errorf("unexpected watch status %+v", ws)
+	}
+	if ws.LastError != "denied" || ws.LastErrorTime == nil {
+		t.Errorf("expected the last error, got %q at %v", ws.LastError, ws.LastErrorTime)
+	}
+}
@@ -19,7 +19,9 @@ package graph
 import (
 	"strings"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
 )
 
@@ -31,15 +33,32 @@ const (
 	MetadataNamespace      = "metadata.namespace"
 	MetadataNamespaceQuery = "{." + MetadataNamespace + "}"
 	MetadataLabels         = "metadata.labels"
+	MetadataAnnotations    = "metadata.annotations"
 	MetadataNameQuery      = "{.metadata.name}"
 )
 
+// MatchValue connects a source to the targets whose label or annotation equals the value of the
+// NameTemplate evaluated for the source. TargetLabelPath is the path of the label or annotation,
+// e.g. metadata.annotations.meta.helm.sh/release-name connects a Helm release to its objects.
+const MatchValue v1alpha1.ConnectionType = "MatchValue"
+
 type Edge struct {
 	Src        schema.GroupVersionKind
 	Dst        schema.GroupVersionKind
 	W          uint64
 	Connection v1alpha1.ResourceConnectionSpec
 	Forward    bool
+
+	// plan is the compiled Connection. If nil, it is read from the cache of compiled connections.
+	plan *ConnectionPlan
+}
+
+// compiled returns the compiled connection of the edge.
+func (e *Edge) compiled() (*ConnectionPlan, error) {
+	if e.plan != nil {
+		return e.plan, nil
+	}
+	return plans.Plan(e.Connection)
 }
 
 type AdjacencyMap map[schema.GroupVersionKind]*Edge
@@ -52,8 +71,8 @@ type AdjacencyMap map[schema.GroupVersionKind]*Edge
 // map[string]string
 
 // ref: https://github.com/coreos/prometheus-operator/blob/cc584ecfa08d2eb95ba9401f116e3a20bf71be8b/pkg/apis/monitoring/v1/types.go#L578
-// NamespaceSelector is a selector for selecting either all namespaces or a
-// list of namespaces.
+// NamespaceSelector is a selector for selecting either all namespaces, a
+// list of namespaces or the namespaces matching a label selector.
 // +k8s:openapi-gen=true
 type NamespaceSelector struct {
 	// Boolean describing whether all namespaces are selected in contrast to a
@@ -62,9 +81,15 @@ type NamespaceSelector struct {
 	// List of namespace names.
 	MatchNames []string `json:"matchNames,omitempty"`
 
-	// TODO(fabxc): this should embed metav1.LabelSelector eventually.
-	// Currently the selector is only used for namespaces which require more complex
-	// implementation to support label selections.
+	// Label selector matched against the labels of the Namespace objects, eg,
+	// Prometheus serviceMonitorNamespaceSelector. If MatchNames is also set,
+	// the selected namespaces must satisfy both.
+	metav1.LabelSelector `json:",inline"`
+}
+
+// SelectsByLabel returns true if the selector has label requirements.
+func (s NamespaceSelector) SelectsByLabel() bool {
+	return len(s.MatchLabels) > 0 || len(s.MatchExpressions) > 0
 }
 
 // ResourceRef contains information that points to the resource being used
@@ -77,6 +102,11 @@ type ResourceRef struct {
 	Kind string `json:"kind,omitempty"`
 	// APIGroup is the group for the resource being referenced
 	APIGroup string `json:"apiGroup,omitempty"`
+	// UID is the uid of the resource being referenced
+	UID types.UID `json:"uid,omitempty"`
+
+	// groupSet is true if the reference names the core group by an empty APIGroup
+	groupSet bool
 }
 
 func fields(path string) []string {
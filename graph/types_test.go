@@ -25,6 +25,7 @@ func TestExtractName(t *testing.T) {
 		name     string
 		selector string
 		result   string
+		noMatch  bool
 	}{
 		{
 			name:     "kubedb-sample",
@@ -41,11 +42,31 @@ func TestExtractName(t *testing.T) {
 			selector: "{.metadata.name}~Elasticsearch.kubedb.com",
 			result:   "my.db",
 		},
+		{
+			name:     "my.db~ElasticsearchXkubedbYcom",
+			selector: "{.metadata.name}~Elasticsearch.kubedb.com",
+			noMatch:  true,
+		},
+		{
+			name:     "sample(1)+",
+			selector: "{.metadata.name}(1)+",
+			result:   "sample",
+		},
+		{
+			name:     "sample-sample",
+			selector: "{.metadata.name}-{.metadata.name}",
+			result:   "sample",
+		},
+		{
+			name:     "sample-other",
+			selector: "{.metadata.name}-{.metadata.name}",
+			noMatch:  true,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			r, ok := ExtractName(test.name, test.selector)
-			if !ok {
+			if ok == test.noMatch {
 				t.FailNow()
 			}
 			if test.result != r {
@@ -17,23 +17,27 @@ limitations under the License.
 package graph
 
 import (
-	"sync"
-
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	apiv1 "kmodules.xyz/client-go/api/v1"
 	"kmodules.xyz/resource-metadata/hub"
 	ksets "kmodules.xyz/sets"
 )
 
-var Registry = hub.NewRegistryOfKnownResources()
+var Registry = NewDescriptorRegistry(hub.NewRegistryOfKnownResources())
+
+var objGraph = NewObjectGraph()
+
+var nsIndex = newNamespaceIndex()
+
+var labelIdx = NewLabelIndex()
+
+var fieldIdx = NewFieldIndexes()
+
+var plans = NewConnectionPlans()
 
-var objGraph = &ObjectGraph{
-	m:     sync.RWMutex{},
-	edges: map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{},
-	ids:   map[apiv1.OID]map[apiv1.EdgeLabel]ksets.OID{},
-}
+var connFailures = newConnectionFailures()
 
-var Schema = getGraphQLSchema()
+var watches = newWatchTracker()
 
 var resourceChannel = make(chan apiv1.ResourceID, 100)
 var resourceTracker = map[schema.GroupVersionKind]apiv1.ResourceID{}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// backend answers graph queries, either by calling the graph service or in process.
+type backend interface {
+	Links(src apiv1.ObjectID, label apiv1.EdgeLabel, gk *schema.GroupKind) ([]apiv1.ObjectID, error)
+	ResourceGraph(src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error)
+	Path(src, dst apiv1.ObjectID) ([]graph.PathStep, error)
+	Render(src apiv1.ObjectID, layout, page string) (*v1alpha1.ResourceView, error)
+}
+
+type sourceOptions struct {
+	server    string
+	filenames []string
+	discovery string
+	namespace string
+}
+
+func addSourceFlags(fs *pflag.FlagSet) *sourceOptions {
+	var opts sourceOptions
+	fs.StringVar(&opts.server, "server", "", "Address of the graph service, eg, http://localhost:8082. If empty, the graph is computed in process")
+	fs.StringSliceVarP(&opts.filenames, "filename", "f", nil, "Compute the graph in process from these manifest files or directories instead of the cluster")
+	fs.StringVar(&opts.discovery, "discovery", "", "Static discovery file used to build the RESTMapper, eg, apis.json or rs.json")
+	fs.StringVarP(&opts.namespace, "namespace", "n", metav1.NamespaceDefault, "Namespace of objects given in kind/name format")
+	return &opts
+}
+
+// newBackend returns the backend selected by opts and the RESTMapper used to resolve kind/name arguments.
+func newBackend(opts *sourceOptions) (backend, meta.RESTMapper, error) {
+	if opts.server != "" {
+		if len(opts.filenames) > 0 {
+			return nil, nil, errors.New("--server and --filename are mutually exclusive")
+		}
+		mapper, err := newRESTMapper(opts.discovery)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &remoteBackend{server: strings.TrimSuffix(opts.server, "/")}, mapper, nil
+	}
+
+	kc, err := newLocalClient(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	objs, err := graph.ObjectFinder{Client: kc}.ListObjects()
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := graph.BuildGraph(kc, objs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the renderer runs GraphQL queries against the package graph
+	graph.SetGraph(g)
+	return &localBackend{kc: kc, g: g}, kc.RESTMapper(), nil
+}
+
+// newLocalClient returns a client of the manifests in opts, or of the cluster if there are none.
+func newLocalClient(opts *sourceOptions) (client.Client, error) {
+	if len(opts.filenames) == 0 {
+		return newClient()
+	}
+	discovery := opts.discovery
+	if discovery == "" {
+		discovery = "apis.json"
+	}
+	mapper, err := graph.LoadRESTMapper(discovery)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := graph.LoadManifests(opts.filenames...)
+	if err != nil {
+		return nil, err
+	}
+	return graph.NewOfflineClient(mapper, opts.namespace, objs...)
+}
+
+func newRESTMapper(discovery string) (meta.RESTMapper, error) {
+	if discovery != "" {
+		return graph.LoadRESTMapper(discovery)
+	}
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return apiutil.NewDynamicRESTMapper(cfg)
+}
+
+type localBackend struct {
+	kc client.Client
+	g  *graph.ObjectGraph
+}
+
+var _ backend = &localBackend{}
+
+func (b *localBackend) Links(src apiv1.ObjectID, label apiv1.EdgeLabel, gk *schema.GroupKind) ([]apiv1.ObjectID, error) {
+	links, err := b.g.Links(&src, label)
+	if err != nil {
+		return nil, err
+	}
+	var out []apiv1.ObjectID
+	for linkGK, ids := range links {
+		if gk == nil || (linkGK.Group == gk.Group && linkGK.Kind == gk.Kind) {
+			out = append(out, ids...)
+		}
+	}
+	sortObjectIDs(out)
+	return out, nil
+}
+
+func (b *localBackend) ResourceGraph(src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
+	return b.g.ResourceGraph(b.kc.RESTMapper(), src)
+}
+
+func (b *localBackend) Path(src, dst apiv1.ObjectID) ([]graph.PathStep, error) {
+	return b.g.Path(src, dst)
+}
+
+func (b *localBackend) Render(src apiv1.ObjectID, layout, page string) (*v1alpha1.ResourceView, error) {
+	return graph.RenderLayout(
+		b.kc,
+		apiv1.ObjectInfo{
+			Resource: apiv1.ResourceID{Group: src.Group, Kind: src.Kind},
+			Ref:      apiv1.ObjectReference{Namespace: src.Namespace, Name: src.Name},
+		},
+		layout,
+		page,
+		true,
+		sets.NewString(),
+	)
+}
+
+type remoteBackend struct {
+	server string
+}
+
+var _ backend = &remoteBackend{}
+
+const linksQuery = `query Links($src: String!, $group: String, $kind: String) {
+  find(oid: $src) {
+    links: %s(group: $group, kind: $kind) {
+      group
+      kind
+      namespace
+      name
+    }
+  }
+}`
+
+func (b *remoteBackend) Links(src apiv1.ObjectID, label apiv1.EdgeLabel, gk *schema.GroupKind) ([]apiv1.ObjectID, error) {
+	vars := map[string]interface{}{
+		"src": string(src.OID()),
+	}
+	if gk != nil {
+		vars["group"] = gk.Group
+		vars["kind"] = gk.Kind
+	}
+	var data struct {
+		Find *struct {
+			Links []apiv1.ObjectID `json:"links"`
+		} `json:"find"`
+	}
+	if err := b.query(fmt.Sprintf(linksQuery, label), vars, &data); err != nil {
+		return nil, err
+	}
+	if data.Find == nil {
+		return nil, nil
+	}
+	sortObjectIDs(data.Find.Links)
+	return data.Find.Links, nil
+}
+
+const pathQuery = `query Path($src: String!, $dst: String!) {
+  find(oid: $src) {
+    path(to: $dst) {
+      object {
+        group
+        kind
+        namespace
+        name
+      }
+      label
+    }
+  }
+}`
+
+func (b *remoteBackend) Path(src, dst apiv1.ObjectID) ([]graph.PathStep, error) {
+	vars := map[string]interface{}{
+		"src": string(src.OID()),
+		"dst": string(dst.OID()),
+	}
+	var data struct {
+		Find *struct {
+			Path []graph.PathStep `json:"path"`
+		} `json:"find"`
+	}
+	if err := b.query(pathQuery, vars, &data); err != nil {
+		return nil, err
+	}
+	if data.Find == nil {
+		return nil, nil
+	}
+	return data.Find.Path, nil
+}
+
+func (b *remoteBackend) ResourceGraph(src apiv1.ObjectID) (*v1alpha1.ResourceGraphResponse, error) {
+	var out v1alpha1.ResourceGraphResponse
+	err := b.get("/graph", url.Values{"oid": {string(src.OID())}}, &out)
+	return &out, err
+}
+
+func (b *remoteBackend) Render(src apiv1.ObjectID, layout, page string) (*v1alpha1.ResourceView, error) {
+	var out v1alpha1.ResourceView
+	err := b.get("/render", url.Values{
+		"oid":    {string(src.OID())},
+		"layout": {layout},
+		"page":   {page},
+	}, &out)
+	return &out, err
+}
+
+func (b *remoteBackend) query(query string, vars map[string]interface{}, data interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": vars,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(b.server+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", b.server, err)
+	}
+	if len(result.Errors) > 0 {
+		msgs := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("failed to execute graphql operation, errors: %s", strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(result.Data, data)
+}
+
+func (b *remoteBackend) get(path string, params url.Values, out interface{}) error {
+	resp, err := http.Get(b.server + path + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *remoteBackend) DryRun(req graph.DryRunRequest) (*graph.DryRunResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(b.server+"/dryrun", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out graph.DryRunResult
+	return &out, json.NewDecoder(resp.Body).Decode(&out)
+}
+
+func sortObjectIDs(ids []apiv1.ObjectID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].OID() < ids[j].OID() })
+}
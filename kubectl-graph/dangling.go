@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+)
+
+// kubectl graph dangling -n demo --kind Pod
+func runDangling(args []string) error {
+	fs := newFlagSet("dangling")
+	namespace := fs.StringP("namespace", "n", "", "If present, only scan objects in this namespace")
+	kinds := fs.StringSlice("kind", nil, "If present, only scan objects of these kinds, in Kind or Kind.group format")
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	gks := make([]schema.GroupKind, 0, len(*kinds))
+	for _, k := range *kinds {
+		gks = append(gks, schema.ParseGroupKind(k))
+	}
+
+	kc, err := newClient()
+	if err != nil {
+		return err
+	}
+	finder := graph.ObjectFinder{Client: kc}
+	report, err := finder.ScanDangling(*namespace, gks...)
+	if err != nil {
+		return err
+	}
+
+	if *output != "table" {
+		return printObject(os.Stdout, *output, report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBLEM\tSOURCE\tTARGET\tTYPE\tLABELS")
+	for _, e := range report.Dangling {
+		fmt.Fprintf(w, "Dangling\t%s\t%s\t%s\t%s\n", formatObjectID(e.Source), formatObjectID(e.Target), e.Type, formatLabels(e.Labels))
+	}
+	for _, e := range report.Orphans {
+		fmt.Fprintf(w, "Orphan\t%s\t%s\t%s\t%s\n", formatObjectID(e.Source), formatObjectID(e.Target), e.Type, formatLabels(e.Labels))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, "warning:", e)
+	}
+	return nil
+}
+
+// formatObjectID prints an object in kubectl style, eg, kube-system:deployment.apps/coredns.
+func formatObjectID(id apiv1.ObjectID) string {
+	kind := strings.ToLower(id.Kind)
+	if id.Group != "" {
+		kind += "." + id.Group
+	}
+	if id.Namespace == "" {
+		return kind + "/" + id.Name
+	}
+	return id.Namespace + ":" + kind + "/" + id.Name
+}
+
+func formatLabels(labels []apiv1.EdgeLabel) string {
+	s := make([]string, 0, len(labels))
+	for _, lbl := range labels {
+		s = append(s, string(lbl))
+	}
+	return strings.Join(s, ",")
+}
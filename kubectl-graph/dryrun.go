@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/yaml"
+)
+
+// kubectl graph dryrun deployment.apps/coredns -n kube-system --connection connection.yaml
+// kubectl graph dryrun --object deployment.yaml --connection connection.yaml
+func runDryRun(args []string) error {
+	fs := newFlagSet("dryrun")
+	src := addSourceFlags(fs)
+	connection := fs.StringP("connection", "c", "", "File containing the ResourceConnection to test, in the format of the connections of a ResourceDescriptor")
+	object := fs.String("object", "", "File containing the source object, eg, a manifest that is not applied yet, instead of an object argument")
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *connection == "" {
+		return errors.New("--connection is required")
+	}
+	if fs.NArg() > 1 || (fs.NArg() == 1) == (*object != "") {
+		return errors.New("either an object or --object must be specified")
+	}
+
+	data, err := os.ReadFile(*connection)
+	if err != nil {
+		return err
+	}
+	var req graph.DryRunRequest
+	if err := yaml.UnmarshalStrict(data, &req.Connection); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", *connection, err)
+	}
+	if *object != "" {
+		objs, err := graph.LoadManifests(*object)
+		if err != nil {
+			return err
+		}
+		if len(objs) != 1 {
+			return fmt.Errorf("%s must contain exactly one object, found %d", *object, len(objs))
+		}
+		req.Object = objs[0]
+	}
+
+	var mapper meta.RESTMapper
+	var dryRun func(graph.DryRunRequest) (*graph.DryRunResult, error)
+	if src.server != "" {
+		if len(src.filenames) > 0 {
+			return errors.New("--server and --filename are mutually exclusive")
+		}
+		if fs.NArg() == 1 {
+			if mapper, err = newRESTMapper(src.discovery); err != nil {
+				return err
+			}
+		}
+		dryRun = (&remoteBackend{server: strings.TrimSuffix(src.server, "/")}).DryRun
+	} else {
+		kc, err := newLocalClient(src)
+		if err != nil {
+			return err
+		}
+		mapper = kc.RESTMapper()
+		dryRun = graph.ObjectFinder{Client: kc}.DryRun
+	}
+	if fs.NArg() == 1 {
+		oid, err := parseObjectID(fs.Arg(0), src.namespace, mapper)
+		if err != nil {
+			return err
+		}
+		req.Source = oid.OID()
+	}
+
+	result, err := dryRun(req)
+	if err != nil {
+		return err
+	}
+	if *output != "table" {
+		if err := printObject(os.Stdout, *output, result); err != nil {
+			return err
+		}
+	} else if err := printDryRun(os.Stdout, result); err != nil {
+		return err
+	}
+
+	if len(result.Errors) > 0 {
+		return errors.New("the connection is invalid")
+	}
+	return nil
+}
+
+func printDryRun(out io.Writer, result *graph.DryRunResult) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Source:\t%s\n", formatObjectID(result.Source))
+	fmt.Fprintf(w, "Target:\t%s, Kind=%s\n", result.Target.APIVersion, result.Target.Kind)
+	for _, e := range result.Errors {
+		fmt.Fprintf(w, "Error:\t%s\n", e)
+	}
+	if result.Forward != nil {
+		if result.Forward.Selector != "" {
+			fmt.Fprintf(w, "Selector:\t%s\n", result.Forward.Selector)
+		}
+		if len(result.Forward.References) > 0 {
+			fmt.Fprintf(w, "References:\t%s\n", strings.Join(result.Forward.References, ", "))
+		}
+	}
+	for _, id := range result.Asymmetric {
+		fmt.Fprintf(w, "Asymmetric:\t%s doesn't find the source backward\n", formatObjectID(id))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if result.Forward == nil {
+		return nil
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tFROM\tMATCH\tDURATION")
+	printStep := func(direction string, step graph.DryRunStep) {
+		from := formatObjectID(step.From)
+		switch {
+		case step.Error != "":
+			fmt.Fprintf(w, "%s\t%s\terror: %s\t%s\n", direction, from, step.Error, step.Duration.Duration)
+		case len(step.Matches) == 0:
+			fmt.Fprintf(w, "%s\t%s\t<none>\t%s\n", direction, from, step.Duration.Duration)
+		}
+		for _, id := range step.Matches {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", direction, from, formatObjectID(id), step.Duration.Duration)
+		}
+	}
+	printStep("forward", *result.Forward)
+	for _, step := range result.Backward {
+		printStep("backward", step)
+	}
+	return w.Flush()
+}
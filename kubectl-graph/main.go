@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/klog/v2/klogr"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+}
+
+type command struct {
+	short string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"dangling": {
+		short: "List dangling references and orphaned objects",
+		run:   runDangling,
+	},
+	"dryrun": {
+		short: "Show what a connection matches for an object without changing the graph",
+		run:   runDryRun,
+	},
+	"links": {
+		short: "List the objects linked to an object by an edge label",
+		run:   runLinks,
+	},
+	"tree": {
+		short: "Show the resource graph of an object as a tree",
+		run:   runTree,
+	},
+	"path": {
+		short: "Show the shortest path between two objects",
+		run:   runPath,
+	},
+	"render": {
+		short: "Render the layout of an object",
+		run:   runRender,
+	},
+	"offline": {
+		short: "Show the resource graph of manifests without a cluster",
+		run:   runOffline,
+	},
+	"validate": {
+		short: "Validate ResourceDescriptors against the API of the cluster",
+		run:   runValidate,
+	},
+}
+
+// kubectl graph <command> [flags]
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage(os.Stdout)
+		return
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(klogr.New())
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: kubectl graph <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].short)
+	}
+}
+
+// newFlagSet returns a flag set for a command that also accepts the --kubeconfig flag.
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.AddGoFlagSet(flag.CommandLine)
+	return fs
+}
+
+func newClient() (client.Client, error) {
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	mapper, err := apiutil.NewDynamicRESTMapper(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{
+		Scheme: scheme,
+		Mapper: mapper,
+	})
+}
+
+func printObject(w io.Writer, output string, v interface{}) error {
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
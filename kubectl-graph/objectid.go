@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+)
+
+// parseObjectID accepts an object in OID format, eg, G=apps,K=Deployment,NS=kube-system,N=coredns,
+// or in kubectl format, eg, deployment.apps/coredns or deployments/coredns, in the given namespace.
+func parseObjectID(arg, namespace string, mapper meta.RESTMapper) (*apiv1.ObjectID, error) {
+	if strings.Contains(arg, "K=") {
+		return apiv1.ParseObjectID(apiv1.OID(arg))
+	}
+	return graph.ParseObjectRef(mapper, arg, namespace)
+}
+
+// parseGroupKind resolves a kind or resource in kubectl format, eg, Deployment.apps,
+// deployment.apps or deployments.apps, to a GroupKind.
+func parseGroupKind(s string, mapper meta.RESTMapper) (schema.GroupKind, error) {
+	gr := schema.ParseGroupResource(s)
+	mapping, err := graph.ResolveGroupKind(mapper, gr.Group, gr.Resource)
+	if err != nil {
+		return schema.GroupKind{}, err
+	}
+	return mapping.GroupVersionKind.GroupKind(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// kubectl graph offline -f ./chart --discovery rs.json [G=apps,K=Deployment,NS=demo,N=web]
+func runOffline(args []string) error {
+	fs := newFlagSet("offline")
+	filenames := fs.StringSliceP("filename", "f", nil, "Files or directories containing the manifests, or - for stdin")
+	discovery := fs.String("discovery", "apis.json", "Static discovery file used to build the RESTMapper, eg, apis.json or rs.json")
+	namespace := fs.StringP("namespace", "n", "default", "Namespace of the namespaced objects that do not set one")
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*filenames) == 0 {
+		return errors.New("at least one manifest file must be specified with -f")
+	}
+	if fs.NArg() > 1 {
+		return errors.New("at most one object id can be specified")
+	}
+
+	mapper, err := graph.LoadRESTMapper(*discovery)
+	if err != nil {
+		return err
+	}
+	objs, err := graph.LoadManifests(*filenames...)
+	if err != nil {
+		return err
+	}
+	kc, err := graph.NewOfflineClient(mapper, *namespace, objs...)
+	if err != nil {
+		return err
+	}
+	g, err := graph.BuildGraph(kc, objs)
+	if err != nil {
+		return err
+	}
+
+	var resp *v1alpha1.ResourceGraphResponse
+	if fs.NArg() == 1 {
+		oid, err := apiv1.ParseObjectID(apiv1.OID(fs.Arg(0)))
+		if err != nil {
+			return err
+		}
+		resp, err = g.ResourceGraph(mapper, *oid)
+		if err != nil {
+			return err
+		}
+	} else {
+		resp, err = g.FullResourceGraph(mapper)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *output != "table" {
+		return printObject(os.Stdout, *output, resp)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tTARGET\tLABELS")
+	for _, c := range resp.Connections {
+		fmt.Fprintf(w, "%s\t%s\t%s\n",
+			formatObjectPointer(resp.Resources, c.Source),
+			formatObjectPointer(resp.Resources, c.Target),
+			strings.Join(c.Labels, ","))
+	}
+	return w.Flush()
+}
+
+func formatObjectPointer(resources []apiv1.ResourceID, p v1alpha1.ObjectPointer) string {
+	rid := resources[p.ResourceID]
+	return formatObjectID(apiv1.ObjectID{
+		Group:     rid.Group,
+		Kind:      rid.Kind,
+		Namespace: p.Namespace,
+		Name:      p.Name,
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// kubectl graph links deployment.apps/coredns -n kube-system --label offshoot --kind Pod
+func runLinks(args []string) error {
+	fs := newFlagSet("links")
+	src := addSourceFlags(fs)
+	label := fs.String("label", string(apiv1.EdgeOffshoot), "Label of the edges to follow")
+	kind := fs.String("kind", "", "If present, only list linked objects of this kind, in Kind or Kind.group format")
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml|tree")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one object must be specified")
+	}
+
+	b, mapper, err := newBackend(src)
+	if err != nil {
+		return err
+	}
+	oid, err := parseObjectID(fs.Arg(0), src.namespace, mapper)
+	if err != nil {
+		return err
+	}
+	var gk *schema.GroupKind
+	if *kind != "" {
+		v, err := parseGroupKind(*kind, mapper)
+		if err != nil {
+			return err
+		}
+		gk = &v
+	}
+
+	links, err := b.Links(*oid, apiv1.EdgeLabel(*label), gk)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "GROUP\tKIND\tNAMESPACE\tNAME")
+		for _, id := range links {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id.Group, id.Kind, id.Namespace, id.Name)
+		}
+		return w.Flush()
+	case "tree":
+		root := &treeNode{name: formatObjectID(*oid)}
+		for _, id := range links {
+			root.children = append(root.children, &treeNode{label: *label, name: formatObjectID(id)})
+		}
+		root.print(os.Stdout)
+		return nil
+	default:
+		return printObject(os.Stdout, *output, links)
+	}
+}
+
+// kubectl graph tree deployment.apps/coredns -n kube-system
+func runTree(args []string) error {
+	fs := newFlagSet("tree")
+	src := addSourceFlags(fs)
+	output := fs.StringP("output", "o", "tree", "Output format. One of: table|json|yaml|tree")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one object must be specified")
+	}
+
+	b, mapper, err := newBackend(src)
+	if err != nil {
+		return err
+	}
+	oid, err := parseObjectID(fs.Arg(0), src.namespace, mapper)
+	if err != nil {
+		return err
+	}
+	resp, err := b.ResourceGraph(*oid)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "table":
+		return printConnections(os.Stdout, resp)
+	case "tree":
+		newResourceTree(resp, *oid).print(os.Stdout)
+		return nil
+	default:
+		return printObject(os.Stdout, *output, resp)
+	}
+}
+
+// kubectl graph path deployment.apps/coredns service/kube-dns -n kube-system
+func runPath(args []string) error {
+	fs := newFlagSet("path")
+	src := addSourceFlags(fs)
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml|tree")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("exactly two objects must be specified")
+	}
+
+	b, mapper, err := newBackend(src)
+	if err != nil {
+		return err
+	}
+	from, err := parseObjectID(fs.Arg(0), src.namespace, mapper)
+	if err != nil {
+		return err
+	}
+	to, err := parseObjectID(fs.Arg(1), src.namespace, mapper)
+	if err != nil {
+		return err
+	}
+	path, err := b.Path(*from, *to)
+	if err != nil {
+		return err
+	}
+	if path == nil {
+		return fmt.Errorf("%s is not connected to %s", formatObjectID(*from), formatObjectID(*to))
+	}
+
+	switch *output {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STEP\tLABEL\tOBJECT")
+		for i, step := range path {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", i, step.Label, formatObjectID(step.Object))
+		}
+		return w.Flush()
+	case "tree":
+		root := &treeNode{name: formatObjectID(path[0].Object)}
+		for cur, i := root, 1; i < len(path); i++ {
+			next := &treeNode{label: string(path[i].Label), name: formatObjectID(path[i].Object)}
+			cur.children = []*treeNode{next}
+			cur = next
+		}
+		root.print(os.Stdout)
+		return nil
+	default:
+		return printObject(os.Stdout, *output, path)
+	}
+}
+
+// kubectl graph render mongodb.kubedb.com/mg-sh -n demo --page Overview
+func runRender(args []string) error {
+	fs := newFlagSet("render")
+	src := addSourceFlags(fs)
+	layout := fs.String("layout", "", "Name of the ResourceLayout. If empty, the default layout of the object's type is used")
+	page := fs.String("page", "", "If present, only render this page of the layout")
+	output := fs.StringP("output", "o", "yaml", "Output format. One of: table|json|yaml|tree")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one object must be specified")
+	}
+
+	b, mapper, err := newBackend(src)
+	if err != nil {
+		return err
+	}
+	oid, err := parseObjectID(fs.Arg(0), src.namespace, mapper)
+	if err != nil {
+		return err
+	}
+	view, err := b.Render(*oid, *layout, *page)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "table":
+		return printResourceView(os.Stdout, view)
+	case "tree":
+		root := &treeNode{name: view.LayoutName}
+		for _, p := range view.Pages {
+			pn := &treeNode{name: p.Name}
+			for _, block := range pageBlocks(p) {
+				pn.children = append(pn.children, &treeNode{label: string(block.Kind), name: blockName(block)})
+			}
+			root.children = append(root.children, pn)
+		}
+		root.print(os.Stdout)
+		return nil
+	default:
+		return printObject(os.Stdout, *output, view)
+	}
+}
+
+func printConnections(w io.Writer, resp *v1alpha1.ResourceGraphResponse) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTARGET\tLABELS")
+	rows := make([]string, 0, len(resp.Connections))
+	for _, c := range resp.Connections {
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s",
+			formatObjectPointer(resp.Resources, c.Source),
+			formatObjectPointer(resp.Resources, c.Target),
+			strings.Join(c.Labels, ",")))
+	}
+	sort.Strings(rows)
+	for _, row := range rows {
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+func pageBlocks(p v1alpha1.ResourcePageView) []v1alpha1.PageBlockView {
+	var blocks []v1alpha1.PageBlockView
+	if p.Info != nil {
+		blocks = append(blocks, *p.Info)
+	}
+	if p.Insight != nil {
+		blocks = append(blocks, *p.Insight)
+	}
+	return append(blocks, p.Blocks...)
+}
+
+func blockName(block v1alpha1.PageBlockView) string {
+	if block.Name != "" {
+		return block.Name
+	}
+	if block.Resource != nil {
+		return block.Resource.Kind
+	}
+	return string(block.Kind)
+}
+
+func printResourceView(w io.Writer, view *v1alpha1.ResourceView) error {
+	for _, p := range view.Pages {
+		for _, block := range pageBlocks(p) {
+			fmt.Fprintf(w, "# %s / %s\n", p.Name, blockName(block))
+			if block.Table == nil {
+				fmt.Fprintln(w)
+				continue
+			}
+			tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+			cols := make([]string, 0, len(block.Table.Columns))
+			for _, c := range block.Table.Columns {
+				cols = append(cols, strings.ToUpper(c.Name))
+			}
+			fmt.Fprintln(tw, strings.Join(cols, "\t"))
+			for _, row := range block.Table.Rows {
+				cells := make([]string, 0, len(row.Cells))
+				for _, cell := range row.Cells {
+					cells = append(cells, fmt.Sprintf("%v", cell.Data))
+				}
+				fmt.Fprintln(tw, strings.Join(cells, "\t"))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+type treeNode struct {
+	label    string
+	name     string
+	children []*treeNode
+}
+
+func (n *treeNode) print(w io.Writer) {
+	fmt.Fprintln(w, n.name)
+	n.printChildren(w, "")
+}
+
+func (n *treeNode) printChildren(w io.Writer, prefix string) {
+	for i, c := range n.children {
+		branch, indent := "├── ", "│   "
+		if i == len(n.children)-1 {
+			branch, indent = "└── ", "    "
+		}
+		if c.label != "" {
+			fmt.Fprintf(w, "%s%s[%s] %s\n", prefix, branch, c.label, c.name)
+		} else {
+			fmt.Fprintf(w, "%s%s%s\n", prefix, branch, c.name)
+		}
+		c.printChildren(w, prefix+indent)
+	}
+}
+
+// newResourceTree arranges the connections of a resource graph as a spanning tree rooted at src.
+func newResourceTree(resp *v1alpha1.ResourceGraphResponse, src apiv1.ObjectID) *treeNode {
+	type link struct {
+		label string
+		id    apiv1.ObjectID
+	}
+	toID := func(p v1alpha1.ObjectPointer) apiv1.ObjectID {
+		rid := resp.Resources[p.ResourceID]
+		return apiv1.ObjectID{Group: rid.Group, Kind: rid.Kind, Namespace: p.Namespace, Name: p.Name}
+	}
+	adj := map[apiv1.OID][]link{}
+	for _, c := range resp.Connections {
+		s, t := toID(c.Source), toID(c.Target)
+		label := strings.Join(c.Labels, ",")
+		adj[s.OID()] = append(adj[s.OID()], link{label: label, id: t})
+		adj[t.OID()] = append(adj[t.OID()], link{label: label, id: s})
+	}
+
+	type item struct {
+		node *treeNode
+		oid  apiv1.OID
+	}
+	root := &treeNode{name: formatObjectID(src)}
+	visited := map[apiv1.OID]bool{src.OID(): true}
+	queue := []item{{root, src.OID()}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		links := adj[cur.oid]
+		sort.Slice(links, func(i, j int) bool { return formatObjectID(links[i].id) < formatObjectID(links[j].id) })
+		for _, l := range links {
+			if visited[l.id.OID()] {
+				continue
+			}
+			visited[l.id.OID()] = true
+			child := &treeNode{label: l.label, name: formatObjectID(l.id)}
+			cur.node.children = append(cur.node.children, child)
+			queue = append(queue, item{child, l.id.OID()})
+		}
+	}
+	return root
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"github.com/tamalsaha/resource-watcher-demo/validation"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+)
+
+// kubectl graph validate -f ./descriptors [--discovery apis.json]
+func runValidate(args []string) error {
+	fs := newFlagSet("validate")
+	filenames := fs.StringSliceP("filename", "f", nil, "Files or directories containing the ResourceDescriptors. If empty, the descriptors stored in the cluster are validated")
+	discovery := fs.String("discovery", "", "Static discovery file used to check the resources, eg, apis.json or rs.json. If empty, the API of the cluster is used")
+	output := fs.StringP("output", "o", "table", "Output format. One of: table|json|yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var mapper meta.RESTMapper
+	var rds []*v1alpha1.ResourceDescriptor
+	if *discovery != "" {
+		var err error
+		if mapper, err = graph.LoadRESTMapper(*discovery); err != nil {
+			return err
+		}
+	}
+	if len(*filenames) == 0 || mapper == nil {
+		kc, err := newClient()
+		if err != nil {
+			return err
+		}
+		if mapper == nil {
+			mapper = kc.RESTMapper()
+		}
+		if len(*filenames) == 0 {
+			var list v1alpha1.ResourceDescriptorList
+			if err := kc.List(context.TODO(), &list); err != nil {
+				return err
+			}
+			for i := range list.Items {
+				rds = append(rds, &list.Items[i])
+			}
+		}
+	}
+	if len(*filenames) > 0 {
+		var err error
+		if rds, err = graph.ReadDescriptorFiles(*filenames...); err != nil {
+			return err
+		}
+	}
+
+	results := validation.Validator{Mapper: mapper}.ValidateAll(rds)
+	var invalid int
+	for _, r := range results {
+		if len(r.Errors) > 0 {
+			invalid++
+		}
+	}
+
+	if *output != "table" {
+		if err := printObject(os.Stdout, *output, results); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "DESCRIPTOR\tPATH\tERROR\tDETAIL")
+		for _, r := range results {
+			for _, e := range r.Errors {
+				detail := e.Detail
+				if e.Value != nil {
+					detail = fmt.Sprintf("%v: %s", e.Value, detail)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Descriptor, e.Path, e.Type, detail)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d descriptors are invalid", invalid, len(results))
+	}
+	return nil
+}
@@ -11,9 +11,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/graphql-go/handler"
 	"github.com/tamalsaha/resource-watcher-demo/graph"
+	"github.com/tamalsaha/resource-watcher-demo/validation"
 	core "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -30,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
 var (
@@ -39,17 +43,28 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 }
 
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var descriptorDir string
+	var descriptorResyncPeriod time.Duration
+	var enableValidationWebhook bool
+	var historyPath string
+	var historyRetention time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&descriptorDir, "descriptor-dir", "", "Directory of ResourceDescriptors merged over the embedded ones.")
+	flag.DurationVar(&descriptorResyncPeriod, "descriptor-resync-period", 30*time.Second, "How often the descriptor directory is reloaded.")
+	flag.BoolVar(&enableValidationWebhook, "enable-validation-webhook", false, "Serve the webhook that validates ResourceDescriptors. It requires a serving certificate.")
+	flag.StringVar(&historyPath, "history-path", "", "File of the embedded store recording the history of the graph. The history is disabled if empty.")
+	flag.DurationVar(&historyRetention, "history-retention", 7*24*time.Hour, "How long the history of the graph is kept. Zero keeps it forever.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -58,6 +73,11 @@ func main() {
 
 	ctrl.SetLogger(klogr.New())
 
+	// objects the client of the manager reads from the apiserver instead of the cache
+	uncached := []client.Object{
+		&core.Pod{},
+	}
+
 	cfg := ctrl.GetConfigOrDie()
 	cfg.QPS = 100
 	cfg.Burst = 100
@@ -68,10 +88,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "783ac4f6.rswatcher.dev",
-		ClientDisableCacheFor: []client.Object{
-			&core.Pod{},
-		},
-		NewClient: cu.NewClient,
+		ClientDisableCacheFor:  uncached,
+		NewClient:              cu.NewClient,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -150,20 +168,23 @@ func main() {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	// ready once discovery has run and the controller of every discovered type has synced
+	if err := mgr.AddReadyzCheck("readyz", graph.ReadyCheck); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
 
 	mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
-		h := handler.New(&handler.Config{
-			Schema:     &graph.Schema,
-			Pretty:     true,
-			GraphiQL:   false,
-			Playground: true,
+		http.Handle("/", &graph.GraphQLHandler{
+			Config: handler.Config{
+				Pretty:     true,
+				GraphiQL:   false,
+				Playground: true,
+			},
+			Context: func(r *http.Request) context.Context {
+				return graph.WithClient(r.Context(), mgr.GetClient())
+			},
 		})
-
-		http.Handle("/", h)
 		http.Handle("/generic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// k get genericresources -l k8s.io/group=,k8s.io/kind=Pod
 
@@ -196,8 +217,37 @@ func main() {
 		}))
 
 		http.Handle("/graph", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			objid, _ := apiv1.ParseObjectID("G=apps,K=Deployment,NS=kube-system,N=coredns")
-			resp, err := graph.ResourceGraph(mgr.GetRESTMapper(), *objid)
+			oid := r.URL.Query().Get("oid")
+			if oid == "" {
+				oid = "G=apps,K=Deployment,NS=kube-system,N=coredns"
+			}
+			objid, err := apiv1.ParseObjectID(apiv1.OID(oid))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid oid %q, errors: %v", oid, err)
+				return
+			}
+			var snap *graph.Snapshot
+			if at := r.URL.Query().Get("at"); at != "" {
+				t, err := time.Parse(time.RFC3339, at)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprintf(w, "invalid time %q, errors: %v", at, err)
+					return
+				}
+				snap, err = graph.NewSnapshotAt(t)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprintf(w, "failed to read graph history, errors: %v", err)
+					return
+				}
+			} else {
+				snap = graph.NewSnapshot()
+				// only the current graph is versioned, past graphs are rebuilt from the history
+				w.Header().Set(graph.VersionHeader, strconv.FormatUint(snap.Version(), 10))
+			}
+			defer snap.Release()
+			resp, err := snap.ResourceGraph(mgr.GetRESTMapper(), *objid)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				_, _ = fmt.Fprintf(w, "failed to execute graphql operation, errors: %v", err)
@@ -209,6 +259,38 @@ func main() {
 			return
 		}))
 
+		http.Handle("/debug/connections", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rJSON, _ := json.MarshalIndent(graph.ConnectionFailures(), "", "  ")
+			w.Write(rJSON)
+		}))
+
+		http.Handle("/debug/graph", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rJSON, _ := json.MarshalIndent(graph.Status(), "", "  ")
+			w.Write(rJSON)
+		}))
+
+		http.Handle("/dryrun", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req graph.DryRunRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid request, errors: %v", err)
+				return
+			}
+			resp, err := graph.NewFinder(mgr.GetClient()).DryRun(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "failed to evaluate connection, errors: %v", err)
+				return
+			}
+
+			rJSON, _ := json.MarshalIndent(resp, "", "  ")
+			w.Write(rJSON)
+		}))
+
 		/*
 
 			request:
@@ -224,25 +306,45 @@ func main() {
 			  convertToTable: true
 		*/
 		http.Handle("/render", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			src := apiv1.ObjectInfo{
+				Resource: apiv1.ResourceID{
+					Group:   "kubedb.com",
+					Version: "",
+					Name:    "",
+					Kind:    "MongoDB",
+					Scope:   "",
+				},
+				Ref: apiv1.ObjectReference{
+					Namespace: "demo",
+					Name:      "mg-sh",
+				},
+			}
+			layoutName := "kubedb-kubedb.com-v1alpha2-mongodbs"
+			pageName := "Database Insights" // "Operations"
+
+			q := r.URL.Query()
+			if oid := q.Get("oid"); oid != "" {
+				objid, err := apiv1.ParseObjectID(apiv1.OID(oid))
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprintf(w, "invalid oid %q, errors: %v", oid, err)
+					return
+				}
+				src = apiv1.ObjectInfo{
+					Resource: apiv1.ResourceID{Group: objid.Group, Kind: objid.Kind},
+					Ref:      apiv1.ObjectReference{Namespace: objid.Namespace, Name: objid.Name},
+				}
+				layoutName = q.Get("layout")
+				pageName = q.Get("page")
+			}
+
 			resp, err := graph.RenderLayout(
 				mgr.GetClient(),
-				apiv1.ObjectInfo{
-					Resource: apiv1.ResourceID{
-						Group:   "kubedb.com",
-						Version: "",
-						Name:    "",
-						Kind:    "MongoDB",
-						Scope:   "",
-					},
-					Ref: apiv1.ObjectReference{
-						Namespace: "demo",
-						Name:      "mg-sh",
-					},
-				},
-				"kubedb-kubedb.com-v1alpha2-mongodbs", // layoutName string, // optional
-				"Database Insights",                   // "Operations", // pageName string, // optional
-				true,                                  // convertToTable bool,
-				sets.NewString(),                      // renderSelfOnly bool,
+				src,
+				layoutName,       // layoutName string, // optional
+				pageName,         // pageName string, // optional
+				true,             // convertToTable bool,
+				sets.NewString(), // renderSelfOnly bool,
 			)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
@@ -293,11 +395,73 @@ func main() {
 		return http.ListenAndServe(":8082", nil)
 	}))
 
+	// descriptors are loaded before the field indexes are set up, so their connections are indexed
+	if descriptorDir != "" {
+		rds, err := graph.LoadDescriptorDir(descriptorDir)
+		if err != nil {
+			setupLog.Error(err, "unable to load resource descriptors", "dir", descriptorDir)
+		}
+		graph.Registry.Set(graph.DirectorySource, rds)
+		if err := mgr.Add(manager.RunnableFunc(graph.WatchDescriptorDir(mgr, descriptorDir, descriptorResyncPeriod))); err != nil {
+			setupLog.Error(err, "unable to set up resource descriptor loader")
+			os.Exit(1)
+		}
+	}
+	rdGK := v1alpha1.SchemeGroupVersion.WithKind(v1alpha1.ResourceKindResourceDescriptor).GroupKind()
+	if _, err := mgr.GetRESTMapper().RESTMapping(rdGK); err == nil {
+		rds, err := graph.LoadClusterDescriptors(ctx, mgr.GetAPIReader())
+		if err != nil {
+			setupLog.Error(err, "unable to load resource descriptors from the cluster")
+		}
+		graph.Registry.Set(graph.ClusterSource, rds)
+		if err := (&graph.DescriptorReconciler{Client: mgr.GetClient()}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ResourceDescriptor")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("ResourceDescriptors are not served by the cluster, using the embedded descriptors")
+	}
+	if enableValidationWebhook {
+		mgr.GetWebhookServer().Register(validation.WebhookPath, &webhook.Admission{
+			Handler: &validation.Webhook{Validator: validation.Validator{Mapper: mgr.GetRESTMapper()}},
+		})
+	}
+
+	// the history starts recording before the graph is built
+	if historyPath != "" {
+		h, err := graph.OpenHistory(graph.HistoryOptions{Path: historyPath, Retention: historyRetention})
+		if err != nil {
+			setupLog.Error(err, "unable to open graph history", "path", historyPath)
+			os.Exit(1)
+		}
+		graph.EnableHistory(h)
+		if err := mgr.Add(manager.RunnableFunc(h.Run)); err != nil {
+			setupLog.Error(err, "unable to set up graph history")
+			os.Exit(1)
+		}
+	}
+
+	// connections that fail to compile are skipped when building the graph
+	if err := graph.CompileConnections(); err != nil {
+		setupLog.Error(err, "invalid resource connections")
+	}
+
+	// field indexes can't be added once the informers start
+	if err := graph.SetupFieldIndexes(ctx, mgr, uncached...); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		os.Exit(1)
+	}
+
 	if err := mgr.Add(manager.RunnableFunc(graph.PollNewResourceTypes(cfg))); err != nil {
 		setupLog.Error(err, "unable to set up resource poller")
 		os.Exit(1)
 	}
 
+	if err := mgr.Add(manager.RunnableFunc(graph.RunRequeueQueues)); err != nil {
+		setupLog.Error(err, "unable to set up requeue queues")
+		os.Exit(1)
+	}
+
 	if err := mgr.Add(manager.RunnableFunc(graph.SetupGraphReconciler(mgr))); err != nil {
 		setupLog.Error(err, "unable to set up resource reconciler configurator")
 		os.Exit(1)
@@ -0,0 +1,184 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validation checks ResourceDescriptors statically, so mistakes in their connections
+// are found before the descriptors are loaded instead of at reconcile time.
+package validation
+
+import (
+	"fmt"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	crdv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"kmodules.xyz/resource-metadata/hub/resourcedescriptors"
+)
+
+// Validator checks ResourceDescriptors against the API described by Mapper.
+// If Mapper is nil, the resources and targets are not checked against the API.
+type Validator struct {
+	Mapper meta.RESTMapper
+}
+
+// Result is the outcome of validating a descriptor.
+type Result struct {
+	Descriptor string       `json:"descriptor"`
+	Errors     []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is an error at a path of a descriptor.
+type FieldError struct {
+	Path   string          `json:"path"`
+	Type   field.ErrorType `json:"type"`
+	Value  interface{}     `json:"value,omitempty"`
+	Detail string          `json:"detail,omitempty"`
+}
+
+func (e FieldError) Error() string {
+	return (&field.Error{Type: e.Type, Field: e.Path, BadValue: e.Value, Detail: e.Detail}).Error()
+}
+
+// ValidateAll validates the descriptors and returns a result for each of them.
+func (v Validator) ValidateAll(rds []*v1alpha1.ResourceDescriptor) []Result {
+	out := make([]Result, 0, len(rds))
+	for _, rd := range rds {
+		errs := v.Validate(rd)
+		r := Result{Descriptor: rd.Name}
+		for _, err := range errs {
+			r.Errors = append(r.Errors, FieldError{
+				Path:   err.Field,
+				Type:   err.Type,
+				Value:  badValue(err),
+				Detail: err.Detail,
+			})
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// badValue omits the values that are not worth printing.
+func badValue(err *field.Error) interface{} {
+	switch err.Type {
+	case field.ErrorTypeRequired, field.ErrorTypeForbidden, field.ErrorTypeTooMany, field.ErrorTypeInternal:
+		return nil
+	}
+	return err.BadValue
+}
+
+// Validate returns the errors of the descriptor.
+func (v Validator) Validate(rd *v1alpha1.ResourceDescriptor) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+	res := rd.Spec.Resource
+
+	resPath := specPath.Child("resource")
+	if res.Version == "" {
+		errs = append(errs, field.Required(resPath.Child("version"), ""))
+	}
+	if res.Kind == "" {
+		errs = append(errs, field.Required(resPath.Child("kind"), ""))
+	}
+	if res.Name == "" {
+		errs = append(errs, field.Required(resPath.Child("name"), ""))
+	}
+	if len(errs) == 0 {
+		if expected := resourcedescriptors.GetName(res.GroupVersionResource()); rd.Name != expected {
+			errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), rd.Name, fmt.Sprintf("must be %s", expected)))
+		}
+		errs = append(errs, v.validateResource(res, resPath)...)
+	}
+
+	connPath := specPath.Child("connections")
+	for i, c := range rd.Spec.Connections {
+		errs = append(errs, v.validateConnection(c, rd.Spec.Validation, connPath.Index(i))...)
+	}
+	return errs
+}
+
+// validateResource checks that the resource is served with the given name and scope.
+func (v Validator) validateResource(res apiv1.ResourceID, fldPath *field.Path) field.ErrorList {
+	if v.Mapper == nil {
+		return nil
+	}
+	gvk := res.GroupVersionKind()
+	mapping, err := v.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return field.ErrorList{field.NotFound(fldPath, gvk.String())}
+	}
+
+	var errs field.ErrorList
+	if mapping.Resource.Resource != res.Name {
+		errs = append(errs, field.Invalid(fldPath.Child("name"), res.Name, fmt.Sprintf("%s is served as %s", gvk.Kind, mapping.Resource.Resource)))
+	}
+	if res.Scope != "" {
+		scope := apiv1.ClusterScoped
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			scope = apiv1.NamespaceScoped
+		}
+		if res.Scope != scope {
+			errs = append(errs, field.Invalid(fldPath.Child("scope"), res.Scope, fmt.Sprintf("%s is %s", gvk.Kind, scope)))
+		}
+	}
+	return errs
+}
+
+// validateConnection returns the errors of a connection of the resource validated by source.
+func (v Validator) validateConnection(c v1alpha1.ResourceConnection, source *crdv1.CustomResourceValidation, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	targetPath := fldPath.Child("target")
+	gv, err := schema.ParseGroupVersion(c.Target.APIVersion)
+	switch {
+	case c.Target.APIVersion == "":
+		errs = append(errs, field.Required(targetPath.Child("apiVersion"), ""))
+	case err != nil:
+		errs = append(errs, field.Invalid(targetPath.Child("apiVersion"), c.Target.APIVersion, err.Error()))
+	}
+	if c.Target.Kind == "" {
+		errs = append(errs, field.Required(targetPath.Child("kind"), ""))
+	}
+	var target *crdv1.CustomResourceValidation
+	if len(errs) == 0 && v.Mapper != nil {
+		gvk := gv.WithKind(c.Target.Kind)
+		if mapping, err := v.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			errs = append(errs, field.NotFound(targetPath, gvk.String()))
+		} else if rd, err := resourcedescriptors.LoadByGVR(mapping.Resource); err == nil {
+			target = rd.Spec.Validation
+		}
+	}
+
+	labelsPath := fldPath.Child("labels")
+	if len(c.Labels) == 0 {
+		errs = append(errs, field.Required(labelsPath, "at least one edge label is required"))
+	}
+	for i, lbl := range c.Labels {
+		if err := graph.ValidateEdgeLabel(lbl); err != nil {
+			errs = append(errs, field.Invalid(labelsPath.Index(i), lbl, err.Error()))
+		}
+	}
+
+	connErrs := graph.ValidateConnection(c.ResourceConnectionSpec, fldPath)
+	if len(connErrs) == 0 {
+		// the predicates are only type checked once they compile
+		connErrs = graph.ValidateConnectionTypes(c.ResourceConnectionSpec, source, target, fldPath)
+	}
+	return append(errs, connErrs...)
+}
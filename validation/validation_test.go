@@ -0,0 +1,270 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tamalsaha/resource-watcher-demo/graph"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	apiv1 "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newTestMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, meta.RESTScopeRoot)
+	return mapper
+}
+
+func newDeploymentDescriptor(connections ...v1alpha1.ResourceConnection) *v1alpha1.ResourceDescriptor {
+	return &v1alpha1.ResourceDescriptor{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       v1alpha1.ResourceKindResourceDescriptor,
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: "apps-v1-deployments"},
+		Spec: v1alpha1.ResourceDescriptorSpec{
+			Resource: apiv1.ResourceID{
+				Group:   "apps",
+				Version: "v1",
+				Name:    "deployments",
+				Kind:    "Deployment",
+				Scope:   apiv1.NamespaceScoped,
+			},
+			Connections: connections,
+		},
+	}
+}
+
+func secretConnection(spec v1alpha1.ResourceConnectionSpec) v1alpha1.ResourceConnection {
+	return v1alpha1.ResourceConnection{
+		Target:                 metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		Labels:                 []apiv1.EdgeLabel{apiv1.EdgeAuthVia},
+		ResourceConnectionSpec: spec,
+	}
+}
+
+type fieldErr struct {
+	Path string
+	Type field.ErrorType
+}
+
+func TestValidate(t *testing.T) {
+	v := Validator{Mapper: newTestMapper()}
+	tests := []struct {
+		name     string
+		rd       *v1alpha1.ResourceDescriptor
+		expected []fieldErr
+	}{
+		{
+			name: "valid",
+			rd: newDeploymentDescriptor(
+				secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName, NameTemplate: "{.metadata.name}-auth", NamespacePath: graph.MetadataNamespace}),
+				secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef, References: []string{"{.spec.template.spec.volumes[*].secret}"}}),
+			),
+		},
+		{
+			name: "invalid reference",
+			rd:   newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchRef, References: []string{"{.spec.refs}", "{.spec.refs[}"}})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].references[1]", Type: field.ErrorTypeInvalid},
+			},
+		},
+		{
+			name: "missing name template",
+			rd:   newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].nameTemplate", Type: field.ErrorTypeRequired},
+			},
+		},
+		{
+			name: "expression",
+			rd: newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{
+				Type:         graph.MatchExpression,
+				References:   []string{`target.type == "kubernetes.io/tls" && target.data["tls.crt"] != ""`, "target.metadata.name == source.metadata.name"},
+				NameTemplate: "{.metadata.name}-tls",
+			})),
+		},
+		{
+			name: "expression types",
+			rd: newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{
+				Type:         graph.MatchExpression,
+				References:   []string{`target.typ == "kubernetes.io/tls"`, "target.immutable == 1", "target.metadata.name == source.metadata.name"},
+				NameTemplate: "{.metadata.name}-tls",
+			})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].references[0]", Type: field.ErrorTypeInvalid},
+				{Path: "spec.connections[0].references[1]", Type: field.ErrorTypeInvalid},
+			},
+		},
+		{
+			name: "expression without hint",
+			rd: newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{
+				Type:       graph.MatchExpression,
+				References: []string{"target.metadata.name == source.metadata.name"},
+			})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].selector", Type: field.ErrorTypeRequired},
+			},
+		},
+		{
+			name: "missing level",
+			rd:   newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.OwnedBy})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].level", Type: field.ErrorTypeRequired},
+			},
+		},
+		{
+			name: "unknown type",
+			rd:   newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{Type: "MatchLabel"})),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].type", Type: field.ErrorTypeNotSupported},
+			},
+		},
+		{
+			name: "unknown target",
+			rd: newDeploymentDescriptor(v1alpha1.ResourceConnection{
+				Target:                 metav1.TypeMeta{APIVersion: "example.com/v1", Kind: "Widget"},
+				Labels:                 []apiv1.EdgeLabel{apiv1.EdgeOffshoot},
+				ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.OwnedBy, Level: v1alpha1.Controller},
+			}),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].target", Type: field.ErrorTypeNotFound},
+			},
+		},
+		{
+			name: "invalid labels",
+			rd: newDeploymentDescriptor(
+				v1alpha1.ResourceConnection{
+					Target:                 metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+					Labels:                 []apiv1.EdgeLabel{"auth-via", "path"},
+					ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName, NameTemplate: "{.metadata.name}"},
+				},
+				v1alpha1.ResourceConnection{
+					Target:                 metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+					ResourceConnectionSpec: v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName, NameTemplate: "{.metadata.name}"},
+				},
+			),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].labels[0]", Type: field.ErrorTypeInvalid},
+				{Path: "spec.connections[0].labels[1]", Type: field.ErrorTypeInvalid},
+				{Path: "spec.connections[1].labels", Type: field.ErrorTypeRequired},
+			},
+		},
+		{
+			name: "resource",
+			rd: func() *v1alpha1.ResourceDescriptor {
+				rd := newDeploymentDescriptor()
+				rd.Name = "deployments"
+				rd.Spec.Resource.Scope = apiv1.ClusterScoped
+				return rd
+			}(),
+			expected: []fieldErr{
+				{Path: "metadata.name", Type: field.ErrorTypeInvalid},
+				{Path: "spec.resource.scope", Type: field.ErrorTypeInvalid},
+			},
+		},
+		{
+			name: "every error",
+			rd: newDeploymentDescriptor(
+				secretConnection(v1alpha1.ResourceConnectionSpec{Type: graph.MatchExpression, References: []string{"source.spec +"}, SelectorPath: "spec.selector"}),
+			),
+			expected: []fieldErr{
+				{Path: "spec.connections[0].selectorPath", Type: field.ErrorTypeForbidden},
+				{Path: "spec.connections[0].references[0]", Type: field.ErrorTypeInvalid},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []fieldErr
+			for _, err := range v.Validate(test.rd) {
+				got = append(got, fieldErr{Path: err.Field, Type: err.Type})
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+// TestValidateKnownDescriptors checks the descriptors embedded in the module without a mapper.
+func TestValidateKnownDescriptors(t *testing.T) {
+	var rds []*v1alpha1.ResourceDescriptor
+	graph.Registry.Visit(func(_ string, rd *v1alpha1.ResourceDescriptor) {
+		rds = append(rds, rd)
+	})
+	for _, r := range (Validator{}).ValidateAll(rds) {
+		for _, err := range r.Errors {
+			t.Errorf("%s: %v", r.Descriptor, err)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	w := &Webhook{Validator: Validator{Mapper: newTestMapper()}}
+	request := func(op admissionv1.Operation, rd *v1alpha1.ResourceDescriptor) admission.Request {
+		raw, err := json.Marshal(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Object:    runtime.RawExtension{Raw: raw},
+		}}
+	}
+
+	valid := newDeploymentDescriptor(secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName, NameTemplate: "{.metadata.name}"}))
+	if resp := w.Handle(context.TODO(), request(admissionv1.Create, valid)); !resp.Allowed {
+		t.Errorf("expected a valid descriptor to be allowed, got %v", resp.Result)
+	}
+
+	invalid := newDeploymentDescriptor(
+		secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.MatchName}),
+		secretConnection(v1alpha1.ResourceConnectionSpec{Type: v1alpha1.OwnedBy}),
+	)
+	resp := w.Handle(context.TODO(), request(admissionv1.Update, invalid))
+	if resp.Allowed {
+		t.Fatal("expected an invalid descriptor to be denied")
+	}
+	if resp.Result == nil || resp.Result.Reason != metav1.StatusReasonInvalid || resp.Result.Details == nil {
+		t.Fatalf("expected an Invalid status, got %v", resp.Result)
+	}
+	var fields []string
+	for _, c := range resp.Result.Details.Causes {
+		fields = append(fields, c.Field)
+	}
+	if expected := []string{"spec.connections[0].nameTemplate", "spec.connections[1].level"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected causes %v, got %v", expected, fields)
+	}
+
+	if resp := w.Handle(context.TODO(), request(admissionv1.Delete, invalid)); !resp.Allowed {
+		t.Error("expected deletes to be allowed")
+	}
+}
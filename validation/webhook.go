@@ -0,0 +1,66 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// WebhookPath is the path the validating webhook is served at.
+const WebhookPath = "/validate-meta-k8s-appscode-com-v1alpha1-resourcedescriptor"
+
+// +kubebuilder:webhook:path=/validate-meta-k8s-appscode-com-v1alpha1-resourcedescriptor,mutating=false,failurePolicy=fail,sideEffects=None,groups=meta.k8s.appscode.com,resources=resourcedescriptors,verbs=create;update,versions=v1alpha1,name=vresourcedescriptor.rswatcher.dev,admissionReviewVersions=v1
+
+// Webhook is a validating admission webhook that rejects invalid ResourceDescriptors.
+// The rejection is an Invalid status with a cause per error, like the API server
+// returns for built-in types.
+type Webhook struct {
+	Validator Validator
+}
+
+var _ admission.Handler = &Webhook{}
+
+func (w *Webhook) Handle(_ context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+
+	var rd v1alpha1.ResourceDescriptor
+	if err := json.Unmarshal(req.Object.Raw, &rd); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	errs := w.Validator.Validate(&rd)
+	if len(errs) == 0 {
+		return admission.Allowed("")
+	}
+
+	gk := v1alpha1.SchemeGroupVersion.WithKind(v1alpha1.ResourceKindResourceDescriptor).GroupKind()
+	status := kerr.NewInvalid(gk, rd.Name, errs).Status()
+	return admission.Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &status,
+		},
+	}
+}